@@ -0,0 +1,404 @@
+// Click analytics: counts how often each short URL is looked up and when it was last looked up.
+// The persistent maps call Record_Hit from GetEntry, which only does a sync.Map lookup and a few atomic adds, so it's cheap enough for the read path.
+// Web handlers can also call Record_Click with the referrer and user agent, which are queued and written out with the next flush.
+// If the queue is full the details are dropped, but the hit still counts.
+//
+// Every Flush_interval_seconds the hits since the last flush are appended to the analytics log, one "hits" record per key that was looked up.
+// The analytics log is kept in its own directory, apart from the URL logs, in files named "analytics-<day>.log" where <day> is the unix time the day starts.
+// On startup the totals are rebuilt from the analytics log, so TopN survives restarts. Hits that haven't been flushed are lost if the process dies.
+//
+// Expiring maps reuse IDs, so the CEPUM calls Forget when an entry goes away. That writes an "access_reset" record, and nothing before it counts for the key any more.
+// Entries that expire while the process is down never go through that, so the CEPUM also calls Forget_If_Tracked whenever it creates a new entry.
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const DEFAULT_MAX_PENDING_CLICKS = 100000
+
+const analytics_log_prefix = "analytics-"
+const analytics_log_suffix = ".log"
+const seconds_per_day = 24 * 60 * 60
+
+type AccessTrackerParams struct {
+	Log_directory_path_absolute string         // Where the analytics log goes. Must not be the URL log directory.
+	Storage_backend             StorageBackend // nil means the local file system
+	B53m                        *Base53IDManager
+	Allow_alias_ids             bool
+	Flush_interval_seconds      int // 0 means only flush when Flush is called
+	Max_pending_clicks          int // How many clicks with details can wait for the next flush. 0 means DEFAULT_MAX_PENDING_CLICKS.
+	Retention_days              int // Analytics log files older than this are deleted when flushing. 0 means keep them forever.
+	Clock                       Clock
+}
+
+type AccessStats struct {
+	Key         string
+	Hits        int64
+	Last_access int64 // unix time, 0 if never
+}
+
+// What a web handler knows about a click, see Nginx_Log_Received_Request
+type ClickDetails struct {
+	Referrer   string `json:"referrer"`
+	User_agent string `json:"user_agent"`
+}
+
+type ClickRecord struct {
+	Timestamp int64
+	ClickDetails
+}
+
+type HitHistoryPoint struct {
+	Timestamp int64 // when the last of these hits happened
+	Hits      int64 // hits since the previous point
+}
+
+type AccessHistory struct {
+	Hits   []HitHistoryPoint
+	Clicks []ClickRecord
+}
+
+type key_access_counters struct {
+	hits           atomic.Int64
+	unflushed_hits atomic.Int64
+	last_access    atomic.Int64
+}
+
+type pending_access_record struct {
+	key         string
+	record_type string
+	value       string
+	timestamp   int64
+}
+
+type AccessTracker struct {
+	counters           sync.Map // key -> *key_access_counters
+	pending_mut        sync.Mutex
+	pending            []pending_access_record // clicks and resets, in order
+	dropped_clicks     atomic.Int64
+	flush_mut          sync.Mutex // so that flushes don't overlap
+	backend            StorageBackend
+	directory_path     string
+	b53m               *Base53IDManager
+	allow_alias_ids    bool
+	max_pending_clicks int
+	retention_days     int
+	clock              Clock
+}
+
+// Loads the totals from the analytics log and starts flushing every Flush_interval_seconds.
+func NewAccessTracker(params *AccessTrackerParams) *AccessTracker {
+	at := &AccessTracker{
+		counters:           sync.Map{},
+		pending_mut:        sync.Mutex{},
+		pending:            []pending_access_record{},
+		dropped_clicks:     atomic.Int64{},
+		flush_mut:          sync.Mutex{},
+		backend:            storage_backend_or_local(params.Storage_backend),
+		directory_path:     params.Log_directory_path_absolute,
+		b53m:               params.B53m,
+		allow_alias_ids:    params.Allow_alias_ids,
+		max_pending_clicks: params.Max_pending_clicks,
+		retention_days:     params.Retention_days,
+		clock:              clock_or_real(params.Clock),
+	}
+	if at.max_pending_clicks <= 0 {
+		at.max_pending_clicks = DEFAULT_MAX_PENDING_CLICKS
+	}
+	err := at.backend.MkdirAll(at.directory_path)
+	if err != nil {
+		log.Fatal("Failed to create analytics log directory:", at.directory_path, "error:", err)
+		panic(err)
+	}
+	err = at.for_each_record(func(record *LogRecord) {
+		switch record.Type {
+		case LOG_RECORD_TYPE_HITS:
+			hits, err := String_to_int64(record.Value)
+			if err != nil {
+				return
+			}
+			counters := at.counters_for(record.Key)
+			counters.hits.Add(hits)
+			counters.last_access.Store(max(counters.last_access.Load(), record.Timestamp))
+		case LOG_RECORD_TYPE_ACCESS_RESET:
+			at.counters.Delete(record.Key)
+		}
+	})
+	if err != nil {
+		log.Fatal("Failed to load analytics log:", err)
+		panic(err)
+	}
+	if params.Flush_interval_seconds > 0 {
+		go RunFuncEveryXSeconds(func() {
+			err := at.Flush()
+			if err != nil {
+				log.Println("Failed to flush analytics log, will try again next time. Error:", err)
+			}
+		}, params.Flush_interval_seconds)
+	}
+	return at
+}
+
+func (at *AccessTracker) counters_for(key string) *key_access_counters {
+	counters, ok := at.counters.Load(key)
+	if !ok {
+		counters, _ = at.counters.LoadOrStore(key, &key_access_counters{})
+	}
+	return counters.(*key_access_counters) //nolint:forcetypeassert // only these go in
+}
+
+// All of the Record methods and Forget can be called on a nil *AccessTracker, in which case they do nothing.
+
+// Counts a successful lookup of key.
+func (at *AccessTracker) Record_Hit(key string) {
+	if at == nil {
+		return
+	}
+	counters := at.counters_for(key)
+	counters.hits.Add(1)
+	counters.unflushed_hits.Add(1)
+	counters.last_access.Store(at.clock())
+}
+
+// Keeps the details of a click on key for the per-key history. It doesn't count as a hit, since GetEntry has already counted it.
+func (at *AccessTracker) Record_Click(key string, details ClickDetails) {
+	if at == nil {
+		return
+	}
+	value, err := json.Marshal(details) // escapes tabs and newlines, so it can go in a log record
+	if err != nil {
+		return
+	}
+	at.queue(pending_access_record{key: key, record_type: LOG_RECORD_TYPE_CLICK, value: string(value), timestamp: at.clock()}, true)
+}
+
+// Forgets everything about key, e.g. because its entry has expired and the ID may be handed out again.
+func (at *AccessTracker) Forget(key string) {
+	if at == nil {
+		return
+	}
+	at.counters.Delete(key)
+	at.queue(pending_access_record{key: key, record_type: LOG_RECORD_TYPE_ACCESS_RESET, value: "", timestamp: at.clock()}, false)
+}
+
+// Same as Forget, but only if there are stats for key. Called for every new entry, since any stats it has belong to an entry that had the ID before.
+func (at *AccessTracker) Forget_If_Tracked(key string) {
+	if at == nil {
+		return
+	}
+	if _, ok := at.counters.Load(key); ok {
+		at.Forget(key)
+	}
+}
+
+// Resets are never dropped, otherwise a reused ID would inherit the old entry's history after a restart.
+func (at *AccessTracker) queue(record pending_access_record, droppable bool) {
+	at.pending_mut.Lock()
+	defer at.pending_mut.Unlock()
+
+	if droppable && len(at.pending) >= at.max_pending_clicks {
+		at.dropped_clicks.Add(1)
+		return
+	}
+	at.pending = append(at.pending, record)
+}
+
+// How many clicks were dropped because the queue was full
+func (at *AccessTracker) DroppedClicks() int64 {
+	return at.dropped_clicks.Load()
+}
+
+func (at *AccessTracker) Stats(key string) (AccessStats, bool) {
+	counters, ok := at.counters.Load(key)
+	if !ok {
+		return AccessStats{Key: key, Hits: 0, Last_access: 0}, false
+	}
+	c := counters.(*key_access_counters) //nolint:forcetypeassert // only these go in
+	return AccessStats{Key: key, Hits: c.hits.Load(), Last_access: c.last_access.Load()}, true
+}
+
+// The n keys with the most hits, most first. Ties are broken by key so that the result is stable.
+func (at *AccessTracker) TopN(n int) []AccessStats {
+	all := []AccessStats{}
+	at.counters.Range(func(key, counters any) bool {
+		c := counters.(*key_access_counters) //nolint:forcetypeassert // only these go in
+		k := key.(string)                    //nolint:forcetypeassert // only these go in
+		all = append(all, AccessStats{Key: k, Hits: c.hits.Load(), Last_access: c.last_access.Load()})
+		return true
+	})
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Hits != all[j].Hits {
+			return all[i].Hits > all[j].Hits
+		}
+		return all[i].Key < all[j].Key
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// Reads the hits and clicks for key from the analytics log, oldest first. Only includes what has been flushed.
+// This reads the whole analytics log, so it's meant for dashboards, not for the read path.
+func (at *AccessTracker) History(key string) (*AccessHistory, error) {
+	history := AccessHistory{Hits: []HitHistoryPoint{}, Clicks: []ClickRecord{}}
+	err := at.for_each_record(func(record *LogRecord) {
+		if record.Key != key {
+			return
+		}
+		switch record.Type {
+		case LOG_RECORD_TYPE_HITS:
+			hits, err := String_to_int64(record.Value)
+			if err == nil {
+				history.Hits = append(history.Hits, HitHistoryPoint{Timestamp: record.Timestamp, Hits: hits})
+			}
+		case LOG_RECORD_TYPE_CLICK:
+			click := ClickRecord{Timestamp: record.Timestamp, ClickDetails: ClickDetails{Referrer: "", User_agent: ""}}
+			if json.Unmarshal([]byte(record.Value), &click.ClickDetails) == nil {
+				history.Clicks = append(history.Clicks, click)
+			}
+		case LOG_RECORD_TYPE_ACCESS_RESET:
+			history = AccessHistory{Hits: []HitHistoryPoint{}, Clicks: []ClickRecord{}}
+		}
+	})
+	return &history, err
+}
+
+// Writes out the queued clicks and resets and the hits since the last flush.
+// If the write fails, everything is put back so that the next flush tries again.
+func (at *AccessTracker) Flush() error {
+	at.flush_mut.Lock()
+	defer at.flush_mut.Unlock()
+
+	at.pending_mut.Lock()
+	pending := at.pending
+	at.pending = []pending_access_record{}
+	at.pending_mut.Unlock()
+
+	type flushed_hits struct {
+		counters *key_access_counters
+		hits     int64
+	}
+	taken := []flushed_hits{}
+	var sb strings.Builder
+	write := func(key string, record_type string, value string, timestamp int64) {
+		line, err := Format_Log_Record(key, value, record_type, timestamp)
+		if err != nil {
+			log.Println("Skipping analytics record for key", key, "error:", err)
+			return
+		}
+		sb.WriteString(line)
+	}
+	for _, record := range pending {
+		write(record.key, record.record_type, record.value, record.timestamp)
+	}
+	at.counters.Range(func(key, counters any) bool {
+		c := counters.(*key_access_counters) //nolint:forcetypeassert // only these go in
+		hits := c.unflushed_hits.Swap(0)
+		if hits > 0 {
+			taken = append(taken, flushed_hits{counters: c, hits: hits})
+			write(key.(string), LOG_RECORD_TYPE_HITS, Int64_to_string(hits), c.last_access.Load()) //nolint:forcetypeassert // only these go in
+		}
+		return true
+	})
+
+	now := at.clock()
+	if sb.Len() > 0 {
+		err := at.backend.AppendToSegment(filepath.Join(at.directory_path, analytics_log_filename(now)), []byte(sb.String()))
+		if err != nil {
+			for _, t := range taken {
+				t.counters.unflushed_hits.Add(t.hits)
+			}
+			at.pending_mut.Lock()
+			at.pending = append(pending, at.pending...)
+			at.pending_mut.Unlock()
+			return err
+		}
+	}
+	if at.retention_days > 0 {
+		at.delete_old_files(now)
+	}
+	return nil
+}
+
+func analytics_log_filename(timestamp int64) string {
+	return analytics_log_prefix + Int64_to_string(timestamp-timestamp%seconds_per_day) + analytics_log_suffix
+}
+
+// Returns the start of the day that the analytics log file is for
+func parse_analytics_log_filename(name string) (int64, error) {
+	if !strings.HasPrefix(name, analytics_log_prefix) || !strings.HasSuffix(name, analytics_log_suffix) {
+		return 0, errors.New("Not an analytics log file: " + name)
+	}
+	return String_to_int64(strings.TrimSuffix(strings.TrimPrefix(name, analytics_log_prefix), analytics_log_suffix))
+}
+
+// Analytics log files in the order they were written. Anything else in the directory is ignored.
+func (at *AccessTracker) list_files() ([]string, error) {
+	names, err := at.backend.ListSegments(at.directory_path)
+	if err != nil {
+		return nil, err
+	}
+	days := make(map[string]int64)
+	files := []string{}
+	for _, name := range names {
+		day, err := parse_analytics_log_filename(name)
+		if err != nil {
+			continue
+		}
+		days[name] = day
+		files = append(files, name)
+	}
+	sort.Slice(files, func(i, j int) bool { return days[files[i]] < days[files[j]] })
+	return files, nil
+}
+
+// A truncated last record (the process died while appending) is skipped, just like the URL loader does.
+func (at *AccessTracker) for_each_record(fn func(record *LogRecord)) error {
+	files, err := at.list_files()
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		path := filepath.Join(at.directory_path, name)
+		err = ForEachLogRecordInSegment(at.backend, path, at.b53m, at.allow_alias_ids, func(record *LogRecord) error {
+			fn(record)
+			return nil
+		})
+		var truncated_err LogFileTruncatedError
+		if errors.As(err, &truncated_err) {
+			log.Println("Analytics log file", path, "ends with a partial record at offset", truncated_err.Offset)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (at *AccessTracker) delete_old_files(now int64) {
+	files, err := at.list_files()
+	if err != nil {
+		log.Println("Failed to list analytics log files:", err)
+		return
+	}
+	for _, name := range files {
+		day, _ := parse_analytics_log_filename(name)
+		if day+int64(at.retention_days+1)*seconds_per_day > now {
+			continue
+		}
+		err = at.backend.Delete(filepath.Join(at.directory_path, name))
+		if err != nil {
+			log.Println("Failed to delete old analytics log file:", name, "error:", err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package util_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func new_test_access_tracker(h *urlmaptest.Harness) *util.AccessTracker {
+	return util.NewAccessTracker(&util.AccessTrackerParams{ //nolint:exhaustruct // it's a test
+		Log_directory_path_absolute: filepath.Join(h.Dir, "analytics"),
+		Storage_backend:             h.Backend,
+		B53m:                        h.B53m,
+		Allow_alias_ids:             true,
+		Clock:                       h.Clock.Now,
+	})
+}
+
+func Test_AccessTracker_Hits_Survive_Restart(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	tracker := new_test_access_tracker(h)
+	cppum := h.StartCPPUM(func(p *util.CPPUMParams) { p.Access_tracker = tracker })
+	a_key, err := cppum.PutEntry(2, "a.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	b_key, err := cppum.PutEntry(2, "b.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	for i := 0; i < 3; i++ {
+		_, err = cppum.GetEntry(a_key)
+		util.Assert_no_error(t, err, 1)
+	}
+	h.Clock.Advance(10)
+	_, err = cppum.GetEntry(b_key)
+	util.Assert_no_error(t, err, 1)
+	_, err = cppum.GetEntry("zz") // misses don't count
+	util.Assert_error_equals(t, err, util.CPMNonExistentKeyError{}.Error(), 1)
+
+	top := tracker.TopN(10)
+	util.Assert_result_equals_interface(t, len(top), nil, 2, 1)
+	util.Assert_result_equals_interface(t, top[0], nil, util.AccessStats{Key: a_key, Hits: 3, Last_access: urlmaptest.DEFAULT_START_TIME}, 1)
+	util.Assert_result_equals_interface(t, top[1], nil, util.AccessStats{Key: b_key, Hits: 1, Last_access: urlmaptest.DEFAULT_START_TIME + 10}, 1)
+	util.Assert_result_equals_interface(t, len(tracker.TopN(1)), nil, 1, 1)
+
+	// Only what was flushed comes back
+	util.Assert_no_error(t, tracker.Flush(), 1)
+	_, err = cppum.GetEntry(b_key)
+	util.Assert_no_error(t, err, 1)
+	tracker = new_test_access_tracker(h)
+	stats, ok := tracker.Stats(a_key)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+	util.Assert_result_equals_interface(t, stats.Hits, nil, int64(3), 1)
+	stats, _ = tracker.Stats(b_key)
+	util.Assert_result_equals_interface(t, stats.Hits, nil, int64(1), 1)
+}
+
+func Test_AccessTracker_Failed_Flush_Is_Retried(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	tracker := new_test_access_tracker(h)
+	tracker.Record_Hit("my-alias")
+	tracker.Record_Click("my-alias", util.ClickDetails{Referrer: "https://example.com/\tpage", User_agent: "curl/8.0"})
+	h.Backend.FailNextWrites(1, errors.New("EIO"))
+	err := tracker.Flush()
+	util.Assert_error_equals(t, err, "EIO", 1)
+	h.Clock.Advance(5)
+	tracker.Record_Hit("my-alias")
+	util.Assert_no_error(t, tracker.Flush(), 1)
+
+	history, err := tracker.History("my-alias")
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(history.Hits), nil, 1, 1)
+	util.Assert_result_equals_interface(t, history.Hits[0], nil, util.HitHistoryPoint{Timestamp: urlmaptest.DEFAULT_START_TIME + 5, Hits: 2}, 1)
+	util.Assert_result_equals_interface(t, len(history.Clicks), nil, 1, 1)
+	util.Assert_result_equals_interface(t, history.Clicks[0].Referrer, nil, "https://example.com/\tpage", 1)
+	util.Assert_result_equals_interface(t, history.Clicks[0].User_agent, nil, "curl/8.0", 1)
+}
+
+func Test_AccessTracker_Expired_IDs_Start_Over(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	tracker := new_test_access_tracker(h)
+	cepum := h.StartCEPUM(func(p *util.CEPUMParams) { p.Access_tracker = tracker })
+	key, err := cepum.PutEntry(2, "a.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(key)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, tracker.Flush(), 1)
+
+	h.Clock.Advance(200)
+	cepum.RemoveAllExpiredURLsFromRAM()
+	_, ok := tracker.Stats(key)
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+
+	// The ID is reused and the new entry's hits are counted from zero, even after a restart
+	_, err = cepum.PutEntryWithID(key, "b.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(key)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, tracker.Flush(), 1)
+	tracker = new_test_access_tracker(h)
+	stats, _ := tracker.Stats(key)
+	util.Assert_result_equals_interface(t, stats.Hits, nil, int64(1), 1)
+	history, err := tracker.History(key)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(history.Hits), nil, 1, 1)
+}
+
+func Test_AccessTracker_IDs_That_Expired_While_Down_Start_Over(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	tracker := new_test_access_tracker(h)
+	cepum := h.StartCEPUM(func(p *util.CEPUMParams) { p.Access_tracker = tracker })
+	key, err := cepum.PutEntry(2, "a.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(key)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, tracker.Flush(), 1)
+
+	// The entry expires while the process is down, so Forget is never called for it
+	h.Clock.Advance(1000)
+	tracker = new_test_access_tracker(h)
+	cepum = h.StartCEPUM(func(p *util.CEPUMParams) { p.Access_tracker = tracker })
+	_, err = cepum.GetEntry(key)
+	util.Assert_error_equals(t, err, util.CEMNonExistentKeyError{}.Error(), 1)
+	stats, _ := tracker.Stats(key)
+	util.Assert_result_equals_interface(t, stats.Hits, nil, int64(1), 1)
+
+	// Whoever gets the ID next starts from zero, even after a restart
+	_, err = cepum.PutEntryWithID(key, "b.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	_, ok := tracker.Stats(key)
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	util.Assert_no_error(t, tracker.Flush(), 1)
+	tracker = new_test_access_tracker(h)
+	_, ok = tracker.Stats(key)
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+}
@@ -0,0 +1,204 @@
+// A MapWithPastesCount that uses a lot less RAM than map[string]*ExpiringMapItem.
+//
+// The normal map costs around 360 bytes per 128 byte URL: a string header for the key, a pointer to the item, the item itself, and a string header and separate allocation for the value.
+// Here the key is packed into a uint64 (Base53 IDs are at most 8 bytes, see Convert_str_to_uint64) and the values are appended to a slab made of 1 MiB chunks.
+// The chunks are allocated at their full size up front, so unlike one big []byte, the slab never wastes half its capacity after growing.
+// The map holds no pointers at all, so the GC doesn't have to scan it either. See https://www.komu.engineer/blogs/01/go-gc-maps
+//
+// The catch is that GetKey has to build a new item every time, so it allocates, and the items it returns are copies.
+// Only the value, its type and GetExpiryTime are stored, so items must not be changed after they're inserted: changes to a copy are silently lost.
+// That rules out items with max hits, which the expiring map counts down in place, so the expiring version is only for items without them.
+// Deleted values leave holes in the slab, which is compacted once more than half of it is holes.
+// Keys that don't fit in a uint64 (alias IDs longer than 8 bytes) are kept in a normal map on the side.
+//
+// The permanent map uses it when CPPUMParams.Use_arena_map is set. The expiring map keeps its items in expiringmap instead,
+// so NewArenaMapWithPastesCount_Expiring is only for code that manages its own expiry.
+package util
+
+import "strings"
+
+const arena_map_chunk_size = 1 << 20
+
+type arena_map_entry struct {
+	chunk     uint32 // index into the slab
+	offset    uint32 // where the value starts in the chunk
+	length    uint32
+	is_paste  bool
+	timestamp int64 // whatever make_item expects, e.g. the expiry time
+}
+
+type ArenaMapWithPastesCount[T MapItem] struct {
+	m            map[uint64]arena_map_entry
+	long_keys    map[string]arena_map_entry // keys that can't be packed into a uint64
+	slab         [][]byte
+	live_bytes   int64
+	hole_bytes   int64
+	pastes_count int
+	make_item    func(value string, value_type MapItemValueType, timestamp int64) T
+}
+
+// make_item turns what was stored back into an item. The timestamp passed to it is whatever GetExpiryTime returned when the item was inserted.
+func NewArenaMapWithPastesCount[T MapItem](size int64, make_item func(value string, value_type MapItemValueType, timestamp int64) T) MapWithPastesCount[T] {
+	return &ArenaMapWithPastesCount[T]{
+		m:            make(map[uint64]arena_map_entry, size),
+		long_keys:    make(map[string]arena_map_entry),
+		slab:         make([][]byte, 0),
+		live_bytes:   0,
+		hole_bytes:   0,
+		pastes_count: 0,
+		make_item:    make_item,
+	}
+}
+
+func NewArenaMapWithPastesCount_Expiring(size int64) MapWithPastesCount[*ExpiringMapItem] {
+	return NewArenaMapWithPastesCount[*ExpiringMapItem](size, NewExpiringMapItem)
+}
+
+func NewArenaMapWithPastesCount_Permanent(size int64) MapWithPastesCount[*PermanentMapItem] {
+	return NewArenaMapWithPastesCount[*PermanentMapItem](size, func(value string, value_type MapItemValueType, _ int64) *PermanentMapItem {
+		return &PermanentMapItem{
+			value:         value,
+			itemValueType: value_type,
+		}
+	})
+}
+
+// Returns false if the key can't be packed into a uint64 and back without losing anything
+func arena_map_packable_key(key string) bool {
+	return len(key) > 0 && len(key) <= 8 && !strings.ContainsRune(key, 0) //nolint:gomnd // 8 is size of uint64
+}
+
+// Convert_uint64_to_str needs the length, which is however many bytes aren't zero padding
+func arena_map_unpack_key(packed uint64) string {
+	length := 8 //nolint:gomnd // 8 is size of uint64
+	for length > 0 && (packed>>(8*(8-length)))&0xff == 0 {
+		length--
+	}
+	return Convert_uint64_to_str(packed, length)
+}
+
+func (amwpc *ArenaMapWithPastesCount[T]) lookup(key string) (arena_map_entry, bool) {
+	if arena_map_packable_key(key) {
+		entry, ok := amwpc.m[Convert_str_to_uint64(key)]
+		return entry, ok
+	}
+	entry, ok := amwpc.long_keys[key]
+	return entry, ok
+}
+
+func (amwpc *ArenaMapWithPastesCount[T]) item_from_entry(entry arena_map_entry) T {
+	value := string(amwpc.slab[entry.chunk][entry.offset : entry.offset+entry.length])
+	var value_type MapItemValueType = TYPE_MAP_ITEM_URL
+	if entry.is_paste {
+		value_type = TYPE_MAP_ITEM_PASTE
+	}
+	return amwpc.make_item(value, value_type, entry.timestamp)
+}
+
+func (amwpc *ArenaMapWithPastesCount[T]) InsertNew(key string, value T) error {
+	_, ok := amwpc.lookup(key)
+	if ok {
+		return KeyAlreadyExistsError{}
+	}
+
+	entry := amwpc.append_to_slab(&amwpc.slab, value.GetValue())
+	entry.is_paste = value.GetType().ValueType == TYPE_MAP_ITEM_PASTE
+	entry.timestamp = value.GetExpiryTime()
+	amwpc.live_bytes += int64(entry.length)
+	if arena_map_packable_key(key) {
+		amwpc.m[Convert_str_to_uint64(key)] = entry
+	} else {
+		amwpc.long_keys[key] = entry
+	}
+	if entry.is_paste {
+		amwpc.pastes_count++
+	}
+	return nil
+}
+
+// Values that don't fit in what's left of the last chunk go in a new chunk. Values bigger than a chunk get a chunk of their own.
+func (amwpc *ArenaMapWithPastesCount[T]) append_to_slab(slab *[][]byte, value string) arena_map_entry {
+	n := len(*slab)
+	if n == 0 || cap((*slab)[n-1])-len((*slab)[n-1]) < len(value) {
+		*slab = append(*slab, make([]byte, 0, max(arena_map_chunk_size, len(value))))
+		n++
+	}
+	chunk := &(*slab)[n-1]
+	entry := arena_map_entry{
+		chunk:     uint32(n - 1),
+		offset:    uint32(len(*chunk)),
+		length:    uint32(len(value)),
+		is_paste:  false,
+		timestamp: 0,
+	}
+	*chunk = append(*chunk, value...)
+	return entry
+}
+
+func (amwpc *ArenaMapWithPastesCount[T]) GetKey(key string) (T, error) {
+	entry, ok := amwpc.lookup(key)
+	if !ok {
+		var zero_value T
+		return zero_value, CPMNonExistentKeyError{}
+	}
+	return amwpc.item_from_entry(entry), nil
+}
+
+func (amwpc *ArenaMapWithPastesCount[T]) DeleteKey(key string) {
+	entry, ok := amwpc.lookup(key)
+	if !ok {
+		return
+	}
+
+	if entry.is_paste {
+		amwpc.pastes_count--
+	}
+	if arena_map_packable_key(key) {
+		delete(amwpc.m, Convert_str_to_uint64(key))
+	} else {
+		delete(amwpc.long_keys, key)
+	}
+	amwpc.live_bytes -= int64(entry.length)
+	amwpc.hole_bytes += int64(entry.length)
+	if amwpc.hole_bytes > amwpc.live_bytes {
+		amwpc.compact()
+	}
+}
+
+// Copies the live values into a new slab. This is O(n), but it only happens after half the slab has been deleted, so it's amortized O(1) per delete.
+func (amwpc *ArenaMapWithPastesCount[T]) compact() {
+	new_slab := make([][]byte, 0)
+	move := func(entry arena_map_entry) arena_map_entry {
+		value := amwpc.slab[entry.chunk][entry.offset : entry.offset+entry.length]
+		moved := amwpc.append_to_slab(&new_slab, string(value))
+		moved.is_paste = entry.is_paste
+		moved.timestamp = entry.timestamp
+		return moved
+	}
+	for k, entry := range amwpc.m {
+		amwpc.m[k] = move(entry)
+	}
+	for k, entry := range amwpc.long_keys {
+		amwpc.long_keys[k] = move(entry)
+	}
+	amwpc.slab = new_slab
+	amwpc.hole_bytes = 0
+}
+
+func (amwpc *ArenaMapWithPastesCount[T]) NumItems() int {
+	return len(amwpc.m) + len(amwpc.long_keys)
+}
+
+func (amwpc *ArenaMapWithPastesCount[T]) NumPastes() int {
+	return amwpc.pastes_count
+}
+
+// fn must not modify the map.
+func (amwpc *ArenaMapWithPastesCount[T]) ForEach(fn func(key string, value T)) {
+	for k, entry := range amwpc.m {
+		fn(arena_map_unpack_key(k), amwpc.item_from_entry(entry))
+	}
+	for k, entry := range amwpc.long_keys {
+		fn(k, amwpc.item_from_entry(entry))
+	}
+}
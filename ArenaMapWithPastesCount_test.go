@@ -0,0 +1,118 @@
+package util_test
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func Test_ArenaMapWithPastesCount(t *testing.T) {
+	t.Parallel()
+
+	m := util.NewArenaMapWithPastesCount_Expiring(0)
+	err := m.InsertNew("2y", util.NewTestExpiringMapItem("google.com", util.TYPE_MAP_ITEM_URL, 1700000000))
+	util.Assert_no_error(t, err, 1)
+	err = m.InsertNew("3v4t5678", util.NewTestExpiringMapItem("/pastes/1", util.TYPE_MAP_ITEM_PASTE, 1700000001))
+	util.Assert_no_error(t, err, 1)
+	err = m.InsertNew("my-long-vanity-url", util.NewTestExpiringMapItem("example.com", util.TYPE_MAP_ITEM_URL, 1700000002))
+	util.Assert_no_error(t, err, 1)
+	err = m.InsertNew("2y", util.NewTestExpiringMapItem("other.com", util.TYPE_MAP_ITEM_URL, 1700000000))
+	util.Assert_error_equals(t, err, util.KeyAlreadyExistsError{}.Error(), 1)
+	util.Assert_result_equals_interface(t, m.NumItems(), nil, 3, 1)
+	util.Assert_result_equals_interface(t, m.NumPastes(), nil, 1, 1)
+
+	item, err := m.GetKey("3v4t5678")
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "/pastes/1", 1)
+	util.Assert_result_equals_interface(t, item.GetExpiryTime(), nil, int64(1700000001), 1)
+	util.Assert_result_equals_interface(t, item.GetType().ValueType, nil, util.TYPE_MAP_ITEM_PASTE, 1)
+	item, err = m.GetKey("my-long-vanity-url")
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "example.com", 1)
+	_, err = m.GetKey("00")
+	util.Assert_error_equals(t, err, util.CPMNonExistentKeyError{}.Error(), 1)
+
+	keys := []string{}
+	m.ForEach(func(key string, _ *util.ExpiringMapItem) { keys = append(keys, key) })
+	sort.Strings(keys)
+	util.Assert_result_equals_string_slice(t, keys, nil, []string{"2y", "3v4t5678", "my-long-vanity-url"}, 1)
+
+	// Deleting most of the values compacts the slab, and what's left must still be readable
+	m.DeleteKey("3v4t5678")
+	m.DeleteKey("my-long-vanity-url")
+	m.DeleteKey("does-not-exist")
+	util.Assert_result_equals_interface(t, m.NumItems(), nil, 1, 1)
+	util.Assert_result_equals_interface(t, m.NumPastes(), nil, 0, 1)
+	item, err = m.GetKey("2y")
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "google.com", 1)
+}
+
+// Reports the heap bytes per item after inserting b.N 128 byte URLs.
+// go test -run XXX -bench MapWithPastesCount_Memory -benchtime 10000000x
+func Test_CPPUM_With_Arena_Map(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	use_arena_map := func(params *util.CPPUMParams) {
+		params.Use_arena_map = true
+		params.Allow_alias_ids = true
+	}
+	cppum := h.StartCPPUM(use_arena_map)
+	url_key, err := cppum.PutEntry(2, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	alias_key, err := cppum.PutEntryWithID("my-long-vanity-url", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	paste_key, err := cppum.PutEntry(2, "some paste", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+
+	// Same entries after loading them back into a new arena map
+	cppum = h.StartCPPUM(use_arena_map)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 3, 1)
+	item, err := cppum.GetEntry(url_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "google.com", 1)
+	item, err = cppum.GetEntry(alias_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "example.com", 1)
+	item, err = cppum.GetEntry(paste_key)
+	util.Assert_no_error(t, err, 1)
+	contents, err := cppum.ReadPaste(item, "")
+	util.Assert_result_equals_bytes(t, contents, err, "some paste", 1)
+}
+
+func benchmark_map_with_pastes_count_memory(b *testing.B, new_map func(size int64) util.MapWithPastesCount[*util.ExpiringMapItem]) {
+	b.Helper()
+
+	b53m := util.NewBase53IDManager()
+	var id util.Base53ID
+	id, err := b53m.NewBase53ID("00000", '0', false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	url_prefix := "https://example.com/" + strings.Repeat("a", 128-20-8) // 20 for the prefix, 8 for the counter
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+
+	m := new_map(0)
+	for i := 0; i < b.N; i++ {
+		url := url_prefix + util.Int64_to_string(int64(10000000 + i))[:8]
+		_ = m.InsertNew(id.GetCombinedString(), util.NewTestExpiringMapItem(url, util.TYPE_MAP_ITEM_URL, 1700000000))
+		id, _ = b53m.B53_generate_next_Base53ID(id)
+	}
+
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/float64(b.N), "heap_bytes/item")
+	runtime.KeepAlive(m)
+}
+
+func Benchmark_MapWithPastesCount_Memory_StringMap(b *testing.B) {
+	benchmark_map_with_pastes_count_memory(b, util.NewMapWithPastesCount[*util.ExpiringMapItem])
+}
+
+func Benchmark_MapWithPastesCount_Memory_Arena(b *testing.B) {
+	benchmark_map_with_pastes_count_memory(b, util.NewArenaMapWithPastesCount_Expiring)
+}
@@ -0,0 +1,163 @@
+// Loading a big map can take a while: every log file has to be parsed and every unused Base53 ID up to Generate_strings_up_to has to be enumerated.
+// AsyncPersistentMap lets the server start listening straight away. Until the map is loaded, GetEntry and the PutEntry functions return a MapLoadingError
+// and Health says it's still loading, so the readiness check keeps it out of the load balancer.
+package util
+
+import "fmt"
+
+// Returned by AsyncPersistentMap while the map is still loading from disk.
+// Use errors.Is(err, ErrMapLoading) to check for it.
+type MapLoadingError struct {
+	Progress LoadStatus
+}
+
+var ErrMapLoading = MapLoadingError{Progress: LoadStatus{}}
+
+func (e MapLoadingError) Error() string {
+	return fmt.Sprintf("The map is still loading: %d of %d log files loaded, %d records, %d of %d ID lengths generated",
+		e.Progress.Files_loaded, e.Progress.Files_total, e.Progress.Records_loaded, e.Progress.Id_lengths_generated, e.Progress.Id_lengths_total)
+}
+
+func (e MapLoadingError) Is(target error) bool {
+	_, ok := target.(MapLoadingError) //nolint:errorlint // it's the type that matters
+	return ok
+}
+
+type AsyncPersistentMap struct {
+	load_progress *LoadProgress
+	loaded        chan struct{} // closed once m is set
+	m             GenericConcurrentPersistentMap
+}
+
+func start_async_persistent_map(load_progress *LoadProgress, create_fn func() GenericConcurrentPersistentMap) *AsyncPersistentMap {
+	apm := &AsyncPersistentMap{
+		load_progress: load_progress,
+		loaded:        make(chan struct{}),
+		m:             nil,
+	}
+	go func() {
+		apm.m = create_fn()
+		close(apm.loaded)
+	}()
+	return apm
+}
+
+// Returns the map, or a MapLoadingError if it isn't loaded yet
+func (apm *AsyncPersistentMap) Map() (GenericConcurrentPersistentMap, error) { //nolint:ireturn // it's an interface on purpose
+	select {
+	case <-apm.loaded:
+		return apm.m, nil
+	default:
+		return nil, MapLoadingError{Progress: apm.load_progress.Status()}
+	}
+}
+
+// Blocks until the map is loaded
+func (apm *AsyncPersistentMap) Wait() GenericConcurrentPersistentMap { //nolint:ireturn // it's an interface on purpose
+	<-apm.loaded
+	return apm.m
+}
+
+func (apm *AsyncPersistentMap) Progress() LoadStatus {
+	return apm.load_progress.Status()
+}
+
+func (apm *AsyncPersistentMap) GetEntry(short_url string) (MapItem, error) { //nolint:ireturn // is ok
+	m, err := apm.Map()
+	if err != nil {
+		return nil, err
+	}
+	return m.GetEntry(short_url)
+}
+
+func (apm *AsyncPersistentMap) GetEntryNoConsume(short_url string) (MapItem, error) { //nolint:ireturn // is ok
+	m, err := apm.Map()
+	if err != nil {
+		return nil, err
+	}
+	return m.GetEntryNoConsume(short_url)
+}
+
+func (apm *AsyncPersistentMap) UseHit(short_url string, item MapItem) error {
+	m, err := apm.Map()
+	if err != nil {
+		return err
+	}
+	return m.UseHit(short_url, item)
+}
+
+func (apm *AsyncPersistentMap) ReadPaste(item MapItem, passphrase string) ([]byte, error) {
+	m, err := apm.Map()
+	if err != nil {
+		return nil, err
+	}
+	return m.ReadPaste(item, passphrase)
+}
+
+func (apm *AsyncPersistentMap) PutEntry(requested_length int, long_url string, expiry_time int64, value_type MapItemValueType) (string, error) {
+	m, err := apm.Map()
+	if err != nil {
+		return "", err
+	}
+	return m.PutEntry(requested_length, long_url, expiry_time, value_type)
+}
+
+func (apm *AsyncPersistentMap) PutEntryWithID(requested_id string, long_url string, expiry_time int64, value_type MapItemValueType) (string, error) {
+	m, err := apm.Map()
+	if err != nil {
+		return "", err
+	}
+	return m.PutEntryWithID(requested_id, long_url, expiry_time, value_type)
+}
+
+func (apm *AsyncPersistentMap) PutEntryWithIdempotencyKey(idempotency_key string, requested_length int, long_url string, expiry_time int64,
+	value_type MapItemValueType) (string, error) {
+	m, err := apm.Map()
+	if err != nil {
+		return "", err
+	}
+	return m.PutEntryWithIdempotencyKey(idempotency_key, requested_length, long_url, expiry_time, value_type)
+}
+
+// 0 while loading
+func (apm *AsyncPersistentMap) NumItems() int {
+	m, err := apm.Map()
+	if err != nil {
+		return 0
+	}
+	return m.NumItems()
+}
+
+// 0 while loading
+func (apm *AsyncPersistentMap) NumPastes() int {
+	m, err := apm.Map()
+	if err != nil {
+		return 0
+	}
+	return m.NumPastes()
+}
+
+// Nothing has been written while loading, so nothing has failed yet
+func (apm *AsyncPersistentMap) StorageStatus() StorageStatus {
+	m, err := apm.Map()
+	if err != nil {
+		return StorageStatus{Writable: true}
+	}
+	return m.StorageStatus()
+}
+
+func (apm *AsyncPersistentMap) Health() MapHealth {
+	m, err := apm.Map()
+	if err != nil {
+		return MapHealth{
+			Load_progress:     apm.load_progress.Status(),
+			Storage:           StorageStatus{Writable: true},
+			Num_items:         0,
+			Remaining_ids:     map[int]int{},
+			Log_dir_space:     nil,
+			Paste_dir_space:   nil,
+			Last_expiry_sweep: 0,
+		}
+	}
+	return m.Health()
+}
@@ -0,0 +1,56 @@
+package util_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func Test_Async_Map_Rejects_Requests_Until_Loaded(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cppum := h.StartCPPUM(nil)
+	key, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	// Hold the loader on the first log file
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	h.Backend.SetReadHook(func(op string, _ string) {
+		if op == "OpenSegment" {
+			close(loading)
+			<-release
+		}
+	})
+	apm := util.CreateConcurrentPersistentPermanentURLMapFromDiskAsync(h.CPPUMParams())
+	<-loading
+
+	_, err = apm.GetEntry(key)
+	if !errors.Is(err, util.ErrMapLoading) {
+		t.Fatal("Expected ErrMapLoading, got:", err)
+	}
+	_, err = apm.PutEntry(4, "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	if !errors.Is(err, util.ErrMapLoading) {
+		t.Fatal("Expected ErrMapLoading, got:", err)
+	}
+	progress := apm.Progress()
+	util.Assert_result_equals_bool(t, progress.Done, nil, false, 1)
+	util.Assert_result_equals_interface(t, progress.Files_total, nil, int64(1), 1)
+	util.Assert_result_equals_interface(t, progress.Files_loaded, nil, int64(0), 1)
+	util.Assert_result_equals_bool(t, apm.Health().Ready(), nil, false, 1)
+
+	h.Backend.SetReadHook(nil)
+	close(release)
+	apm.Wait()
+	item, err := apm.GetEntry(key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "google.com", 1)
+	progress = apm.Progress()
+	util.Assert_result_equals_bool(t, progress.Done, nil, true, 1)
+	util.Assert_result_equals_interface(t, progress.Files_loaded, nil, int64(1), 1)
+	util.Assert_result_equals_interface(t, progress.Records_loaded, nil, int64(1), 1)
+	util.Assert_result_equals_interface(t, progress.Id_lengths_generated, nil, int64(1), 1)
+	util.Assert_result_equals_bool(t, apm.Health().Ready(), nil, true, 1)
+}
@@ -0,0 +1,556 @@
+// Incremental backups of log directories, and restoring a log directory from a backup.
+//
+// For the permanent map only sealed log files are backed up, i.e. every numbered log file except the highest numbered one, which is still being appended to.
+// Sealed files never change, so each one is only copied once.
+// For the expiring map every bucket is still being appended to until its end time has passed, and by then everything in it has expired.
+// So the live buckets are backed up instead, as snapshots: each backup copies a bucket up to the end of its last complete record,
+// and copies it again next time if it has grown since. Buckets whose end time has passed are skipped.
+// Paste files referenced by records in the backed up log files are backed up along with them, since the records only store the path.
+//
+// A backup directory looks like this:
+//
+//	manifest.json
+//	logs/3.log
+//	pastes/created_at_1700000000_sha1_..._rand_...
+//
+// The manifest lists every file in the backup with its size and sha256, so each backup only copies files that aren't in the manifest yet (or have grown, for buckets).
+// Tar backups contain the new files plus the full manifest, so extracting a series of tar backups in order into one directory gives the same result as backing up into that directory.
+//
+// Backups and restores go straight to the local file system, so maps that keep their files in another StorageBackend can't be backed up with this.
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const BACKUP_MANIFEST_FILENAME = "manifest.json"
+
+type BackupManifestFile struct {
+	Name          string `json:"name"` // path relative to the backup directory, e.g. "logs/3.log"
+	Size          int64  `json:"size"`
+	Sha256        string `json:"sha256"`
+	Min_timestamp int64  `json:"min_timestamp,omitempty"` // smallest record timestamp, log files only
+	Max_timestamp int64  `json:"max_timestamp,omitempty"` // largest record timestamp, log files only
+	Backed_up_at  int64  `json:"backed_up_at"`
+}
+
+type BackupManifest struct {
+	Expiring bool                 `json:"expiring"`
+	Files    []BackupManifestFile `json:"files"`
+}
+
+func (manifest *BackupManifest) has_file(name string) bool {
+	return manifest.get_file(name) != nil
+}
+
+func (manifest *BackupManifest) get_file(name string) *BackupManifestFile {
+	for i := range manifest.Files {
+		if manifest.Files[i].Name == name {
+			return &manifest.Files[i]
+		}
+	}
+	return nil
+}
+
+// Replaces the file with the same name if there is one, otherwise adds it
+func (manifest *BackupManifest) set_file(file *BackupManifestFile) {
+	existing := manifest.get_file(file.Name)
+	if existing != nil {
+		*existing = *file
+		return
+	}
+	manifest.Files = append(manifest.Files, *file)
+}
+
+type BackupParams struct {
+	Log_directory_path_absolute string
+	Expiring                    bool // true for CEPUM log directories, false for CPPUM log directories
+	B53m                        *Base53IDManager
+	Allow_alias_ids             bool
+}
+
+type BackupReport struct {
+	Log_files_copied   int
+	Paste_files_copied int
+	Missing_pastes     []string // pastes that were referenced by a backed up log file but no longer exist, e.g. because they expired
+}
+
+// Returns the names of the log files that a backup should look at, in order:
+// the sealed log files for the permanent map, and the buckets that haven't ended yet for the expiring map.
+func List_Backup_Log_Files(log_directory_path_absolute string, expiring bool) ([]string, error) {
+	entries, err := os.ReadDir(log_directory_path_absolute)
+	if err != nil {
+		return nil, err
+	}
+	cur_unix_timestamp := time.Now().Unix()
+	var highest_number int64 = -1
+	names := []string{}
+	numbers := map[string]int64{} // log file number, or bucket timestamp
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if expiring {
+			bucket_timestamp, err := LBSES_Parse_bucket_filename_to_timestamp(entry.Name())
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse name of file in log directory %#v: %w", entry.Name(), err)
+			}
+			// The bucket only holds entries that expire before its timestamp, so once that has passed there's nothing live in it
+			if bucket_timestamp > cur_unix_timestamp {
+				numbers[entry.Name()] = bucket_timestamp
+				names = append(names, entry.Name())
+			}
+			continue
+		}
+		number, err := LSPS_Parse_log_filename_to_number(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse name of file in log directory %#v: %w", entry.Name(), err)
+		}
+		numbers[entry.Name()] = number
+		highest_number = max(highest_number, number)
+		names = append(names, entry.Name())
+	}
+	if !expiring {
+		sealed := names[:0]
+		for _, name := range names {
+			if numbers[name] < highest_number {
+				sealed = append(sealed, name)
+			}
+		}
+		names = sealed
+	}
+	sort.Slice(names, func(i, j int) bool { return numbers[names[i]] < numbers[names[j]] })
+	return names, nil
+}
+
+// Something that backup files get written to: a directory or a tar stream.
+type backup_sink interface {
+	// Copies size bytes from r into the backup under name
+	Write_File(name string, size int64, r io.Reader) error
+	Write_Manifest(manifest *BackupManifest) error
+}
+
+type backup_directory_sink struct {
+	backup_directory_path_absolute string
+}
+
+func (sink *backup_directory_sink) Write_File(name string, size int64, r io.Reader) error {
+	path := filepath.Join(sink.backup_directory_path_absolute, name)
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary name first so that an interrupted backup never leaves a partial file under the real name
+	tmp_path := path + ".tmp"
+	f, err := os.Create(tmp_path)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(f, r)
+	if err == nil && written != size {
+		err = fmt.Errorf("Backup: %s changed size while being copied", name)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		_ = os.Remove(tmp_path)
+		return err
+	}
+	return os.Rename(tmp_path, path)
+}
+
+func (sink *backup_directory_sink) Write_Manifest(manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp_path := filepath.Join(sink.backup_directory_path_absolute, BACKUP_MANIFEST_FILENAME+".tmp")
+	err = os.WriteFile(tmp_path, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, filepath.Join(sink.backup_directory_path_absolute, BACKUP_MANIFEST_FILENAME))
+}
+
+type backup_tar_sink struct {
+	tw *tar.Writer
+}
+
+func (sink *backup_tar_sink) Write_File(name string, size int64, r io.Reader) error {
+	err := sink.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(sink.tw, r)
+	return err
+}
+
+func (sink *backup_tar_sink) Write_Manifest(manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = sink.Write_File(BACKUP_MANIFEST_FILENAME, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return sink.tw.Close()
+}
+
+// Copies the file into the sink, hashing it on the way
+func backup_copy_file(sink backup_sink, source_path string, name string) (*BackupManifestFile, error) {
+	f, err := os.Open(source_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	size := Get_file_size(f)
+	hasher := sha256.New()
+	err = sink.Write_File(name, size, io.TeeReader(io.LimitReader(f, size), hasher))
+	if err != nil {
+		return nil, err
+	}
+	return &BackupManifestFile{
+		Name:         name,
+		Size:         size,
+		Sha256:       hex.EncodeToString(hasher.Sum(nil)),
+		Backed_up_at: time.Now().Unix(),
+	}, nil
+}
+
+// Reads the bucket up to the end of its last complete record. Records are appended while we read, so anything after that may be half written.
+func read_log_file_snapshot(source_path string) ([]byte, error) {
+	data, err := os.ReadFile(source_path)
+	if err != nil {
+		return nil, err
+	}
+	return data[:bytes.LastIndexByte(data, '\n')+1], nil
+}
+
+// Copies data into the sink, which must not change while it's being copied
+func backup_copy_bytes(sink backup_sink, data []byte, name string) (*BackupManifestFile, error) {
+	err := sink.Write_File(name, int64(len(data)), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hash_bytes := sha256.Sum256(data)
+	return &BackupManifestFile{
+		Name:         name,
+		Size:         int64(len(data)),
+		Sha256:       hex.EncodeToString(hash_bytes[:]),
+		Backed_up_at: time.Now().Unix(),
+	}, nil
+}
+
+// Backs up the log files that aren't in the manifest yet (or, for buckets, have grown since), along with their pastes. The manifest is updated in place.
+func backup_log_directory(params *BackupParams, manifest *BackupManifest, sink backup_sink) (*BackupReport, error) {
+	if len(manifest.Files) > 0 && manifest.Expiring != params.Expiring {
+		return nil, errors.New("Backup: the existing backup is for a different kind of log directory")
+	}
+	manifest.Expiring = params.Expiring
+	names, err := List_Backup_Log_Files(params.Log_directory_path_absolute, params.Expiring)
+	if err != nil {
+		return nil, err
+	}
+	report := BackupReport{}
+	for _, name := range names {
+		log_name := "logs/" + name
+		source_path := filepath.Join(params.Log_directory_path_absolute, name)
+		var snapshot []byte = nil // only for buckets. Sealed log files are streamed, since they don't change.
+		if params.Expiring {
+			snapshot, err = read_log_file_snapshot(source_path)
+			if err != nil {
+				return &report, err
+			}
+			if existing := manifest.get_file(log_name); existing != nil && existing.Size >= int64(len(snapshot)) {
+				continue
+			}
+		} else if manifest.has_file(log_name) {
+			continue
+		}
+		var min_timestamp, max_timestamp int64 = 0, 0
+		for_each_record := func(fn func(*LogRecord) error) error {
+			return ForEachLogRecordInFile(source_path, params.B53m, params.Allow_alias_ids, fn)
+		}
+		if snapshot != nil {
+			for_each_record = func(fn func(*LogRecord) error) error {
+				return for_each_log_record_in_bytes(snapshot, params.B53m, params.Allow_alias_ids, fn)
+			}
+		}
+		err = for_each_record(func(record *LogRecord) error {
+			if min_timestamp == 0 || record.Timestamp < min_timestamp {
+				min_timestamp = record.Timestamp
+			}
+			max_timestamp = max(max_timestamp, record.Timestamp)
+			if record.ValueType != TYPE_MAP_ITEM_PASTE {
+				return nil
+			}
+			paste_name := "pastes/" + filepath.Base(record.Value)
+			if manifest.has_file(paste_name) {
+				return nil
+			}
+			file, err := backup_copy_file(sink, record.Value, paste_name)
+			if errors.Is(err, os.ErrNotExist) {
+				report.Missing_pastes = append(report.Missing_pastes, record.Value)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			manifest.Files = append(manifest.Files, *file)
+			report.Paste_files_copied++
+			return nil
+		})
+		if err != nil {
+			return &report, fmt.Errorf("%s: %w", source_path, err)
+		}
+		// The log file goes after its pastes, so that every log file in the manifest has all of its pastes backed up too.
+		var file *BackupManifestFile
+		if snapshot != nil {
+			file, err = backup_copy_bytes(sink, snapshot, log_name)
+		} else {
+			file, err = backup_copy_file(sink, source_path, log_name)
+		}
+		if err != nil {
+			return &report, err
+		}
+		file.Min_timestamp = min_timestamp
+		file.Max_timestamp = max_timestamp
+		manifest.set_file(file)
+		report.Log_files_copied++
+	}
+	return &report, sink.Write_Manifest(manifest)
+}
+
+func Read_Backup_Manifest(path string) (*BackupManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := BackupManifest{}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backup manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// Backs up the log files that aren't in the backup directory yet. The backup directory is created if it doesn't exist.
+func BackupToDirectory(params *BackupParams, backup_directory_path_absolute string) (*BackupReport, error) {
+	err := os.MkdirAll(backup_directory_path_absolute, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := Read_Backup_Manifest(filepath.Join(backup_directory_path_absolute, BACKUP_MANIFEST_FILENAME))
+	if errors.Is(err, os.ErrNotExist) {
+		manifest = &BackupManifest{}
+	} else if err != nil {
+		return nil, err
+	}
+	return backup_log_directory(params, manifest, &backup_directory_sink{backup_directory_path_absolute: backup_directory_path_absolute})
+}
+
+// Writes a tar stream containing the log files that aren't in previous_manifest, plus the updated manifest.
+// Pass nil for a full backup. Returns the updated manifest, which should be passed in next time.
+func BackupToTar(params *BackupParams, previous_manifest *BackupManifest, w io.Writer) (*BackupManifest, *BackupReport, error) {
+	manifest := BackupManifest{}
+	if previous_manifest != nil {
+		manifest.Expiring = previous_manifest.Expiring
+		manifest.Files = append(manifest.Files, previous_manifest.Files...)
+	}
+	report, err := backup_log_directory(params, &manifest, &backup_tar_sink{tw: tar.NewWriter(w)})
+	return &manifest, report, err
+}
+
+type RestoreParams struct {
+	Backup_directory_path_absolute string
+	Log_directory_path_absolute    string // must be empty
+	Paste_directory_path_absolute  string
+	Bucket_interval                int64 // Only used for the expiring map
+	Log_file_max_size_bytes        int64 // Only used for the permanent map
+	B53m                           *Base53IDManager
+	Allow_alias_ids                bool
+	Xattr_params                   *XattrParams
+	Until_timestamp                int64 // If non-zero, only restore records with timestamps up to and including this. That's creation time for the permanent map and expiry time for the expiring map.
+}
+
+type BackupChecksumMismatchError struct {
+	Name string
+}
+
+func (e BackupChecksumMismatchError) Error() string {
+	return "Backup file " + e.Name + " does not match the checksum in the manifest"
+}
+
+func verify_backup_file(backup_directory_path_absolute string, file *BackupManifestFile) error {
+	f, err := os.Open(filepath.Join(backup_directory_path_absolute, file.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return err
+	}
+	if size != file.Size || hex.EncodeToString(hasher.Sum(nil)) != file.Sha256 {
+		return BackupChecksumMismatchError{Name: file.Name}
+	}
+	return nil
+}
+
+// Rebuilds a log directory and paste directory from a backup directory. Every file is checked against the manifest first.
+// Entries whose paste isn't in the backup are skipped. Returns the number of entries restored.
+// If an error is returned, the directories are left partially written and should be deleted.
+func RestoreFromBackup(params *RestoreParams) (int, error) { //nolint:funlen // it's fine
+	manifest, err := Read_Backup_Manifest(filepath.Join(params.Backup_directory_path_absolute, BACKUP_MANIFEST_FILENAME))
+	if err != nil {
+		return 0, err
+	}
+	if manifest.Expiring && params.Bucket_interval <= 0 {
+		return 0, errors.New("Restore: the backup is of an expiring map, so a bucket interval is required")
+	}
+	entries, err := os.ReadDir(params.Log_directory_path_absolute)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) != 0 {
+		return 0, ImportDirectoryNotEmptyError{}
+	}
+
+	log_files := []*BackupManifestFile{}
+	for i := range manifest.Files {
+		file := &manifest.Files[i]
+		err = verify_backup_file(params.Backup_directory_path_absolute, file)
+		if err != nil {
+			return 0, err
+		}
+		if filepath.Dir(file.Name) == "logs" {
+			log_files = append(log_files, file)
+		}
+	}
+
+	var log_storage LogStorage
+	var paste_storage PasteStorage
+	if manifest.Expiring {
+		log_storage = NewLogBucketStructuredExpiringStorage(params.Bucket_interval, params.Log_directory_path_absolute)
+		paste_storage = NewExpiringBucketStorage(params.Paste_directory_path_absolute)
+	} else {
+		lsps := NewLogStructuredPermanentStorage(params.Log_file_max_size_bytes, params.Log_directory_path_absolute)
+		defer lsps.Close()
+		log_storage = lsps
+		paste_storage = NewPermanentBucketStorage(params.Paste_directory_path_absolute)
+	}
+
+	restored_keys := make(map[string]bool)
+	// Restored pastes get new file names, and the read and eviction records of the restored entries have to point at the new name too
+	restored_paste_paths := make(map[string]string)
+	// Max hits and idempotency records only apply to the entry record straight after them, so they're held back until that entry is written
+	pending_chained_records := []*LogRecord{}
+	count := 0
+	for _, file := range log_files {
+		if params.Until_timestamp != 0 && file.Min_timestamp > params.Until_timestamp {
+			continue
+		}
+		absolute_filepath := filepath.Join(params.Backup_directory_path_absolute, file.Name)
+		err = ForEachLogRecordInFile(absolute_filepath, params.B53m, params.Allow_alias_ids, func(record *LogRecord) error {
+			if params.Until_timestamp != 0 && record.Timestamp > params.Until_timestamp {
+				return nil
+			}
+			if record.Type == LOG_RECORD_TYPE_PASTE_ENCRYPTION {
+				// Write_Entry_Durably_Common writes a new one
+				return nil
+			}
+			chained_records := pending_chained_records
+			pending_chained_records = []*LogRecord{}
+			switch {
+			case is_chained_record(record):
+				if len(chained_records) > 0 && (chained_records[0].Key != record.Key || chained_records[0].Timestamp != record.Timestamp) {
+					chained_records = []*LogRecord{}
+				}
+				pending_chained_records = append(chained_records, record)
+				return nil
+			case record.Type == LOG_RECORD_TYPE_PASTE_INTENT:
+				// Write_Entry_Durably_Common writes a new one
+				return nil
+			case record.ValueType == nil:
+				if !restored_keys[record.Key] {
+					return nil
+				}
+				value := record.Value
+				if new_path, ok := restored_paste_paths[value]; ok {
+					value = new_path
+				}
+				return log_storage.AppendNewRecord(record.Key, value, record.Type, record.Timestamp)
+			}
+			value := record.Value
+			if record.ValueType == TYPE_MAP_ITEM_PASTE {
+				contents, err := os.ReadFile(filepath.Join(params.Backup_directory_path_absolute, "pastes", filepath.Base(record.Value)))
+				if errors.Is(err, os.ErrNotExist) {
+					log.Println("Restore: skipping key", record.Key, "because its paste is not in the backup")
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				value = string(contents)
+			}
+			entry_log_storage := log_storage
+			if len(chained_records) > 0 && chained_records[0].Key == record.Key && chained_records[0].Timestamp == record.Timestamp {
+				entry_log_storage = chained_records_log_storage{LogStorage: log_storage, records: chained_records}
+			}
+			stored_value, err := Write_Entry_Durably_Common(record.Key, value, record.ValueType, record.Timestamp, entry_log_storage, paste_storage, params.Xattr_params)
+			if err != nil {
+				return err
+			}
+			if record.ValueType == TYPE_MAP_ITEM_PASTE {
+				restored_paste_paths[record.Value] = stored_value
+			}
+			restored_keys[record.Key] = true
+			count++
+			return nil
+		})
+		if err != nil {
+			return count, fmt.Errorf("%s: %w", absolute_filepath, err)
+		}
+	}
+	return count, nil
+}
+
+// Writes the records that were held back just before the entry record, the same way the map wrote them in the first place
+type chained_records_log_storage struct {
+	LogStorage
+	records []*LogRecord
+}
+
+func (s chained_records_log_storage) AppendNewEntry(key string, value string, value_type MapItemValueType, timestamp int64) error {
+	for _, record := range s.records {
+		err := s.LogStorage.AppendNewRecord(record.Key, record.Value, record.Type, record.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	return s.LogStorage.AppendNewEntry(key, value, value_type, timestamp)
+}
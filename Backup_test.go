@@ -0,0 +1,260 @@
+package util_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func Test_Backup_Incremental_And_Point_In_Time_Restore(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	log_dir := filepath.Join(dir, "logs")
+	paste_dir := filepath.Join(dir, "pastes")
+	backup_dir := filepath.Join(dir, "backup")
+	util.Assert_no_error(t, os.MkdirAll(log_dir, os.ModePerm), 1)
+	util.Assert_no_error(t, os.MkdirAll(paste_dir, os.ModePerm), 1)
+	paste_path := filepath.Join(paste_dir, "created_at_1700000100_test")
+	util.Assert_no_error(t, os.WriteFile(paste_path, []byte("pasted"), 0o644), 1)
+
+	write_test_log_file(t, filepath.Join(log_dir, "0.log"), []util.ExportedEntry{
+		{Key: "2y", Type: "url", Value: "https://a.example", Timestamp: 1700000000},
+		{Key: "3v", Type: "paste", Value: paste_path, Timestamp: 1700000100},
+	}, "")
+	write_test_log_file(t, filepath.Join(log_dir, "1.log"), []util.ExportedEntry{
+		{Key: "4t", Type: "url", Value: "https://b.example", Timestamp: 1700000200},
+	}, "")
+	// The highest numbered file is still being written to, so it isn't backed up yet
+	write_test_log_file(t, filepath.Join(log_dir, "2.log"), []util.ExportedEntry{
+		{Key: "00", Type: "url", Value: "https://c.example", Timestamp: 1700000300},
+	}, "")
+
+	backup_params := util.BackupParams{
+		Log_directory_path_absolute: log_dir,
+		Expiring:                    false,
+		B53m:                        util.NewBase53IDManager(),
+	}
+	report, err := util.BackupToDirectory(&backup_params, backup_dir)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Log_files_copied, nil, 2, 1)
+	util.Assert_result_equals_interface(t, report.Paste_files_copied, nil, 1, 1)
+
+	// Nothing new to copy
+	report, err = util.BackupToDirectory(&backup_params, backup_dir)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Log_files_copied, nil, 0, 1)
+
+	// Once the log rotates, 2.log is sealed
+	write_test_log_file(t, filepath.Join(log_dir, "3.log"), []util.ExportedEntry{}, "")
+	report, err = util.BackupToDirectory(&backup_params, backup_dir)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Log_files_copied, nil, 1, 1)
+
+	restore := func(until int64) (int, string) {
+		restore_dir := t.TempDir()
+		restore_log_dir := filepath.Join(restore_dir, "logs")
+		util.Assert_no_error(t, os.MkdirAll(restore_log_dir, os.ModePerm), 1)
+		count, err := util.RestoreFromBackup(&util.RestoreParams{
+			Backup_directory_path_absolute: backup_dir,
+			Log_directory_path_absolute:    restore_log_dir,
+			Paste_directory_path_absolute:  filepath.Join(restore_dir, "pastes"),
+			Log_file_max_size_bytes:        1000,
+			B53m:                           util.NewBase53IDManager(),
+			Xattr_params:                   &util.XattrParams{},
+			Until_timestamp:                until,
+		})
+		util.Assert_no_error(t, err, 1)
+		var buf bytes.Buffer
+		_, err = util.ExportLogDirectory(&util.ExportParams{
+			Log_directory_path_absolute: restore_log_dir,
+			B53m:                        util.NewBase53IDManager(),
+			Format:                      util.EXPORT_FORMAT_CSV,
+		}, &buf)
+		util.Assert_no_error(t, err, 1)
+		return count, buf.String()
+	}
+
+	count, exported := restore(0)
+	util.Assert_result_equals_interface(t, count, nil, 4, 1)
+	if !strings.Contains(exported, "3v,paste,cGFzdGVk,1700000100") {
+		t.Fatal("Restored paste is wrong:", exported)
+	}
+	count, exported = restore(1700000150)
+	util.Assert_result_equals_interface(t, count, nil, 2, 1)
+	if strings.Contains(exported, "\n4t,") || strings.Contains(exported, "\n00,") {
+		t.Fatal("Restored entries after the cutoff:", exported)
+	}
+
+	// Corrupted backups are refused
+	util.Assert_no_error(t, os.WriteFile(filepath.Join(backup_dir, "logs", "1.log"), []byte("garbage"), 0o644), 1)
+	_, err = util.RestoreFromBackup(&util.RestoreParams{
+		Backup_directory_path_absolute: backup_dir,
+		Log_directory_path_absolute:    t.TempDir(),
+		B53m:                           util.NewBase53IDManager(),
+	})
+	if !errors.As(err, &util.BackupChecksumMismatchError{}) {
+		t.Fatal("Expected checksum mismatch, got:", err)
+	}
+}
+
+func Test_Backup_To_Tar(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write_test_log_file(t, filepath.Join(dir, "0.log"), []util.ExportedEntry{
+		{Key: "2y", Type: "url", Value: "https://a.example", Timestamp: 1700000000},
+	}, "")
+	write_test_log_file(t, filepath.Join(dir, "1.log"), []util.ExportedEntry{}, "")
+	backup_params := util.BackupParams{
+		Log_directory_path_absolute: dir,
+		B53m:                        util.NewBase53IDManager(),
+	}
+
+	tar_names := func(data []byte) []string {
+		names := []string{}
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				return names
+			}
+			util.Assert_no_error(t, err, 1)
+			names = append(names, hdr.Name)
+		}
+	}
+
+	var buf bytes.Buffer
+	manifest, _, err := util.BackupToTar(&backup_params, nil, &buf)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, strings.Join(tar_names(buf.Bytes()), " "), nil, "logs/0.log manifest.json", 1)
+
+	// The next tar only has the manifest, which still lists 0.log
+	buf.Reset()
+	manifest, _, err = util.BackupToTar(&backup_params, manifest, &buf)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, strings.Join(tar_names(buf.Bytes()), " "), nil, "manifest.json", 1)
+	util.Assert_result_equals_interface(t, len(manifest.Files), nil, 1, 1)
+}
+
+func Test_Backup_Expiring_Snapshots_Live_Buckets(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	log_dir := filepath.Join(dir, "logs")
+	backup_dir := filepath.Join(dir, "backup")
+	util.Assert_no_error(t, os.MkdirAll(log_dir, os.ModePerm), 1)
+	now := time.Now().Unix()
+	// Created in reverse order, but listed in time order
+	early_bucket := filepath.Join(log_dir, util.LBSES_Get_bucket_filename(now+99000))
+	late_bucket := filepath.Join(log_dir, util.LBSES_Get_bucket_filename(now+1000000))
+	write_test_log_file(t, late_bucket, []util.ExportedEntry{
+		{Key: "3v", Type: "url", Value: "https://b.example", Timestamp: now + 999000},
+	}, "")
+	write_test_log_file(t, early_bucket, []util.ExportedEntry{
+		{Key: "2y", Type: "url", Value: "https://a.example", Timestamp: now + 98000},
+	}, "")
+	// Everything in this one has expired, so it isn't backed up
+	write_test_log_file(t, filepath.Join(log_dir, util.LBSES_Get_bucket_filename(now-100)), []util.ExportedEntry{
+		{Key: "4t", Type: "url", Value: "https://c.example", Timestamp: now - 200},
+	}, "")
+
+	backup_params := util.BackupParams{
+		Log_directory_path_absolute: log_dir,
+		Expiring:                    true,
+		B53m:                        util.NewBase53IDManager(),
+	}
+	names, err := util.List_Backup_Log_Files(log_dir, true)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, strings.Join(names, " "), nil, filepath.Base(early_bucket)+" "+filepath.Base(late_bucket), 1)
+	report, err := util.BackupToDirectory(&backup_params, backup_dir)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Log_files_copied, nil, 2, 1)
+
+	// A bucket that grows is copied again, up to its last complete record
+	f, err := os.OpenFile(early_bucket, os.O_APPEND|os.O_WRONLY, 0o644)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, util.Write_Entry_To_File("00", "https://d.example", util.TYPE_MAP_ITEM_URL, now+98500, f), 1)
+	_, err = f.WriteString("half a record")
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, f.Close(), 1)
+	report, err = util.BackupToDirectory(&backup_params, backup_dir)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Log_files_copied, nil, 1, 1)
+	manifest, err := util.Read_Backup_Manifest(filepath.Join(backup_dir, util.BACKUP_MANIFEST_FILENAME))
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(manifest.Files), nil, 2, 1)
+	report, err = util.BackupToDirectory(&backup_params, backup_dir)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Log_files_copied, nil, 0, 1)
+
+	// and the live entries come back
+	count, err := util.RestoreFromBackup(&util.RestoreParams{
+		Backup_directory_path_absolute: backup_dir,
+		Log_directory_path_absolute:    t.TempDir(),
+		Paste_directory_path_absolute:  t.TempDir(),
+		Bucket_interval:                60,
+		B53m:                           util.NewBase53IDManager(),
+		Xattr_params:                   &util.XattrParams{},
+	})
+	util.Assert_result_equals_interface(t, count, err, 3, 1)
+}
+
+func Test_Restore_Keeps_Max_Hits_And_Idempotency_Keys(t *testing.T) {
+	t.Parallel()
+
+	// Backups compare bucket times against the real clock
+	with_idempotency_keys := func(params *util.CEPUMParams) { params.Idempotency_window_seconds = 3600 }
+	src := urlmaptest.NewOnDisk(t)
+	src.Clock.Set(time.Now().Unix())
+	cepum := src.StartCEPUM(with_idempotency_keys)
+	limited_key, err := cepum.PutEntryWithMaxHits(2, "burn after reading", src.Clock.Now()+1000, util.TYPE_MAP_ITEM_PASTE, 3)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(limited_key)
+	util.Assert_no_error(t, err, 1)
+	token_key, err := cepum.PutEntryWithIdempotencyKey("some-token", 2, "google.com", src.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	backup_dir := filepath.Join(t.TempDir(), "backup")
+	_, err = util.BackupToDirectory(&util.BackupParams{
+		Log_directory_path_absolute: src.LogDir(),
+		Expiring:                    true,
+		B53m:                        src.B53m,
+	}, backup_dir)
+	util.Assert_no_error(t, err, 1)
+	dst := urlmaptest.NewOnDisk(t)
+	dst.Clock.Set(src.Clock.Now())
+	count, err := util.RestoreFromBackup(&util.RestoreParams{
+		Backup_directory_path_absolute: backup_dir,
+		Log_directory_path_absolute:    dst.LogDir(),
+		Paste_directory_path_absolute:  dst.PasteDir(),
+		Bucket_interval:                60,
+		B53m:                           dst.B53m,
+		Xattr_params:                   &util.XattrParams{},
+	})
+	util.Assert_result_equals_interface(t, count, err, 2, 1)
+
+	// The read before the backup still counts, even though the paste file has a new name
+	cepum = dst.StartCEPUM(with_idempotency_keys)
+	for i := 0; i < 2; i++ {
+		item, err := cepum.GetEntry(limited_key)
+		util.Assert_no_error(t, err, 1)
+		contents, err := cepum.ReadPaste(item, "")
+		util.Assert_result_equals_bytes(t, contents, err, "burn after reading", 1)
+	}
+	_, err = cepum.GetEntry(limited_key)
+	util.Assert_error_equals(t, err, util.KeyExpiredError{}.Error(), 1)
+
+	key, err := cepum.PutEntryWithIdempotencyKey("some-token", 2, "google.com", dst.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, key, err, token_key, 1)
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 2, 1)
+}
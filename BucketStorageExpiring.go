@@ -19,12 +19,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"sync"
-
-	"golang.org/x/sys/unix"
 )
 
 type ExpiringBucketStorage struct {
 	mut                            sync.Mutex
+	backend                        StorageBackend
 	bucket_directory_path_absolute string
 }
 
@@ -40,9 +39,15 @@ type ExpiringBucketStorage struct {
 // e.g. if bucket interval is 200, then bucket 200 holds all timestamps 0-199, bucket 400 holds all timestamps 200-399, bucket 600 holds 400-599, and so on.
 // bucket files are named "expires_before_18400" where the last number is a unix timestamp
 func NewExpiringBucketStorage(bucket_directory_path_absolute string) *ExpiringBucketStorage {
+	return NewExpiringBucketStorageWithBackend(nil, bucket_directory_path_absolute)
+}
+
+// Same as NewExpiringBucketStorage but the paste files are kept in the given backend. nil means the local file system.
+func NewExpiringBucketStorageWithBackend(backend StorageBackend, bucket_directory_path_absolute string) *ExpiringBucketStorage {
+	backend = storage_backend_or_local(backend)
 	// check if bucket directory exists
 	// create it if it doesn't exist.
-	err := os.MkdirAll(bucket_directory_path_absolute, os.ModePerm)
+	err := backend.MkdirAll(bucket_directory_path_absolute)
 	if err != nil {
 		log.Fatal("Fatal error: Could not create directory:", err)
 		panic(err)
@@ -50,6 +55,7 @@ func NewExpiringBucketStorage(bucket_directory_path_absolute string) *ExpiringBu
 
 	return &ExpiringBucketStorage{
 		mut:                            sync.Mutex{},
+		backend:                        backend,
 		bucket_directory_path_absolute: bucket_directory_path_absolute,
 	}
 }
@@ -64,47 +70,55 @@ func GetPasteFileName_Common(prefix string, file_contents []byte, timestamp int6
 	return prefix + Int64_to_string(timestamp) + "_sha1_" + hex_sha1 + "_rand_" + rand_string
 }
 
+// Returns the directory that the paste files are in.
+func (ebs *ExpiringBucketStorage) DirectoryPath() string {
+	return ebs.bucket_directory_path_absolute
+}
+
+// Returns a path for a new paste file without creating it. The file is created by WriteNewFile.
+// This lets PutEntry write the path into the log before the file exists, so that a crash in between can be rolled back.
+func (ebs *ExpiringBucketStorage) NewFilePath(file_contents []byte, expiry_time int64) string {
+	return filepath.Join(ebs.bucket_directory_path_absolute, GetPasteFileName_Common("expires_at_", file_contents, expiry_time))
+}
+
+// Creates the file at absfilepath, which must not already exist, and syncs it to disk.
+// Returns an error wrapping os.ErrExist if the file already exists.
+// If any other error is returned, the file may have been partially written and should be removed.
+func (ebs *ExpiringBucketStorage) WriteNewFile(absfilepath string, file_contents []byte, xattr_params *XattrParams) error {
+	ebs.mut.Lock()
+	defer ebs.mut.Unlock()
+
+	// The log record that points to this file may be written right after this, so the backend syncs the contents before returning.
+	return ebs.backend.PutBlob(absfilepath, file_contents, xattr_params)
+}
+
+// Removes a paste file. Used to roll back a paste whose log record couldn't be written, and to delete expired pastes.
+func (ebs *ExpiringBucketStorage) DeleteFile(absfilepath string) error {
+	return ebs.backend.Delete(absfilepath)
+}
+
 // Adds a new entry to the log file
 //
 // Also important: Make sure the input does not contain carriage return or newline.
-func (ebs *ExpiringBucketStorage) InsertFile(file_contents []byte, expiry_time int64, xattr_params *XattrParams) string {
-	ebs.mut.Lock()
-	defer ebs.mut.Unlock()
+func (ebs *ExpiringBucketStorage) InsertFile(file_contents []byte, expiry_time int64, xattr_params *XattrParams) (string, error) {
 	// Don't check expiry time. Just put it.
-	// Compute md5 hash of file
-	// we use md5 to detect corruption - 16 bytes is enough.
-
 	// Now generate a new filename that doesn't already exist
 	// Just generate a random 8-character string, should be good enough
-	var absfilepath string
 	for count := 0; count < 10; count++ {
-		absfilepath = filepath.Join(ebs.bucket_directory_path_absolute, GetPasteFileName_Common("expires_at_", file_contents, expiry_time))
-		// Check if file already exists
-		f, err := os.OpenFile(absfilepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-		// If file already exists try again
+		absfilepath := ebs.NewFilePath(file_contents, expiry_time)
+		err := ebs.WriteNewFile(absfilepath, file_contents, xattr_params)
 		if err == nil {
-			_, err := f.Write(file_contents)
-			if err != nil {
-				log.Fatal(err)
-				panic(err)
-			}
-			if err = f.Close(); err != nil {
-				log.Fatal(err)
-				panic(err)
-			}
-			if xattr_params.SetXattr {
-				err = unix.Setxattr(absfilepath, xattr_params.XattrName, []byte(xattr_params.Xattrvalue), 0)
-				if err != nil {
-					log.Fatal(err)
-					panic(err)
-				}
-			}
-			return absfilepath
+			return absfilepath, nil
+		}
+		// If file already exists try again
+		if !errors.Is(err, os.ErrExist) {
+			// Don't leave a partially written file behind
+			_ = ebs.DeleteFile(absfilepath)
+			return "", err
 		}
 		log.Println("Unexpected collision occurred!!!", absfilepath)
 	}
-	log.Fatal("Tried 10 times to write new file, all failed. Is the disk full?")
-	panic("This should never happen.")
+	return "", errors.New("Tried 10 times to write new file, all of the names were taken")
 }
 
 var bucket_dir_name_pattern = `^([0-9]+)$`
@@ -10,17 +10,17 @@
 package util
 
 import (
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
-
-	"golang.org/x/sys/unix"
 )
 
 type PermanentBucketStorage struct {
 	mut                            sync.Mutex
+	backend                        StorageBackend
 	bucket_directory_path_absolute string
 }
 
@@ -36,9 +36,15 @@ type PermanentBucketStorage struct {
 // e.g. if bucket interval is 200, then bucket 200 holds all timestamps 0-199, bucket 400 holds all timestamps 200-399, bucket 600 holds 400-599, and so on.
 // bucket files are named "expires_before_18400" where the last number is a unix timestamp
 func NewPermanentBucketStorage(bucket_directory_path_absolute string) *PermanentBucketStorage {
+	return NewPermanentBucketStorageWithBackend(nil, bucket_directory_path_absolute)
+}
+
+// Same as NewPermanentBucketStorage but the paste files are kept in the given backend. nil means the local file system.
+func NewPermanentBucketStorageWithBackend(backend StorageBackend, bucket_directory_path_absolute string) *PermanentBucketStorage {
+	backend = storage_backend_or_local(backend)
 	// check if bucket directory exists
 	// create it if it doesn't exist.
-	err := os.MkdirAll(bucket_directory_path_absolute, os.ModePerm)
+	err := backend.MkdirAll(bucket_directory_path_absolute)
 	if err != nil {
 		log.Fatal("Fatal error: Could not create directory:", err)
 		panic(err)
@@ -46,44 +52,55 @@ func NewPermanentBucketStorage(bucket_directory_path_absolute string) *Permanent
 
 	return &PermanentBucketStorage{
 		mut:                            sync.Mutex{},
+		backend:                        backend,
 		bucket_directory_path_absolute: bucket_directory_path_absolute,
 	}
 }
 
-func (pbs *PermanentBucketStorage) InsertFile(file_contents []byte, _ int64, xattr_params *XattrParams) string {
+// Returns the directory that the paste files are in.
+func (pbs *PermanentBucketStorage) DirectoryPath() string {
+	return pbs.bucket_directory_path_absolute
+}
+
+// Returns a path for a new paste file without creating it. The file is created by WriteNewFile.
+// This lets PutEntry write the path into the log before the file exists, so that a crash in between can be rolled back.
+func (pbs *PermanentBucketStorage) NewFilePath(file_contents []byte, _ int64) string {
+	return filepath.Join(pbs.bucket_directory_path_absolute, GetPasteFileName_Common("created_at_", file_contents, time.Now().Unix()))
+}
+
+// Creates the file at absfilepath, which must not already exist, and syncs it to disk.
+// Returns an error wrapping os.ErrExist if the file already exists.
+// If any other error is returned, the file may have been partially written and should be removed.
+func (pbs *PermanentBucketStorage) WriteNewFile(absfilepath string, file_contents []byte, xattr_params *XattrParams) error {
 	pbs.mut.Lock()
 	defer pbs.mut.Unlock()
 
+	// The log record that points to this file may be written right after this, so the backend syncs the contents before returning.
+	return pbs.backend.PutBlob(absfilepath, file_contents, xattr_params)
+}
+
+// Removes a paste file. Used to roll back a paste whose log record couldn't be written, and to delete expired pastes.
+func (pbs *PermanentBucketStorage) DeleteFile(absfilepath string) error {
+	return pbs.backend.Delete(absfilepath)
+}
+
+func (pbs *PermanentBucketStorage) InsertFile(file_contents []byte, timestamp int64, xattr_params *XattrParams) (string, error) {
+	// Don't check expiry time. Just put it.
 	// Now generate a new filename that doesn't already exist
 	// Just generate a random 8-character string, should be good enough
-	var absfilepath string
-	cur_timestamp := time.Now().Unix()
 	for count := 0; count < 10; count++ {
-		absfilepath = filepath.Join(pbs.bucket_directory_path_absolute, GetPasteFileName_Common("created_at_", file_contents, cur_timestamp))
-		// Check if file already exists
-		f, err := os.OpenFile(absfilepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-		// If file already exists try again
+		absfilepath := pbs.NewFilePath(file_contents, timestamp)
+		err := pbs.WriteNewFile(absfilepath, file_contents, xattr_params)
 		if err == nil {
-			_, err := f.Write(file_contents)
-			if err != nil {
-				log.Fatal(err)
-				panic(err)
-			}
-			if err = f.Close(); err != nil {
-				log.Fatal(err)
-				panic(err)
-			}
-			if xattr_params.SetXattr {
-				err = unix.Setxattr(absfilepath, xattr_params.XattrName, []byte(xattr_params.Xattrvalue), 0)
-				if err != nil {
-					log.Fatal(err)
-					panic(err)
-				}
-			}
-			return absfilepath
+			return absfilepath, nil
+		}
+		// If file already exists try again
+		if !errors.Is(err, os.ErrExist) {
+			// Don't leave a partially written file behind
+			_ = pbs.DeleteFile(absfilepath)
+			return "", err
 		}
 		log.Println("Unexpected collision occurred!!!", absfilepath)
 	}
-	log.Fatal("Tried 10 times to write new file, all failed. Is the disk full?")
-	panic("This should never happen.")
+	return "", errors.New("Tried 10 times to write new file, all of the names were taken")
 }
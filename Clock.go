@@ -0,0 +1,18 @@
+// The persistent maps read the current time through a Clock so that tests can move time forward without sleeping.
+package util
+
+import "time"
+
+// Returns the current unix time in seconds.
+type Clock func() int64
+
+func Real_Clock() int64 {
+	return time.Now().Unix()
+}
+
+func clock_or_real(clock Clock) Clock {
+	if clock == nil {
+		return Real_Clock
+	}
+	return clock
+}
@@ -2,12 +2,12 @@
 // For slightly better performance, replace map[string]string with map[int64]string. See https://www.komu.engineer/blogs/01/go-gc-maps
 // Memory usage can be more than double what you actually store in it.
 // Based on my own testing, storing 10 million 128 byte URLs will take around 3.6GB of RAM, so each 128 byte URL took around 360 bytes of RAM.
-// Entries can only be inserted, they cannot be updated or deleted before they expire.
+// Entries can only be inserted, they cannot be updated or deleted before they expire, unless the map has a size limit and they get evicted. See SetCapacity.
 // Uses sync.Mutex to protect concurrent access. Adding, getting, and removing entries require obtaining the mutex first.
 // TODO: Benchmark switching to use a RWMutex or a sync.Map for improved performance.
 // I tested sync.Map, it apparently has no reserve feature? Bulk load is slow - 7.8 seconds.
-// Heap-based implementation for performance and simplicity
-// Benchmarks show that Remove_All_Expired takes 3 seconds to remove 10 million expired entries
+// Built on expiringmap.ConcurrentExpiringMap, which uses a heap by default. See ExpiryIndex for the bucketed alternative.
+// Benchmarks show that Remove_All_Expired takes 3 seconds to remove 10 million expired entries, but it releases the lock every expiry_batch_size entries so reads don't stall.
 // Benchmarks show that NewConcurrentExpiringMapFromSlice takes 3.5 seconds to load 10 million entries
 // No requirement for entries to have same TTL duration
 // No support for updating expiry time - though this functionality can be added later if necessary.
@@ -19,34 +19,37 @@
 package util
 
 import (
-	"container/heap"
 	"fmt"
 	"log"
-	"sync"
-	"time"
-)
+	"sync/atomic"
 
-type ExpiringHeapItem struct {
-	// Yes, sometimes it is more space-efficient to store only a pointer to the map key rather than the key itself, but here keys are expected to be small, around 6-7 bytes on average.
-	key              string
-	expiry_time_unix int64 // When the item expires. This is used as the priority. Doesn't have to be unix time.
-}
+	"github.com/1f604/util/expiringmap"
+)
 
 type ExpiringMapItem struct {
 	value         string           // The actual value of the item; arbitrary.
 	itemValueType MapItemValueType // URL or paste
 	// Yes, expiry_time_unix is duplicated but it's only 8 bytes, using a pointer here wouldn't gain much.
 	expiry_time_unix int64 // When the item expires. This is used as the priority. Doesn't have to be unix time.
+	remaining_hits   int64 // How many more times it can be got, see PutEntryWithMaxHits. 0 means no limit. Only touched under the persistent map's lock.
+	max_hits         int64 // Never changes once the entry is in the map, so it can be read without the lock
 }
 
-func NewTestExpiringMapItem(value string, valuetype MapItemValueType, timestamp int64) *ExpiringMapItem {
+// Makes an item without a max hits limit. PutEntryWithMaxHits sets the limit on the item itself after it's in the map.
+func NewExpiringMapItem(value string, valuetype MapItemValueType, expiry_time_unix int64) *ExpiringMapItem {
 	return &ExpiringMapItem{
 		value:            value,
 		itemValueType:    valuetype,
-		expiry_time_unix: timestamp,
+		expiry_time_unix: expiry_time_unix,
+		remaining_hits:   0,
+		max_hits:         0,
 	}
 }
 
+func NewTestExpiringMapItem(value string, valuetype MapItemValueType, timestamp int64) *ExpiringMapItem {
+	return NewExpiringMapItem(value, valuetype, timestamp)
+}
+
 func (emi *ExpiringMapItem) MapItemToString() string {
 	return fmt.Sprintf("ExpiringMapItem{value:%#v, expiry_time_unix:%#v}", emi.value, emi.expiry_time_unix)
 }
@@ -59,6 +62,11 @@ func (emi *ExpiringMapItem) GetExpiryTime() int64 {
 	return emi.expiry_time_unix
 }
 
+// How many times the entry could be got in total, see PutEntryWithMaxHits. 0 means no limit.
+func (emi *ExpiringMapItem) GetMaxHits() int64 {
+	return emi.max_hits
+}
+
 func (emi *ExpiringMapItem) GetType() MapItemType {
 	return MapItemType{
 		IsTemporary: true,
@@ -69,88 +77,88 @@ func (emi *ExpiringMapItem) GetType() MapItemType {
 type ExpiryCallback func(string, MapItem)
 
 // keys are strings
+// This is a thin wrapper around expiringmap.ConcurrentExpiringMap that keeps the API the persistent maps expect and counts the pastes.
 type ConcurrentExpiringMap struct {
-	mut             sync.Mutex
-	m               MapWithPastesCount[*ExpiringMapItem]
-	hq              ExpiringHeapQueue
-	expiry_callback ExpiryCallback
+	m               *expiringmap.ConcurrentExpiringMap[string, *ExpiringMapItem]
+	pastes_count    atomic.Int64
+	record_eviction func(key string, item MapItem) error // see SetCapacity
+}
+
+// How many entries Remove_All_Expired removes before letting go of the lock so that readers can get in
+const DEFAULT_EXPIRY_BATCH_SIZE = expiringmap.DEFAULT_EXPIRY_BATCH_SIZE
+
+// Alias so that users of util don't have to import expiringmap to pick an expiry index
+type ExpiryIndex = expiringmap.ExpiryIndex[string]
+
+type BucketedExpiryIndex = expiringmap.BucketedExpiryIndex[string]
+
+func NewHeapExpiryIndex(size int64) ExpiryIndex { //nolint:ireturn // it's an interface on purpose
+	return expiringmap.NewHeapExpiryIndex[string](size)
+}
+
+func NewBucketedExpiryIndex(bucket_interval int64) *BucketedExpiryIndex {
+	return expiringmap.NewBucketedExpiryIndex[string](bucket_interval)
+}
+
+func new_concurrent_expiring_map(size int64, expiry_callback ExpiryCallback) *ConcurrentExpiringMap {
+	cem := &ConcurrentExpiringMap{
+		m:               nil,
+		pastes_count:    atomic.Int64{},
+		record_eviction: nil,
+	}
+	cem.m = expiringmap.New(expiringmap.Options[string, *ExpiringMapItem]{ //nolint:exhaustruct // the rest are off
+		Initial_size: size,
+		Clock:        expiringmap.Clock(Real_Clock),
+		Expiry_callback: func(key string, item *ExpiringMapItem, _ expiringmap.RemovalReason) {
+			if item.itemValueType == TYPE_MAP_ITEM_PASTE {
+				cem.pastes_count.Add(-1)
+			}
+			if expiry_callback != nil {
+				expiry_callback(key, item)
+			}
+		},
+	})
+	return cem
 }
 
 // This method properly constructs the object
 func (*ConcurrentExpiringMap) BeginConstruction(stored_map_length int64, expiry_callback ExpiryCallback) ConcurrentMap { //nolint:ireturn //ok...
-	m := NewMapWithPastesCount[*ExpiringMapItem](stored_map_length)
-	hq := make(ExpiringHeapQueue, 0, stored_map_length)
-	return &ConcurrentExpiringMap{
-		mut:             sync.Mutex{},
-		m:               m,
-		hq:              hq,
-		expiry_callback: expiry_callback,
-	}
+	return new_concurrent_expiring_map(stored_map_length, expiry_callback)
 }
 
 // Caller must check that the key_str is not already in the map.
 func (cem *ConcurrentExpiringMap) ContinueConstruction(key_str string, value_str string, expiry_time int64, item_value_type MapItemValueType) {
-	// first add it to the map
-	map_item := ExpiringMapItem{
-		value:            value_str,
-		expiry_time_unix: expiry_time,
-		itemValueType:    item_value_type,
-	}
-	err := cem.m.InsertNew(key_str, &map_item)
+	err := cem.Put_New_Entry(key_str, value_str, expiry_time, item_value_type)
 	Check_err(err)
-
-	// then add it to the heap
-	heap_item := ExpiringHeapItem{
-		key:              key_str,
-		expiry_time_unix: expiry_time,
-	}
-	cem.hq.Push(&heap_item)
 }
 
-func (cem *ConcurrentExpiringMap) FinishConstruction() {
-	// Now initialize the heap
-	heap.Init(&cem.hq)
-}
+// Nothing to do, the heap sorts itself out the first time something expires
+func (cem *ConcurrentExpiringMap) FinishConstruction() {}
 
 func NewEmptyConcurrentExpiringMap(expiry_callback ExpiryCallback) *ConcurrentExpiringMap {
-	m := NewMapWithPastesCount[*ExpiringMapItem](0)
-	hq := make(ExpiringHeapQueue, 0)
-	// heap.Init(&hq) // No need to initialize an empty heap.
-
-	return &ConcurrentExpiringMap{
-		mut:             sync.Mutex{},
-		m:               m,
-		hq:              hq,
-		expiry_callback: expiry_callback,
-	}
+	return new_concurrent_expiring_map(0, expiry_callback)
 }
 
-// Will only return an error if the key already exists.
+// Returns KeyAlreadyExistsError if the key already exists, or MapFullError if the map is full and its eviction policy is EVICTION_POLICY_REJECT_NEW.
 func (cem *ConcurrentExpiringMap) Put_New_Entry(key string, value string, expiry_time int64, value_type MapItemValueType) error {
-	cem.mut.Lock()
-	defer cem.mut.Unlock()
-
-	// first add it to the map
 	map_item := ExpiringMapItem{
 		value:            value,
 		itemValueType:    value_type,
 		expiry_time_unix: expiry_time,
+		remaining_hits:   0,
+		max_hits:         0,
 	}
-	err := cem.m.InsertNew(key, &map_item)
-	if err != nil {
+	err := cem.m.PutNew(key, &map_item, expiry_time)
+	switch err.(type) { //nolint:errorlint // it returns them as they are
+	case nil:
+	case expiringmap.MapFullError:
+		return MapFullError{}
+	default:
 		return KeyAlreadyExistsError{}
 	}
-
-	// then add it to the heap
-	heap_item := ExpiringHeapItem{
-		key:              key,
-		expiry_time_unix: expiry_time,
+	if value_type == TYPE_MAP_ITEM_PASTE {
+		cem.pastes_count.Add(1)
 	}
-	heap.Push(&cem.hq, &heap_item)
-	// fmt.Println("added:", item)
-	// fmt.Println("New map:", cem.m)
-	// fmt.Printf("New heap: %+v\n", cem.hq)
-
 	return nil
 }
 
@@ -164,80 +172,104 @@ type CEMItem struct {
 // Takes around 3.5s to load 10 million items, 300ms for loading 1 million items
 
 func NewConcurrentExpiringMapFromSlice(expiry_callback ExpiryCallback, kv_pairs []CEMItem) *ConcurrentExpiringMap {
-	m := NewMapWithPastesCount[*ExpiringMapItem](int64(len(kv_pairs)))
-	hq := make(ExpiringHeapQueue, 0, len(kv_pairs))
-
+	cem := new_concurrent_expiring_map(int64(len(kv_pairs)), expiry_callback)
 	for _, cem_item := range kv_pairs {
-		key := cem_item.Key
-		value := cem_item.Value
-		expiry_time := cem_item.Expiry_time_unix
-
-		// first add it to the map
-		map_item := ExpiringMapItem{
-			value:            value,
-			itemValueType:    TYPE_MAP_ITEM_URL, // TODO: Fix this properly
-			expiry_time_unix: expiry_time,
-		}
-		err := m.InsertNew(key, &map_item)
-		Check_err(err)
+		cem.ContinueConstruction(cem_item.Key, cem_item.Value, cem_item.Expiry_time_unix, TYPE_MAP_ITEM_URL) // TODO: Fix this properly
+	}
+	return cem
+}
 
-		// then add it to the heap
-		heap_item := ExpiringHeapItem{
-			key:              key,
-			expiry_time_unix: expiry_time,
-		}
-		hq.Push(&heap_item)
+// Makes the map use the given clock to decide which entries have expired. nil means the real clock.
+func (cem *ConcurrentExpiringMap) SetClock(clock Clock) {
+	cem.m.SetClock(expiringmap.Clock(clock_or_real(clock)))
+}
+
+// Replaces the expiry index, e.g. with a BucketedExpiryIndex. Only call this while the map is empty, e.g. right after BeginConstruction.
+func (cem *ConcurrentExpiringMap) SetExpiryIndex(expiry_index ExpiryIndex) {
+	cem.m.SetExpiryIndex(expiry_index)
+}
+
+// Sets how many entries Remove_All_Expired removes each time it takes the lock. Anything less than 1 means DEFAULT_EXPIRY_BATCH_SIZE.
+func (cem *ConcurrentExpiringMap) SetExpiryBatchSize(batch_size int) {
+	cem.m.SetExpiryBatchSize(batch_size)
+}
+
+type EvictionPolicy = expiringmap.EvictionPolicy
+
+const (
+	EVICTION_POLICY_LRU               = expiringmap.EVICTION_POLICY_LRU
+	EVICTION_POLICY_SOONEST_TO_EXPIRE = expiringmap.EVICTION_POLICY_SOONEST_TO_EXPIRE
+	EVICTION_POLICY_REJECT_NEW        = expiringmap.EVICTION_POLICY_REJECT_NEW
+)
+
+// What each entry costs on top of its key and value. Roughly what the 360 bytes per 128 byte URL at the top of this file works out to.
+const ESTIMATED_CEM_ENTRY_OVERHEAD_BYTES = 232
+
+func Estimated_CEM_Entry_Size(key string, item *ExpiringMapItem) int64 {
+	return int64(len(key) + len(item.value) + ESTIMATED_CEM_ENTRY_OVERHEAD_BYTES)
+}
+
+// Limits the map to max_items entries and max_bytes estimated bytes (see Estimated_CEM_Entry_Size). 0 means no limit.
+// Evicted entries go through the expiry callback just like expired ones, but record_eviction is called first, while the entry is still in the map.
+// If record_eviction fails, the entry isn't evicted and the map stays over its limit for now.
+// Otherwise the entry would come back after a restart, and in the meantime its ID could be handed out again and the paste GC could delete its paste.
+// Entries are evicted straight away if the map is already over the limits.
+func (cem *ConcurrentExpiringMap) SetCapacity(max_items int, max_bytes int64, policy EvictionPolicy, record_eviction func(key string, item MapItem) error) {
+	cem.record_eviction = record_eviction
+	cem.m.SetCapacity(expiringmap.Capacity[string, *ExpiringMapItem]{
+		Max_items:       max_items,
+		Max_bytes:       max_bytes,
+		Size_of:         Estimated_CEM_Entry_Size,
+		Eviction_policy: policy,
+		Before_evict:    cem.before_evict,
+	})
+}
+
+func (cem *ConcurrentExpiringMap) before_evict(key string, item *ExpiringMapItem) error {
+	if cem.record_eviction == nil {
+		return nil
 	}
-	// Now initialize the heap
-	heap.Init(&hq)
-
-	// fmt.Println("added:", item)
-	// fmt.Println("New map:", cem.m)
-	// fmt.Printf("New heap: %+v\n", cem.hq)
-
-	return &ConcurrentExpiringMap{
-		mut:             sync.Mutex{},
-		m:               m,
-		hq:              hq,
-		expiry_callback: expiry_callback,
+	err := cem.record_eviction(key, item)
+	if err != nil {
+		log.Println("Failed to record eviction of key", key, "- keeping it in the map for now. Error:", err)
 	}
+	return err
+}
+
+// Whether Put_New_Entry would return MapFullError. Only ever true with EVICTION_POLICY_REJECT_NEW.
+func (cem *ConcurrentExpiringMap) IsFull() bool {
+	return cem.m.IsFull()
+}
+
+// Removes the entry if it's the one that was evicted, and returns it. Only the loader needs this, to replay eviction records.
+func (cem *ConcurrentExpiringMap) remove_evicted_entry(key string, value string, expiry_time int64) (*ExpiringMapItem, bool) {
+	item, item_expiry_time, ok := cem.m.GetWithExpiry(key)
+	if !ok || item_expiry_time != expiry_time || item.value != value {
+		return nil, false
+	}
+	cem.m.Delete(key)
+	if item.itemValueType == TYPE_MAP_ITEM_PASTE {
+		cem.pastes_count.Add(-1)
+	}
+	return item, true
+}
+
+// Returns the item even if it has expired, so that the persistent map can change it in place.
+func (cem *ConcurrentExpiringMap) get_item(key string) (*ExpiringMapItem, bool) {
+	item, _, ok := cem.m.GetWithExpiry(key)
+	return item, ok
+}
+
+// Makes the entry expire now, so Get_Entry returns KeyExpiredError until Remove_All_Expired takes it out and the expiry callback runs.
+func (cem *ConcurrentExpiringMap) expire_now(key string) {
+	cem.m.Extend(key, cem.m.Now())
 }
 
 // keep links around for extra_keeparound_seconds just to tell people that the link has expired
 // this function will remove 10 million entries in 3 seconds
+// Entries are removed in batches of expiry_batch_size, and the lock is released between batches so that reads never have to wait for the whole thing.
 func (cem *ConcurrentExpiringMap) Remove_All_Expired(extra_keeparound_seconds int64) {
-	// fmt.Println("$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$ REMOVE ALL EXPIRED CALLED")
-	// log.Println("$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$$ REMOVE ALL EXPIRED CALLED")
-	cem.mut.Lock()
-	defer cem.mut.Unlock()
-
-	cur_time := time.Now().Unix()
-	// pop root from hq until root is no longer expired or the thing is empty
-	for len(cem.hq) > 0 && cem.hq[0].expiry_time_unix+extra_keeparound_seconds <= cur_time {
-		// first remove from heap
-		heap_item := heap.Pop(&cem.hq)
-		item, ok := heap_item.(*ExpiringHeapItem)
-		if !ok {
-			panic("Expected ExpiringHeapItem, got something else. This should never happen.")
-		}
-		// now call the callback with the removed item key
-		if cem.expiry_callback != nil {
-			map_item, err := cem.m.GetKey(item.key)
-			if err != nil {
-				log.Fatal("Failed to find key to delete", err)
-				panic(err)
-			}
-			cem.expiry_callback(item.key, map_item)
-		}
-		// then remove from map
-		// fmt.Println("===================================================================================== Removing item:", item.expiry_time_unix, item.key)
-		// log.Println("===================================================================================== Removing item:", item.expiry_time_unix, item.key)
-		cem.m.DeleteKey(item.key)
-		// fmt.Println("removed:", item)
-		// fmt.Println("New map:", cem.m)
-		// fmt.Printf("New heap: %+v\n", cem.hq)
-	}
-	// fmt.Println("Done expiring items.")
+	cem.m.RemoveExpired(extra_keeparound_seconds)
 }
 
 type CEMNonExistentKeyError struct{}
@@ -246,6 +278,11 @@ func (e CEMNonExistentKeyError) Error() string {
 	return "ConcurrentExpiringMap: nonexistent key"
 }
 
+func (e CEMNonExistentKeyError) Is(target error) bool {
+	return target == ErrNotFound //nolint:errorlint,goerr113 // it's a sentinel
+}
+
+// Returned for entries that have expired but are still kept around for extra_keeparound_seconds, so that people can be told when the link expired.
 type KeyExpiredError struct {
 	value            string
 	expiry_time_unix int64
@@ -255,52 +292,69 @@ func (e KeyExpiredError) Error() string {
 	return "ConcurrentExpiringMap: key expired"
 }
 
+func (e KeyExpiredError) Is(target error) bool {
+	return target == ErrExpired //nolint:errorlint,goerr113 // it's a sentinel
+}
+
+// What the key pointed to, i.e. the long URL or the path of the paste file
+func (e KeyExpiredError) GetValue() string {
+	return e.value
+}
+
+// When the entry expired. For entries put with PutEntryWithMaxHits that ran out of hits, this is when the last hit was.
+func (e KeyExpiredError) GetExpiryTime() int64 {
+	return e.expiry_time_unix
+}
+
+type MapFullError struct{}
+
+func (e MapFullError) Error() string {
+	return "ConcurrentExpiringMap: map is full"
+}
+
 type KeyAlreadyExistsError struct{}
 
 func (e KeyAlreadyExistsError) Error() string {
 	return "ConcurrentExpiringMap: key already exists"
 }
 
+func (e KeyAlreadyExistsError) Is(target error) bool {
+	return target == ErrAlreadyExists //nolint:errorlint,goerr113 // it's a sentinel
+}
+
 func (cem *ConcurrentExpiringMap) NumItems() int {
-	cem.mut.Lock()
-	defer cem.mut.Unlock()
+	return cem.m.Len()
+}
 
-	return cem.m.NumItems()
+// Returns the file paths of all pastes in the map, including expired ones that haven't been removed yet.
+func (cem *ConcurrentExpiringMap) PastePaths() map[string]bool {
+	paths := make(map[string]bool, cem.NumPastes())
+	cem.m.ForEach(func(_ string, item *ExpiringMapItem, _ int64) {
+		if item.itemValueType == TYPE_MAP_ITEM_PASTE {
+			paths[item.value] = true
+		}
+	})
+	return paths
 }
 
 func (cem *ConcurrentExpiringMap) NumPastes() int {
-	cem.mut.Lock()
-	defer cem.mut.Unlock()
-
-	return cem.m.NumPastes()
+	return int(cem.pastes_count.Load())
 }
 
-// func (cem *ConcurrentExpiringMap) GetAllItems() map[string]ExpiringMapItem {
-// 	return cem.m.
-// }
-
 func (cem *ConcurrentExpiringMap) Get_Entry(key string) (MapItem, error) { //nolint:ireturn //ok...
-	// 1. acquire read lock
-	cem.mut.Lock()
-	defer cem.mut.Unlock()
-
-	// 2. check if it's in the map
-	map_item, err := cem.m.GetKey(key)
-	// If the key doesn't exist
-	if err != nil {
-		// return error saying key doesn't exist
+	// Expired entries are still returned here, so that we can tell people the link has expired rather than that it never existed
+	map_item, expiry_time, ok := cem.m.GetWithExpiry(key)
+	if !ok {
 		return nil, CEMNonExistentKeyError{}
 	}
 
-	// 3. check if it's expired
-	if map_item.expiry_time_unix <= time.Now().Unix() {
+	if expiry_time <= cem.m.Now() {
 		return nil, KeyExpiredError{
 			value:            map_item.value,
-			expiry_time_unix: map_item.expiry_time_unix,
+			expiry_time_unix: expiry_time, // not map_item's, which is still the original one if the entry ran out of hits
 		}
 	}
 
-	// 4. if it's not expired, then return it
 	return map_item, nil
 }
 
@@ -316,36 +370,3 @@ type TTLMap [K any, V any] struct {
 func (p ExpiringMapItem) String() string {
 	return fmt.Sprintf("ExpiringMapItem{value:%v, expiry_time:%d}", p.value, p.expiry_time_unix)
 }
-
-func (p ExpiringHeapItem) String() string {
-	return fmt.Sprintf("ExpiringHeapItem{key:%v, expiry_time:%d}", p.key, p.expiry_time_unix)
-}
-
-// ============= All this stuff is just to implement the interface required by heap ===================
-type ExpiringHeapQueue []*ExpiringHeapItem
-
-func (pq ExpiringHeapQueue) Len() int { return len(pq) }
-
-func (pq ExpiringHeapQueue) Less(i, j int) bool { // root is the element with smallest expiry date
-	return pq[i].expiry_time_unix < pq[j].expiry_time_unix
-}
-
-func (pq ExpiringHeapQueue) Swap(i, j int) {
-	pq[i], pq[j] = pq[j], pq[i]
-}
-
-func (pq *ExpiringHeapQueue) Push(x any) {
-	item := x.(*ExpiringHeapItem)
-	*pq = append(*pq, item)
-}
-
-func (pq *ExpiringHeapQueue) Pop() any {
-	old := *pq
-	n := len(old)
-	item := old[n-1]
-	old[n-1] = nil // avoid memory leak
-	*pq = old[0 : n-1]
-	return item
-}
-
-// ====================================================================================================
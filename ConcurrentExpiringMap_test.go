@@ -4,6 +4,7 @@
 package util_test
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"testing"
@@ -236,3 +237,28 @@ func Test_ConcurrentExpiringMap_Expiry_Callback(t *testing.T) {
 	util.Assert_error_equals(t, err, "ConcurrentExpiringMap: nonexistent key", 1)
 
 }
+
+func Test_Map_Errors_Match_Sentinels(t *testing.T) {
+	t.Parallel()
+
+	cur_time := time.Now().Unix()
+	cem := util.NewEmptyConcurrentExpiringMap(nil)
+	util.Assert_no_error(t, cem.Put_New_Entry("gone", "https://example.com/", cur_time-10, util.TYPE_MAP_ITEM_URL), 1)
+
+	_, err := cem.Get_Entry("gone")
+	util.Assert_result_equals_bool(t, errors.Is(err, util.ErrExpired), nil, true, 1)
+	util.Assert_result_equals_bool(t, errors.Is(err, util.ErrNotFound), nil, false, 1)
+	var expired_err util.KeyExpiredError
+	util.Assert_result_equals_bool(t, errors.As(err, &expired_err), nil, true, 1)
+	util.Assert_result_equals_interface(t, expired_err.GetValue(), nil, "https://example.com/", 1)
+	util.Assert_result_equals_interface(t, expired_err.GetExpiryTime(), nil, cur_time-10, 1)
+
+	_, err = cem.Get_Entry("nope")
+	util.Assert_result_equals_bool(t, errors.Is(err, util.ErrNotFound), nil, true, 1)
+	err = cem.Put_New_Entry("gone", "x", cur_time+10, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_bool(t, errors.Is(fmt.Errorf("wrapped: %w", err), util.ErrAlreadyExists), nil, true, 1)
+
+	cpm := util.NewEmptyConcurrentPermanentMap()
+	_, err = cpm.Get_Entry("nope")
+	util.Assert_result_equals_bool(t, errors.Is(err, util.ErrNotFound), nil, true, 1)
+}
@@ -22,6 +22,10 @@ func (e CPMNonExistentKeyError) Error() string {
 	return "ConcurrentPermanentMap: nonexistent key"
 }
 
+func (e CPMNonExistentKeyError) Is(target error) bool {
+	return target == ErrNotFound //nolint:errorlint,goerr113 // it's a sentinel
+}
+
 func (pmi *PermanentMapItem) MapItemToString() string {
 	return fmt.Sprintf("PermanentMapItem{value:%#v}", pmi.value)
 }
@@ -48,6 +52,20 @@ func (cpm *ConcurrentPermanentMap) NumItems() int {
 	return cpm.m.NumItems()
 }
 
+// Returns the file paths of all pastes in the map, including expired ones that haven't been removed yet.
+func (cpm *ConcurrentPermanentMap) PastePaths() map[string]bool {
+	cpm.mut.Lock()
+	defer cpm.mut.Unlock()
+
+	paths := make(map[string]bool, cpm.m.NumPastes())
+	cpm.m.ForEach(func(_ string, item *PermanentMapItem) {
+		if item.itemValueType == TYPE_MAP_ITEM_PASTE {
+			paths[item.value] = true
+		}
+	})
+	return paths
+}
+
 func (cpm *ConcurrentPermanentMap) NumPastes() int {
 	cpm.mut.Lock()
 	defer cpm.mut.Unlock()
@@ -64,6 +82,17 @@ func (*ConcurrentPermanentMap) BeginConstruction(stored_map_length int64, expiry
 	}
 }
 
+// Makes the map keep its entries in an ArenaMapWithPastesCount, which uses a lot less RAM. Only call this while the map is empty, e.g. right after BeginConstruction.
+func (cpm *ConcurrentPermanentMap) UseArenaMap(size int64) {
+	cpm.mut.Lock()
+	defer cpm.mut.Unlock()
+
+	if cpm.m.NumItems() != 0 {
+		panic("UseArenaMap called on a map that isn't empty")
+	}
+	cpm.m = NewArenaMapWithPastesCount_Permanent(size)
+}
+
 // Caller must check that the key_str is not already in the map.
 func (cpm *ConcurrentPermanentMap) ContinueConstruction(key_str string, value_str string, expiry_time int64, item_value_type MapItemValueType) {
 	// just add it to the map
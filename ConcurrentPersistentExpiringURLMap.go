@@ -6,10 +6,11 @@
 package util
 
 import (
+	"errors"
 	"log"
 	"os"
 	"sync"
-	"time"
+	"sync/atomic"
 )
 
 type ConcurrentExpiringPersistentURLMap struct {
@@ -24,6 +25,17 @@ type ConcurrentExpiringPersistentURLMap struct {
 	extra_keeparound_seconds_disk int64
 	map_size_persister            *MapSizeFileManager
 	xattr_params                  *XattrParams
+	allow_alias_ids               bool
+	dedup_index                   *DedupIndex
+	idempotency_store             *IdempotencyKeyStore
+	storage_backend               StorageBackend
+	storage_health                *StorageHealth
+	clock                         Clock
+	load_progress                 *LoadProgress
+	log_directory_path            string
+	last_expiry_sweep             atomic.Int64
+	access_tracker                *AccessTracker
+	paste_keyring                 *PasteKeyring
 }
 
 type MapItem2 struct {
@@ -91,7 +103,76 @@ func (manager *ConcurrentExpiringPersistentURLMap) GetEntry(short_url string) (M
 	defer manager.mut.Unlock()
 
 	val, err := GetEntryCommon(manager.map_storage, short_url)
-	return val, err
+	if err == nil {
+		err = manager.use_up_hit_locked(short_url, val)
+	}
+	if err != nil {
+		return nil, err
+	}
+	manager.access_tracker.Record_Hit(short_url)
+	return val, nil
+}
+
+// Same as GetEntry, except that it doesn't use up a hit or count as an access. Call UseHit once the entry is actually handed out,
+// e.g. after checking the passphrase of a paste, so that failed and HEAD requests don't burn the reads of an entry with max hits.
+func (manager *ConcurrentExpiringPersistentURLMap) GetEntryNoConsume(short_url string) (MapItem, error) { //nolint:ireturn // is ok
+	manager.mut.Lock()
+	defer manager.mut.Unlock()
+
+	return GetEntryCommon(manager.map_storage, short_url)
+}
+
+// Uses up a hit of item, which came from GetEntryNoConsume(short_url), and counts the access.
+// Returns the same errors as GetEntry if the entry has run out of hits or expired in the meantime, in which case it must not be handed out.
+func (manager *ConcurrentExpiringPersistentURLMap) UseHit(short_url string, item MapItem) error {
+	manager.mut.Lock()
+	defer manager.mut.Unlock()
+
+	val, err := GetEntryCommon(manager.map_storage, short_url)
+	if err != nil {
+		return err
+	}
+	if val != item {
+		// The ID has been handed out again since the lookup
+		return CEMNonExistentKeyError{}
+	}
+	err = manager.use_up_hit_locked(short_url, val)
+	if err != nil {
+		return err
+	}
+	manager.access_tracker.Record_Hit(short_url)
+	return nil
+}
+
+// Caller must hold manager.mut. For entries put with PutEntryWithMaxHits, persists that one of the hits has been used up before the entry is handed out.
+// The last hit is written as an eviction record, so the loader drops the entry just like an evicted one. In RAM it then looks expired until the next sweep recycles its ID and deletes its paste.
+// The last reader still gets the entry, so the paste file has to stay until then.
+func (manager *ConcurrentExpiringPersistentURLMap) use_up_hit_locked(short_url string, val MapItem) error {
+	item, ok := val.(*ExpiringMapItem)
+	if !ok || item.remaining_hits == 0 {
+		return nil
+	}
+	if item.remaining_hits > 1 {
+		err := manager.lbses.AppendNewRecord(short_url, item.value, LOG_RECORD_TYPE_READ, item.expiry_time_unix)
+		if err != nil {
+			return StorageUnavailableError{Err: err}
+		}
+		item.remaining_hits--
+		return nil
+	}
+	err := manager.record_eviction(short_url, item)
+	if err != nil {
+		return StorageUnavailableError{Err: err}
+	}
+	manager.map_storage.expire_now(short_url)
+	return nil
+}
+
+// Reads the paste that item points to, decrypting it if need be. passphrase is only needed for password-protected pastes, see PasteEncryption.go.
+// The last reader of a PutEntryWithMaxHits entry can still read it, since its paste file is only deleted once it has been removed from RAM.
+func (manager *ConcurrentExpiringPersistentURLMap) ReadPaste(item MapItem, passphrase string) ([]byte, error) {
+	// No need for lock here, paste files never change.
+	return ReadPaste_Common(manager.storage_backend, manager.paste_keyring, item, passphrase)
 }
 
 // Shorten long URL into short URL and return the short URL and store the entry both in map and on disk
@@ -99,8 +180,105 @@ func (manager *ConcurrentExpiringPersistentURLMap) PutEntry(requested_length int
 	manager.mut.Lock()
 	defer manager.mut.Unlock()
 
-	val, err := PutEntry_Common(requested_length, long_url, value_type, expiry_time, manager.generate_strings_up_to, manager.slice_storage,
-		manager.map_storage, manager.b53m, manager.lbses, manager.ebs, manager.map_size_persister, manager.xattr_params)
+	return manager.put_entry_locked(requested_length, long_url, expiry_time, value_type, manager.lbses)
+}
+
+// Same as PutEntry, except that retrying with the same idempotency key returns the short URL created by the first call.
+func (manager *ConcurrentExpiringPersistentURLMap) PutEntryWithIdempotencyKey(idempotency_key string, requested_length int, long_url string, expiry_time int64,
+	value_type MapItemValueType) (string, error) {
+	manager.mut.Lock()
+	defer manager.mut.Unlock()
+
+	val, err := PutEntry_Idempotent_Common(manager.idempotency_store, manager.map_storage, idempotency_key, Compute_Idempotency_Request_Digest(requested_length, long_url, value_type), manager.lbses, func(log_storage LogStorage) (string, error) {
+		return manager.put_entry_locked(requested_length, long_url, expiry_time, value_type, log_storage)
+	})
+	return val, err
+}
+
+// Caller must hold manager.mut. The entry is written to log_storage, which is manager.lbses or a wrapper around it.
+func (manager *ConcurrentExpiringPersistentURLMap) put_entry_locked(requested_length int, long_url string, expiry_time int64, value_type MapItemValueType,
+	log_storage LogStorage) (string, error) {
+	long_url, err := Seal_Paste_Common(manager.paste_keyring, long_url, value_type)
+	if err != nil {
+		return "", err
+	}
+
+	val, err := PutEntry_Dedup_Common(manager.dedup_index, manager.map_storage, requested_length, long_url, value_type, expiry_time, func() (string, error) {
+		key, err := PutEntry_Storage_Health_Common(manager.storage_health, func() (string, error) {
+			return PutEntry_Common(requested_length, long_url, value_type, expiry_time, manager.generate_strings_up_to, manager.slice_storage,
+				manager.map_storage, manager.b53m, log_storage, manager.ebs, manager.map_size_persister, manager.xattr_params)
+		})
+		if err == nil {
+			manager.access_tracker.Forget_If_Tracked(key)
+		}
+		return key, err
+	})
+	return val, err
+}
+
+// Same as PutEntry, except that the entry can only be got max_hits times, e.g. for burn-after-reading pastes. After that it behaves as if it had expired.
+// Every get is written to the log before it returns, so restarting doesn't hand out extra reads. That means gets of these entries fail while the storage is failing.
+// These entries are never deduplicated, since they'd share the count.
+func (manager *ConcurrentExpiringPersistentURLMap) PutEntryWithMaxHits(requested_length int, long_url string, expiry_time int64, value_type MapItemValueType,
+	max_hits int64) (string, error) {
+	if max_hits < 1 {
+		return "", errors.New("max_hits must be at least 1.")
+	}
+	manager.mut.Lock()
+	defer manager.mut.Unlock()
+
+	long_url, err := Seal_Paste_Common(manager.paste_keyring, long_url, value_type)
+	if err != nil {
+		return "", err
+	}
+	log_storage := max_hits_log_storage{LogStorage: manager.lbses, max_hits: max_hits}
+	key, err := PutEntry_Storage_Health_Common(manager.storage_health, func() (string, error) {
+		return PutEntry_Common(requested_length, long_url, value_type, expiry_time, manager.generate_strings_up_to, manager.slice_storage,
+			manager.map_storage, manager.b53m, log_storage, manager.ebs, manager.map_size_persister, manager.xattr_params)
+	})
+	if err != nil {
+		return "", err
+	}
+	manager.access_tracker.Forget_If_Tracked(key)
+	// Nobody can get it before this, since that takes manager.mut too
+	item, _ := manager.map_storage.get_item(key)
+	item.remaining_hits = max_hits
+	item.max_hits = max_hits
+	return key, nil
+}
+
+// Writes the max hits record just before the entry record, so the loader knows about the limit by the time it sees the entry.
+// If the entry record then fails to be written, the loader ignores the max hits record since the next record isn't its entry.
+type max_hits_log_storage struct {
+	LogStorage
+	max_hits int64
+}
+
+func (s max_hits_log_storage) AppendNewEntry(key string, value string, value_type MapItemValueType, timestamp int64) error {
+	err := s.LogStorage.AppendNewRecord(key, Int64_to_string(s.max_hits), LOG_RECORD_TYPE_MAX_HITS, timestamp)
+	if err != nil {
+		return err
+	}
+	return s.LogStorage.AppendNewEntry(key, value, value_type, timestamp)
+}
+
+// Store the entry under a caller-chosen ID (e.g. a vanity URL) instead of a randomly generated one.
+func (manager *ConcurrentExpiringPersistentURLMap) PutEntryWithID(requested_id string, long_url string, expiry_time int64, value_type MapItemValueType) (string, error) {
+	manager.mut.Lock()
+	defer manager.mut.Unlock()
+
+	long_url, err := Seal_Paste_Common(manager.paste_keyring, long_url, value_type)
+	if err != nil {
+		return "", err
+	}
+
+	val, err := PutEntry_Storage_Health_Common(manager.storage_health, func() (string, error) {
+		return PutEntryWithID_Common(requested_id, manager.allow_alias_ids, long_url, value_type, expiry_time, manager.generate_strings_up_to, manager.slice_storage,
+			manager.map_storage, manager.b53m, manager.lbses, manager.ebs, manager.map_size_persister, manager.xattr_params)
+	})
+	if err == nil {
+		manager.access_tracker.Forget_If_Tracked(val)
+	}
 	return val, err
 }
 
@@ -117,26 +295,73 @@ type CEPUMParams struct {
 	Size_file_rounded_multiple           int64
 	Generate_strings_up_to               int
 	Xattr_params                         *XattrParams
+	Allow_alias_ids                      bool           // Allow PutEntryWithID to accept IDs that are not valid Base53 IDs
+	Deduplicate_entries                  bool           // PutEntry returns the existing ID for an identical URL or paste that expires in the same bucket
+	Idempotency_window_seconds           int64          // How long idempotency keys are remembered for. 0 disables idempotency keys.
+	Paste_gc_interval_seconds            int            // How often to delete orphaned paste files. 0 disables the periodic paste GC.
+	Paste_gc_grace_period_seconds        int64          // Paste files younger than this are never deleted by the paste GC. At least PASTE_GC_MIN_GRACE_PERIOD_SECONDS if the periodic GC is on.
+	Storage_backend                      StorageBackend // Where the logs, pastes and size file are kept. nil means the local file system.
+	Clock                                Clock          // nil means the real clock
+	Storage_retry_interval_seconds       int64          // While writes are failing, PutEntry only tries to write this often. See StorageHealth.
+	Log_parse_workers                    int            // How many log files are parsed at the same time when loading. 0 means GOMAXPROCS.
+	Bucketed_expiry_index                bool           // Index expiry times by Bucket_interval instead of using a heap. See ExpiryIndex.
+	Max_items                            int            // Most entries to keep in RAM. 0 means no limit.
+	Max_bytes                            int64          // Most estimated bytes to keep in RAM, see Estimated_CEM_Entry_Size. 0 means no limit.
+	Eviction_policy                      EvictionPolicy // What to do when Max_items or Max_bytes is reached. Evicted entries are gone for good, just as if they had expired.
+	Access_tracker                       *AccessTracker // Counts successful GetEntry calls. nil disables access tracking.
+	Paste_keyring                        *PasteKeyring  // Encrypts new pastes. nil stores them as they are.
 }
 
 // This is the one you want to use in production
 func CreateConcurrentExpiringPersistentURLMapFromDisk(cepum_params *CEPUMParams) *ConcurrentExpiringPersistentURLMap {
+	return create_cepum_from_disk(cepum_params, NewLoadProgress())
+}
+
+// Same as CreateConcurrentExpiringPersistentURLMapFromDisk except that it returns straight away and loads in the background. See AsyncPersistentMap.
+func CreateConcurrentExpiringPersistentURLMapFromDiskAsync(cepum_params *CEPUMParams) *AsyncPersistentMap {
+	load_progress := NewLoadProgress()
+	return start_async_persistent_map(load_progress, func() GenericConcurrentPersistentMap {
+		return create_cepum_from_disk(cepum_params, load_progress)
+	})
+}
+
+func create_cepum_from_disk(cepum_params *CEPUMParams, load_progress *LoadProgress) *ConcurrentExpiringPersistentURLMap {
 	if !(cepum_params.Extra_keeparound_seconds_disk > (cepum_params.Extra_keeparound_seconds_ram+5)*2) {
 		log.Fatal("Extra keep around seconds disk must be much greater than ram!")
 		panic("Invalid config")
 	}
+	validate_paste_gc_params(cepum_params.Paste_gc_interval_seconds, cepum_params.Paste_gc_grace_period_seconds)
 
-	cur_unix_timestamp := time.Now().Unix()
+	clock := clock_or_real(cepum_params.Clock)
+	cur_unix_timestamp := clock()
 	Entry_should_be_deleted_fn := func(expiry_time int64) bool {
 		return expiry_time < cur_unix_timestamp
 	}
 	slice_storage := make(map[int]*RandomBag64)
-	expiry_callback := _internal_get_cem_expiry_callback(&slice_storage, cepum_params.Generate_strings_up_to) // this won't get called until much later so it's okay...
+	var dedup_index *DedupIndex = nil
+	if cepum_params.Deduplicate_entries {
+		bucket_interval := cepum_params.Bucket_interval
+		dedup_index = NewDedupIndex(func(expiry_time int64) int64 {
+			return expiry_time / bucket_interval
+		})
+	}
+	var idempotency_store *IdempotencyKeyStore = nil
+	if cepum_params.Idempotency_window_seconds > 0 {
+		idempotency_store = NewIdempotencyKeyStore(cepum_params.Idempotency_window_seconds)
+		idempotency_store.SetClock(clock)
+	}
+	storage_backend := storage_backend_or_local(cepum_params.Storage_backend)
+	lbses := NewLogBucketStructuredExpiringStorageWithBackend(storage_backend, cepum_params.Bucket_interval, cepum_params.Bucket_directory_path_absolute)
+	ebs := NewExpiringBucketStorageWithBackend(storage_backend, cepum_params.Paste_bucket_directory_path_absolute)
+	lbses.SetClock(clock)
+	expiry_callback := _internal_get_cem_expiry_callback(&slice_storage, cepum_params.B53m, cepum_params.Generate_strings_up_to, dedup_index, idempotency_store, ebs,
+		cepum_params.Access_tracker) // this won't get called until much later so it's okay...
 
-	lbses := NewLogBucketStructuredExpiringStorage(cepum_params.Bucket_interval, cepum_params.Bucket_directory_path_absolute)
-	ebs := NewExpiringBucketStorage(cepum_params.Paste_bucket_directory_path_absolute)
-	// delete expired log files on startup
-	lbses.DeleteExpiredLogFiles(cepum_params.Extra_keeparound_seconds_disk)
+	// delete expired log files on startup. Whatever is left gets loaded and skipped since it has expired, and deleted next time.
+	err := lbses.DeleteExpiredLogFiles(cepum_params.Extra_keeparound_seconds_disk)
+	if err != nil {
+		log.Println("Failed to delete expired log files:", err)
+	}
 
 	var nil_map_ptr *ConcurrentExpiringMap = nil
 
@@ -152,11 +377,21 @@ func CreateConcurrentExpiringPersistentURLMapFromDisk(cepum_params *CEPUMParams)
 		Size_file_rounded_multiple:  cepum_params.Size_file_rounded_multiple,
 		Generate_strings_up_to:      cepum_params.Generate_strings_up_to,
 		Size_file_path_absolute:     cepum_params.Size_file_path_absolute,
+		Allow_alias_ids:             cepum_params.Allow_alias_ids,
+		Dedup_index:                 dedup_index,
+		Idempotency_store:           idempotency_store,
+		Storage_backend:             storage_backend,
+		Clock:                       clock,
+		Load_progress:               load_progress,
+		Log_parse_workers:           cepum_params.Log_parse_workers,
+	}
+	if cepum_params.Bucketed_expiry_index {
+		params.Expiry_index_bucket_interval = cepum_params.Bucket_interval
 	}
 
 	concurrent_map, map_size_persister := LoadStoredRecordsFromDisk(&params)
 
-	manager := ConcurrentExpiringPersistentURLMap{ //nolint:forcetypeassert // just let it crash.
+	manager := &ConcurrentExpiringPersistentURLMap{ //nolint:forcetypeassert // just let it crash.
 		mut:                           sync.Mutex{},
 		slice_storage:                 slice_storage,
 		map_storage:                   concurrent_map.(*ConcurrentExpiringMap),
@@ -168,6 +403,22 @@ func CreateConcurrentExpiringPersistentURLMapFromDisk(cepum_params *CEPUMParams)
 		generate_strings_up_to:        cepum_params.Generate_strings_up_to,
 		map_size_persister:            map_size_persister,
 		xattr_params:                  cepum_params.Xattr_params,
+		allow_alias_ids:               cepum_params.Allow_alias_ids,
+		dedup_index:                   dedup_index,
+		idempotency_store:             idempotency_store,
+		storage_backend:               storage_backend,
+		storage_health:                NewStorageHealth(cepum_params.Storage_retry_interval_seconds, clock),
+		clock:                         clock,
+		load_progress:                 load_progress,
+		log_directory_path:            cepum_params.Bucket_directory_path_absolute,
+		last_expiry_sweep:             atomic.Int64{},
+		access_tracker:                cepum_params.Access_tracker,
+		paste_keyring:                 cepum_params.Paste_keyring,
+	}
+
+	// Done after loading so that nothing is evicted while the map is half built. If the limits are lower than last time, the extra entries are evicted now.
+	if cepum_params.Max_items > 0 || cepum_params.Max_bytes > 0 {
+		manager.map_storage.SetCapacity(cepum_params.Max_items, cepum_params.Max_bytes, cepum_params.Eviction_policy, manager.record_eviction)
 	}
 
 	// It is very important to ensure that these functions run ONLY AFTER the LoadStoredRecordsFromDisk has finished.
@@ -176,28 +427,85 @@ func CreateConcurrentExpiringPersistentURLMapFromDisk(cepum_params *CEPUMParams)
 	//time.Sleep(60 * time.Second)
 	go RunFuncEveryXSeconds(manager.RemoveAllExpiredURLsFromDisk, cepum_params.Expiry_check_interval_seconds_disk)
 	go RunFuncEveryXSeconds(manager.RemoveAllExpiredURLsFromRAM, cepum_params.Expiry_check_interval_seconds_ram)
-	return &manager
+	if idempotency_store != nil {
+		go RunFuncEveryXSeconds(idempotency_store.Remove_All_Expired, cepum_params.Expiry_check_interval_seconds_ram)
+	}
+	if cepum_params.Paste_gc_interval_seconds > 0 {
+		go RunFuncEveryXSeconds(func() {
+			log_paste_gc_report(manager.CollectOrphanedPastes(cepum_params.Paste_gc_grace_period_seconds, true))
+		}, cepum_params.Paste_gc_interval_seconds)
+	}
+	return manager
+}
+
+// Whether PutEntry can currently write to storage. See StorageHealth.
+func (manager *ConcurrentExpiringPersistentURLMap) StorageStatus() StorageStatus {
+	// No need for lock here, storage_health has its own lock.
+	return manager.storage_health.Status()
+}
+
+// For health checks
+func (manager *ConcurrentExpiringPersistentURLMap) Health() MapHealth {
+	manager.mut.Lock()
+	remaining_ids := Remaining_IDs_Common(manager.slice_storage)
+	manager.mut.Unlock()
+
+	return MapHealth{
+		Load_progress:     manager.load_progress.Status(),
+		Storage:           manager.storage_health.Status(),
+		Num_items:         manager.map_storage.NumItems(),
+		Remaining_ids:     remaining_ids,
+		Log_dir_space:     Disk_Space_For_Health_Common(manager.storage_backend, manager.log_directory_path),
+		Paste_dir_space:   Disk_Space_For_Health_Common(manager.storage_backend, manager.ebs.DirectoryPath()),
+		Last_expiry_sweep: manager.last_expiry_sweep.Load(),
+	}
+}
+
+// Finds paste files that aren't referenced by any entry in the map and deletes them if delete_orphans is set.
+func (manager *ConcurrentExpiringPersistentURLMap) CollectOrphanedPastes(grace_period_seconds int64, delete_orphans bool) (*PasteGCReport, error) {
+	// Don't need lock here because cem has lock
+	return collect_orphaned_pastes_for_map(manager.storage_backend, manager.map_storage.PastePaths, manager.ebs.DirectoryPath(), grace_period_seconds, delete_orphans)
 }
 
 // Removed expired URLs from map in RAM every x seconds
 func (manager *ConcurrentExpiringPersistentURLMap) RemoveAllExpiredURLsFromRAM() {
 	// Don't need lock here because cem has lock
 	manager.map_storage.Remove_All_Expired(manager.extra_keeparound_seconds_ram)
+	manager.last_expiry_sweep.Store(manager.clock())
 }
 
 // Removed expired URLs from disk every x seconds
 func (manager *ConcurrentExpiringPersistentURLMap) RemoveAllExpiredURLsFromDisk() {
 	// Don't need lock here because lbses has lock
-	manager.lbses.DeleteExpiredLogFiles(manager.extra_keeparound_seconds_disk)
+	err := manager.lbses.DeleteExpiredLogFiles(manager.extra_keeparound_seconds_disk)
+	if err != nil {
+		log.Println("Failed to delete expired log files:", err)
+	}
+}
+
+// Writes an eviction record so that the evicted entry isn't loaded again after a restart, since by then its ID may belong to a new entry.
+// The record has the entry's expiry time, so it goes into the same log file as the entry and gets deleted along with it.
+func (manager *ConcurrentExpiringPersistentURLMap) record_eviction(key string, item MapItem) error {
+	// Don't need lock here because lbses has lock
+	return manager.lbses.AppendNewRecord(key, item.GetValue(), LOG_RECORD_TYPE_EVICTION, item.GetExpiryTime())
 }
 
 // This callback puts the expired short URL ID back into the internal slice so that it can be reused
-// It also deletes the associated file on disk if any
-func _internal_get_cem_expiry_callback(slice_storage *map[int]*RandomBag64, generate_strings_up_to int) ExpiryCallback {
+// It also deletes the associated file on disk if any, and removes the entry from the dedup index and idempotency store if there are any
+// The access stats are reset too, so that whoever gets the ID next doesn't inherit them.
+func _internal_get_cem_expiry_callback(slice_storage *map[int]*RandomBag64, b53m *Base53IDManager, generate_strings_up_to int, dedup_index *DedupIndex,
+	idempotency_store *IdempotencyKeyStore, ebs *ExpiringBucketStorage, access_tracker *AccessTracker) ExpiryCallback {
 	return func(url_str string, map_item MapItem) {
-		// check length of URL string
+		access_tracker.Forget(url_str)
+		if dedup_index != nil {
+			dedup_index.Remove(url_str)
+		}
+		if idempotency_store != nil {
+			idempotency_store.RemoveShortURL(url_str)
+		}
+		// check length of URL string. Aliases never came from the slice, so they don't go back into it, even if they're short enough.
 		length := len(url_str)
-		if length <= generate_strings_up_to {
+		if length <= generate_strings_up_to && Validate_Stored_Key(b53m, url_str, false) == nil {
 			// convert string back to uint64
 			uint_num := Convert_str_to_uint64(url_str)
 			(*slice_storage)[length].Push(uint_num)
@@ -205,10 +513,10 @@ func _internal_get_cem_expiry_callback(slice_storage *map[int]*RandomBag64, gene
 		// delete the associated file on disk
 		if map_item.GetType().ValueType == TYPE_MAP_ITEM_PASTE {
 			absfilepath := map_item.GetValue()
-			err := os.Remove(absfilepath)
-			if err != nil {
-				log.Fatal(err)
-				panic(err)
+			err := ebs.DeleteFile(absfilepath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				// The paste GC will get it later
+				log.Println("Failed to delete expired paste file:", absfilepath, "error:", err)
 			}
 		}
 	}
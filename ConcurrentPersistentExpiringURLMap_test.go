@@ -4,9 +4,12 @@
 package util_test
 
 import (
+	"errors"
+	"syscall"
 	"testing"
 
 	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
 )
 
 func Test_CPEUM_AddRestartReload(t *testing.T) {
@@ -16,3 +19,390 @@ func Test_CPEUM_AddRestartReload(t *testing.T) {
 	cepum_params := util.CEPUMParams{}
 	util.CreateConcurrentExpiringPersistentURLMapFromDisk(&cepum_params)
 }
+
+func Test_CEPUM_Eviction(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	limit := func(p *util.CEPUMParams) {
+		p.Max_items = 3
+		p.Eviction_policy = util.EVICTION_POLICY_LRU
+	}
+	cepum := h.StartCEPUM(limit)
+	now := h.Clock.Now()
+	paste_key, err := cepum.PutEntry(2, "evicted paste", now+400, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	b_key, err := cepum.PutEntry(2, "b.com", now+200, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	c_key, err := cepum.PutEntry(2, "c.com", now+300, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(b_key)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(c_key)
+	util.Assert_no_error(t, err, 1)
+
+	// The paste is the least recently used, so it goes. Its ID is recycled and its file is deleted.
+	_, err = cepum.PutEntry(2, "d.com", now+500, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 3, 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, 53-3, 1)
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 0, 1)
+
+	// Reuse the evicted ID for an entry that expires before the old one, so that its log file is loaded first after a restart. That evicts "b".
+	_, err = cepum.PutEntryWithID(paste_key, "reused.com", now+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(b_key)
+	util.Assert_error_equals(t, err, util.CEMNonExistentKeyError{}.Error(), 1)
+
+	// Neither evicted entry comes back, and the reused ID isn't mistaken for a duplicate
+	cepum = h.StartCEPUM(limit)
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 3, 1)
+	item, err := cepum.GetEntry(paste_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "reused.com", 1)
+	_, err = cepum.GetEntry(b_key)
+	util.Assert_error_equals(t, err, util.CEMNonExistentKeyError{}.Error(), 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, 53-3, 1)
+}
+
+func Test_CEPUM_Failed_Eviction_Record_Keeps_Entry(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	limit := func(p *util.CEPUMParams) {
+		p.Max_items = 1
+		p.Eviction_policy = util.EVICTION_POLICY_LRU
+	}
+	cepum := h.StartCEPUM(limit)
+	now := h.Clock.Now()
+	// Find out which log file the paste's entry went to, so that only the eviction record written to it fails
+	paste_log_file := ""
+	h.Backend.SetFaultHook(func(op string, path string) error {
+		if op == "AppendToSegment" {
+			paste_log_file = path
+		}
+		return nil
+	})
+	paste_key, err := cepum.PutEntry(2, "kept paste", now+400, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	h.Backend.SetFaultHook(func(op string, path string) error {
+		if op == "AppendToSegment" && path == paste_log_file {
+			return syscall.EIO
+		}
+		return nil
+	})
+
+	// The new entry goes in, but the paste can't be evicted without its eviction record, so it stays
+	url_key, err := cepum.PutEntry(2, "b.com", now+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 2, 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, 53-2, 1)
+	item, err := cepum.GetEntry(paste_key)
+	util.Assert_no_error(t, err, 1)
+
+	// so the paste GC leaves its file alone
+	report, err := cepum.CollectOrphanedPastes(0, true)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(report.Orphans), nil, 0, 1)
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 1, 1)
+
+	// After a restart both entries are back, and the paste can still be read
+	h.Backend.SetFaultHook(nil)
+	cepum = h.StartCEPUM(nil)
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 2, 1)
+	item, err = cepum.GetEntry(paste_key)
+	util.Assert_no_error(t, err, 1)
+	paste, err := cepum.ReadPaste(item, "")
+	util.Assert_result_equals_interface(t, string(paste), err, "kept paste", 1)
+	item, err = cepum.GetEntry(url_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "b.com", 1)
+}
+
+func Test_CEPUM_Reject_New_When_Full(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(func(p *util.CEPUMParams) {
+		p.Max_items = 1
+		p.Eviction_policy = util.EVICTION_POLICY_REJECT_NEW
+		p.Allow_alias_ids = true
+	})
+	_, err := cepum.PutEntry(2, "a.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	writes := h.Backend.Writes()
+	_, err = cepum.PutEntry(2, "b.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.MapFullError{}.Error(), 1)
+	_, err = cepum.PutEntryWithID("my-alias", "b.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.MapFullError{}.Error(), 1)
+	// Nothing was written and no ID was used up
+	util.Assert_result_equals_interface(t, h.Backend.Writes(), nil, writes, 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, 53-1, 1)
+}
+
+func Test_CEPUM_Max_Hits(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	key, err := cepum.PutEntryWithMaxHits(2, "burn after reading", h.Clock.Now()+1000, util.TYPE_MAP_ITEM_PASTE, 3)
+	util.Assert_no_error(t, err, 1)
+	for i := 0; i < 2; i++ {
+		_, err = cepum.GetEntry(key)
+		util.Assert_no_error(t, err, 1)
+	}
+
+	// The count survives a restart
+	cepum = h.StartCEPUM(nil)
+	_, err = cepum.GetEntry(key)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(key)
+	util.Assert_error_equals(t, err, util.KeyExpiredError{}.Error(), 1)
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 1, 1) // the last reader may still be reading it
+
+	// It goes the same way as an expired entry
+	h.Clock.Advance(100)
+	cepum.RemoveAllExpiredURLsFromRAM()
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 0, 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, 53, 1)
+
+	// and doesn't come back after a restart, even though its ID may have been handed out again
+	_, err = cepum.PutEntryWithID(key, "new.com", h.Clock.Now()+2000, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	cepum = h.StartCEPUM(nil)
+	item, err := cepum.GetEntry(key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "new.com", 1)
+}
+
+func Test_CEPUM_Max_Hits_Lookup_Without_Using_Up(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	key, err := cepum.PutEntryWithMaxHits(2, "a.com", h.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL, 1)
+	util.Assert_no_error(t, err, 1)
+
+	// Looking it up any number of times doesn't use up the hit
+	var item util.MapItem
+	for i := 0; i < 3; i++ {
+		item, err = cepum.GetEntryNoConsume(key)
+		util.Assert_result_equals_interface(t, item.GetValue(), err, "a.com", 1)
+	}
+	err = cepum.UseHit(key, item)
+	util.Assert_no_error(t, err, 1)
+
+	// Two requests that looked it up before either used it can't both have it
+	err = cepum.UseHit(key, item)
+	util.Assert_error_equals(t, err, util.KeyExpiredError{}.Error(), 1)
+	_, err = cepum.GetEntryNoConsume(key)
+	util.Assert_error_equals(t, err, util.KeyExpiredError{}.Error(), 1)
+}
+
+func Test_CEPUM_Max_Hits_Needs_Storage(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	_, err := cepum.PutEntryWithMaxHits(2, "a.com", h.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL, 0)
+	util.Assert_error_equals(t, err, "max_hits must be at least 1.", 1)
+	key, err := cepum.PutEntryWithMaxHits(2, "a.com", h.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL, 1)
+	util.Assert_no_error(t, err, 1)
+
+	// If the read can't be recorded then it doesn't happen
+	h.Backend.FailNextWrites(1, errors.New("EIO"))
+	_, err = cepum.GetEntry(key)
+	util.Assert_error_equals(t, err, util.StorageUnavailableError{Err: errors.New("EIO")}.Error(), 1)
+	item, err := cepum.GetEntry(key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "a.com", 1)
+	_, err = cepum.GetEntry(key)
+	util.Assert_error_equals(t, err, util.KeyExpiredError{}.Error(), 1)
+
+	// Restarting straight away doesn't bring it back either
+	cepum = h.StartCEPUM(nil)
+	_, err = cepum.GetEntry(key)
+	util.Assert_error_equals(t, err, util.CEMNonExistentKeyError{}.Error(), 1)
+}
+
+func Test_CEPUM_PutEntryWithID_Failed_Write_Keeps_ID(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	remaining := cepum.Health().Remaining_ids[2]
+
+	// The ID goes back in the bag if the entry can't be written, so it can still be asked for again
+	h.Backend.FailNextWrites(1, errors.New("EIO"))
+	_, err := cepum.PutEntryWithID("00", "a.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.StorageUnavailableError{Err: errors.New("EIO")}.Error(), 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, remaining, 1)
+	key, err := cepum.PutEntryWithID("00", "a.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, key, err, "00", 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, remaining-1, 1)
+}
+
+func Test_CEPUM_Expired_Aliases_Are_Not_Recycled(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(func(p *util.CEPUMParams) { p.Allow_alias_ids = true })
+	// Short aliases that aren't Base53 IDs: too short, not Base53, and Base53 characters with a bad checksum
+	aliases := []string{"a", "a-"}
+	for _, c := range []byte("23456789ABCDEFGHJKLMNPQRSTUVXYZabcefghijknopqrstuvxyz") {
+		if util.Validate_Stored_Key(h.B53m, "0"+string(c), false) != nil {
+			aliases = append(aliases, "0"+string(c))
+			break
+		}
+	}
+	util.Assert_result_equals_interface(t, len(aliases), nil, 3, 1)
+	for _, alias := range aliases {
+		_, err := cepum.PutEntryWithID(alias, "alias.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+	}
+	h.Clock.Advance(1000)
+	cepum.RemoveAllExpiredURLsFromRAM()
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, 53, 1)
+
+	// Taking an alias again doesn't leave it in the slice for PutEntry to hand out
+	_, err := cepum.PutEntryWithID(aliases[2], "again.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	for i := 0; i < 53; i++ {
+		key, err := cepum.PutEntry(2, "drain.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+		util.Assert_no_error(t, util.Validate_Stored_Key(h.B53m, key, false), 1)
+	}
+	_, err = cepum.PutEntry(2, "drain.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, "No short URLs left", 1)
+}
+
+func Test_CEPUM_Idempotency_Key_Of_Expired_Entry(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(func(p *util.CEPUMParams) { p.Idempotency_window_seconds = 3600 })
+	key, err := cepum.PutEntryWithIdempotencyKey("request-1", 2, "a.com", h.Clock.Now()+10, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	// The entry has expired but is still in RAM, so a retry gets a new entry instead of a dead link
+	h.Clock.Advance(11)
+	retry_key, err := cepum.PutEntryWithIdempotencyKey("request-1", 2, "a.com", h.Clock.Now()+10, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	if retry_key == key {
+		t.Fatal("Idempotency key returned an expired entry")
+	}
+	item, err := cepum.GetEntry(retry_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "a.com", 1)
+}
+
+func Test_CEPUM_Deduplicate_Entries(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(func(p *util.CEPUMParams) { p.Deduplicate_entries = true })
+	now := h.Clock.Now()
+	// All of these expiry times fall into the same bucket
+	key, err := cepum.PutEntry(2, "a.com", now+140, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	same_key, err := cepum.PutEntry(2, "a.com", now+130, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, same_key, err, key, 1)
+
+	// An entry that would expire too early isn't reused
+	later_key, err := cepum.PutEntry(2, "a.com", now+150, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	if later_key == key {
+		t.Fatal("Reused an entry that expires before the requested expiry time")
+	}
+	item, err := cepum.GetEntry(later_key)
+	util.Assert_result_equals_interface(t, item.GetExpiryTime(), err, now+150, 1)
+
+	// Neither is one with a different length
+	longer_key, err := cepum.PutEntry(3, "a.com", now+140, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(longer_key), nil, 3, 1)
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 3, 1)
+}
+
+func Test_CEPUM_Deduplicate_Entries_Skips_Requested_IDs(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	dedup := func(p *util.CEPUMParams) { p.Deduplicate_entries = true }
+	cepum := h.StartCEPUM(dedup)
+	_, err := cepum.PutEntryWithID("00", "a.com", h.Clock.Now()+140, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	// Someone's vanity ID is never handed out for a random PutEntry
+	key, err := cepum.PutEntry(2, "a.com", h.Clock.Now()+130, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	if key == "00" {
+		t.Fatal("PutEntry reused an entry put with PutEntryWithID")
+	}
+
+	// Not even after a restart
+	var vanity_key string
+	for _, csum := range []byte("02345678ABCDEFGHJKLMNPQRSTUVXYZabcefghijknopqrstuvxyz") {
+		id, err := h.B53m.NewBase53ID("22", csum, false)
+		if err == nil {
+			vanity_key = id.GetCombinedString()
+		}
+	}
+	_, err = cepum.PutEntryWithID(vanity_key, "b.com", h.Clock.Now()+140, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	cepum = h.StartCEPUM(dedup)
+	key, err = cepum.PutEntry(3, "b.com", h.Clock.Now()+130, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	if key == vanity_key {
+		t.Fatal("PutEntry reused an entry put with PutEntryWithID after a restart")
+	}
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 4, 1)
+}
+
+// Hands out the given paths before falling back to random ones
+type colliding_paste_storage struct {
+	util.PasteStorage
+	paths []string
+}
+
+func (s *colliding_paste_storage) NewFilePath(file_contents []byte, expiry_time int64) string {
+	if len(s.paths) == 0 {
+		return s.PasteStorage.NewFilePath(file_contents, expiry_time)
+	}
+	path := s.paths[0]
+	s.paths = s.paths[1:]
+	return path
+}
+
+func Test_CEPUM_Paste_Name_Collision(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	allow_aliases := func(p *util.CEPUMParams) { p.Allow_alias_ids = true }
+	cepum := h.StartCEPUM(allow_aliases)
+	expiry_time := h.Clock.Now() + 1000
+	key, err := cepum.PutEntry(2, "first paste", expiry_time, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	taken_path := h.PasteFiles()[0]
+
+	// The next paste gets the same name twice, so it has to pick another one without touching the first paste's file
+	params := h.CEPUMParams()
+	lbses := util.NewLogBucketStructuredExpiringStorageWithBackend(h.Backend, params.Bucket_interval, h.LogDir())
+	lbses.SetClock(h.Clock.Now)
+	paste_storage := &colliding_paste_storage{
+		PasteStorage: util.NewExpiringBucketStorageWithBackend(h.Backend, h.PasteDir()),
+		paths:        []string{taken_path, taken_path},
+	}
+	path, err := util.Write_Entry_Durably_Common("second-paste", "second paste", util.TYPE_MAP_ITEM_PASTE, expiry_time, lbses, paste_storage, &util.XattrParams{})
+	util.Assert_no_error(t, err, 1)
+	if path == taken_path {
+		t.Fatal("Second paste was written over the first one")
+	}
+	contents, err := h.Backend.GetBlob(taken_path)
+	util.Assert_result_equals_bytes(t, contents, err, "first paste", 1)
+
+	// The intent records for the taken name don't make the loader delete it
+	cepum = h.StartCEPUM(allow_aliases)
+	for k, expected := range map[string]string{key: "first paste", "second-paste": "second paste"} {
+		item, err := cepum.GetEntry(k)
+		util.Assert_no_error(t, err, 1)
+		contents, err = cepum.ReadPaste(item, "")
+		util.Assert_result_equals_bytes(t, contents, err, expected, 1)
+	}
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 2, 1)
+}
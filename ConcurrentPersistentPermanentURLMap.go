@@ -8,7 +8,6 @@ package util
 import (
 	"log"
 	"sync"
-	"time"
 )
 
 type ConcurrentPersistentPermanentURLMap struct {
@@ -21,6 +20,16 @@ type ConcurrentPersistentPermanentURLMap struct {
 	generate_strings_up_to int
 	map_size_persister     *MapSizeFileManager
 	xattr_params           *XattrParams
+	allow_alias_ids        bool
+	dedup_index            *DedupIndex
+	idempotency_store      *IdempotencyKeyStore
+	storage_backend        StorageBackend
+	clock                  Clock
+	storage_health         *StorageHealth
+	load_progress          *LoadProgress
+	log_directory_path     string
+	access_tracker         *AccessTracker
+	paste_keyring          *PasteKeyring
 }
 
 func (manager *ConcurrentPersistentPermanentURLMap) PrintInternalState() {
@@ -53,21 +62,115 @@ func (manager *ConcurrentPersistentPermanentURLMap) GetEntry(short_url string) (
 	defer manager.mut.Unlock()
 
 	val, err := GetEntryCommon(manager.urlmap, short_url)
+	if err == nil {
+		manager.access_tracker.Record_Hit(short_url)
+	}
 	return val, err
 }
 
+// Same as GetEntry, except that it doesn't count as an access. Permanent entries have no max hits, so UseHit only counts the access.
+func (manager *ConcurrentPersistentPermanentURLMap) GetEntryNoConsume(short_url string) (MapItem, error) { //nolint:ireturn //this is ok
+	manager.mut.Lock()
+	defer manager.mut.Unlock()
+
+	return GetEntryCommon(manager.urlmap, short_url)
+}
+
+func (manager *ConcurrentPersistentPermanentURLMap) UseHit(short_url string, _ MapItem) error {
+	manager.access_tracker.Record_Hit(short_url)
+	return nil
+}
+
+// Reads the paste that item points to, decrypting it if need be. passphrase is only needed for password-protected pastes, see PasteEncryption.go.
+func (manager *ConcurrentPersistentPermanentURLMap) ReadPaste(item MapItem, passphrase string) ([]byte, error) {
+	// No need for lock here, paste files never change.
+	return ReadPaste_Common(manager.storage_backend, manager.paste_keyring, item, passphrase)
+}
+
 // Shorten long URL into short URL and return the short URL and store the entry both in map and on disk
 func (manager *ConcurrentPersistentPermanentURLMap) PutEntry(requested_length int, long_url string, _ int64, value_type MapItemValueType) (string, error) {
 	manager.mut.Lock()
 	defer manager.mut.Unlock()
 
-	cur_unix_timestamp := time.Now().Unix()
+	return manager.put_entry_locked(requested_length, long_url, value_type, manager.lsps)
+}
+
+// Same as PutEntry, except that retrying with the same idempotency key returns the short URL created by the first call.
+func (manager *ConcurrentPersistentPermanentURLMap) PutEntryWithIdempotencyKey(idempotency_key string, requested_length int, long_url string, _ int64,
+	value_type MapItemValueType) (string, error) {
+	manager.mut.Lock()
+	defer manager.mut.Unlock()
+
+	val, err := PutEntry_Idempotent_Common(manager.idempotency_store, manager.urlmap, idempotency_key, Compute_Idempotency_Request_Digest(requested_length, long_url, value_type), manager.lsps, func(log_storage LogStorage) (string, error) {
+		return manager.put_entry_locked(requested_length, long_url, value_type, log_storage)
+	})
+	return val, err
+}
+
+// Caller must hold manager.mut. The entry is written to log_storage, which is manager.lsps or a wrapper around it.
+func (manager *ConcurrentPersistentPermanentURLMap) put_entry_locked(requested_length int, long_url string, value_type MapItemValueType, log_storage LogStorage) (string, error) {
+	cur_unix_timestamp := manager.clock()
+	long_url, err := Seal_Paste_Common(manager.paste_keyring, long_url, value_type)
+	if err != nil {
+		return "", err
+	}
+
+	val, err := PutEntry_Dedup_Common(manager.dedup_index, manager.urlmap, requested_length, long_url, value_type, cur_unix_timestamp, func() (string, error) {
+		return PutEntry_Storage_Health_Common(manager.storage_health, func() (string, error) {
+			return PutEntry_Common(requested_length, long_url, value_type, cur_unix_timestamp, manager.generate_strings_up_to, manager.slice_map, manager.urlmap,
+				manager.b53m, log_storage, manager.pbs, manager.map_size_persister, manager.xattr_params)
+		})
+	})
+	return val, err
+}
+
+// Store the entry under a caller-chosen ID (e.g. a vanity URL) instead of a randomly generated one.
+func (manager *ConcurrentPersistentPermanentURLMap) PutEntryWithID(requested_id string, long_url string, _ int64, value_type MapItemValueType) (string, error) {
+	manager.mut.Lock()
+	defer manager.mut.Unlock()
+
+	cur_unix_timestamp := manager.clock()
+	long_url, err := Seal_Paste_Common(manager.paste_keyring, long_url, value_type)
+	if err != nil {
+		return "", err
+	}
 
-	val, err := PutEntry_Common(requested_length, long_url, value_type, cur_unix_timestamp, manager.generate_strings_up_to, manager.slice_map, manager.urlmap,
-		manager.b53m, manager.lsps, manager.pbs, manager.map_size_persister, manager.xattr_params)
+	val, err := PutEntry_Storage_Health_Common(manager.storage_health, func() (string, error) {
+		return PutEntryWithID_Common(requested_id, manager.allow_alias_ids, long_url, value_type, cur_unix_timestamp, manager.generate_strings_up_to, manager.slice_map,
+			manager.urlmap, manager.b53m, manager.lsps, manager.pbs, manager.map_size_persister, manager.xattr_params)
+	})
 	return val, err
 }
 
+// Whether PutEntry can currently write to storage. See StorageHealth.
+func (manager *ConcurrentPersistentPermanentURLMap) StorageStatus() StorageStatus {
+	// No need for lock here, storage_health has its own lock.
+	return manager.storage_health.Status()
+}
+
+// For health checks. Permanent entries never expire so Last_expiry_sweep is always 0.
+func (manager *ConcurrentPersistentPermanentURLMap) Health() MapHealth {
+	manager.mut.Lock()
+	remaining_ids := Remaining_IDs_Common(manager.slice_map)
+	manager.mut.Unlock()
+
+	return MapHealth{
+		Load_progress:     manager.load_progress.Status(),
+		Storage:           manager.storage_health.Status(),
+		Num_items:         manager.urlmap.NumItems(),
+		Remaining_ids:     remaining_ids,
+		Log_dir_space:     Disk_Space_For_Health_Common(manager.storage_backend, manager.log_directory_path),
+		Paste_dir_space:   Disk_Space_For_Health_Common(manager.storage_backend, manager.pbs.DirectoryPath()),
+		Last_expiry_sweep: 0,
+	}
+}
+
+// Finds paste files that aren't referenced by any entry in the map and deletes them if delete_orphans is set.
+func (manager *ConcurrentPersistentPermanentURLMap) CollectOrphanedPastes(grace_period_seconds int64, delete_orphans bool) (*PasteGCReport, error) {
+	// No need for lock here, the map has its own lock.
+	return collect_orphaned_pastes_for_map(manager.storage_backend, manager.urlmap.PastePaths, manager.pbs.DirectoryPath(), grace_period_seconds, delete_orphans)
+}
+
 type CPPUMParams struct {
 	Log_directory_path_absolute    string
 	Bucket_directory_path_absolute string
@@ -77,14 +180,50 @@ type CPPUMParams struct {
 	Size_file_rounded_multiple     int64
 	Size_file_path_absolute        string
 	Xattr_params                   *XattrParams
+	Allow_alias_ids                bool           // Allow PutEntryWithID to accept IDs that are not valid Base53 IDs
+	Deduplicate_entries            bool           // PutEntry returns the existing ID for an identical URL or paste
+	Idempotency_window_seconds     int64          // How long idempotency keys are remembered for. 0 disables idempotency keys.
+	Paste_gc_interval_seconds      int            // How often to delete orphaned paste files. 0 disables the periodic paste GC.
+	Paste_gc_grace_period_seconds  int64          // Paste files younger than this are never deleted by the paste GC. At least PASTE_GC_MIN_GRACE_PERIOD_SECONDS if the periodic GC is on.
+	Storage_backend                StorageBackend // Where the logs, pastes and size file are kept. nil means the local file system.
+	Clock                          Clock          // nil means the real clock
+	Storage_retry_interval_seconds int64          // While writes are failing, PutEntry only tries to write this often. See StorageHealth.
+	Log_parse_workers              int            // How many log files are parsed at the same time when loading. 0 means GOMAXPROCS.
+	Access_tracker                 *AccessTracker // Counts successful GetEntry calls. nil disables access tracking.
+	Paste_keyring                  *PasteKeyring  // Encrypts new pastes. nil stores them as they are.
+	Use_arena_map                  bool           // Keep the entries in an ArenaMapWithPastesCount, which uses a lot less RAM but allocates on every GetEntry
 }
 
 // This is the one you want to use in production
 func CreateConcurrentPersistentPermanentURLMapFromDisk(cppum_params *CPPUMParams) *ConcurrentPersistentPermanentURLMap {
+	return create_cppum_from_disk(cppum_params, NewLoadProgress())
+}
+
+// Same as CreateConcurrentPersistentPermanentURLMapFromDisk except that it returns straight away and loads in the background. See AsyncPersistentMap.
+func CreateConcurrentPersistentPermanentURLMapFromDiskAsync(cppum_params *CPPUMParams) *AsyncPersistentMap {
+	load_progress := NewLoadProgress()
+	return start_async_persistent_map(load_progress, func() GenericConcurrentPersistentMap {
+		return create_cppum_from_disk(cppum_params, load_progress)
+	})
+}
+
+func create_cppum_from_disk(cppum_params *CPPUMParams, load_progress *LoadProgress) *ConcurrentPersistentPermanentURLMap {
+	validate_paste_gc_params(cppum_params.Paste_gc_interval_seconds, cppum_params.Paste_gc_grace_period_seconds)
 	slice_storage := make(map[int]*RandomBag64)
-	lsps := NewLogStructuredPermanentStorage(cppum_params.Log_file_max_size_bytes, cppum_params.Log_directory_path_absolute)
-	pbs := NewPermanentBucketStorage(cppum_params.Bucket_directory_path_absolute)
+	storage_backend := storage_backend_or_local(cppum_params.Storage_backend)
+	clock := clock_or_real(cppum_params.Clock)
+	lsps := NewLogStructuredPermanentStorageWithBackend(storage_backend, cppum_params.Log_file_max_size_bytes, cppum_params.Log_directory_path_absolute)
+	pbs := NewPermanentBucketStorageWithBackend(storage_backend, cppum_params.Bucket_directory_path_absolute)
 	var nil_map_ptr *ConcurrentPermanentMap = nil
+	var dedup_index *DedupIndex = nil
+	if cppum_params.Deduplicate_entries {
+		dedup_index = NewDedupIndex(nil) // permanent entries never expire so there's only one expiry class
+	}
+	var idempotency_store *IdempotencyKeyStore = nil
+	if cppum_params.Idempotency_window_seconds > 0 {
+		idempotency_store = NewIdempotencyKeyStore(cppum_params.Idempotency_window_seconds)
+		idempotency_store.SetClock(clock)
+	}
 
 	// Now load from each file into the map
 	params := LSRFD_Params{
@@ -98,6 +237,14 @@ func CreateConcurrentPersistentPermanentURLMapFromDisk(cppum_params *CPPUMParams
 		Size_file_rounded_multiple:  cppum_params.Size_file_rounded_multiple,
 		Generate_strings_up_to:      cppum_params.Generate_strings_up_to,
 		Size_file_path_absolute:     cppum_params.Size_file_path_absolute,
+		Allow_alias_ids:             cppum_params.Allow_alias_ids,
+		Dedup_index:                 dedup_index,
+		Idempotency_store:           idempotency_store,
+		Storage_backend:             storage_backend,
+		Clock:                       clock,
+		Load_progress:               load_progress,
+		Log_parse_workers:           cppum_params.Log_parse_workers,
+		Use_arena_map:               cppum_params.Use_arena_map,
 	}
 
 	concurrent_map, map_size_persister := LoadStoredRecordsFromDisk(&params)
@@ -111,7 +258,26 @@ func CreateConcurrentPersistentPermanentURLMapFromDisk(cppum_params *CPPUMParams
 		pbs:                    pbs,
 		generate_strings_up_to: cppum_params.Generate_strings_up_to,
 		map_size_persister:     map_size_persister,
+		xattr_params:           cppum_params.Xattr_params,
+		allow_alias_ids:        cppum_params.Allow_alias_ids,
+		dedup_index:            dedup_index,
+		idempotency_store:      idempotency_store,
+		storage_backend:        storage_backend,
+		clock:                  clock,
+		storage_health:         NewStorageHealth(cppum_params.Storage_retry_interval_seconds, clock),
+		load_progress:          load_progress,
+		log_directory_path:     cppum_params.Log_directory_path_absolute,
+		access_tracker:         cppum_params.Access_tracker,
+		paste_keyring:          cppum_params.Paste_keyring,
 	}
 
+	if idempotency_store != nil {
+		go RunFuncEveryXSeconds(idempotency_store.Remove_All_Expired, int(min(cppum_params.Idempotency_window_seconds, 60))) //nolint:gomnd // once a minute is plenty
+	}
+	if cppum_params.Paste_gc_interval_seconds > 0 {
+		go RunFuncEveryXSeconds(func() {
+			log_paste_gc_report(manager.CollectOrphanedPastes(cppum_params.Paste_gc_grace_period_seconds, true))
+		}, cppum_params.Paste_gc_interval_seconds)
+	}
 	return &manager
 }
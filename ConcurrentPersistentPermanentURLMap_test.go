@@ -4,8 +4,12 @@
 package util_test
 
 import (
+	"errors"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/1f604/util"
 )
@@ -29,3 +33,213 @@ func Test_CPPUM_AddRestartReload(t *testing.T) {
 	val, err := cppum.PutEntry(2, "google.com", 0, util.TYPE_MAP_ITEM_URL)
 	log.Println(val, err)
 }
+
+func new_test_cppum(t *testing.T, dir string, allow_alias_ids bool) *util.ConcurrentPersistentPermanentURLMap {
+	t.Helper()
+
+	return new_test_cppum_with_params(t, dir, func(p *util.CPPUMParams) { p.Allow_alias_ids = allow_alias_ids })
+}
+
+func new_test_cppum_with_params(t *testing.T, dir string, modify_params func(*util.CPPUMParams)) *util.ConcurrentPersistentPermanentURLMap {
+	t.Helper()
+
+	log_dir := filepath.Join(dir, "logs")
+	err := os.MkdirAll(log_dir, os.ModePerm)
+	util.Assert_no_error(t, err, 1)
+
+	cppum_params := util.CPPUMParams{
+		Log_directory_path_absolute:    log_dir,
+		Bucket_directory_path_absolute: filepath.Join(dir, "pastes"),
+		B53m:                           util.NewBase53IDManager(),
+		Generate_strings_up_to:         2,
+		Log_file_max_size_bytes:        300,
+		Size_file_rounded_multiple:     5,
+		Size_file_path_absolute:        filepath.Join(dir, "size.txt"),
+		Xattr_params:                   &util.XattrParams{},
+	}
+	modify_params(&cppum_params)
+	return util.CreateConcurrentPersistentPermanentURLMapFromDisk(&cppum_params)
+}
+
+func Test_CPPUM_PutEntryWithID(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	cppum := new_test_cppum(t, dir, false)
+
+	// "0" with checksum "0" is a valid 2 character Base53 ID.
+	key, err := cppum.PutEntryWithID("00", "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, key, err, "00", 1)
+
+	// Taken IDs are rejected
+	_, err = cppum.PutEntryWithID("00", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.KeyAlreadyExistsError{}.Error(), 1)
+
+	// Remapping applies: 'O' is read as '0'
+	_, err = cppum.PutEntryWithID("OO", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.KeyAlreadyExistsError{}.Error(), 1)
+
+	// Bad checksum
+	_, err = cppum.PutEntryWithID("02", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.Base53ErrorChecksumMismatch{}.Error(), 1)
+
+	// Aliases are off by default
+	_, err = cppum.PutEntryWithID("my-link", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.Base53ErrorIllegalCharacter{}.Error(), 1)
+
+	// The requested ID must never be handed out again by PutEntry
+	for {
+		key, err = cppum.PutEntry(2, "example.com", 0, util.TYPE_MAP_ITEM_URL)
+		if err != nil {
+			break
+		}
+		if key == "00" {
+			t.Fatal("PutEntry handed out an ID that was already taken by PutEntryWithID")
+		}
+	}
+	util.Assert_error_equals(t, err, "No short URLs left", 1)
+}
+
+func Test_CPPUM_PutEntryWithID_Alias_Survives_Restart(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	cppum := new_test_cppum(t, dir, true)
+
+	key, err := cppum.PutEntryWithID("my-link", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, key, err, "my-link", 1)
+
+	_, err = cppum.PutEntryWithID("not/allowed", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.AliasIDInvalidError{}.Error(), 1)
+
+	cppum = new_test_cppum(t, dir, true)
+	val, err := cppum.GetEntry("my-link")
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, val.GetValue(), nil, "example.com", 1)
+}
+
+func Test_CPPUM_Deduplicate_Entries(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	enable_dedup := func(p *util.CPPUMParams) { p.Deduplicate_entries = true }
+	cppum := new_test_cppum_with_params(t, dir, enable_dedup)
+
+	url_key, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	key, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, key, err, url_key, 1)
+
+	paste_key, err := cppum.PutEntry(4, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	key, err = cppum.PutEntry(4, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_result_equals_interface(t, key, err, paste_key, 1)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 2, 1)
+
+	// Not if a different length was asked for
+	key, err = cppum.PutEntry(5, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(key), nil, 5, 1)
+
+	// A URL and a paste with the same contents are different entries
+	key, err = cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	if key == url_key {
+		t.Fatal("Paste was deduplicated against a URL")
+	}
+
+	// The index is rebuilt on restart
+	cppum = new_test_cppum_with_params(t, dir, enable_dedup)
+	key, err = cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, key, err, url_key, 1)
+	key, err = cppum.PutEntry(4, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_result_equals_interface(t, key, err, paste_key, 1)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 4, 1)
+}
+
+func Test_CPPUM_Idempotency_Keys(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	enable_idempotency := func(p *util.CPPUMParams) { p.Idempotency_window_seconds = 3600 }
+	cppum := new_test_cppum_with_params(t, dir, enable_idempotency)
+
+	first_key, err := cppum.PutEntryWithIdempotencyKey("request-1", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	key, err := cppum.PutEntryWithIdempotencyKey("request-1", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, key, err, first_key, 1)
+
+	// A different token creates a new entry
+	key, err = cppum.PutEntryWithIdempotencyKey("request-2", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	if key == first_key {
+		t.Fatal("Different idempotency keys returned the same short URL")
+	}
+
+	_, err = cppum.PutEntryWithIdempotencyKey("has space", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.IdempotencyKeyInvalidError{}.Error(), 1)
+
+	// Reusing a token for something else is an error
+	_, err = cppum.PutEntryWithIdempotencyKey("request-1", 4, "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.IdempotencyKeyConflictError{}.Error(), 1)
+
+	// The token survives a restart, and so does what it was used for
+	cppum = new_test_cppum_with_params(t, dir, enable_idempotency)
+	key, err = cppum.PutEntryWithIdempotencyKey("request-1", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, key, err, first_key, 1)
+	_, err = cppum.PutEntryWithIdempotencyKey("request-1", 4, "google.com", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_error_equals(t, err, util.IdempotencyKeyConflictError{}.Error(), 1)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 2, 1)
+
+	// Tokens are rejected when the feature is off
+	cppum = new_test_cppum_with_params(t, dir, func(*util.CPPUMParams) {})
+	_, err = cppum.PutEntryWithIdempotencyKey("request-1", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_error_equals(t, err, util.IdempotencyKeysDisabledError{}.Error(), 1)
+}
+
+func Test_CPPUM_Uncommitted_Paste_Is_Rolled_Back(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	cppum := new_test_cppum(t, dir, false)
+
+	key, err := cppum.PutEntry(2, "committed paste", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+
+	// A failed log append must not leave the entry in RAM
+	_, err = cppum.PutEntry(2, "bad\turl", 0, util.TYPE_MAP_ITEM_URL)
+	if err == nil {
+		t.Fatal("Expected an error for a URL containing a tab")
+	}
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 1, 1)
+
+	// Simulate a crash after the intent record and paste file were written, but before the commit record
+	// The crashed ID has to be a different one from the committed paste's random ID
+	crashed_id := "2y"
+	if key == crashed_id {
+		crashed_id = "3v"
+	}
+	crashed_paste_path := filepath.Join(dir, "pastes", "created_at_1_crashed")
+	err = os.WriteFile(crashed_paste_path, []byte("crashed paste"), 0o644)
+	util.Assert_no_error(t, err, 1)
+	f, err := os.OpenFile(filepath.Join(dir, "logs", "1000.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	util.Assert_no_error(t, err, 1)
+	err = util.Write_Record_To_File(crashed_id, crashed_paste_path, util.LOG_RECORD_TYPE_PASTE_INTENT, time.Now().Unix(), f)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, f.Close(), 1)
+
+	cppum = new_test_cppum(t, dir, false)
+	_, err = os.Stat(crashed_paste_path)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Expected uncommitted paste file to be deleted, got:", err)
+	}
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 1, 1)
+	item, err := cppum.GetEntry(key)
+	util.Assert_no_error(t, err, 1)
+	contents, err := os.ReadFile(item.GetValue())
+	util.Assert_result_equals_interface(t, string(contents), err, "committed paste", 1)
+
+	// The rolled back ID was never committed, so it's still free
+	_, err = cppum.PutEntryWithID(crashed_id, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+}
@@ -6,16 +6,9 @@
 package util
 
 import (
-	"bufio"
-	"bytes"
-	"crypto/md5"
-	"encoding/base64"
-	"encoding/hex"
 	"errors"
-	"io"
 	"log"
 	"os"
-	"path/filepath"
 	"strings"
 )
 
@@ -41,12 +34,14 @@ type ConcurrentMap interface {
 }
 
 type URLMap interface {
+	Get_Entry(string) (MapItem, error)
 	Put_New_Entry(string, string, int64, MapItemValueType) error
 	NumItems() int
 }
 
 type LogStorage interface {
 	AppendNewEntry(string, string, MapItemValueType, int64) error
+	AppendNewRecord(string, string, string, int64) error
 }
 
 func GetEntryCommon(cm ConcurrentMap, short_url string) (MapItem, error) {
@@ -65,264 +60,761 @@ type XattrParams struct {
 }
 
 type PasteStorage interface {
-	InsertFile([]byte, int64, *XattrParams) string
+	InsertFile([]byte, int64, *XattrParams) (string, error)
+	NewFilePath([]byte, int64) string
+	WriteNewFile(string, []byte, *XattrParams) error
+	DeleteFile(string) error
+}
+
+// Returns true if the key is in the map, even if it has expired but hasn't been removed yet.
+func url_map_contains_key(urlmap URLMap, key_str string) bool {
+	_, err := urlmap.Get_Entry(key_str)
+	switch err.(type) { //nolint:errorlint // just let it fail
+	case CPMNonExistentKeyError, CEMNonExistentKeyError:
+		return false
+	}
+	return true
+}
+
+// Only an expiring map with EVICTION_POLICY_REJECT_NEW can be full
+func url_map_is_full(urlmap URLMap) bool {
+	cem, ok := urlmap.(*ConcurrentExpiringMap)
+	return ok && cem.IsFull()
+}
+
+// Makes a new entry durable on disk before it is put into the map, using a write-ahead protocol:
+// 1. For pastes, append an intent record naming the paste file that is about to be written.
+// 2. Write the paste file.
+// 3. Append the entry record itself, which serves as the commit record.
+// Every step is synced to disk before the next one starts. If the process crashes before step 3, the loader finds the intent without a matching entry and deletes the paste file.
+// URLs don't need an intent record since the entry record is the only thing that gets written.
+// Returns the value to store in the map, i.e. the long URL or the path of the paste file.
+// On error nothing has been committed, and the caller must not put the entry into the map.
+// Errors from the storage itself are wrapped in StorageUnavailableError, so that they can be told apart from invalid input.
+func Write_Entry_Durably_Common(key_str string, long_url string, value_type MapItemValueType, timestamp int64, log_storage LogStorage,
+	paste_storage PasteStorage, xattr_params *XattrParams) (string, error) {
+	value := long_url
+	if value_type == TYPE_MAP_ITEM_PASTE {
+		// This is a little bit hacky because we're using long_url as paste_data and then using the file path as the long URL...
+		value = paste_storage.NewFilePath([]byte(long_url), timestamp)
+	}
+	// Check that the record can be written before touching the storage
+	_, err := Format_Log_Record(key_str, value, value_type.ToString(), timestamp)
+	if err != nil {
+		return "", err
+	}
+	if value_type == TYPE_MAP_ITEM_PASTE {
+		value, err = write_paste_with_intent(key_str, []byte(long_url), timestamp, value, log_storage, paste_storage, xattr_params)
+		if err != nil {
+			return "", err
+		}
+	}
+	err = with_paste_encryption_info(log_storage, []byte(long_url), value_type).AppendNewEntry(key_str, value, value_type, timestamp)
+	if err != nil {
+		if value_type == TYPE_MAP_ITEM_PASTE {
+			_ = paste_storage.DeleteFile(value)
+		}
+		return "", StorageUnavailableError{Err: err}
+	}
+	return value, nil
+}
+
+// Steps 1 and 2 of Write_Entry_Durably_Common. If the paste file's name is already taken, which means it belongs to some other entry,
+// that file is left alone and another name is tried. The intent record for the taken name is harmless, since the loader never rolls back a file
+// that an entry was committed with.
+func write_paste_with_intent(key_str string, paste_data []byte, timestamp int64, absfilepath string, log_storage LogStorage, paste_storage PasteStorage,
+	xattr_params *XattrParams) (string, error) {
+	for count := 0; count < 10; count++ {
+		if count > 0 {
+			absfilepath = paste_storage.NewFilePath(paste_data, timestamp)
+		}
+		err := log_storage.AppendNewRecord(key_str, absfilepath, LOG_RECORD_TYPE_PASTE_INTENT, timestamp)
+		if err != nil {
+			return "", StorageUnavailableError{Err: err}
+		}
+		err = paste_storage.WriteNewFile(absfilepath, paste_data, xattr_params)
+		if err == nil {
+			return absfilepath, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			// The intent is already in the log, so if this fails too then the loader will clean it up.
+			_ = paste_storage.DeleteFile(absfilepath)
+			return "", StorageUnavailableError{Err: err}
+		}
+		log.Println("Unexpected collision occurred!!!", absfilepath)
+	}
+	return "", errors.New("Tried 10 times to write new file, all of the names were taken")
 }
 
 // Shorten long URL into short URL and return the short URL and store the entry both in map and on disk
+// The entry is only put into the map once it is durable on disk, see Write_Entry_Durably_Common.
 func PutEntry_Common(requested_length int, long_url string, value_type MapItemValueType, timestamp int64, generate_strings_up_to int,
 	slice_storage map[int]*RandomBag64, urlmap URLMap, b53m *Base53IDManager, log_storage LogStorage, paste_storage PasteStorage, map_size_persister *MapSizeFileManager,
 	xattr_params *XattrParams) (string, error) {
 	if requested_length < 2 { //nolint:gomnd // 2 is not magic here. BASE53 can only go down to 2 characters because it uses one character for the checksum
 		return "", errors.New("Requested length is too small.")
 	}
+	// Checked before anything is written, since once the entry is on disk it has to go into the map
+	if url_map_is_full(urlmap) {
+		return "", MapFullError{}
+	}
+	// First pick an ID that isn't in the map. Nothing has been written anywhere yet.
 	// if length is <= 5, grab it from one of the slices
 	var result_str string
-	if requested_length <= generate_strings_up_to { //nolint:nestif // yeah it's complicated
-		randombag, ok := slice_storage[requested_length]
+	var randombag *RandomBag64
+	var item uint64
+	if requested_length <= generate_strings_up_to {
+		var ok bool
+		randombag, ok = slice_storage[requested_length]
 		if !ok {
 			log.Fatal("Failed to index slice_storage. This should never happen.")
 			panic("Failed to index slice_storage. This should never happen.")
 		}
-		item, err := randombag.PopRandom()
+		var err error
+		item, err = randombag.PopRandom()
 		if err != nil {
 			// This should be a common scenario.
 			// We haven't modified anything at this point, so it's fine to return error here.
 			return "", errors.New("No short URLs left")
 		}
-		// At this point, the item has been removed from the slice, so add it to the map.
-		// Add item to the map
 		result_str = Convert_uint64_to_str(item, requested_length)
-		// Add paste to storage first
-
-		// If it's a paste, first add it to bucket storage before adding it into map
-		// This is a little bit hacky because we're using long_url as paste_data and then using the directory path as the long URL...
-		if value_type == TYPE_MAP_ITEM_PASTE {
-			long_url = paste_storage.InsertFile([]byte(long_url), timestamp, xattr_params)
-		}
-
-		err = urlmap.Put_New_Entry(result_str, long_url, timestamp, value_type)
-		if err != nil { // Only possible error is if entry already exists, which it should never do since we got it from the slice.
-			log.Fatal("Put_New_Entry failed. This should never happen. Error:", err)
-			panic("Put_New_Entry failed. This should never happen. Error:" + err.Error())
-		}
-		// Successfully put it into the map. Now write it to disk too
-		goto added_item_to_map
 	} else { // Otherwise randomly generate it and see if it already exists
-		// try 100 times, trying again when it fails due to already existing in the map
+		// try 100 times, trying again when it already exists in the map
 		// probability of failing 100 times in a row should be astronomically small
-		// If it's a paste, first add it to bucket storage before adding it into map
-		// This is a little bit hacky because we're using long_url as paste_data and then using the directory path as the long URL...
-		if value_type == TYPE_MAP_ITEM_PASTE {
-			long_url = paste_storage.InsertFile([]byte(long_url), timestamp, xattr_params)
-		}
-
-		for i := 0; i < 100; i++ {
+		for i := 0; ; i++ {
+			if i == 100 { //nolint:gomnd // 100 is plenty
+				log.Fatal("Failed to generate new random string 100 times, this should never happen")
+				panic("Failed to generate new random string 100 times, this should never happen")
+			}
 			id, err := b53m.B53_generate_random_Base53ID(requested_length)
 			if err != nil {
 				log.Fatal("Failed to generate new random ID. This should never happen. Error:", err)
 				panic(err)
 			}
 			result_str = id.GetCombinedString()
-			err = urlmap.Put_New_Entry(result_str, long_url, timestamp, value_type)
-			if err == nil {
-				// Successfully put it into the map. Now write it to disk too
-				goto added_item_to_map
+			if !url_map_contains_key(urlmap, result_str) {
+				break
 			}
 			if i > 3 { //nolint:gomnd // 3 is a good number.
 				log.Println("Unexpected event: got duplicate ID", i, "times in a row. ID is:", result_str)
 			}
 		}
-		log.Fatal("Failed to generate new random string 100 times, this should never happen")
-		panic("Failed to generate new random string 100 times, this should never happen")
 	}
-	// Successfully put it into the map. Now write it to disk too
-added_item_to_map:
-	// Update the size file if necessary
-	// log.Print("urlmap.NumItems():", urlmap.NumItems())
-	map_size_persister.UpdateMapSizeRounded(int64(urlmap.NumItems()))
+
 	// It's okay if this is slow since it's just a write. Most operations are going to be reads.
-	err := log_storage.AppendNewEntry(result_str, long_url, value_type, timestamp)
-	// log.Println("calling log_storage.AppendNewEntry(result_str, long_url, timestamp)")
+	value, err := Write_Entry_Durably_Common(result_str, long_url, value_type, timestamp, log_storage, paste_storage, xattr_params)
 	if err != nil {
-		// It should never fail.
-		log.Fatal("AppendNewEntry failed:", err)
-		panic(err)
+		// Nothing was committed, so give the ID back.
+		if randombag != nil {
+			randombag.Push(item)
+		}
+		return "", err
+	}
+
+	// The entry is on disk, so now it can go into the map.
+	err = urlmap.Put_New_Entry(result_str, value, timestamp, value_type)
+	if err != nil { // Only possible error is if entry already exists, which it can't since we checked above while holding the manager lock.
+		log.Fatal("Put_New_Entry failed. This should never happen. Error:", err)
+		panic("Put_New_Entry failed. This should never happen. Error:" + err.Error())
 	}
+	// Update the size file if necessary
+	map_size_persister.UpdateMapSizeRounded(int64(urlmap.NumItems()))
 	return result_str, nil
 }
 
+type AliasIDInvalidError struct{}
+
+func (e AliasIDInvalidError) Error() string {
+	return "Alias ID must be 1 to 64 characters long and contain only letters, digits, '-' and '_'"
+}
+
+const ALIAS_ID_MAX_LENGTH = 64
+
+// Alias IDs are IDs that are not valid Base53 IDs. They live in their own namespace:
+// since every randomly generated ID is a valid Base53 ID, an alias can never collide with one.
+func Validate_Alias_ID(id string) error {
+	if len(id) == 0 || len(id) > ALIAS_ID_MAX_LENGTH {
+		return AliasIDInvalidError{}
+	}
+	for i := 0; i < len(id); i++ {
+		if IsAlnum[id[i]] == 0 && id[i] != '-' && id[i] != '_' {
+			return AliasIDInvalidError{}
+		}
+	}
+	return nil
+}
+
+// Validates a key read back from a log file. Keys must be Base53 IDs, unless aliases are allowed in which case non-Base53 aliases are also accepted.
+func Validate_Stored_Key(b53m *Base53IDManager, key_str string, allow_alias_ids bool) error {
+	var err error
+	if len(key_str) < 2 { //nolint:gomnd // 2 is the minimum length of a Base53 ID
+		err = Base53ErrorStrWithoutCsumTooShort{}
+	} else {
+		_, err = b53m.NewBase53ID(key_str[:len(key_str)-1], key_str[len(key_str)-1], false)
+	}
+	if err != nil && allow_alias_ids && Validate_Alias_ID(key_str) == nil {
+		return nil
+	}
+	return err
+}
+
+// Normalizes a requested ID into the key that will be stored in the map.
+// Returns the key and whether or not it is a Base53 ID (as opposed to an alias).
+func Normalize_Requested_ID(b53m *Base53IDManager, requested_id string, allow_alias_ids bool) (string, bool, error) {
+	var b53_err error
+	if len(requested_id) < 2 { //nolint:gomnd // 2 is the minimum length of a Base53 ID
+		b53_err = Base53ErrorStrWithoutCsumTooShort{}
+	} else {
+		id, err := b53m.NewBase53ID(requested_id[:len(requested_id)-1], requested_id[len(requested_id)-1], true)
+		if err == nil {
+			return id.GetCombinedString(), true, nil
+		}
+		b53_err = err
+	}
+	// Not a Base53 ID, so it can only be an alias.
+	if !allow_alias_ids {
+		return "", false, b53_err
+	}
+	err := Validate_Alias_ID(requested_id)
+	if err != nil {
+		return "", false, err
+	}
+	return requested_id, false, nil
+}
+
+// Store the entry under a caller-chosen ID instead of a random one.
+// Returns KeyAlreadyExistsError if the ID is already taken.
+// If the ID is one of the pregenerated ones, it is removed from the RandomBag so that it is never handed out again.
+func PutEntryWithID_Common(requested_id string, allow_alias_ids bool, long_url string, value_type MapItemValueType, timestamp int64, generate_strings_up_to int,
+	slice_storage map[int]*RandomBag64, urlmap URLMap, b53m *Base53IDManager, log_storage LogStorage, paste_storage PasteStorage, map_size_persister *MapSizeFileManager,
+	xattr_params *XattrParams) (string, error) {
+	key_str, is_base53, err := Normalize_Requested_ID(b53m, requested_id, allow_alias_ids)
+	if err != nil {
+		return "", err
+	}
+
+	if url_map_contains_key(urlmap, key_str) {
+		return "", KeyAlreadyExistsError{}
+	}
+	if url_map_is_full(urlmap) {
+		return "", MapFullError{}
+	}
+	// Take the ID out of the bag first so that it can never be popped once it's in the map. It goes back in if the write fails.
+	var randombag *RandomBag64
+	if is_base53 && len(key_str) <= generate_strings_up_to {
+		var ok bool
+		randombag, ok = slice_storage[len(key_str)]
+		if !ok {
+			log.Fatal("Failed to index slice_storage. This should never happen.")
+			panic("Failed to index slice_storage. This should never happen.")
+		}
+		err = randombag.Remove(Convert_str_to_uint64(key_str))
+		if err != nil { // neither in the map nor in the bag, so it's been lost somewhere
+			log.Println("Requested ID was neither in the map nor in the bag. ID:", key_str)
+			return "", err
+		}
+	}
+	value, err := Write_Entry_Durably_Common(key_str, long_url, value_type, timestamp, requested_id_log_storage{LogStorage: log_storage}, paste_storage, xattr_params)
+	if err != nil {
+		if randombag != nil {
+			randombag.Push(Convert_str_to_uint64(key_str))
+		}
+		return "", err
+	}
+	err = urlmap.Put_New_Entry(key_str, value, timestamp, value_type)
+	if err != nil { // We checked above while holding the manager lock, so this can't happen.
+		log.Fatal("Put_New_Entry failed. This should never happen. Error:", err)
+		panic("Put_New_Entry failed. This should never happen. Error:" + err.Error())
+	}
+
+	map_size_persister.UpdateMapSizeRounded(int64(urlmap.NumItems()))
+	return key_str, nil
+}
+
+// Writes a requested ID record just before the entry record, so that the loader knows not to put the entry in the dedup index.
+// Otherwise a random PutEntry for the same URL could be handed someone's vanity ID.
+type requested_id_log_storage struct {
+	LogStorage
+}
+
+func (s requested_id_log_storage) AppendNewEntry(key string, value string, value_type MapItemValueType, timestamp int64) error {
+	err := s.LogStorage.AppendNewRecord(key, "", LOG_RECORD_TYPE_REQUESTED_ID, timestamp)
+	if err != nil {
+		return err
+	}
+	return s.LogStorage.AppendNewEntry(key, value, value_type, timestamp)
+}
+
+// Returns the short URL ID of an identical live entry if there is one, otherwise calls put_fn to create a new entry and indexes it.
+// The existing entry is only reused if its ID has the requested length and, for expiring entries, it lasts at least as long as the requested expiry time.
+// If dedup_index is nil then this just calls put_fn.
+func PutEntry_Dedup_Common(dedup_index *DedupIndex, cm ConcurrentMap, requested_length int, long_url string, value_type MapItemValueType, timestamp int64,
+	put_fn func() (string, error)) (string, error) {
+	if dedup_index == nil {
+		return put_fn()
+	}
+	digest := Compute_Dedup_Digest([]byte(long_url), value_type)
+	existing_key, ok := dedup_index.Lookup(digest, value_type, timestamp, requested_length)
+	if ok {
+		// The index may still point to an entry that has expired but hasn't been removed from RAM yet, so check that it's still live.
+		item, err := cm.Get_Entry(existing_key)
+		if err == nil && (!item.GetType().IsTemporary || item.GetExpiryTime() >= timestamp) {
+			return existing_key, nil
+		}
+	}
+	key, err := put_fn()
+	if err != nil {
+		return "", err
+	}
+	dedup_index.Add(key, digest, value_type, timestamp)
+	return key, nil
+}
+
+type IdempotencyKeysDisabledError struct{}
+
+func (e IdempotencyKeysDisabledError) Error() string {
+	return "Idempotency keys are not enabled for this map"
+}
+
+// If the token has been seen within the idempotency window, returns the short URL ID that was created for it instead of calling put_fn.
+// Otherwise calls put_fn and persists the token in the log so that retries still work after a restart.
+// put_fn must write the entry to the log storage it's given, which writes the token record just before the entry record.
+// That way the token can't get lost if the server dies right after the entry is written.
+// Returns IdempotencyKeyConflictError if the token was used for a different request, see Compute_Idempotency_Request_Digest.
+// An empty token means no idempotency, i.e. put_fn is just called directly.
+func PutEntry_Idempotent_Common(iks *IdempotencyKeyStore, cm ConcurrentMap, token string, request_digest string, log_storage LogStorage,
+	put_fn func(LogStorage) (string, error)) (string, error) {
+	if token == "" {
+		return put_fn(log_storage)
+	}
+	if iks == nil {
+		return "", IdempotencyKeysDisabledError{}
+	}
+	err := Validate_Idempotency_Key(token)
+	if err != nil {
+		return "", err
+	}
+	short_url, stored_digest, ok := iks.Lookup(token)
+	if ok && stored_digest != request_digest {
+		return "", IdempotencyKeyConflictError{}
+	}
+	// Tokens are dropped when their entry is removed from the map, but an expired entry can stay in RAM for a while before that happens.
+	// A retry then gets a new entry, since the old one can't be handed out any more.
+	if ok {
+		_, err = cm.Get_Entry(short_url)
+		if err == nil {
+			return short_url, nil
+		}
+	}
+	token_expiry_time := iks.Now() + iks.WindowSeconds()
+	token_storage := &idempotency_key_log_storage{
+		LogStorage:        log_storage,
+		token:             token,
+		request_digest:    request_digest,
+		token_expiry_time: token_expiry_time,
+		written:           false,
+	}
+	key, err := put_fn(token_storage)
+	if err != nil {
+		return "", err
+	}
+	if !token_storage.written {
+		// put_fn returned an existing entry (e.g. a duplicate), so there was no entry record to go with the token. The entry is already on disk,
+		// so a separate record is fine: if it doesn't get written, a retry just finds the same entry again.
+		err = log_storage.AppendNewRecord(key, token+" "+request_digest, LOG_RECORD_TYPE_IDEMPOTENCY_KEY, token_expiry_time)
+		if err != nil {
+			log.Println("Failed to persist idempotency key for", key, "error:", err)
+		}
+	}
+	iks.Add(token, key, request_digest, token_expiry_time)
+	return key, nil
+}
+
+// Writes the idempotency record just before the entry record, with the entry's timestamp so that it goes into the same log file.
+// The value is the token's expiry time, the token and the request digest, which tells the loader that the record belongs to the next record.
+// If the entry record then fails to be written, the loader ignores the token since the next record isn't its entry.
+type idempotency_key_log_storage struct {
+	LogStorage
+	token             string
+	request_digest    string
+	token_expiry_time int64
+	written           bool
+}
+
+func (s *idempotency_key_log_storage) AppendNewEntry(key string, value string, value_type MapItemValueType, timestamp int64) error {
+	err := s.LogStorage.AppendNewRecord(key, Int64_to_string(s.token_expiry_time)+" "+s.token+" "+s.request_digest, LOG_RECORD_TYPE_IDEMPOTENCY_KEY, timestamp)
+	if err != nil {
+		return err
+	}
+	err = s.LogStorage.AppendNewEntry(key, value, value_type, timestamp)
+	if err != nil {
+		return err
+	}
+	s.written = true
+	return nil
+}
+
+// Whether the record only applies to the entry record straight after it, if that has the same key and timestamp
+func is_chained_record(record *LogRecord) bool {
+	if record.Type == LOG_RECORD_TYPE_MAX_HITS || record.Type == LOG_RECORD_TYPE_REQUESTED_ID || record.Type == LOG_RECORD_TYPE_PASTE_ENCRYPTION {
+		return true
+	}
+	if record.Type == LOG_RECORD_TYPE_IDEMPOTENCY_KEY {
+		_, _, _, ok := parse_chained_idempotency_record(record.Value)
+		return ok
+	}
+	return false
+}
+
+// Parses the value of an idempotency record written by idempotency_key_log_storage into the token, its request digest and its expiry time.
+// Returns false for standalone records, whose value is just the token and its request digest, and whose timestamp is the token's expiry time.
+func parse_chained_idempotency_record(value string) (string, string, int64, bool) {
+	// Tokens can't contain spaces
+	fields := strings.Split(value, " ")
+	if len(fields) != 3 { //nolint:gomnd // expiry time, token, request digest
+		return "", "", 0, false
+	}
+	expiry_time, err := String_to_int64(fields[0])
+	if err != nil {
+		return "", "", 0, false
+	}
+	return fields[1], fields[2], expiry_time, true
+}
+
+// Parses the value of a standalone idempotency record into the token and its request digest
+func parse_standalone_idempotency_record(value string) (string, string) {
+	token, request_digest, _ := strings.Cut(value, " ")
+	return token, request_digest
+}
+
 type NonExistentKeyError interface {
 	NonExistentKeyError() string
 }
 
+// Both maps return their own error types, but they match these with errors.Is, so callers don't need to know which map they're talking to.
+var (
+	ErrNotFound      = errors.New("key not found")      // CEMNonExistentKeyError, CPMNonExistentKeyError
+	ErrExpired       = errors.New("key expired")        // KeyExpiredError. Use errors.As to find out when it expired.
+	ErrAlreadyExists = errors.New("key already exists") // KeyAlreadyExistsError
+)
+
 type LSRFD_Params struct {
-	B53m                        *Base53IDManager
-	Log_directory_path_absolute string
-	Size_file_path_absolute     string
-	Entry_should_be_deleted_fn  func(int64) bool
-	Lss                         LogStructuredStorage
-	Expiry_callback             ExpiryCallback
-	Slice_storage               map[int]*RandomBag64
-	Nil_ptr                     ConcurrentMap
-	Size_file_rounded_multiple  int64
-	Generate_strings_up_to      int
+	B53m                         *Base53IDManager
+	Log_directory_path_absolute  string
+	Size_file_path_absolute      string
+	Entry_should_be_deleted_fn   func(int64) bool
+	Lss                          LogStructuredStorage
+	Expiry_callback              ExpiryCallback
+	Slice_storage                map[int]*RandomBag64
+	Nil_ptr                      ConcurrentMap
+	Size_file_rounded_multiple   int64
+	Generate_strings_up_to       int
+	Allow_alias_ids              bool
+	Dedup_index                  *DedupIndex          // nil if deduplication is disabled
+	Idempotency_store            *IdempotencyKeyStore // nil if idempotency keys are disabled
+	Storage_backend              StorageBackend       // nil means the local file system
+	Clock                        Clock                // nil means the real clock
+	Load_progress                *LoadProgress        // nil if nobody is watching
+	Log_parse_workers            int                  // How many log files are parsed at the same time. 0 means GOMAXPROCS.
+	Expiry_index_bucket_interval int64                // If not 0, the expiring map uses a BucketedExpiryIndex with this interval instead of a heap
+	Use_arena_map                bool                 // If true, the permanent map keeps its entries in an ArenaMapWithPastesCount
 }
 
 // This is the one you want to use in production
 func LoadStoredRecordsFromDisk(params *LSRFD_Params) (ConcurrentMap, *MapSizeFileManager) { //nolint:gocognit,ireturn // yeah, it is complicated...
-	// First, list all the files in the directory
-	entries, err := os.ReadDir(params.Log_directory_path_absolute)
+	// First, list all the files in the directory, validating their names
+	backend := storage_backend_or_local(params.Storage_backend)
+	files_to_be_loaded_from, err := List_Log_Segments(backend, params.Log_directory_path_absolute, params.Lss)
 	if err != nil {
-		log.Fatal("Failed to open bucket directory:", params.Log_directory_path_absolute, "error:", err)
+		log.Fatal("Failed to list log directory:", params.Log_directory_path_absolute, "error:", err)
 		panic(err)
 	}
-	// Now for each file, try to parse the file's filename and load it into the map, deleting associated files if entry is expired
-	files_to_be_loaded_from := make([]string, 0, len(entries))
-	for _, entry := range entries {
-		if entry.IsDir() { // ignore directories
-			continue
-		}
-		// validate file name
-		err = params.Lss.ValidateLogFilename(entry.Name())
-		if err != nil {
-			log.Fatal("Failed to parse name of file in log directory:", entry.Name(), "got error:", err)
-			panic(err)
-		}
 
-		// add it to the list of files to be loaded from
-		absolute_file_path := filepath.Join(params.Log_directory_path_absolute, entry.Name())
-		files_to_be_loaded_from = append(files_to_be_loaded_from, absolute_file_path)
-	}
+	params.Load_progress.set_totals(len(files_to_be_loaded_from), max(params.Generate_strings_up_to-1, 0))
 
-	map_size_persister := NewMapSizeFileManager(params.Size_file_path_absolute, params.Size_file_rounded_multiple)
+	map_size_persister := NewMapSizeFileManagerWithBackend(backend, params.Size_file_path_absolute, params.Size_file_rounded_multiple)
 	// Load size of map from file
 	stored_map_length := map_size_persister.current_rounded_size
 
 	// Create the map and slice efficiently using the loaded rounded size. It's okay if it's too small, since these will grow automatically.
 	concurrent_map := params.Nil_ptr.BeginConstruction(stored_map_length, params.Expiry_callback)
-
-	for _, absolute_filepath := range files_to_be_loaded_from {
-		f, err := os.Open(absolute_filepath) //nolint:govet // ignore err shadow
-		if err != nil {
-			log.Fatal("Failed to open bucket log file:", absolute_filepath, "err:", err)
-			panic(err)
+	// The expiring map needs the clock before anything calls Get_Entry on it below
+	if cem, ok := concurrent_map.(*ConcurrentExpiringMap); ok {
+		cem.SetClock(params.Clock)
+		if params.Expiry_index_bucket_interval > 0 {
+			cem.SetExpiryIndex(NewBucketedExpiryIndex(params.Expiry_index_bucket_interval))
 		}
+	}
+	if cpm, ok := concurrent_map.(*ConcurrentPermanentMap); ok && params.Use_arena_map {
+		cpm.UseArenaMap(stored_map_length)
+	}
+	cur_unix_timestamp := clock_or_real(params.Clock)()
+	// Paste intents and the entries that commit them can be in different files, and the files aren't read in order, so match them up as we go.
+	// Whatever is left in uncommitted_paste_intents at the end is rolled back.
+	uncommitted_paste_intents := make(map[string]string) // paste path -> key
+	unmatched_paste_commits := make(map[string]bool)     // paste paths of entries whose intent we haven't seen yet
+	committed_paste_paths := make(map[string]bool)       // never rolled back, even if there's another intent for them (see write_paste_with_intent)
+
+	// Insert it into map (and push it into heap for ConcurrentExpiringMap)
+	requested_id_entries := make(map[string]bool) // evicted_entry_key of entries put with PutEntryWithID, which aren't deduplicated against
+	insert_record := func(record *LogRecord) {
+		concurrent_map.ContinueConstruction(record.Key, record.Value, record.Timestamp, record.ValueType)
+		params.Load_progress.record_loaded()
+		if params.Dedup_index != nil && !requested_id_entries[evicted_entry_key(record)] {
+			params.Dedup_index.AddStoredEntryFromBackend(backend, record.Key, record.Value, record.ValueType, record.Timestamp)
+		}
+	}
 
-		// Now scan the input from the file
-		br := bufio.NewReader(f)
-		for {
-			str_without_hash, err := br.ReadBytes('\x1e')
-			//			log.Println("str_without_hash, err:", str_without_hash, err)
-			if len(str_without_hash) > 0 {
-				str_without_hash = str_without_hash[:len(str_without_hash)-1] // Remove trailing \r
-			}
-			// check if error is EOF
-			if errors.Is(err, io.EOF) {
-				// make sure we're not waiting for more input
-				// If ReadBytes encounters an error before finding a delimiter,
-				// it returns the data read before the error and the error itself (often io.EOF).
-				if len(str_without_hash) != 0 {
-					log.Fatal("File ", absolute_filepath, " does not end with newline, indicating some kind of corruption")
-					panic("File doesn't end with newline.")
-				}
-				break
+	// When a full expiring map evicts an entry, its ID goes straight back into the RandomBag, but its record stays on disk until it expires.
+	// So there can be two live entries for the same key, one of them followed by an eviction record (in the same file, since it has the same expiry time).
+	// Until we see the eviction record we don't know which one is live, so the entries after the first are held here.
+	conflicting_records := make(map[string][]*LogRecord) // key -> entry records
+	delete_evicted_paste := func(paste_path string) {
+		err := backend.Delete(paste_path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to delete evicted paste file:", paste_path, "error:", err)
+		}
+	}
+	replay_eviction := func(record *LogRecord) {
+		cem, ok := concurrent_map.(*ConcurrentExpiringMap)
+		if !ok {
+			return // Only the expiring map evicts
+		}
+		pending := conflicting_records[record.Key]
+		item, removed := cem.remove_evicted_entry(record.Key, record.Value, record.Timestamp)
+		if removed {
+			if params.Dedup_index != nil {
+				params.Dedup_index.Remove(record.Key)
 			}
-			if err != nil {
-				log.Fatal("Unexpected non-EOF error")
-				panic(err)
+			if params.Idempotency_store != nil {
+				params.Idempotency_store.RemoveShortURL(record.Key)
 			}
-
-			md5_base64, err := br.ReadBytes('\n')
-			if err != nil {
-				log.Println("Failed on file:", absolute_filepath)
+			if item.itemValueType == TYPE_MAP_ITEM_PASTE {
+				delete_evicted_paste(item.value)
 			}
-			Check_err(err)
-			md5_base64 = md5_base64[:len(md5_base64)-1] // remove trailing newline
-			parts := strings.Split(string(str_without_hash), "\t")
-			if len(parts) != 4 { //nolint:gomnd // 3 is okay here...
-				log.Fatal("Expected 4 parts (key, value, type, imestamp), got", len(parts))
-				panic("Got unexpected number of parts")
+			if len(pending) > 0 {
+				insert_record(pending[0])
+				pending = pending[1:]
 			}
-			key_str := parts[0]
-			value_str := parts[1]
-			type_str := parts[2]
-			timestamp_str := parts[3]
-
-			// Check URL ID
-			_, err = params.B53m.NewBase53ID(key_str[:len(key_str)-1], key_str[len(key_str)-1], false)
-			if err != nil {
-				log.Fatal("Invalid URL ID:", key_str, "Error:", err)
-				panic(err)
+		} else {
+			for i, conflicting := range pending {
+				if conflicting.Value == record.Value && conflicting.Timestamp == record.Timestamp {
+					if conflicting.ValueType == TYPE_MAP_ITEM_PASTE {
+						delete_evicted_paste(conflicting.Value)
+					}
+					pending = append(pending[:i], pending[i+1:]...)
+					break
+				}
 			}
+		}
+		if len(pending) == 0 {
+			delete(conflicting_records, record.Key)
+		} else {
+			conflicting_records[record.Key] = pending
+		}
+	}
 
-			// Check type_str
-			var map_item_type MapItemValueType
-			switch type_str {
-			case "url":
-				map_item_type = TYPE_MAP_ITEM_URL
-			case "paste":
-				map_item_type = TYPE_MAP_ITEM_PASTE
-			default:
-				log.Fatal("Unrecognized value type")
-				panic("Unrecognized value type")
+	// Entries put with PutEntryWithMaxHits, by evicted_entry_key. Their read records are counted so that the remaining hits can be set once everything is loaded.
+	// Entries that used up their last hit have an eviction record, so they're dropped like evicted ones.
+	type limited_entry struct {
+		entry    *LogRecord
+		max_hits int64
+		reads    int64
+	}
+	limited_entries := make(map[string]*limited_entry)
+	var pending_max_hits *LogRecord = nil        // only applies to the record straight after it
+	var pending_idempotency_key *LogRecord = nil // same
+	var pending_requested_id *LogRecord = nil    // same
+
+	// Loads one record into the map, deleting associated files if entry is expired. Only ever called from this goroutine, so none of this needs locking.
+	apply_record := func(record *LogRecord) error {
+		key_str := record.Key
+		value_str := record.Value
+		timestamp_unix := record.Timestamp
+		map_item_type := record.ValueType
+
+		// Chained to the entry after it, but only there for tools. It can be anywhere in the chain, so it mustn't make the others think their entry didn't come.
+		if record.Type == LOG_RECORD_TYPE_PASTE_ENCRYPTION {
+			return nil
+		}
+		if pending_max_hits != nil {
+			if map_item_type != nil && pending_max_hits.Key == key_str && pending_max_hits.Timestamp == timestamp_unix {
+				max_hits, err := String_to_int64(pending_max_hits.Value)
+				if err == nil && max_hits > 0 {
+					limited_entries[evicted_entry_key(record)] = &limited_entry{entry: record, max_hits: max_hits, reads: 0}
+				}
 			}
-
-			// Check md5_base64
-			md5_bytes, err := base64.StdEncoding.DecodeString(string(md5_base64))
-			if err != nil {
-				log.Fatal("Could not decode base64-encoded md5", err)
-				panic(err)
+			pending_max_hits = nil
+		}
+		if record.Type == LOG_RECORD_TYPE_MAX_HITS {
+			pending_max_hits = record
+			return nil
+		}
+		if pending_requested_id != nil {
+			if map_item_type != nil && pending_requested_id.Key == key_str && pending_requested_id.Timestamp == timestamp_unix {
+				requested_id_entries[evicted_entry_key(record)] = true
 			}
-			// Now recompute the md5 and check it against the stored value
-			recomputed_md5 := md5.Sum(str_without_hash) //nolint:gosec // md5 is fine here.
-			if !bytes.Equal(recomputed_md5[:], md5_bytes) {
-				log.Fatalf("md5 does not match. Stored: %s Recomputed: %s", hex.EncodeToString(md5_bytes), hex.EncodeToString(recomputed_md5[:]))
-				panic("md5 does not match.")
+			pending_requested_id = nil
+		}
+		if record.Type == LOG_RECORD_TYPE_REQUESTED_ID {
+			pending_requested_id = record
+			return nil
+		}
+		if pending_idempotency_key != nil {
+			token, request_digest, token_expiry_time, _ := parse_chained_idempotency_record(pending_idempotency_key.Value)
+			if map_item_type != nil && pending_idempotency_key.Key == key_str && pending_idempotency_key.Timestamp == timestamp_unix &&
+				params.Idempotency_store != nil && token_expiry_time > cur_unix_timestamp {
+				params.Idempotency_store.Add(token, key_str, request_digest, token_expiry_time)
 			}
+			pending_idempotency_key = nil
+		}
 
-			// convert timestamp_str to timestamp_unix
-			timestamp_unix, err := String_to_int64(timestamp_str)
-			if err != nil {
-				log.Fatal("Could not convert timestamp_str to int64", err)
-				panic(err)
+		// Idempotency records aren't map entries. Either they go with the entry record after them, or they're standalone and the timestamp is
+		// when the token stops being valid.
+		if record.Type == LOG_RECORD_TYPE_IDEMPOTENCY_KEY {
+			if _, _, _, ok := parse_chained_idempotency_record(value_str); ok {
+				pending_idempotency_key = record
+			} else if params.Idempotency_store != nil && timestamp_unix > cur_unix_timestamp {
+				token, request_digest := parse_standalone_idempotency_record(value_str)
+				params.Idempotency_store.Add(token, key_str, request_digest, timestamp_unix)
 			}
-
-			err = Validate_Timestamp_Common(timestamp_unix)
-			if err != nil {
-				log.Fatal(err)
-				panic(err)
+			return nil
+		}
+		if record.Type == LOG_RECORD_TYPE_PASTE_INTENT {
+			if unmatched_paste_commits[value_str] {
+				delete(unmatched_paste_commits, value_str)
+			} else {
+				uncommitted_paste_intents[value_str] = key_str
+			}
+			return nil
+		}
+		if map_item_type == TYPE_MAP_ITEM_PASTE {
+			if _, ok := uncommitted_paste_intents[value_str]; ok {
+				delete(uncommitted_paste_intents, value_str)
+			} else {
+				unmatched_paste_commits[value_str] = true
 			}
+			committed_paste_paths[value_str] = true
+		}
 
-			if params.Entry_should_be_deleted_fn != nil {
-				// If entry is expired AND entry is temporary then delete the paste.
-				// This function being non-nil means we're in the temporary version.
-				// Therefore delete the paste if it's expired.
-				ignore_entry := params.Entry_should_be_deleted_fn(timestamp_unix)
-				if ignore_entry {
-					if map_item_type == TYPE_MAP_ITEM_PASTE {
-						// Try to delete it
-						// Ignore errors since it might already be deleted
-						_ = os.Remove(value_str)
+		if params.Entry_should_be_deleted_fn != nil {
+			// If entry is expired AND entry is temporary then delete the paste.
+			// This function being non-nil means we're in the temporary version.
+			// Therefore delete the paste if it's expired.
+			ignore_entry := params.Entry_should_be_deleted_fn(timestamp_unix)
+			if ignore_entry {
+				if map_item_type == TYPE_MAP_ITEM_PASTE {
+					// Try to delete it
+					// It might already be deleted, which is fine. Anything else is left for the paste GC to clean up.
+					err := backend.Delete(value_str)
+					if err != nil && !errors.Is(err, os.ErrNotExist) {
+						log.Println("Failed to delete expired paste file:", value_str, "error:", err)
 					}
-					continue
 				}
+				return nil
 			}
+		}
 
-			// So now we know the entry in the file is not expired.
-			// But what if there is already an entry in the map???
-			val, err := concurrent_map.Get_Entry(key_str) // if map already contains item, err will be nil
-			if err == nil {                               // This implies that we've already seen a non-expired entry for that URL ID, which should never happen
-				log.Fatal("Multiple non-expired entries found in log files for same key string: ", val.MapItemToString(), " key_str: ", key_str)
-				panic("Multiple non-expired entries found in log files for same URL ID")
+		if record.Type == LOG_RECORD_TYPE_EVICTION {
+			replay_eviction(record)
+			delete(limited_entries, evicted_entry_key(record))
+			return nil
+		}
+		if record.Type == LOG_RECORD_TYPE_READ {
+			if limited, ok := limited_entries[evicted_entry_key(record)]; ok {
+				limited.reads++
 			}
+			return nil
+		}
+		if record.ValueType == nil { // analytics records don't belong in here, but they're harmless
+			return nil
+		}
+
+		// So now we know the entry in the file is not expired.
+		// But what if there is already an entry in the map???
+		val, err := concurrent_map.Get_Entry(key_str) // if map already contains item, err will be nil
+		if err == nil {                               // This implies that we've already seen a non-expired entry for that URL ID
+			if _, ok := concurrent_map.(*ConcurrentExpiringMap); ok {
+				// One of them may have been evicted, in which case there's an eviction record still to come
+				conflicting_records[key_str] = append(conflicting_records[key_str], record)
+				return nil
+			}
+			log.Fatal("Multiple non-expired entries found in log files for same key string: ", val.MapItemToString(), " key_str: ", key_str)
+			panic("Multiple non-expired entries found in log files for same URL ID")
+		}
 
-			// Insert it into map (and push it into heap for ConcurrentExpiringMap)
-			concurrent_map.ContinueConstruction(key_str, value_str, timestamp_unix, map_item_type)
+		insert_record(record)
+		return nil
+	}
+
+	// The files are parsed in parallel but applied to the map here one at a time, in order
+	err = ForEachParsedLogSegment(backend, files_to_be_loaded_from, params.B53m, params.Allow_alias_ids, params.Log_parse_workers, func(parsed *ParsedLogSegment) error {
+		for _, record := range parsed.Records {
+			err := apply_record(record) //nolint:govet // shadow is okay here.
+			if err != nil {
+				return err
+			}
+		}
+		err := parsed.Err //nolint:govet // shadow is okay here.
+		var truncated_err LogFileTruncatedError
+		if errors.As(err, &truncated_err) {
+			// The process died in the middle of an append. That record was never acknowledged, so drop it.
+			// It has to be cut off, otherwise the next record appended to this file would be glued onto it.
+			log.Println("Log file", parsed.Path, "ends with a partial record at offset", truncated_err.Offset, "- truncating it")
+			err = backend.TruncateSegment(parsed.Path, truncated_err.Offset)
 		}
+		if err != nil {
+			log.Fatal("Failed to load log file:", parsed.Path, "error:", err)
+			panic(err)
+		}
+		params.Load_progress.file_loaded()
+		return nil
+	})
+	if err != nil {
+		log.Fatal("Failed to load log files:", err)
+		panic(err)
 	}
-	// Call heap.Init() for ConcurrentExpiringMap
+	for key_str, pending := range conflicting_records {
+		log.Fatal("Multiple non-expired entries found in log files for same key string: ", pending[0].Value, " key_str: ", key_str)
+		panic("Multiple non-expired entries found in log files for same URL ID")
+	}
+	if cem, ok := concurrent_map.(*ConcurrentExpiringMap); ok {
+		for _, limited := range limited_entries {
+			item, ok := cem.get_item(limited.entry.Key)
+			if !ok || item.value != limited.entry.Value || item.expiry_time_unix != limited.entry.Timestamp {
+				continue // expired, or lost to a conflicting entry
+			}
+			// The last hit is written as an eviction record, so there's always at least one left here
+			item.remaining_hits = max(limited.max_hits-limited.reads, 1)
+			item.max_hits = limited.max_hits
+			if params.Dedup_index != nil {
+				params.Dedup_index.Remove(limited.entry.Key)
+			}
+		}
+	}
+	// Let the map finish off after the bulk load
 	concurrent_map.FinishConstruction()
 
+	// Roll back puts that crashed before they were committed. The paste file may or may not have been written.
+	for paste_path, key_str := range uncommitted_paste_intents {
+		if committed_paste_paths[paste_path] {
+			continue
+		}
+		log.Println("Rolling back uncommitted paste for key", key_str, "file:", paste_path)
+		err = backend.Delete(paste_path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Println("Failed to delete uncommitted paste file:", paste_path, "error:", err)
+		}
+	}
+
+	// Drop tokens pointing to entries that weren't loaded, otherwise they would point to IDs that are about to go back into the RandomBag.
+	if params.Idempotency_store != nil {
+		params.Idempotency_store.RetainShortURLs(func(keystr string) bool {
+			_, err := concurrent_map.Get_Entry(keystr) //nolint:govet // shadow is okay here.
+			return err == nil
+		})
+	}
+
 	should_be_added_fn := func(keystr string) bool { // Only add to slice if it's not in the map
 		_, err := concurrent_map.Get_Entry(keystr) //nolint:govet // shadow is okay here.
 		if err != nil {
@@ -338,12 +830,14 @@ func LoadStoredRecordsFromDisk(params *LSRFD_Params) (ConcurrentMap, *MapSizeFil
 	}
 	for n := 2; n <= params.Generate_strings_up_to; n++ {
 		log.Println("Generating all Base 53 IDs of length", n)
+		params.Load_progress.generating_id_length_started(n)
 		slice, err := params.B53m.B53_generate_all_Base53IDs_int64_optimized(n, should_be_added_fn) //nolint:govet // ignore err shadow
 		if err != nil {
 			log.Fatal("B53_generate_all_Base53IDs_int64_optimized failed", err)
 			panic("B53_generate_all_Base53IDs_int64_optimized failed: " + err.Error())
 		}
 		params.Slice_storage[n] = CreateRandomBagFromSlice(slice)
+		params.Load_progress.id_length_generated()
 	}
 
 	if !IsSameType(concurrent_map, params.Nil_ptr) {
@@ -351,18 +845,28 @@ func LoadStoredRecordsFromDisk(params *LSRFD_Params) (ConcurrentMap, *MapSizeFil
 		panic("Not same type.")
 	}
 	map_size_persister.UpdateMapSizeRounded(int64(concurrent_map.NumItems()))
+	params.Load_progress.finish()
 	return concurrent_map, map_size_persister
 }
 
 type GenericConcurrentPersistentMap interface {
 	GetEntry(short_url string) (MapItem, error)
+	GetEntryNoConsume(short_url string) (MapItem, error)
+	UseHit(short_url string, item MapItem) error
+	ReadPaste(item MapItem, passphrase string) ([]byte, error)
 	PutEntry(requested_length int, long_url string, expiry_time int64, value_type MapItemValueType) (string, error)
+	PutEntryWithID(requested_id string, long_url string, expiry_time int64, value_type MapItemValueType) (string, error)
+	PutEntryWithIdempotencyKey(idempotency_key string, requested_length int, long_url string, expiry_time int64, value_type MapItemValueType) (string, error)
 	NumItems() int
 	NumPastes() int
+	StorageStatus() StorageStatus
+	Health() MapHealth
 }
 
 func type_asserts() {
 	var _ GenericConcurrentPersistentMap = &ConcurrentExpiringPersistentURLMap{}
 
 	var _ GenericConcurrentPersistentMap = &ConcurrentPersistentPermanentURLMap{}
+
+	var _ GenericConcurrentPersistentMap = &AsyncPersistentMap{}
 }
@@ -0,0 +1,122 @@
+// Reverse index from value to short URL ID, used to deduplicate identical long URLs and identical pastes.
+// Entries are grouped by value type and "expiry class" so that an entry is only ever reused for a request that wants the same kind of entry:
+// for the permanent map the expiry class is always 0, for the expiring map it is the LBSES bucket that the expiry time falls into.
+// They're also grouped by the length of the short URL ID, so that asking for a longer ID doesn't return a shorter one.
+// URLs are indexed by the URL itself, pastes are indexed by the sha256 of their contents.
+// Only entries with randomly generated IDs go in here. Entries put with PutEntryWithID belong to whoever asked for that ID, so they're never handed out to anyone else.
+// Users of this index are expected to keep it in sync with the map: add entries when they're put and remove them in the ExpiryCallback.
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+)
+
+type dedup_index_key struct {
+	value_type   string
+	expiry_class int64
+	id_length    int
+	digest       string
+}
+
+type DedupIndex struct {
+	mut             sync.Mutex
+	value_to_key    map[dedup_index_key]string
+	key_to_value    map[string]dedup_index_key // so that we can remove entries by short URL ID without re-reading paste files
+	expiry_class_fn func(int64) int64          // computes the expiry class from the timestamp. nil means everything is in class 0.
+}
+
+func NewDedupIndex(expiry_class_fn func(int64) int64) *DedupIndex {
+	return &DedupIndex{
+		mut:             sync.Mutex{},
+		value_to_key:    make(map[dedup_index_key]string),
+		key_to_value:    make(map[string]dedup_index_key),
+		expiry_class_fn: expiry_class_fn,
+	}
+}
+
+// Pastes are deduplicated by content hash. URLs are deduplicated by the URL itself.
+func Compute_Dedup_Digest(value []byte, value_type MapItemValueType) string {
+	if value_type == TYPE_MAP_ITEM_PASTE {
+		hash_bytes := sha256.Sum256(value)
+		return hex.EncodeToString(hash_bytes[:])
+	}
+	return string(value)
+}
+
+func (di *DedupIndex) make_key(digest string, value_type MapItemValueType, timestamp int64, id_length int) dedup_index_key {
+	var expiry_class int64 = 0
+	if di.expiry_class_fn != nil {
+		expiry_class = di.expiry_class_fn(timestamp)
+	}
+	return dedup_index_key{
+		value_type:   value_type.ToString(),
+		expiry_class: expiry_class,
+		id_length:    id_length,
+		digest:       digest,
+	}
+}
+
+// Returns the short URL ID of an existing entry with the same digest, type, expiry class and ID length, if any.
+func (di *DedupIndex) Lookup(digest string, value_type MapItemValueType, timestamp int64, id_length int) (string, bool) {
+	di.mut.Lock()
+	defer di.mut.Unlock()
+
+	key, ok := di.value_to_key[di.make_key(digest, value_type, timestamp, id_length)]
+	return key, ok
+}
+
+// If there is already an entry for the digest, it gets replaced. This happens when the old entry has expired but is still kept around in RAM.
+func (di *DedupIndex) Add(short_url string, digest string, value_type MapItemValueType, timestamp int64) {
+	di.mut.Lock()
+	defer di.mut.Unlock()
+
+	k := di.make_key(digest, value_type, timestamp, len(short_url))
+	di.value_to_key[k] = short_url
+	di.key_to_value[short_url] = k
+}
+
+// Removes the short URL ID from the index. Does nothing if it's not in the index.
+func (di *DedupIndex) Remove(short_url string) {
+	di.mut.Lock()
+	defer di.mut.Unlock()
+
+	k, ok := di.key_to_value[short_url]
+	if !ok {
+		return
+	}
+	delete(di.key_to_value, short_url)
+	// Only remove the reverse mapping if it still points to us, since a newer entry may have taken it over.
+	if di.value_to_key[k] == short_url {
+		delete(di.value_to_key, k)
+	}
+}
+
+func (di *DedupIndex) NumItems() int {
+	di.mut.Lock()
+	defer di.mut.Unlock()
+
+	return len(di.key_to_value)
+}
+
+// Used when loading from disk: pastes are stored as file paths in the log, so we have to read the file to get the digest.
+func (di *DedupIndex) AddStoredEntry(short_url string, value_str string, value_type MapItemValueType, timestamp int64) {
+	di.AddStoredEntryFromBackend(nil, short_url, value_str, value_type, timestamp)
+}
+
+// Same as AddStoredEntry but reads paste files from the given backend. nil means the local file system.
+func (di *DedupIndex) AddStoredEntryFromBackend(backend StorageBackend, short_url string, value_str string, value_type MapItemValueType, timestamp int64) {
+	if value_type != TYPE_MAP_ITEM_PASTE {
+		di.Add(short_url, Compute_Dedup_Digest([]byte(value_str), value_type), value_type, timestamp)
+		return
+	}
+	contents, err := storage_backend_or_local(backend).GetBlob(value_str)
+	if err != nil {
+		// Not fatal: the entry just won't be deduplicated.
+		log.Println("Failed to read paste file for dedup index:", value_str, "error:", err)
+		return
+	}
+	di.Add(short_url, Compute_Dedup_Digest(contents, value_type), value_type, timestamp)
+}
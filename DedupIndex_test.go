@@ -0,0 +1,41 @@
+package util_test
+
+import (
+	"testing"
+
+	"github.com/1f604/util"
+)
+
+func Test_DedupIndex(t *testing.T) {
+	t.Parallel()
+
+	di := util.NewDedupIndex(func(expiry_time int64) int64 { return expiry_time / 100 })
+	digest := util.Compute_Dedup_Digest([]byte("google.com"), util.TYPE_MAP_ITEM_URL)
+	di.Add("abc", digest, util.TYPE_MAP_ITEM_URL, 1050)
+
+	// Same bucket
+	key, ok := di.Lookup(digest, util.TYPE_MAP_ITEM_URL, 1099, 3)
+	util.Assert_result_equals_interface(t, key, nil, "abc", 1)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+	// Different bucket
+	_, ok = di.Lookup(digest, util.TYPE_MAP_ITEM_URL, 1100, 3)
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	// Different type
+	_, ok = di.Lookup(digest, util.TYPE_MAP_ITEM_PASTE, 1050, 3)
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	// Different length
+	_, ok = di.Lookup(digest, util.TYPE_MAP_ITEM_URL, 1050, 4)
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+
+	// A newer entry takes over the digest, removing the old entry must not remove the new one
+	di.Add("def", digest, util.TYPE_MAP_ITEM_URL, 1050)
+	di.Remove("abc")
+	key, ok = di.Lookup(digest, util.TYPE_MAP_ITEM_URL, 1050, 3)
+	util.Assert_result_equals_interface(t, key, nil, "def", 1)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+
+	di.Remove("def")
+	_, ok = di.Lookup(digest, util.TYPE_MAP_ITEM_URL, 1050, 3)
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	util.Assert_result_equals_interface(t, di.NumItems(), nil, 0, 1)
+}
@@ -0,0 +1,144 @@
+package util_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func pop_all_expired(index util.ExpiryIndex, cutoff int64, batch_size int) []string {
+	keys := []string{}
+	for {
+		batch := index.PopExpired(cutoff, batch_size)
+		keys = append(keys, batch...)
+		if len(batch) < batch_size {
+			break
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func Test_Bucketed_Expiry_Index_Matches_Heap(t *testing.T) {
+	t.Parallel()
+
+	heap_index := util.NewHeapExpiryIndex(0)
+	bucketed_index := util.NewBucketedExpiryIndex(100)
+	for i := int64(0); i < 1000; i++ {
+		expiry_time := 1700000000 + (i*7919)%1000 // all over the place
+		heap_index.Add(util.Int64_to_string(i), expiry_time)
+		bucketed_index.Add(util.Int64_to_string(i), expiry_time)
+	}
+	heap_index.Init()
+	bucketed_index.Init()
+
+	for _, cutoff := range []int64{1699999999, 1700000000, 1700000150, 1700000199, 1700000200, 1700000555, 1700001000} {
+		expected := pop_all_expired(heap_index, cutoff, 7)
+		got := pop_all_expired(bucketed_index, cutoff, 7)
+		util.Assert_result_equals_string_slice(t, got, nil, expected, 1)
+		util.Assert_result_equals_interface(t, bucketed_index.Len(), nil, heap_index.Len(), 1)
+	}
+	util.Assert_result_equals_interface(t, bucketed_index.Len(), nil, 0, 1)
+}
+
+func Test_Bucketed_Expiry_Index_Pops_Current_Bucket_In_Order(t *testing.T) {
+	t.Parallel()
+
+	// Everything is in one bucket, so every batch comes out of the bucket that cutoff falls in
+	bucketed_index := util.NewBucketedExpiryIndex(1000)
+	for i := int64(0); i < 1000; i++ {
+		bucketed_index.Add(util.Int64_to_string(i), (i*7919)%1000)
+	}
+	for expected := int64(0); expected < 500; expected += 10 {
+		batch := bucketed_index.PopExpired(499, 10)
+		expected_batch := []string{}
+		for i := expected; i < expected+10; i++ {
+			expected_batch = append(expected_batch, util.Int64_to_string((i*679)%1000)) // 679 is 7919^-1 mod 1000
+		}
+		util.Assert_result_equals_string_slice(t, batch, nil, expected_batch, 1)
+	}
+	util.Assert_result_equals_interface(t, len(bucketed_index.PopExpired(499, 10)), nil, 0, 1)
+
+	// Keys added to the bucket while it's being scanned are still found
+	bucketed_index.Add("late", 100)
+	bucketed_index.Add("later", 600)
+	util.Assert_result_equals_string_slice(t, bucketed_index.PopExpired(499, 10), nil, []string{"late"}, 1)
+	util.Assert_result_equals_interface(t, bucketed_index.Len(), nil, 501, 1)
+	key, expiry_time, ok := bucketed_index.PopSoonest()
+	util.Assert_result_equals_interface(t, key, nil, util.Int64_to_string(500*679%1000), 1)
+	util.Assert_result_equals_interface(t, expiry_time, nil, int64(500), 1)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+	util.Assert_result_equals_interface(t, len(pop_all_expired(bucketed_index, 999, 7)), nil, 500, 1)
+	util.Assert_result_equals_interface(t, bucketed_index.Len(), nil, 0, 1)
+}
+
+func Test_CEPUM_Bucketed_Expiry_Index(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(func(p *util.CEPUMParams) { p.Bucketed_expiry_index = true })
+	for i := int64(0); i < 20; i++ {
+		_, err := cepum.PutEntry(2, "example.com/"+util.Int64_to_string(i), h.Clock.Now()+i*100, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+	}
+	// Entries are kept around for Extra_keeparound_seconds_ram (60s) after they expire
+	h.Clock.Advance(1050)
+	cepum.RemoveAllExpiredURLsFromRAM()
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 10, 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, 53-10, 1)
+
+	// Same again after a restart, when the index is built by the loader. The loader skips everything that has expired.
+	cepum = h.StartCEPUM(func(p *util.CEPUMParams) { p.Bucketed_expiry_index = true })
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 9, 1)
+	h.Clock.Advance(1000)
+	cepum.RemoveAllExpiredURLsFromRAM()
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 0, 1)
+	util.Assert_result_equals_interface(t, cepum.Health().Remaining_ids[2], nil, 53, 1)
+}
+
+func Test_Remove_All_Expired_In_Batches(t *testing.T) {
+	t.Parallel()
+
+	expired := 0
+	cem := util.NewEmptyConcurrentExpiringMap(func(string, util.MapItem) { expired++ })
+	cem.SetExpiryBatchSize(3)
+	clock := urlmaptest.NewFakeClock(urlmaptest.DEFAULT_START_TIME)
+	cem.SetClock(clock.Now)
+	for i := int64(0); i < 10; i++ {
+		err := cem.Put_New_Entry(util.Int64_to_string(i), "value", clock.Now()+i, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+	}
+	clock.Advance(100)
+	cem.Remove_All_Expired(0)
+	util.Assert_result_equals_interface(t, expired, nil, 10, 1)
+	util.Assert_result_equals_interface(t, cem.NumItems(), nil, 0, 1)
+}
+
+func benchmark_remove_all_expired(b *testing.B, new_index func() util.ExpiryIndex) {
+	b.Helper()
+
+	const num_items = 1000000
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		cem := util.NewEmptyConcurrentExpiringMap(nil)
+		cem.SetExpiryIndex(new_index())
+		clock := urlmaptest.NewFakeClock(urlmaptest.DEFAULT_START_TIME)
+		cem.SetClock(clock.Now)
+		for j := int64(0); j < num_items; j++ {
+			_ = cem.Put_New_Entry(util.Int64_to_string(j), "value", clock.Now()+(j*7919)%86400, util.TYPE_MAP_ITEM_URL)
+		}
+		clock.Advance(86400)
+		b.StartTimer()
+		cem.Remove_All_Expired(0)
+	}
+}
+
+func Benchmark_Remove_All_Expired_1M_Heap(b *testing.B) {
+	benchmark_remove_all_expired(b, func() util.ExpiryIndex { return util.NewHeapExpiryIndex(0) })
+}
+
+func Benchmark_Remove_All_Expired_1M_Bucketed(b *testing.B) {
+	benchmark_remove_all_expired(b, func() util.ExpiryIndex { return util.NewBucketedExpiryIndex(3600) })
+}
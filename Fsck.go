@@ -0,0 +1,318 @@
+// Offline consistency checker for a log directory and its paste directory, like fsck but for the URL store.
+// The server must not be running while this runs, since the server appends to the same files.
+// It checks everything that LoadStoredRecordsFromDisk would panic on, plus paste files that are missing or not referenced by any live entry.
+// In repair mode, bad records are moved out of the log files into the quarantine directory, and orphaned paste files are deleted.
+// Duplicate live keys are resolved by keeping the first record in the order the files were written (by file number or bucket timestamp, not by name),
+// and quarantining the rest. Subdirectories of the paste directory are reported but left alone, since pastes are never put in one.
+// It reads and rewrites the files with the os package, so it only works on data sets kept on the local file system (a nil Storage_backend).
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	FSCK_PROBLEM_BAD_FILENAME   = "bad filename"
+	FSCK_PROBLEM_BAD_RECORD     = "bad record"
+	FSCK_PROBLEM_TRUNCATED_FILE = "truncated file"
+	FSCK_PROBLEM_DUPLICATE_KEY  = "duplicate live key"
+	FSCK_PROBLEM_MISSING_PASTE  = "missing paste file"
+	FSCK_PROBLEM_ORPHANED_PASTE = "orphaned paste file"
+	FSCK_PROBLEM_UNEXPECTED_DIR = "unexpected directory"
+)
+
+type FsckParams struct {
+	Log_directory_path_absolute        string
+	Paste_directory_path_absolute      string
+	Expiring                           bool // true for CEPUM directories, false for CPPUM directories
+	B53m                               *Base53IDManager
+	Allow_alias_ids                    bool
+	Repair                             bool
+	Quarantine_directory_path_absolute string // Required if Repair is set
+}
+
+type FsckProblem struct {
+	Kind   string
+	Path   string
+	Offset int64 // -1 if the problem is not about a particular record
+	Detail string
+}
+
+type FsckReport struct {
+	Files_scanned       int
+	Records_scanned     int
+	Live_entries        int
+	Pastes_scanned      int
+	Encrypted_pastes    int // live paste entries whose metadata says they're encrypted, see PasteEncryptionInfo
+	Problems            []FsckProblem
+	Records_quarantined int
+	Files_quarantined   int
+	Pastes_deleted      int
+}
+
+func (report *FsckReport) add_problem(kind string, path string, offset int64, detail string) {
+	report.Problems = append(report.Problems, FsckProblem{Kind: kind, Path: path, Offset: offset, Detail: detail})
+}
+
+func (report *FsckReport) Print(w io.Writer) {
+	for _, p := range report.Problems {
+		if p.Offset >= 0 {
+			fmt.Fprintf(w, "%s: %s at offset %d: %s\n", p.Kind, p.Path, p.Offset, p.Detail)
+		} else {
+			fmt.Fprintf(w, "%s: %s: %s\n", p.Kind, p.Path, p.Detail)
+		}
+	}
+	fmt.Fprintf(w, "Scanned %d log files, %d records, %d live entries, %d paste files (%d encrypted).\n", report.Files_scanned, report.Records_scanned, report.Live_entries,
+		report.Pastes_scanned, report.Encrypted_pastes)
+	fmt.Fprintf(w, "Found %d problems.\n", len(report.Problems))
+	if report.Records_quarantined+report.Files_quarantined+report.Pastes_deleted > 0 {
+		fmt.Fprintf(w, "Quarantined %d records and %d files, deleted %d orphaned paste files.\n", report.Records_quarantined, report.Files_quarantined, report.Pastes_deleted)
+	}
+}
+
+type fsck_byte_range struct {
+	start int64
+	end   int64
+}
+
+// Scans the directories and returns a report. Only returns an error if the check itself could not be done, problems with the data go into the report.
+func Fsck(params *FsckParams) (*FsckReport, error) { //nolint:gocognit,funlen // it's a long list of checks
+	if params.Repair {
+		if params.Quarantine_directory_path_absolute == "" {
+			return nil, errors.New("Fsck: repair requires a quarantine directory")
+		}
+		err := os.MkdirAll(params.Quarantine_directory_path_absolute, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var lss LogStructuredStorage = (*LogStructuredPermanentStorage)(nil)
+	if params.Expiring {
+		lss = (*LogBucketStructuredExpiringStorage)(nil)
+	}
+	entries, err := os.ReadDir(params.Log_directory_path_absolute)
+	if err != nil {
+		return nil, err
+	}
+	// os.ReadDir sorts by name, which puts 10.log before 2.log
+	sort.SliceStable(entries, func(i, j int) bool {
+		return fsck_log_file_number(params.Expiring, entries[i].Name()) < fsck_log_file_number(params.Expiring, entries[j].Name())
+	})
+
+	report := FsckReport{}
+	log_files := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() && lss.ValidateLogFilename(entry.Name()) == nil {
+			log_files = append(log_files, filepath.Join(params.Log_directory_path_absolute, entry.Name()))
+		}
+	}
+	// Entries evicted from a full expiring map aren't live, even though they haven't expired. Their pastes have been deleted and their keys may have been reused.
+	evicted := collect_evicted_entries(log_files, params.B53m, params.Allow_alias_ids)
+	cur_unix_timestamp := time.Now().Unix()
+	live_keys := make(map[string]string) // key -> path of the log file it was first seen in
+	referenced_pastes := make(map[string]bool)
+
+	for _, entry := range entries {
+		if entry.IsDir() { // the loader ignores directories too
+			continue
+		}
+		absolute_filepath := filepath.Join(params.Log_directory_path_absolute, entry.Name())
+		err = lss.ValidateLogFilename(entry.Name())
+		if err != nil {
+			report.add_problem(FSCK_PROBLEM_BAD_FILENAME, absolute_filepath, -1, err.Error())
+			if params.Repair {
+				err = os.Rename(absolute_filepath, filepath.Join(params.Quarantine_directory_path_absolute, entry.Name()))
+				if err != nil {
+					return &report, err
+				}
+				report.Files_quarantined++
+			}
+			continue
+		}
+
+		report.Files_scanned++
+		data, err := os.ReadFile(absolute_filepath)
+		if err != nil {
+			return &report, err
+		}
+		bad_ranges := []fsck_byte_range{}
+		// Max hits and idempotency records that go with the entry record straight after them. If that entry is quarantined they go with it,
+		// otherwise the loader would apply them to whatever record ends up after them.
+		var chain_start int64 = -1
+		var chain_head *LogRecord = nil
+		chain_encrypted := false
+		lrr := NewLogRecordReader(bytes.NewReader(data), params.B53m, params.Allow_alias_ids)
+		for {
+			start := lrr.Offset()
+			record, err := lrr.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			var invalid_err LogRecordInvalidError
+			if errors.As(err, &invalid_err) {
+				report.Records_scanned++
+				report.add_problem(FSCK_PROBLEM_BAD_RECORD, absolute_filepath, start, invalid_err.Err.Error())
+				bad_ranges = append(bad_ranges, fsck_byte_range{start: start, end: lrr.Offset()})
+				continue
+			}
+			if err != nil {
+				// Everything from here to the end of the file is unreadable.
+				report.add_problem(FSCK_PROBLEM_TRUNCATED_FILE, absolute_filepath, start, err.Error())
+				bad_ranges = append(bad_ranges, fsck_byte_range{start: start, end: int64(len(data))})
+				break
+			}
+			report.Records_scanned++
+
+			if is_chained_record(record) {
+				if chain_head == nil || chain_head.Key != record.Key || chain_head.Timestamp != record.Timestamp {
+					chain_start = start
+					chain_head = record
+					chain_encrypted = false
+				}
+				if record.Type == LOG_RECORD_TYPE_PASTE_ENCRYPTION {
+					chain_encrypted = true
+				}
+				continue
+			}
+			entry_start := start
+			encrypted := false
+			if chain_head != nil && chain_head.Key == record.Key && chain_head.Timestamp == record.Timestamp && record.ValueType != nil {
+				entry_start = chain_start
+				encrypted = chain_encrypted
+			}
+			chain_head = nil
+
+			// Only live map entries matter from here on
+			if record.ValueType == nil {
+				continue
+			}
+			if params.Expiring && record.Timestamp < cur_unix_timestamp {
+				continue
+			}
+			if evicted[evicted_entry_key(record)] {
+				continue
+			}
+			if first_path, ok := live_keys[record.Key]; ok {
+				report.add_problem(FSCK_PROBLEM_DUPLICATE_KEY, absolute_filepath, start, fmt.Sprintf("key %#v was already seen in %s", record.Key, first_path))
+				bad_ranges = append(bad_ranges, fsck_byte_range{start: entry_start, end: lrr.Offset()})
+				continue
+			}
+			if record.ValueType == TYPE_MAP_ITEM_PASTE {
+				_, err = os.Stat(record.Value)
+				if err != nil {
+					report.add_problem(FSCK_PROBLEM_MISSING_PASTE, absolute_filepath, start, fmt.Sprintf("key %#v references %s: %v", record.Key, record.Value, err))
+					bad_ranges = append(bad_ranges, fsck_byte_range{start: entry_start, end: lrr.Offset()})
+					continue
+				}
+				referenced_pastes[filepath.Clean(record.Value)] = true
+				if encrypted {
+					report.Encrypted_pastes++
+				}
+			}
+			live_keys[record.Key] = absolute_filepath
+			report.Live_entries++
+		}
+
+		if params.Repair && len(bad_ranges) > 0 {
+			err = fsck_quarantine_ranges(params, absolute_filepath, data, bad_ranges)
+			if err != nil {
+				return &report, err
+			}
+			report.Records_quarantined += len(bad_ranges)
+		}
+	}
+
+	if params.Paste_directory_path_absolute == "" {
+		return &report, nil
+	}
+	paste_entries, err := os.ReadDir(params.Paste_directory_path_absolute)
+	if err != nil {
+		return &report, err
+	}
+	for _, entry := range paste_entries {
+		if entry.IsDir() {
+			report.add_problem(FSCK_PROBLEM_UNEXPECTED_DIR, filepath.Join(params.Paste_directory_path_absolute, entry.Name()), -1, "pastes are never put in subdirectories, so its contents weren't checked")
+			continue
+		}
+		report.Pastes_scanned++
+		absolute_filepath := filepath.Join(params.Paste_directory_path_absolute, entry.Name())
+		if referenced_pastes[absolute_filepath] {
+			continue
+		}
+		report.add_problem(FSCK_PROBLEM_ORPHANED_PASTE, absolute_filepath, -1, "not referenced by any live entry")
+		if params.Repair {
+			err = os.Remove(absolute_filepath)
+			if err != nil {
+				return &report, err
+			}
+			report.Pastes_deleted++
+		}
+	}
+	return &report, nil
+}
+
+// The order the file was written in: its number for LSPS files, its bucket timestamp for LBSES files. Files with bad names go last.
+func fsck_log_file_number(expiring bool, filename string) int64 {
+	parse := LSPS_Parse_log_filename_to_number
+	if expiring {
+		parse = LBSES_Parse_bucket_filename_to_timestamp
+	}
+	number, err := parse(filename)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return number
+}
+
+// Appends the bad ranges to a file in the quarantine directory and rewrites the log file without them.
+func fsck_quarantine_ranges(params *FsckParams, absolute_filepath string, data []byte, bad_ranges []fsck_byte_range) error {
+	good := make([]byte, 0, len(data))
+	bad := make([]byte, 0)
+	var pos int64 = 0
+	for _, r := range bad_ranges {
+		good = append(good, data[pos:r.start]...)
+		bad = append(bad, data[r.start:r.end]...)
+		pos = r.end
+	}
+	good = append(good, data[pos:]...)
+
+	quarantine_path := filepath.Join(params.Quarantine_directory_path_absolute, filepath.Base(absolute_filepath)+".quarantined")
+	f, err := os.OpenFile(quarantine_path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(bad)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	// Write the new file into a subdirectory first since the loader ignores directories, then rename it over the old one.
+	tmp_dir := filepath.Join(params.Log_directory_path_absolute, ".fsck_tmp")
+	err = os.MkdirAll(tmp_dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	tmp_path := filepath.Join(tmp_dir, filepath.Base(absolute_filepath))
+	err = os.WriteFile(tmp_path, good, 0o644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp_path, absolute_filepath)
+	if err != nil {
+		return err
+	}
+	return os.Remove(tmp_dir)
+}
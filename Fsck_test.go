@@ -0,0 +1,157 @@
+package util_test
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/1f604/util"
+)
+
+func write_test_log_file(t *testing.T, path string, records []util.ExportedEntry, extra string) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	util.Assert_no_error(t, err, 1)
+	for _, r := range records {
+		value_type, err := util.Parse_MapItemValueType(r.Type)
+		util.Assert_no_error(t, err, 1)
+		err = util.Write_Entry_To_File(r.Key, r.Value, value_type, r.Timestamp, f)
+		util.Assert_no_error(t, err, 1)
+	}
+	_, err = f.WriteString(extra)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, f.Close(), 1)
+}
+
+func Test_Fsck_Finds_And_Repairs_Problems(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	log_dir := filepath.Join(dir, "logs")
+	paste_dir := filepath.Join(dir, "pastes")
+	util.Assert_no_error(t, os.MkdirAll(log_dir, os.ModePerm), 1)
+	util.Assert_no_error(t, os.MkdirAll(paste_dir, os.ModePerm), 1)
+
+	good_paste := filepath.Join(paste_dir, "good")
+	util.Assert_no_error(t, os.WriteFile(good_paste, []byte("hi"), 0o644), 1)
+	util.Assert_no_error(t, os.WriteFile(filepath.Join(paste_dir, "orphan"), []byte("hi"), 0o644), 1)
+
+	write_test_log_file(t, filepath.Join(log_dir, "0.log"), []util.ExportedEntry{
+		{Key: "00", Type: "url", Value: "google.com", Timestamp: 1700000000},
+		{Key: "02", Type: "url", Value: "bad checksum", Timestamp: 1700000000},
+		{Key: "2y", Type: "paste", Value: good_paste, Timestamp: 1700000000},
+	}, "00\tcorrupted\turl\t1700000000\x1eAAAAAAAAAAAAAAAAAAAAAA==\n")
+	write_test_log_file(t, filepath.Join(log_dir, "1.log"), []util.ExportedEntry{
+		{Key: "00", Type: "url", Value: "duplicate", Timestamp: 1700000000},
+		{Key: "3v", Type: "paste", Value: filepath.Join(paste_dir, "missing"), Timestamp: 1700000000},
+	}, "4t\ttruncated")
+	util.Assert_no_error(t, os.WriteFile(filepath.Join(log_dir, "not_a_log.txt"), []byte("x"), 0o644), 1)
+
+	params := util.FsckParams{
+		Log_directory_path_absolute:        log_dir,
+		Paste_directory_path_absolute:      paste_dir,
+		B53m:                               util.NewBase53IDManager(),
+		Quarantine_directory_path_absolute: filepath.Join(dir, "quarantine"),
+	}
+	report, err := util.Fsck(&params)
+	util.Assert_no_error(t, err, 1)
+	kinds := []string{}
+	for _, p := range report.Problems {
+		kinds = append(kinds, p.Kind)
+	}
+	sort.Strings(kinds)
+	util.Assert_result_equals_string_slice(t, kinds, nil, []string{
+		util.FSCK_PROBLEM_BAD_FILENAME,
+		util.FSCK_PROBLEM_BAD_RECORD,
+		util.FSCK_PROBLEM_BAD_RECORD,
+		util.FSCK_PROBLEM_DUPLICATE_KEY,
+		util.FSCK_PROBLEM_MISSING_PASTE,
+		util.FSCK_PROBLEM_ORPHANED_PASTE,
+		util.FSCK_PROBLEM_TRUNCATED_FILE,
+	}, 1)
+	util.Assert_result_equals_interface(t, report.Live_entries, nil, 2, 1)
+
+	params.Repair = true
+	report, err = util.Fsck(&params)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Records_quarantined, nil, 5, 1)
+	util.Assert_result_equals_interface(t, report.Files_quarantined, nil, 1, 1)
+	util.Assert_result_equals_interface(t, report.Pastes_deleted, nil, 1, 1)
+
+	// Everything is clean now
+	params.Repair = false
+	report, err = util.Fsck(&params)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(report.Problems), nil, 0, 1)
+	util.Assert_result_equals_interface(t, report.Live_entries, nil, 2, 1)
+
+	// And the loader accepts it
+	cppum := new_test_cppum(t, dir, false)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 2, 1)
+}
+
+func Test_Fsck_Keeps_Records_In_Write_Order(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	log_dir := filepath.Join(dir, "logs")
+	paste_dir := filepath.Join(dir, "pastes")
+	util.Assert_no_error(t, os.MkdirAll(log_dir, os.ModePerm), 1)
+	util.Assert_no_error(t, os.MkdirAll(filepath.Join(paste_dir, "subdir"), os.ModePerm), 1)
+
+	// 10.log comes before 2.log by name, but it was written after it
+	write_test_log_file(t, filepath.Join(log_dir, "2.log"), []util.ExportedEntry{
+		{Key: "00", Type: "url", Value: "first.com", Timestamp: 1700000000},
+	}, "")
+	write_test_log_file(t, filepath.Join(log_dir, "10.log"), []util.ExportedEntry{
+		{Key: "00", Type: "url", Value: "second.com", Timestamp: 1700000000},
+	}, "")
+
+	report, err := util.Fsck(&util.FsckParams{
+		Log_directory_path_absolute:        log_dir,
+		Paste_directory_path_absolute:      paste_dir,
+		Expiring:                           false,
+		B53m:                               util.NewBase53IDManager(),
+		Allow_alias_ids:                    false,
+		Repair:                             false,
+		Quarantine_directory_path_absolute: "",
+	})
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(report.Problems), nil, 2, 1)
+	util.Assert_result_equals_interface(t, report.Problems[0].Kind, nil, util.FSCK_PROBLEM_DUPLICATE_KEY, 1)
+	util.Assert_result_equals_interface(t, report.Problems[0].Path, nil, filepath.Join(log_dir, "10.log"), 1)
+	// Subdirectories of the paste directory aren't silently skipped
+	util.Assert_result_equals_interface(t, report.Problems[1].Kind, nil, util.FSCK_PROBLEM_UNEXPECTED_DIR, 1)
+	util.Assert_result_equals_interface(t, report.Problems[1].Path, nil, filepath.Join(paste_dir, "subdir"), 1)
+}
+
+func Test_Fsck_Quarantines_Chained_Records_With_Their_Entry(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	log_dir := filepath.Join(dir, "logs")
+	util.Assert_no_error(t, os.MkdirAll(log_dir, os.ModePerm), 1)
+	write_test_log_file(t, filepath.Join(log_dir, "0.log"), []util.ExportedEntry{
+		{Key: "00", Type: "url", Value: "google.com", Timestamp: 1700000000},
+	}, "")
+	f, err := os.Create(filepath.Join(log_dir, "1.log"))
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, util.Write_Record_To_File("00", "3", util.LOG_RECORD_TYPE_MAX_HITS, 1700000000, f), 1)
+	util.Assert_no_error(t, util.Write_Entry_To_File("00", "duplicate", util.TYPE_MAP_ITEM_URL, 1700000000, f), 1)
+	util.Assert_no_error(t, f.Close(), 1)
+
+	report, err := util.Fsck(&util.FsckParams{
+		Log_directory_path_absolute:        log_dir,
+		B53m:                               util.NewBase53IDManager(),
+		Quarantine_directory_path_absolute: filepath.Join(dir, "quarantine"),
+		Repair:                             true,
+	})
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, len(report.Problems), nil, 1, 1)
+	util.Assert_result_equals_interface(t, report.Problems[0].Kind, nil, util.FSCK_PROBLEM_DUPLICATE_KEY, 1)
+	// The max hits record went with the duplicate, so there's nothing left for it to apply to
+	contents, err := os.ReadFile(filepath.Join(log_dir, "1.log"))
+	util.Assert_result_equals_bytes(t, contents, err, "", 1)
+}
@@ -7,6 +7,7 @@ type MapWithPastesCount[T MapItem] interface {
 	DeleteKey(key string)
 	NumPastes() int
 	NumItems() int
+	ForEach(fn func(key string, value T))
 }
 
 type MapWithPastesCount_impl[T MapItem] struct {
@@ -65,3 +66,10 @@ func (mwpc *MapWithPastesCount_impl[T]) NumItems() int {
 func (mwpc *MapWithPastesCount_impl[T]) NumPastes() int {
 	return mwpc.pastes_count
 }
+
+// fn must not modify the map.
+func (mwpc *MapWithPastesCount_impl[T]) ForEach(fn func(key string, value T)) {
+	for k, v := range mwpc.m {
+		fn(k, v)
+	}
+}
@@ -0,0 +1,178 @@
+// Remembers idempotency token -> short URL ID for a limited window so that clients can safely retry PutEntry.
+// The tokens are persisted in the log as "idempotency_key" records, written just before the entry record they belong to (see PutEntry_Idempotent_Common).
+// On startup the loader puts every unexpired token back into the store.
+// Tokens are also dropped when the entry they point to is removed from the map, so that a token can never point to a recycled ID.
+// Each token also remembers a digest of the request it was used for, so that reusing a token for a different URL or paste is an error
+// instead of silently returning the first request's ID.
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+const IDEMPOTENCY_KEY_MAX_LENGTH = 128
+
+type IdempotencyKeyInvalidError struct{}
+
+func (e IdempotencyKeyInvalidError) Error() string {
+	return "Idempotency key must be 1 to 128 printable ASCII characters"
+}
+
+type IdempotencyKeyConflictError struct{}
+
+func (e IdempotencyKeyConflictError) Error() string {
+	return "Idempotency key was already used for a different request"
+}
+
+type idempotency_entry struct {
+	short_url      string
+	request_digest string
+	expiry_time    int64
+}
+
+type IdempotencyKeyStore struct {
+	mut            sync.Mutex
+	window_seconds int64
+	token_to_entry map[string]idempotency_entry
+	key_to_tokens  map[string][]string // short URL ID -> tokens, so that we can drop tokens when the entry goes away
+	clock          Clock
+}
+
+func NewIdempotencyKeyStore(window_seconds int64) *IdempotencyKeyStore {
+	return &IdempotencyKeyStore{
+		mut:            sync.Mutex{},
+		window_seconds: window_seconds,
+		token_to_entry: make(map[string]idempotency_entry),
+		key_to_tokens:  make(map[string][]string),
+		clock:          Real_Clock,
+	}
+}
+
+// Makes the store use the given clock to decide which tokens have expired. nil means the real clock.
+func (iks *IdempotencyKeyStore) SetClock(clock Clock) {
+	iks.mut.Lock()
+	defer iks.mut.Unlock()
+
+	iks.clock = clock_or_real(clock)
+}
+
+// Returns the time according to the store's clock.
+func (iks *IdempotencyKeyStore) Now() int64 {
+	iks.mut.Lock()
+	defer iks.mut.Unlock()
+
+	return iks.clock()
+}
+
+// Printable ASCII only, which also guarantees that the token can be written into the log.
+func Validate_Idempotency_Key(token string) error {
+	if len(token) == 0 || len(token) > IDEMPOTENCY_KEY_MAX_LENGTH {
+		return IdempotencyKeyInvalidError{}
+	}
+	for i := 0; i < len(token); i++ {
+		if token[i] < '!' || token[i] > '~' {
+			return IdempotencyKeyInvalidError{}
+		}
+	}
+	return nil
+}
+
+// What a retry has to match for the token to return the same ID. The expiry time is left out, since clients usually work it out from the current time.
+// Pastes are digested before they're encrypted, since encrypting the same paste twice gives different ciphertexts.
+func Compute_Idempotency_Request_Digest(requested_length int, long_url string, value_type MapItemValueType) string {
+	hash_bytes := sha256.Sum256([]byte(Int64_to_string(int64(requested_length)) + " " + value_type.ToString() + " " + long_url))
+	return hex.EncodeToString(hash_bytes[:])
+}
+
+func (iks *IdempotencyKeyStore) WindowSeconds() int64 {
+	return iks.window_seconds
+}
+
+// Returns the short URL ID and request digest that the token was used for, unless the token has expired.
+func (iks *IdempotencyKeyStore) Lookup(token string) (string, string, bool) {
+	iks.mut.Lock()
+	defer iks.mut.Unlock()
+
+	entry, ok := iks.token_to_entry[token]
+	if !ok || entry.expiry_time <= iks.clock() {
+		return "", "", false
+	}
+	return entry.short_url, entry.request_digest, true
+}
+
+func (iks *IdempotencyKeyStore) Add(token string, short_url string, request_digest string, expiry_time int64) {
+	iks.mut.Lock()
+	defer iks.mut.Unlock()
+
+	iks.token_to_entry[token] = idempotency_entry{
+		short_url:      short_url,
+		request_digest: request_digest,
+		expiry_time:    expiry_time,
+	}
+	iks.key_to_tokens[short_url] = append(iks.key_to_tokens[short_url], token)
+}
+
+// Drops all tokens pointing to the short URL ID. Call this when the entry is removed from the map.
+func (iks *IdempotencyKeyStore) RemoveShortURL(short_url string) {
+	iks.mut.Lock()
+	defer iks.mut.Unlock()
+
+	for _, token := range iks.key_to_tokens[short_url] {
+		if iks.token_to_entry[token].short_url == short_url {
+			delete(iks.token_to_entry, token)
+		}
+	}
+	delete(iks.key_to_tokens, short_url)
+}
+
+// Drops all tokens for which keep_fn returns false. Used after loading from disk to drop tokens that point to entries which no longer exist.
+func (iks *IdempotencyKeyStore) RetainShortURLs(keep_fn func(string) bool) {
+	iks.mut.Lock()
+	short_urls := make([]string, 0, len(iks.key_to_tokens))
+	for short_url := range iks.key_to_tokens {
+		if !keep_fn(short_url) {
+			short_urls = append(short_urls, short_url)
+		}
+	}
+	iks.mut.Unlock()
+
+	for _, short_url := range short_urls {
+		iks.RemoveShortURL(short_url)
+	}
+}
+
+// Removes expired tokens. Run this every so often, otherwise the store only ever grows.
+func (iks *IdempotencyKeyStore) Remove_All_Expired() {
+	iks.mut.Lock()
+	defer iks.mut.Unlock()
+
+	cur_time := iks.clock()
+	for token, entry := range iks.token_to_entry {
+		if entry.expiry_time > cur_time {
+			continue
+		}
+		delete(iks.token_to_entry, token)
+		tokens := iks.key_to_tokens[entry.short_url]
+		for i, t := range tokens {
+			if t == token {
+				tokens[i] = tokens[len(tokens)-1]
+				tokens = tokens[:len(tokens)-1]
+				break
+			}
+		}
+		if len(tokens) == 0 {
+			delete(iks.key_to_tokens, entry.short_url)
+		} else {
+			iks.key_to_tokens[entry.short_url] = tokens
+		}
+	}
+}
+
+func (iks *IdempotencyKeyStore) NumItems() int {
+	iks.mut.Lock()
+	defer iks.mut.Unlock()
+
+	return len(iks.token_to_entry)
+}
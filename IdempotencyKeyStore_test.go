@@ -0,0 +1,33 @@
+package util_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/1f604/util"
+)
+
+func Test_IdempotencyKeyStore(t *testing.T) {
+	t.Parallel()
+
+	cur_time := time.Now().Unix()
+	iks := util.NewIdempotencyKeyStore(100)
+	iks.Add("live", "abc", "digest", cur_time+100)
+	iks.Add("expired", "def", "digest", cur_time-1)
+
+	key, digest, ok := iks.Lookup("live")
+	util.Assert_result_equals_interface(t, key, nil, "abc", 1)
+	util.Assert_result_equals_interface(t, digest, nil, "digest", 1)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+	_, _, ok = iks.Lookup("expired")
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+
+	iks.Remove_All_Expired()
+	util.Assert_result_equals_interface(t, iks.NumItems(), nil, 1, 1)
+
+	// Tokens go away with their entry
+	iks.RemoveShortURL("abc")
+	_, _, ok = iks.Lookup("live")
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	util.Assert_result_equals_interface(t, iks.NumItems(), nil, 0, 1)
+}
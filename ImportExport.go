@@ -0,0 +1,375 @@
+// Bulk export and import of URL map data, for moving data between servers or into other tools.
+// Exports read the log directory directly rather than a running map. The map is built from exactly these records, so the output is the same as the map's contents
+// and we also get the original timestamps, which the permanent map doesn't keep in RAM.
+// Each exported entry has 8 fields: key, type ("url" or "paste"), value, timestamp (expiry time for the expiring map, creation time for the permanent map),
+// remaining_hits for entries put with PutEntryWithMaxHits, which are imported as if they had been put with that many max hits,
+// and the idempotency key the entry was put with, if it's still valid, along with its request digest and expiry time. That way retries still find the entry after an import.
+// Imports also accept CSV files without the remaining_hits column or the idempotency key columns.
+// Paste values are the base64-encoded contents of the paste file, not the file path, so that the export is self-contained.
+// Imports write into a fresh log directory and paste directory which can then be loaded with CreateConcurrent...FromDisk.
+// Both directions only deal with directories on the local file system, not with other storage backends.
+package util
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+type ExportFormat string
+
+const (
+	EXPORT_FORMAT_JSONL ExportFormat = "jsonl"
+	EXPORT_FORMAT_CSV   ExportFormat = "csv"
+)
+
+var g_csv_header = []string{"key", "type", "value", "timestamp", "remaining_hits", "idempotency_key", "idempotency_request_digest", "idempotency_key_expiry"}
+
+// Exports from before max hits existed only have the first 4 columns, and exports from before idempotency keys were exported only have 5
+const csv_min_fields = 4
+
+type ExportedEntry struct {
+	Key            string `json:"key"`
+	Type           string `json:"type"`
+	Value          string `json:"value"`
+	Timestamp      int64  `json:"timestamp"`
+	Remaining_hits int64  `json:"remaining_hits,omitempty"` // How many more times the entry can be got. 0 means no limit.
+	// See PutEntryWithIdempotencyKey and Compute_Idempotency_Request_Digest. Empty if the entry wasn't put with one or it has run out.
+	Idempotency_key            string `json:"idempotency_key,omitempty"`
+	Idempotency_request_digest string `json:"idempotency_request_digest,omitempty"`
+	Idempotency_key_expiry     int64  `json:"idempotency_key_expiry,omitempty"`
+}
+
+type ExportParams struct {
+	Log_directory_path_absolute string
+	Expiring                    bool // true for CEPUM log directories, false for CPPUM log directories
+	B53m                        *Base53IDManager
+	Allow_alias_ids             bool
+	Format                      ExportFormat
+}
+
+type ImportParams struct {
+	Log_directory_path_absolute   string
+	Paste_directory_path_absolute string
+	Expiring                      bool  // true to write a CEPUM log directory, false to write a CPPUM log directory
+	Bucket_interval               int64 // Only used for the expiring map
+	Log_file_max_size_bytes       int64 // Only used for the permanent map
+	B53m                          *Base53IDManager
+	Allow_alias_ids               bool
+	Xattr_params                  *XattrParams
+	Format                        ExportFormat
+}
+
+type entry_writer interface {
+	Write(entry *ExportedEntry) error
+	Flush() error
+}
+
+type jsonl_entry_writer struct {
+	enc *json.Encoder
+}
+
+func (w *jsonl_entry_writer) Write(entry *ExportedEntry) error {
+	return w.enc.Encode(entry)
+}
+
+func (w *jsonl_entry_writer) Flush() error {
+	return nil
+}
+
+type csv_entry_writer struct {
+	cw *csv.Writer
+}
+
+func (w *csv_entry_writer) Write(entry *ExportedEntry) error {
+	return w.cw.Write([]string{entry.Key, entry.Type, entry.Value, Int64_to_string(entry.Timestamp), Int64_to_string(entry.Remaining_hits),
+		entry.Idempotency_key, entry.Idempotency_request_digest, Int64_to_string(entry.Idempotency_key_expiry)})
+}
+
+func (w *csv_entry_writer) Flush() error {
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+func new_entry_writer(w io.Writer, format ExportFormat) (entry_writer, error) { //nolint:ireturn // it's internal
+	switch format {
+	case EXPORT_FORMAT_JSONL:
+		return &jsonl_entry_writer{enc: json.NewEncoder(w)}, nil
+	case EXPORT_FORMAT_CSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(g_csv_header)
+		if err != nil {
+			return nil, err
+		}
+		return &csv_entry_writer{cw: cw}, nil
+	}
+	return nil, fmt.Errorf("Unknown export format %#v", format)
+}
+
+// Writes every live entry in the log directory to w. Returns the number of entries written.
+func ExportLogDirectory(params *ExportParams, w io.Writer) (int, error) {
+	var lss LogStructuredStorage = (*LogStructuredPermanentStorage)(nil)
+	if params.Expiring {
+		lss = (*LogBucketStructuredExpiringStorage)(nil)
+	}
+	files, err := List_Log_Files(params.Log_directory_path_absolute, lss)
+	if err != nil {
+		return 0, err
+	}
+	ew, err := new_entry_writer(w, params.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	// Entries evicted from a full expiring map are still in the log, followed by an eviction record. Their pastes have been deleted.
+	evicted := collect_evicted_entries(files, params.B53m, params.Allow_alias_ids)
+	// Reads of entries with max hits are in the log too, so what gets exported is how many hits are left, not how many there were to start with.
+	remaining_hits := collect_remaining_hits(files, params.B53m, params.Allow_alias_ids)
+
+	cur_unix_timestamp := time.Now().Unix()
+	idempotency_keys := collect_idempotency_keys(files, params.B53m, params.Allow_alias_ids, cur_unix_timestamp)
+	count := 0
+	for _, absolute_filepath := range files {
+		err = ForEachLogRecordInFile(absolute_filepath, params.B53m, params.Allow_alias_ids, func(record *LogRecord) error {
+			if record.ValueType == nil { // not a map entry
+				return nil
+			}
+			if evicted[evicted_entry_key(record)] {
+				return nil
+			}
+			// Same rule as the expiring map's loader: anything that expired before now is not loaded.
+			if params.Expiring && record.Timestamp < cur_unix_timestamp {
+				return nil
+			}
+			entry := ExportedEntry{
+				Key:            record.Key,
+				Type:           record.Type,
+				Value:          record.Value,
+				Timestamp:      record.Timestamp,
+				Remaining_hits: remaining_hits[evicted_entry_key(record)],
+			}
+			if ik, ok := idempotency_keys[evicted_entry_key(record)]; ok {
+				entry.Idempotency_key = ik.token
+				entry.Idempotency_request_digest = ik.request_digest
+				entry.Idempotency_key_expiry = ik.expiry_time
+			}
+			if record.ValueType == TYPE_MAP_ITEM_PASTE {
+				contents, err := os.ReadFile(record.Value)
+				if err != nil {
+					return fmt.Errorf("Failed to read paste for key %#v: %w", record.Key, err)
+				}
+				entry.Value = base64.StdEncoding.EncodeToString(contents)
+			}
+			count++
+			return ew.Write(&entry)
+		})
+		if err != nil {
+			return count, fmt.Errorf("%s: %w", absolute_filepath, err)
+		}
+	}
+	return count, ew.Flush()
+}
+
+type entry_reader interface {
+	Read() (*ExportedEntry, error) // returns io.EOF at the end
+}
+
+type jsonl_entry_reader struct {
+	dec *json.Decoder
+}
+
+func (r *jsonl_entry_reader) Read() (*ExportedEntry, error) {
+	var entry ExportedEntry
+	err := r.dec.Decode(&entry)
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+type csv_entry_reader struct {
+	cr *csv.Reader
+}
+
+func (r *csv_entry_reader) Read() (*ExportedEntry, error) {
+	fields, err := r.cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := String_to_int64(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("Could not convert timestamp to int64: %w", err)
+	}
+	entry := &ExportedEntry{
+		Key:                        fields[0],
+		Type:                       fields[1],
+		Value:                      fields[2],
+		Timestamp:                  timestamp,
+		Remaining_hits:             0,
+		Idempotency_key:            "",
+		Idempotency_request_digest: "",
+		Idempotency_key_expiry:     0,
+	}
+	if len(fields) > 4 { //nolint:gomnd // remaining_hits
+		entry.Remaining_hits, err = String_to_int64(fields[4])
+		if err != nil {
+			return nil, fmt.Errorf("Could not convert remaining_hits to int64: %w", err)
+		}
+	}
+	if len(fields) > 7 { //nolint:gomnd // the idempotency key columns
+		entry.Idempotency_key = fields[5]
+		entry.Idempotency_request_digest = fields[6]
+		entry.Idempotency_key_expiry, err = String_to_int64(fields[7])
+		if err != nil {
+			return nil, fmt.Errorf("Could not convert idempotency_key_expiry to int64: %w", err)
+		}
+	}
+	return entry, nil
+}
+
+func new_entry_reader(r io.Reader, format ExportFormat) (entry_reader, error) { //nolint:ireturn // it's internal
+	switch format {
+	case EXPORT_FORMAT_JSONL:
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		return &jsonl_entry_reader{dec: dec}, nil
+	case EXPORT_FORMAT_CSV:
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = 0 // every record must have as many fields as the header
+		header, err := cr.Read()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CSV header: %w", err)
+		}
+		if len(header) != csv_min_fields && len(header) != csv_min_fields+1 && len(header) != len(g_csv_header) {
+			return nil, fmt.Errorf("Unexpected CSV header %v, expected %v", header, g_csv_header)
+		}
+		for i := range header {
+			if header[i] != g_csv_header[i] {
+				return nil, fmt.Errorf("Unexpected CSV header %v, expected %v", header, g_csv_header)
+			}
+		}
+		return &csv_entry_reader{cr: cr}, nil
+	}
+	return nil, fmt.Errorf("Unknown import format %#v", format)
+}
+
+type ImportDirectoryNotEmptyError struct{}
+
+func (e ImportDirectoryNotEmptyError) Error() string {
+	return "Import: log directory is not empty"
+}
+
+// Reads entries from r and writes them into a fresh log directory (and paste directory for pastes). Returns the number of entries imported.
+// Every entry is validated with the same rules as LoadStoredRecordsFromDisk, and duplicate keys are rejected.
+// If an error is returned, the directories are left partially written and should be deleted.
+func ImportIntoLogDirectory(params *ImportParams, r io.Reader) (int, error) {
+	entries, err := os.ReadDir(params.Log_directory_path_absolute)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) != 0 {
+		return 0, ImportDirectoryNotEmptyError{}
+	}
+	er, err := new_entry_reader(r, params.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	var log_storage LogStorage
+	var paste_storage PasteStorage
+	if params.Expiring {
+		log_storage = NewLogBucketStructuredExpiringStorage(params.Bucket_interval, params.Log_directory_path_absolute)
+		paste_storage = NewExpiringBucketStorage(params.Paste_directory_path_absolute)
+	} else {
+		lsps := NewLogStructuredPermanentStorage(params.Log_file_max_size_bytes, params.Log_directory_path_absolute)
+		defer lsps.Close()
+		log_storage = lsps
+		paste_storage = NewPermanentBucketStorage(params.Paste_directory_path_absolute)
+	}
+
+	seen_keys := make(map[string]struct{})
+	count := 0
+	for {
+		entry, err := er.Read()
+		if errors.Is(err, io.EOF) {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("Entry %d: %w", count+1, err)
+		}
+		err = Validate_Stored_Key(params.B53m, entry.Key, params.Allow_alias_ids)
+		if err != nil {
+			return count, fmt.Errorf("Entry %d: Invalid URL ID %#v: %w", count+1, entry.Key, err)
+		}
+		value_type, err := Parse_MapItemValueType(entry.Type)
+		if err != nil {
+			return count, fmt.Errorf("Entry %d: %w", count+1, err)
+		}
+		err = Validate_Timestamp_Common(entry.Timestamp)
+		if err != nil {
+			return count, fmt.Errorf("Entry %d: %w", count+1, err)
+		}
+		if entry.Remaining_hits < 0 {
+			return count, fmt.Errorf("Entry %d: remaining_hits can't be negative", count+1)
+		}
+		if entry.Remaining_hits > 0 && !params.Expiring {
+			return count, fmt.Errorf("Entry %d: only the expiring map supports max hits", count+1)
+		}
+		if entry.Idempotency_key != "" {
+			err = Validate_Idempotency_Key(entry.Idempotency_key)
+			if err != nil {
+				return count, fmt.Errorf("Entry %d: %w", count+1, err)
+			}
+			if entry.Idempotency_request_digest == "" || strings.Contains(entry.Idempotency_request_digest, " ") || entry.Idempotency_key_expiry <= 0 {
+				return count, fmt.Errorf("Entry %d: idempotency_key needs a request digest and an expiry time", count+1)
+			}
+		}
+		if _, ok := seen_keys[entry.Key]; ok {
+			return count, fmt.Errorf("Entry %d: duplicate key %#v", count+1, entry.Key)
+		}
+		seen_keys[entry.Key] = struct{}{}
+
+		value := entry.Value
+		entry_log_storage := log_storage
+		if value_type == TYPE_MAP_ITEM_PASTE {
+			contents, err := base64.StdEncoding.DecodeString(entry.Value)
+			if err != nil {
+				return count, fmt.Errorf("Entry %d: paste value is not valid base64: %w", count+1, err)
+			}
+			entry_log_storage = with_paste_encryption_info(log_storage, contents, value_type)
+			value, err = paste_storage.InsertFile(contents, entry.Timestamp, params.Xattr_params)
+			if err != nil {
+				return count, fmt.Errorf("Entry %d: %w", count+1, err)
+			}
+		}
+		// Same records as PutEntryWithMaxHits writes, with the hits that were left as the max hits
+		if entry.Remaining_hits > 0 {
+			entry_log_storage = max_hits_log_storage{LogStorage: entry_log_storage, max_hits: entry.Remaining_hits}
+		}
+		// Same as PutEntryWithIdempotencyKey, the idempotency record goes first
+		if entry.Idempotency_key != "" {
+			entry_log_storage = &idempotency_key_log_storage{
+				LogStorage:        entry_log_storage,
+				token:             entry.Idempotency_key,
+				request_digest:    entry.Idempotency_request_digest,
+				token_expiry_time: entry.Idempotency_key_expiry,
+				written:           false,
+			}
+		}
+		err = entry_log_storage.AppendNewEntry(entry.Key, value, value_type, entry.Timestamp)
+		if err != nil {
+			return count, fmt.Errorf("Entry %d: %w", count+1, err)
+		}
+		count++
+		if count%100000 == 0 {
+			log.Println("Imported", count, "entries")
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package util_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func Test_Export_Import_Roundtrip(t *testing.T) {
+	t.Parallel()
+
+	for _, format := range []util.ExportFormat{util.EXPORT_FORMAT_JSONL, util.EXPORT_FORMAT_CSV} {
+		src_dir := t.TempDir()
+		cppum := new_test_cppum(t, src_dir, false)
+		url_key, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+		paste_key, err := cppum.PutEntry(4, "hello\tworld\n", 0, util.TYPE_MAP_ITEM_PASTE)
+		util.Assert_no_error(t, err, 1)
+
+		var buf bytes.Buffer
+		count, err := util.ExportLogDirectory(&util.ExportParams{
+			Log_directory_path_absolute: filepath.Join(src_dir, "logs"),
+			B53m:                        util.NewBase53IDManager(),
+			Format:                      format,
+		}, &buf)
+		util.Assert_result_equals_interface(t, count, err, 2, 1)
+
+		dst_dir := t.TempDir()
+		err = os.MkdirAll(filepath.Join(dst_dir, "logs"), os.ModePerm)
+		util.Assert_no_error(t, err, 1)
+		import_params := util.ImportParams{
+			Log_directory_path_absolute:   filepath.Join(dst_dir, "logs"),
+			Paste_directory_path_absolute: filepath.Join(dst_dir, "pastes"),
+			Log_file_max_size_bytes:       300,
+			B53m:                          util.NewBase53IDManager(),
+			Xattr_params:                  &util.XattrParams{},
+			Format:                        format,
+		}
+		count, err = util.ImportIntoLogDirectory(&import_params, bytes.NewReader(buf.Bytes()))
+		util.Assert_result_equals_interface(t, count, err, 2, 1)
+
+		// Importing into a directory that already has data is refused
+		_, err = util.ImportIntoLogDirectory(&import_params, bytes.NewReader(buf.Bytes()))
+		util.Assert_error_equals(t, err, util.ImportDirectoryNotEmptyError{}.Error(), 1)
+
+		cppum = new_test_cppum(t, dst_dir, false)
+		val, err := cppum.GetEntry(url_key)
+		util.Assert_no_error(t, err, 1)
+		util.Assert_result_equals_interface(t, val.GetValue(), nil, "google.com", 1)
+		val, err = cppum.GetEntry(paste_key)
+		util.Assert_no_error(t, err, 1)
+		contents, err := os.ReadFile(val.GetValue())
+		util.Assert_result_equals_bytes(t, contents, err, "hello\tworld\n", 1)
+	}
+}
+
+func Test_Export_Import_Keeps_Remaining_Hits(t *testing.T) {
+	t.Parallel()
+
+	for _, format := range []util.ExportFormat{util.EXPORT_FORMAT_JSONL, util.EXPORT_FORMAT_CSV} {
+		// Exports compare expiry times against the real clock
+		src := urlmaptest.NewOnDisk(t)
+		src.Clock.Set(time.Now().Unix())
+		cepum := src.StartCEPUM(nil)
+		limited_key, err := cepum.PutEntryWithMaxHits(2, "burn after reading", src.Clock.Now()+1000, util.TYPE_MAP_ITEM_PASTE, 3)
+		util.Assert_no_error(t, err, 1)
+		_, err = cepum.GetEntry(limited_key)
+		util.Assert_no_error(t, err, 1)
+		used_up_key, err := cepum.PutEntryWithMaxHits(2, "https://once.example", src.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL, 1)
+		util.Assert_no_error(t, err, 1)
+		_, err = cepum.GetEntry(used_up_key)
+		util.Assert_no_error(t, err, 1)
+		url_key, err := cepum.PutEntry(2, "google.com", src.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+
+		var buf bytes.Buffer
+		count, err := util.ExportLogDirectory(&util.ExportParams{
+			Log_directory_path_absolute: src.LogDir(),
+			Expiring:                    true,
+			B53m:                        src.B53m,
+			Format:                      format,
+		}, &buf)
+		util.Assert_result_equals_interface(t, count, err, 2, 1)
+
+		dst := urlmaptest.NewOnDisk(t)
+		dst.Clock.Set(src.Clock.Now())
+		count, err = util.ImportIntoLogDirectory(&util.ImportParams{
+			Log_directory_path_absolute:   dst.LogDir(),
+			Paste_directory_path_absolute: dst.PasteDir(),
+			Expiring:                      true,
+			Bucket_interval:               60,
+			B53m:                          dst.B53m,
+			Xattr_params:                  &util.XattrParams{},
+			Format:                        format,
+		}, bytes.NewReader(buf.Bytes()))
+		util.Assert_result_equals_interface(t, count, err, 2, 1)
+
+		// 2 of the 3 hits were left
+		cepum = dst.StartCEPUM(nil)
+		for i := 0; i < 2; i++ {
+			item, err := cepum.GetEntry(limited_key)
+			util.Assert_no_error(t, err, 1)
+			contents, err := cepum.ReadPaste(item, "")
+			util.Assert_result_equals_bytes(t, contents, err, "burn after reading", 1)
+		}
+		_, err = cepum.GetEntry(limited_key)
+		util.Assert_error_equals(t, err, util.KeyExpiredError{}.Error(), 1)
+		for i := 0; i < 2; i++ {
+			item, err := cepum.GetEntry(url_key)
+			util.Assert_result_equals_interface(t, item.GetValue(), err, "google.com", 1)
+		}
+	}
+}
+
+func Test_Export_Import_Keeps_Idempotency_Keys(t *testing.T) {
+	t.Parallel()
+
+	for _, format := range []util.ExportFormat{util.EXPORT_FORMAT_JSONL, util.EXPORT_FORMAT_CSV} {
+		with_idempotency := func(p *util.CEPUMParams) { p.Idempotency_window_seconds = 3600 }
+		// Exports compare expiry times against the real clock
+		src := urlmaptest.NewOnDisk(t)
+		src.Clock.Set(time.Now().Unix())
+		cepum := src.StartCEPUM(with_idempotency)
+		key, err := cepum.PutEntryWithIdempotencyKey("request-1", 2, "google.com", src.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+		_, err = cepum.PutEntry(2, "no-token.com", src.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+
+		var buf bytes.Buffer
+		count, err := util.ExportLogDirectory(&util.ExportParams{
+			Log_directory_path_absolute: src.LogDir(),
+			Expiring:                    true,
+			B53m:                        src.B53m,
+			Format:                      format,
+		}, &buf)
+		util.Assert_result_equals_interface(t, count, err, 2, 1)
+
+		dst := urlmaptest.NewOnDisk(t)
+		dst.Clock.Set(src.Clock.Now())
+		count, err = util.ImportIntoLogDirectory(&util.ImportParams{
+			Log_directory_path_absolute:   dst.LogDir(),
+			Paste_directory_path_absolute: dst.PasteDir(),
+			Expiring:                      true,
+			Bucket_interval:               60,
+			B53m:                          dst.B53m,
+			Xattr_params:                  &util.XattrParams{},
+			Format:                        format,
+		}, bytes.NewReader(buf.Bytes()))
+		util.Assert_result_equals_interface(t, count, err, 2, 1)
+
+		// A retry after the move gets the same entry, and the token still can't be reused for something else
+		cepum = dst.StartCEPUM(with_idempotency)
+		retry_key, err := cepum.PutEntryWithIdempotencyKey("request-1", 2, "google.com", dst.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL)
+		util.Assert_result_equals_interface(t, retry_key, err, key, 1)
+		_, err = cepum.PutEntryWithIdempotencyKey("request-1", 2, "bing.com", dst.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL)
+		util.Assert_error_equals(t, err, util.IdempotencyKeyConflictError{}.Error(), 1)
+		util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 2, 1)
+	}
+}
+
+func Test_Import_Accepts_CSV_Without_Remaining_Hits(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	count, err := util.ImportIntoLogDirectory(&util.ImportParams{
+		Log_directory_path_absolute:   dir,
+		Paste_directory_path_absolute: filepath.Join(dir, "pastes"),
+		Log_file_max_size_bytes:       300,
+		B53m:                          util.NewBase53IDManager(),
+		Xattr_params:                  &util.XattrParams{},
+		Format:                        util.EXPORT_FORMAT_CSV,
+	}, strings.NewReader("key,type,value,timestamp\n00,url,google.com,1700000000\n"))
+	util.Assert_result_equals_interface(t, count, err, 1, 1)
+}
+
+func Test_Import_Rejects_Invalid_Entries(t *testing.T) {
+	t.Parallel()
+
+	bad_inputs := map[string]string{
+		`{"key":"02","type":"url","value":"a","timestamp":1700000000}`:                                                                                           "Entry 1: Invalid URL ID \"02\": " + util.Base53ErrorChecksumMismatch{}.Error(),
+		`{"key":"00","type":"gif","value":"a","timestamp":1700000000}`:                                                                                           "Entry 1: Unrecognized value type \"gif\"",
+		`{"key":"00","type":"url","value":"a","timestamp":5}`:                                                                                                    "Entry 1: Timestamp 5 is before the year 2023",
+		`{"key":"00","type":"url","value":"a","timestamp":1700000000,"extra":"field"}`:                                                                           "Entry 1: json: unknown field \"extra\"",
+		`{"key":"00","type":"url","value":"a","timestamp":1700000000,"remaining_hits":2}`:                                                                        "Entry 1: only the expiring map supports max hits",
+		`{"key":"00","type":"url","value":"a","timestamp":1700000000,"idempotency_key":"request-1"}`:                                                             "Entry 1: idempotency_key needs a request digest and an expiry time",
+		"{\"key\":\"00\",\"type\":\"url\",\"value\":\"a\",\"timestamp\":1700000000}\n{\"key\":\"00\",\"type\":\"url\",\"value\":\"b\",\"timestamp\":1700000000}": "Entry 2: duplicate key \"00\"",
+	}
+	for input, expected := range bad_inputs {
+		dir := t.TempDir()
+		_, err := util.ImportIntoLogDirectory(&util.ImportParams{
+			Log_directory_path_absolute:   dir,
+			Paste_directory_path_absolute: filepath.Join(dir, "pastes"),
+			Log_file_max_size_bytes:       300,
+			B53m:                          util.NewBase53IDManager(),
+			Xattr_params:                  &util.XattrParams{},
+			Format:                        util.EXPORT_FORMAT_JSONL,
+		}, strings.NewReader(input))
+		util.Assert_error_equals(t, err, expected, 1)
+	}
+}
@@ -0,0 +1,85 @@
+// Keeps track of how far LoadStoredRecordsFromDisk has got, so that a health check can tell whether the map is ready yet.
+// The loader updates it as it goes and anyone can read it at any time.
+package util
+
+import "sync/atomic"
+
+type LoadProgress struct {
+	files_total          atomic.Int64
+	files_loaded         atomic.Int64
+	records_loaded       atomic.Int64
+	id_lengths_total     atomic.Int64
+	id_lengths_generated atomic.Int64
+	generating_id_length atomic.Int64
+	done                 atomic.Bool
+}
+
+type LoadStatus struct {
+	Done                 bool
+	Files_total          int64
+	Files_loaded         int64
+	Records_loaded       int64
+	Id_lengths_total     int64 // How many RandomBags have to be filled, one per ID length
+	Id_lengths_generated int64
+	Generating_id_length int64 // Length of the IDs that are being generated right now. 0 if not generating.
+}
+
+func NewLoadProgress() *LoadProgress {
+	return &LoadProgress{}
+}
+
+// All of the methods below can be called on a nil *LoadProgress, in which case they do nothing.
+
+func (lp *LoadProgress) Status() LoadStatus {
+	if lp == nil {
+		return LoadStatus{}
+	}
+	return LoadStatus{
+		Done:                 lp.done.Load(),
+		Files_total:          lp.files_total.Load(),
+		Files_loaded:         lp.files_loaded.Load(),
+		Records_loaded:       lp.records_loaded.Load(),
+		Id_lengths_total:     lp.id_lengths_total.Load(),
+		Id_lengths_generated: lp.id_lengths_generated.Load(),
+		Generating_id_length: lp.generating_id_length.Load(),
+	}
+}
+
+func (lp *LoadProgress) set_totals(files_total int, id_lengths_total int) {
+	if lp == nil {
+		return
+	}
+	lp.files_total.Store(int64(files_total))
+	lp.id_lengths_total.Store(int64(id_lengths_total))
+}
+
+func (lp *LoadProgress) file_loaded() {
+	if lp != nil {
+		lp.files_loaded.Add(1)
+	}
+}
+
+func (lp *LoadProgress) record_loaded() {
+	if lp != nil {
+		lp.records_loaded.Add(1)
+	}
+}
+
+func (lp *LoadProgress) generating_id_length_started(length int) {
+	if lp != nil {
+		lp.generating_id_length.Store(int64(length))
+	}
+}
+
+func (lp *LoadProgress) id_length_generated() {
+	if lp != nil {
+		lp.id_lengths_generated.Add(1)
+		lp.generating_id_length.Store(0)
+	}
+}
+
+func (lp *LoadProgress) finish() {
+	if lp != nil {
+		lp.done.Store(true)
+	}
+}
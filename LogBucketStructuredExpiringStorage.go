@@ -12,17 +12,21 @@
 package util
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"sync"
-	"time"
 )
 
 type LogBucketStructuredExpiringStorage struct {
 	directory_lock                 sync.Mutex
+	backend                        StorageBackend
+	clock                          Clock
 	bucket_interval                int64
 	bucket_directory_path_absolute string
+	torn_buckets                   map[string]int64 // path -> size before a failed append that couldn't be cut off yet
 }
 
 // the bucket interval is the all-important parameter that determines the number of buckets and when buckets will be deleted
@@ -37,8 +41,14 @@ type LogBucketStructuredExpiringStorage struct {
 // e.g. if bucket interval is 200, then bucket 200 holds all timestamps 0-199, bucket 400 holds all timestamps 200-399, bucket 600 holds 400-599, and so on.
 // bucket files are named "expires_before_18400" where the last number is a unix timestamp
 func NewLogBucketStructuredExpiringStorage(bucket_interval int64, bucket_directory_path_absolute string) *LogBucketStructuredExpiringStorage {
+	return NewLogBucketStructuredExpiringStorageWithBackend(nil, bucket_interval, bucket_directory_path_absolute)
+}
+
+// Same as NewLogBucketStructuredExpiringStorage but the log files are kept in the given backend. nil means the local file system.
+func NewLogBucketStructuredExpiringStorageWithBackend(backend StorageBackend, bucket_interval int64, bucket_directory_path_absolute string) *LogBucketStructuredExpiringStorage {
+	backend = storage_backend_or_local(backend)
 	// check if bucket directory exists
-	_, err := os.Stat(bucket_directory_path_absolute)
+	_, err := backend.ListSegments(bucket_directory_path_absolute)
 	if err != nil {
 		log.Fatal("Fatal error: Could not stat bucket directory:", err)
 		panic(err)
@@ -46,8 +56,11 @@ func NewLogBucketStructuredExpiringStorage(bucket_interval int64, bucket_directo
 
 	return &LogBucketStructuredExpiringStorage{
 		directory_lock:                 sync.Mutex{},
+		backend:                        backend,
+		clock:                          Real_Clock,
 		bucket_interval:                bucket_interval,
 		bucket_directory_path_absolute: bucket_directory_path_absolute,
+		torn_buckets:                   make(map[string]int64),
 	}
 }
 
@@ -55,6 +68,11 @@ func NewLogBucketStructuredExpiringStorage(bucket_interval int64, bucket_directo
 //
 // Also important: Make sure the input does not contain carriage return or newline.
 func (lbses *LogBucketStructuredExpiringStorage) AppendNewEntry(key string, value string, value_type MapItemValueType, expiry_time int64) error {
+	return lbses.AppendNewRecord(key, value, value_type.ToString(), expiry_time)
+}
+
+// Same as AppendNewEntry but for records that aren't map entries. The record goes into the bucket for its timestamp, so it gets deleted along with that bucket.
+func (lbses *LogBucketStructuredExpiringStorage) AppendNewRecord(key string, value string, record_type string, expiry_time int64) error {
 	lbses.directory_lock.Lock()
 	defer lbses.directory_lock.Unlock()
 	// Don't check for expiry time
@@ -63,56 +81,89 @@ func (lbses *LogBucketStructuredExpiringStorage) AppendNewEntry(key string, valu
 	// Find the corresponding bucket number. This should always succeed
 	corresponding_bucket_timestamp := ((expiry_time / lbses.bucket_interval) + 1) * lbses.bucket_interval
 	bucket_path := filepath.Join(lbses.bucket_directory_path_absolute, LBSES_Get_bucket_filename(corresponding_bucket_timestamp))
+	record, err := Format_Log_Record(key, value, record_type, expiry_time)
+	if err != nil {
+		return err
+	}
+	// A failed append may have left part of a record at the end of the bucket. The next record must not go after it,
+	// since the loader can only skip a partial record at the end of a file. Buckets can't be rotated, so keep trying to cut it off.
+	size, torn := lbses.torn_buckets[bucket_path]
+	if torn {
+		err = lbses.truncate_bucket(bucket_path, size)
+		if err != nil {
+			return err
+		}
+		delete(lbses.torn_buckets, bucket_path)
+	} else {
+		info, err := lbses.backend.Stat(bucket_path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		size = info.Size
+	}
 	// Find the corresponding log file
 	// If it doesn't exist, create it
 	// If it does exist, then append to it
-	f, err := os.OpenFile(bucket_path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Fatal(err)
-		panic(err)
-	}
-	err = Write_Entry_To_File(key, value, value_type, expiry_time, f)
+	// PutEntry relies on the record being on disk once this returns, which AppendToSegment guarantees.
+	err = lbses.backend.AppendToSegment(bucket_path, []byte(record))
 	if err != nil {
+		truncate_err := lbses.truncate_bucket(bucket_path, size)
+		if truncate_err != nil {
+			log.Println("Failed to cut partial record off log file", bucket_path, "error:", truncate_err)
+			lbses.torn_buckets[bucket_path] = size
+		}
 		return err
 	}
-	if err = f.Close(); err != nil {
-		log.Fatal(err)
-		panic(err)
-	}
 	return nil
 }
 
+// A bucket that was never created has nothing to cut off
+func (lbses *LogBucketStructuredExpiringStorage) truncate_bucket(bucket_path string, size int64) error {
+	err := lbses.backend.TruncateSegment(bucket_path, size)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Makes DeleteExpiredLogFiles use the given clock. nil means the real clock.
+func (lbses *LogBucketStructuredExpiringStorage) SetClock(clock Clock) {
+	lbses.directory_lock.Lock()
+	defer lbses.directory_lock.Unlock()
+
+	lbses.clock = clock_or_real(clock)
+}
+
 // Delete expired buckets (log files)
 // extra_keeparound_seconds_disk defines how long to keep around log files after they expired
-func (lbses *LogBucketStructuredExpiringStorage) DeleteExpiredLogFiles(extra_keeparound_seconds_disk int64) {
+// Files that can't be deleted or whose names can't be parsed are left for next time, and their errors are returned together once the rest have been tried.
+func (lbses *LogBucketStructuredExpiringStorage) DeleteExpiredLogFiles(extra_keeparound_seconds_disk int64) error {
 	lbses.directory_lock.Lock()
 	defer lbses.directory_lock.Unlock()
 	// First, list all the files in the directory
-	entries, err := os.ReadDir(lbses.bucket_directory_path_absolute)
+	names, err := lbses.backend.ListSegments(lbses.bucket_directory_path_absolute)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	cur_timestamp := time.Now().Unix()
-	for _, e := range entries {
-		if e.IsDir() { // ignore directories
+	var errs error
+	cur_timestamp := lbses.clock()
+	for _, name := range names {
+		expiry_timestamp_unix, err := LBSES_Parse_bucket_filename_to_timestamp(name)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("Failed to parse name of bucket file %#v: %w", name, err))
 			continue
 		}
-		// if you can't parse it, raise an error
-		expiry_timestamp_unix, err1 := LBSES_Parse_bucket_filename_to_timestamp(e.Name())
-		if err1 != nil {
-			log.Fatal("Failed to parse name of bucket file:", e.Name(), "got error:", err)
-			panic(err1)
-		}
 		// if it's expired, then delete it
 		// add grace period
 		if (expiry_timestamp_unix + extra_keeparound_seconds_disk) < cur_timestamp {
-			log.Println("Deleting file ", filepath.Join(lbses.bucket_directory_path_absolute, e.Name()))
-			log.Println("Current time:", time.Now().Unix())
-			if err = os.Remove(filepath.Join(lbses.bucket_directory_path_absolute, e.Name())); err != nil {
-				log.Fatal(err)
-				panic(err)
+			log.Println("Deleting file ", filepath.Join(lbses.bucket_directory_path_absolute, name))
+			log.Println("Current time:", cur_timestamp)
+			if err = lbses.backend.Delete(filepath.Join(lbses.bucket_directory_path_absolute, name)); err != nil {
+				// It'll be tried again next time
+				errs = errors.Join(errs, fmt.Errorf("Failed to delete expired log file %#v: %w", name, err))
 			}
 		}
 	}
+	return errs
 }
@@ -13,7 +13,6 @@ import (
 	b64 "encoding/base64"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"regexp"
 )
@@ -48,30 +47,66 @@ func Compute_String_Checksum(str string) string {
 	return ""
 }
 
+// Log records that aren't map entries use their own type string in the type column.
+const (
+	LOG_RECORD_TYPE_IDEMPOTENCY_KEY = "idempotency_key"
+	LOG_RECORD_TYPE_PASTE_INTENT    = "paste_intent" // value is the path of a paste file that is about to be written, see Write_Entry_Durably_Common
+	LOG_RECORD_TYPE_EVICTION        = "eviction"     // the entry with this key, value and expiry time was evicted from a full map or used up its max hits, so the loader must drop it
+	LOG_RECORD_TYPE_MAX_HITS        = "max_hits"     // value is how many times the entry in the next record can be got, see PutEntryWithMaxHits
+	LOG_RECORD_TYPE_READ            = "read"         // the entry with this key, value and expiry time used up one of its max hits
+	LOG_RECORD_TYPE_REQUESTED_ID    = "requested_id" // the entry in the next record was put with PutEntryWithID, so it's never used for deduplication
+	// value says how the paste in the next record is encrypted, see PasteEncryptionInfo. The loader doesn't need it, it's there for tools.
+	LOG_RECORD_TYPE_PASTE_ENCRYPTION = "paste_encryption"
+	// These only go in the analytics log, see AccessTracker
+	LOG_RECORD_TYPE_HITS         = "hits"         // value is how many times the key was looked up since the last flush, timestamp is the last of them
+	LOG_RECORD_TYPE_CLICK        = "click"        // value is a JSON ClickDetails
+	LOG_RECORD_TYPE_ACCESS_RESET = "access_reset" // the key was reused for a new entry, so forget everything before this
+)
+
+// Records of these types aren't map entries, so they have no ValueType
+func is_non_entry_record_type(record_type string) bool {
+	switch record_type {
+	case LOG_RECORD_TYPE_IDEMPOTENCY_KEY, LOG_RECORD_TYPE_PASTE_INTENT, LOG_RECORD_TYPE_EVICTION, LOG_RECORD_TYPE_MAX_HITS, LOG_RECORD_TYPE_READ,
+		LOG_RECORD_TYPE_REQUESTED_ID, LOG_RECORD_TYPE_PASTE_ENCRYPTION, LOG_RECORD_TYPE_HITS, LOG_RECORD_TYPE_CLICK, LOG_RECORD_TYPE_ACCESS_RESET:
+		return true
+	}
+	return false
+}
+
 // IMPORTANT: This function DOES NOT close the file handle!!!
 func Write_Entry_To_File(key string, value string, value_type MapItemValueType, timestamp int64, file_handle *os.File) error {
+	return Write_Record_To_File(key, value, value_type.ToString(), timestamp, file_handle)
+}
+
+// IMPORTANT: This function DOES NOT close the file handle!!!
+func Write_Record_To_File(key string, value string, record_type string, timestamp int64, file_handle *os.File) error {
+	string_to_write, err := Format_Log_Record(key, value, record_type, timestamp)
+	if err != nil {
+		return err
+	}
+	_, err = file_handle.WriteString(string_to_write)
+	return err
+}
+
+// Returns the record as it is written to the log file, including the checksum and trailing newline.
+func Format_Log_Record(key string, value string, record_type string, timestamp int64) (string, error) {
 	// Generate the bytes to write to the file
 	// validate key first
 	for _, c := range key {
 		if c == '\n' || c == '\t' || c == '\x1e' {
-			return errors.New("Error: key contains newline or tab or x1e:" + string("c"))
+			return "", errors.New("Error: key contains newline or tab or x1e:" + string("c"))
 		}
 	}
 	// validate value
 	for _, c := range value {
 		if c == '\n' || c == '\t' || c == '\x1e' {
-			return errors.New("Error: value contains newline or tab or x1e:" + string("c"))
+			return "", errors.New("Error: value contains newline or tab or x1e:" + string("c"))
 		}
 	}
 	// we use md5 to detect corruption - 16 bytes is enough.
-	str_to_sum := key + string("\t") + value + string("\t") + value_type.ToString() + string("\t") + Int64_to_string(timestamp)
+	str_to_sum := key + string("\t") + value + string("\t") + record_type + string("\t") + Int64_to_string(timestamp)
 	hash_bytes := md5.Sum([]byte(str_to_sum))
 	hash_base64 := b64.StdEncoding.EncodeToString(hash_bytes[:])
 	// convert hash to printable string
-	string_to_write := str_to_sum + "\x1e" + hash_base64 + string("\n")
-	if _, err := file_handle.WriteString(string_to_write); err != nil {
-		log.Fatal(err)
-		panic(err)
-	}
-	return nil
+	return str_to_sum + "\x1e" + hash_base64 + string("\n"), nil
 }
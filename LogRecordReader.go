@@ -0,0 +1,351 @@
+// Reads records back out of the log files written by Write_Record_To_File.
+// Each record looks like this: key \t value \t type \t timestamp \x1e base64(md5) \n
+// The reader only validates records, it doesn't know anything about maps. LoadStoredRecordsFromDisk decides what to do with each record.
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type LogRecord struct {
+	Key       string
+	Value     string
+	Type      string           // "url", "paste", or one of the LOG_RECORD_TYPE_* constants
+	ValueType MapItemValueType // nil if the record is not a map entry
+	Timestamp int64
+}
+
+// Returned when the file ends in the middle of a record. Nothing after it can be read.
+type LogFileTruncatedError struct {
+	Offset int64
+}
+
+func (e LogFileTruncatedError) Error() string {
+	return fmt.Sprintf("Log file does not end with newline at offset %d, indicating some kind of corruption", e.Offset)
+}
+
+// Returned when a record was read in full but failed validation. The reader can carry on with the next record.
+type LogRecordInvalidError struct {
+	Offset int64
+	Err    error
+}
+
+func (e LogRecordInvalidError) Error() string {
+	return fmt.Sprintf("Invalid log record at offset %d: %v", e.Offset, e.Err)
+}
+
+func (e LogRecordInvalidError) Unwrap() error {
+	return e.Err
+}
+
+func Parse_MapItemValueType(type_str string) (MapItemValueType, error) { //nolint:ireturn // it's an enum
+	switch type_str {
+	case TYPE_MAP_ITEM_URL.ToString():
+		return TYPE_MAP_ITEM_URL, nil
+	case TYPE_MAP_ITEM_PASTE.ToString():
+		return TYPE_MAP_ITEM_PASTE, nil
+	}
+	return nil, fmt.Errorf("Unrecognized value type %#v", type_str)
+}
+
+// Validates a record using the same rules as LoadStoredRecordsFromDisk.
+// str_without_hash and md5_base64 must not contain the \x1e and \n delimiters.
+func Parse_Log_Record(str_without_hash []byte, md5_base64 []byte, b53m *Base53IDManager, allow_alias_ids bool) (*LogRecord, error) {
+	// Check md5_base64
+	md5_bytes, err := base64.StdEncoding.DecodeString(string(md5_base64))
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode base64-encoded md5: %w", err)
+	}
+	// Now recompute the md5 and check it against the stored value
+	recomputed_md5 := md5.Sum(str_without_hash) //nolint:gosec // md5 is fine here.
+	if !bytes.Equal(recomputed_md5[:], md5_bytes) {
+		return nil, fmt.Errorf("md5 does not match. Stored: %s Recomputed: %s", hex.EncodeToString(md5_bytes), hex.EncodeToString(recomputed_md5[:]))
+	}
+
+	parts := strings.Split(string(str_without_hash), "\t")
+	if len(parts) != 4 { //nolint:gomnd // 4 is okay here...
+		return nil, fmt.Errorf("Expected 4 parts (key, value, type, timestamp), got %d", len(parts))
+	}
+	record := LogRecord{
+		Key:   parts[0],
+		Value: parts[1],
+		Type:  parts[2],
+	}
+
+	// Check URL ID
+	err = Validate_Stored_Key(b53m, record.Key, allow_alias_ids)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URL ID %#v: %w", record.Key, err)
+	}
+
+	// Check type_str
+	if !is_non_entry_record_type(record.Type) {
+		record.ValueType, err = Parse_MapItemValueType(record.Type)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// convert timestamp_str to timestamp_unix
+	record.Timestamp, err = String_to_int64(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("Could not convert timestamp_str to int64: %w", err)
+	}
+	err = Validate_Timestamp_Common(record.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+type LogRecordReader struct {
+	br              *bufio.Reader
+	b53m            *Base53IDManager
+	allow_alias_ids bool
+	offset          int64
+}
+
+func NewLogRecordReader(r io.Reader, b53m *Base53IDManager, allow_alias_ids bool) *LogRecordReader {
+	return &LogRecordReader{
+		br:              bufio.NewReader(r),
+		b53m:            b53m,
+		allow_alias_ids: allow_alias_ids,
+		offset:          0,
+	}
+}
+
+// Byte offset just past the last record that was read.
+func (lrr *LogRecordReader) Offset() int64 {
+	return lrr.offset
+}
+
+// Returns io.EOF once all records have been read.
+// Returns LogRecordInvalidError if the record is invalid, in which case you can keep calling Next.
+// Any other error (e.g. LogFileTruncatedError) means nothing more can be read.
+func (lrr *LogRecordReader) Next() (*LogRecord, error) {
+	record_offset := lrr.offset
+	str_without_hash, err := lrr.br.ReadBytes('\x1e')
+	// check if error is EOF
+	if errors.Is(err, io.EOF) {
+		// make sure we're not waiting for more input
+		// If ReadBytes encounters an error before finding a delimiter,
+		// it returns the data read before the error and the error itself (often io.EOF).
+		if len(str_without_hash) != 0 {
+			return nil, LogFileTruncatedError{Offset: record_offset}
+		}
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	md5_base64, err := lrr.br.ReadBytes('\n')
+	if errors.Is(err, io.EOF) {
+		return nil, LogFileTruncatedError{Offset: record_offset}
+	}
+	if err != nil {
+		return nil, err
+	}
+	lrr.offset += int64(len(str_without_hash) + len(md5_base64))
+
+	str_without_hash = str_without_hash[:len(str_without_hash)-1] // Remove trailing \x1e
+	md5_base64 = md5_base64[:len(md5_base64)-1]                   // remove trailing newline
+	record, err := Parse_Log_Record(str_without_hash, md5_base64, lrr.b53m, lrr.allow_alias_ids)
+	if err != nil {
+		return nil, LogRecordInvalidError{Offset: record_offset, Err: err}
+	}
+	return record, nil
+}
+
+// Calls fn on every record in the file. Stops at the first invalid record or the first error returned by fn.
+func ForEachLogRecordInFile(absolute_filepath string, b53m *Base53IDManager, allow_alias_ids bool, fn func(*LogRecord) error) error {
+	return ForEachLogRecordInSegment(nil, absolute_filepath, b53m, allow_alias_ids, fn)
+}
+
+// Same as ForEachLogRecordInFile but reads the file from the given backend. nil means the local file system.
+func ForEachLogRecordInSegment(backend StorageBackend, absolute_filepath string, b53m *Base53IDManager, allow_alias_ids bool, fn func(*LogRecord) error) error {
+	f, err := storage_backend_or_local(backend).OpenSegment(absolute_filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return for_each_log_record(f, b53m, allow_alias_ids, fn)
+}
+
+// Same as ForEachLogRecordInFile but for a log file that has already been read into memory
+func for_each_log_record_in_bytes(data []byte, b53m *Base53IDManager, allow_alias_ids bool, fn func(*LogRecord) error) error {
+	return for_each_log_record(bytes.NewReader(data), b53m, allow_alias_ids, fn)
+}
+
+func for_each_log_record(r io.Reader, b53m *Base53IDManager, allow_alias_ids bool, fn func(*LogRecord) error) error {
+	lrr := NewLogRecordReader(r, b53m, allow_alias_ids)
+	for {
+		record, err := lrr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(record)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Identifies the entry that an eviction record refers to. See LOG_RECORD_TYPE_EVICTION.
+func evicted_entry_key(record *LogRecord) string {
+	return record.Key + "\t" + record.Value + "\t" + Int64_to_string(record.Timestamp)
+}
+
+// Calls fn for every record in the given local files, in order.
+// Bad records are skipped and unreadable files are left out, since whoever reads the files properly afterwards will report them.
+func for_each_readable_record_in_files(absolute_filepaths []string, b53m *Base53IDManager, allow_alias_ids bool, fn func(absolute_filepath string, record *LogRecord)) {
+	for _, absolute_filepath := range absolute_filepaths {
+		f, err := os.Open(absolute_filepath)
+		if err != nil {
+			continue
+		}
+		lrr := NewLogRecordReader(f, b53m, allow_alias_ids)
+		for {
+			record, err := lrr.Next()
+			var invalid_err LogRecordInvalidError
+			if errors.As(err, &invalid_err) {
+				continue
+			}
+			if err != nil {
+				break
+			}
+			fn(absolute_filepath, record)
+		}
+		f.Close()
+	}
+}
+
+// Returns the evicted_entry_key of every entry that has an eviction record in the given local files.
+func collect_evicted_entries(absolute_filepaths []string, b53m *Base53IDManager, allow_alias_ids bool) map[string]bool {
+	evicted := make(map[string]bool)
+	for_each_readable_record_in_files(absolute_filepaths, b53m, allow_alias_ids, func(_ string, record *LogRecord) {
+		if record.Type == LOG_RECORD_TYPE_EVICTION {
+			evicted[evicted_entry_key(record)] = true
+		}
+	})
+	return evicted
+}
+
+// Returns how many hits are left for every entry put with PutEntryWithMaxHits in the given local files, by evicted_entry_key.
+// Same as the loader: entries that used up their last hit have an eviction record instead, so there's always at least 1 left here.
+func collect_remaining_hits(absolute_filepaths []string, b53m *Base53IDManager, allow_alias_ids bool) map[string]int64 {
+	max_hits := make(map[string]int64)
+	reads := make(map[string]int64)
+	var pending_max_hits *LogRecord = nil // only applies to the record straight after it
+	pending_path := ""
+	for_each_readable_record_in_files(absolute_filepaths, b53m, allow_alias_ids, func(absolute_filepath string, record *LogRecord) {
+		if record.Type == LOG_RECORD_TYPE_PASTE_ENCRYPTION { // comes between the max hits record and its entry
+			return
+		}
+		if pending_max_hits != nil && pending_path == absolute_filepath && record.ValueType != nil &&
+			pending_max_hits.Key == record.Key && pending_max_hits.Timestamp == record.Timestamp {
+			n, err := String_to_int64(pending_max_hits.Value)
+			if err == nil && n > 0 {
+				max_hits[evicted_entry_key(record)] = n
+			}
+		}
+		pending_max_hits = nil
+		switch record.Type {
+		case LOG_RECORD_TYPE_MAX_HITS:
+			pending_max_hits = record
+			pending_path = absolute_filepath
+		case LOG_RECORD_TYPE_READ:
+			reads[evicted_entry_key(record)]++
+		}
+	})
+	remaining_hits := make(map[string]int64, len(max_hits))
+	for key, n := range max_hits {
+		remaining_hits[key] = max(n-reads[key], 1)
+	}
+	return remaining_hits
+}
+
+type exported_idempotency_key struct {
+	token          string
+	request_digest string
+	expiry_time    int64
+}
+
+// Returns the idempotency key of every entry in the given local files that still has one at cur_unix_timestamp, by evicted_entry_key.
+// Same as the loader: chained records belong to the entry record after them (there can be other chained records in between),
+// and standalone records belong to the latest entry with that key before them.
+// An entry can have more than one key if retries were deduplicated onto it. Only the one that's valid for longest is returned.
+func collect_idempotency_keys(absolute_filepaths []string, b53m *Base53IDManager, allow_alias_ids bool, cur_unix_timestamp int64) map[string]exported_idempotency_key {
+	idempotency_keys := make(map[string]exported_idempotency_key)
+	add := func(entry_key string, ik exported_idempotency_key) {
+		if ik.expiry_time > cur_unix_timestamp && ik.expiry_time > idempotency_keys[entry_key].expiry_time {
+			idempotency_keys[entry_key] = ik
+		}
+	}
+	latest_entries := make(map[string]string) // key -> evicted_entry_key
+	var pending *LogRecord = nil
+	pending_path := ""
+	for_each_readable_record_in_files(absolute_filepaths, b53m, allow_alias_ids, func(absolute_filepath string, record *LogRecord) {
+		if record.ValueType != nil {
+			latest_entries[record.Key] = evicted_entry_key(record)
+			if pending != nil && pending_path == absolute_filepath && pending.Key == record.Key && pending.Timestamp == record.Timestamp {
+				token, request_digest, expiry_time, _ := parse_chained_idempotency_record(pending.Value)
+				add(evicted_entry_key(record), exported_idempotency_key{token: token, request_digest: request_digest, expiry_time: expiry_time})
+			}
+			pending = nil
+			return
+		}
+		if record.Type != LOG_RECORD_TYPE_IDEMPOTENCY_KEY {
+			if !is_chained_record(record) {
+				pending = nil
+			}
+			return
+		}
+		if _, _, _, ok := parse_chained_idempotency_record(record.Value); ok {
+			pending = record
+			pending_path = absolute_filepath
+			return
+		}
+		pending = nil
+		if entry_key, ok := latest_entries[record.Key]; ok {
+			token, request_digest := parse_standalone_idempotency_record(record.Value)
+			add(entry_key, exported_idempotency_key{token: token, request_digest: request_digest, expiry_time: record.Timestamp})
+		}
+	})
+	return idempotency_keys
+}
+
+// Lists the log files in the directory, validating every file name. Directories are ignored.
+func List_Log_Files(log_directory_path_absolute string, lss LogStructuredStorage) ([]string, error) {
+	return List_Log_Segments(nil, log_directory_path_absolute, lss)
+}
+
+// Same as List_Log_Files but lists the directory in the given backend. nil means the local file system.
+func List_Log_Segments(backend StorageBackend, log_directory_path_absolute string, lss LogStructuredStorage) ([]string, error) {
+	names, err := storage_backend_or_local(backend).ListSegments(log_directory_path_absolute)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(names))
+	for _, name := range names {
+		err = lss.ValidateLogFilename(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse name of file in log directory %#v: %w", name, err)
+		}
+		files = append(files, filepath.Join(log_directory_path_absolute, name))
+	}
+	return files, nil
+}
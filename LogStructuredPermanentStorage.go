@@ -21,25 +21,30 @@ import (
 
 type LogStructuredPermanentStorage struct {
 	directory_lock              sync.Mutex
+	backend                     StorageBackend
 	log_file_max_size           int64
 	log_directory_path_absolute string
 	current_log_filepath        string
-	current_log_file_handle     *os.File
+	current_log_file_size       int64
+	current_log_file_handle     SegmentAppendHandle
+	must_rotate                 bool // a failed append left part of a record at the end of the current file and it couldn't be cut off
+	closed                      bool
 }
 
 // Works just like the log rotation library - once log file reaches the max size, create a new log file
 // Except we don't need any clever naming scheme, just an increasing number will do, since we're going to read in every file on startup anyway
 // The increasing number naming scheme is actually good for cloud backups since we can just send the highest numbered file every time
 func NewLogStructuredPermanentStorage(log_file_max_size int64, log_directory_path_absolute string) *LogStructuredPermanentStorage {
-	// check if log directory exists
-	_, err := os.Stat(log_directory_path_absolute)
-	if err != nil {
-		log.Fatal("Fatal error: Could not stat log directory:", err)
-		panic(err)
-	}
+	return NewLogStructuredPermanentStorageWithBackend(nil, log_file_max_size, log_directory_path_absolute)
+}
+
+// Same as NewLogStructuredPermanentStorage but the log files are kept in the given backend. nil means the local file system.
+func NewLogStructuredPermanentStorageWithBackend(backend StorageBackend, log_file_max_size int64, log_directory_path_absolute string) *LogStructuredPermanentStorage {
+	backend = storage_backend_or_local(backend)
 	// list all the files in the directory and find the file with the highest numbered name
 	// the file names should be "1.log", "2.log", "3.log" and so on
-	entries, err := os.ReadDir(log_directory_path_absolute)
+	// This also checks that the log directory exists
+	names, err := backend.ListSegments(log_directory_path_absolute)
 	if err != nil {
 		log.Fatal("Failed to open log_directory_path_absolute:", log_directory_path_absolute, "error:", err)
 		panic(err)
@@ -48,19 +53,16 @@ func NewLogStructuredPermanentStorage(log_file_max_size int64, log_directory_pat
 	// Find the name of the file with the biggest number
 	var biggest_numbered_filename string
 	var biggest_seen_number int64 = 0
-	for _, entry := range entries {
-		if entry.IsDir() { // ignore directories
-			continue
-		}
+	for _, name := range names {
 		// if you can't parse it, raise an error
-		number, err := LSPS_Parse_log_filename_to_number(entry.Name())
+		number, err := LSPS_Parse_log_filename_to_number(name)
 		if err != nil {
-			log.Fatal("Failed to parse name of file in bucket directory:", entry.Name(), "got error:", err)
+			log.Fatal("Failed to parse name of file in bucket directory:", name, "got error:", err)
 			panic(err)
 		}
 		if number > biggest_seen_number {
 			biggest_seen_number = number
-			biggest_numbered_filename = entry.Name()
+			biggest_numbered_filename = name
 		}
 	}
 	// If there are no entries, then create 0.log
@@ -70,19 +72,26 @@ func NewLogStructuredPermanentStorage(log_file_max_size int64, log_directory_pat
 
 	fmt.Println("biggest_numbered_filename:", biggest_numbered_filename)
 	current_log_filepath_absolute := filepath.Join(log_directory_path_absolute, biggest_numbered_filename)
-	// We should keep track of the file size too, so that we rotate it when we get to max size
-	fh, err := os.OpenFile(current_log_filepath_absolute, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o644) // open in append mode, create if not already exist
+	// create it if it doesn't already exist. The handle is kept open until the file gets rotated.
+	handle, err := open_segment_for_append(backend, current_log_filepath_absolute)
 	if err != nil {
 		log.Fatal(err)
 		panic("ERROR: FAILED TO OPEN/CREATE NEW LOG FILE!!!")
 	}
+	// We should keep track of the file size too, so that we rotate it when we get to max size
+	info, err := backend.Stat(current_log_filepath_absolute)
+	Check_err(err)
 
 	return &LogStructuredPermanentStorage{
 		directory_lock:              sync.Mutex{},
+		backend:                     backend,
 		log_file_max_size:           log_file_max_size,
 		log_directory_path_absolute: log_directory_path_absolute,
 		current_log_filepath:        current_log_filepath_absolute,
-		current_log_file_handle:     fh,
+		current_log_file_size:       info.Size,
+		current_log_file_handle:     handle,
+		must_rotate:                 false,
+		closed:                      false,
 	}
 }
 
@@ -90,35 +99,78 @@ func NewLogStructuredPermanentStorage(log_file_max_size int64, log_directory_pat
 //
 // Also important: Make sure the input does not contain carriage return or newline.
 func (lsps *LogStructuredPermanentStorage) AppendNewEntry(key string, value string, value_type MapItemValueType, generation_time_unix int64) error {
+	return lsps.AppendNewRecord(key, value, value_type.ToString(), generation_time_unix)
+}
+
+// Same as AppendNewEntry but for records that aren't map entries.
+func (lsps *LogStructuredPermanentStorage) AppendNewRecord(key string, value string, record_type string, timestamp int64) error {
 	lsps.directory_lock.Lock()
 	defer lsps.directory_lock.Unlock()
+
+	if lsps.closed {
+		return errors.New("LogStructuredPermanentStorage is closed")
+	}
+	record, err := Format_Log_Record(key, value, record_type, timestamp)
+	if err != nil {
+		return err
+	}
 	// Write to the log file unless the log file size is too big, in which case we create a new log file and write to that one
-	// Get the current log file size
-	file_size := Get_file_size(lsps.current_log_file_handle)
-	if file_size > lsps.log_file_max_size { // Rotate the log file
+	if lsps.current_log_file_size > lsps.log_file_max_size || lsps.must_rotate { // Rotate the log file
 		// Create new log file and point to that instead
 		dir_part, cur_log_filename := filepath.Split(lsps.current_log_filepath)
 		file_number, err := LSPS_Parse_log_filename_to_number(cur_log_filename)
-		Check_err(err)
+		if err != nil {
+			return err
+		}
 		file_number++
-		// Remember to close the existing handle before creating a new one
-		err = lsps.current_log_file_handle.Close()
-		Check_err(err)
-		// Check if new file already exists, if so panic
+		// Check that the new file doesn't already exist, since appending to it would mix up two files' records
 		new_file_name := Int64_to_string(file_number) + ".log"
 		new_file_path := filepath.Join(dir_part, new_file_name)
-		_, err = os.Stat(new_file_path)
-		if !errors.Is(err, os.ErrNotExist) { // if it exists, then panic
-			log.Fatal("This shouldn't happen. Log file ", cur_log_filename, " already exists.")
-			panic("This shouldn't happen. Log file already exists.")
+		_, err = lsps.backend.Stat(new_file_path)
+		if err == nil {
+			return fmt.Errorf("Log file %#v already exists, this shouldn't happen: %w", new_file_path, os.ErrExist)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		handle, err := open_segment_for_append(lsps.backend, new_file_path)
+		if err != nil {
+			return err
+		}
+		err = lsps.current_log_file_handle.Close()
+		if err != nil {
+			log.Println("Failed to close log file", lsps.current_log_filepath, "error:", err)
 		}
-		// Otherwise create the file and point the pointers to it
-		fh, err := os.OpenFile(new_file_path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o644) // open in append mode, create if not already exist
-		Check_err(err)
 		lsps.current_log_filepath = new_file_path
-		lsps.current_log_file_handle = fh
+		lsps.current_log_file_size = 0
+		lsps.current_log_file_handle = handle
+		lsps.must_rotate = false
+	}
+	// PutEntry relies on the record being on disk once this returns, which the handle guarantees.
+	err = lsps.current_log_file_handle.Append([]byte(record))
+	if err != nil {
+		// Part of the record may have been written. The next record must not go after it, since the loader can only skip a partial record at the end of a file.
+		truncate_err := lsps.backend.TruncateSegment(lsps.current_log_filepath, lsps.current_log_file_size)
+		if truncate_err != nil {
+			log.Println("Failed to cut partial record off log file", lsps.current_log_filepath, "error:", truncate_err, "- starting a new one")
+			lsps.must_rotate = true
+		}
+		return err
+	}
+	lsps.current_log_file_size += int64(len(record))
+	return nil
+}
+
+// The storage must not be used afterwards.
+func (lsps *LogStructuredPermanentStorage) Close() error {
+	lsps.directory_lock.Lock()
+	defer lsps.directory_lock.Unlock()
+
+	if lsps.closed {
+		return nil
 	}
-	return Write_Entry_To_File(key, value, value_type, generation_time_unix, lsps.current_log_file_handle)
+	lsps.closed = true
+	return lsps.current_log_file_handle.Close()
 }
 
 var g_lsps_log_name_pattern = `^([0-9]+)\.log$`
@@ -0,0 +1,38 @@
+// Everything a load balancer or an operator wants to know about a persistent map in one struct. See web.NewReadinessHandler.
+package util
+
+import "log"
+
+type MapHealth struct {
+	Load_progress     LoadStatus
+	Storage           StorageStatus
+	Num_items         int
+	Remaining_ids     map[int]int   // ID length -> how many unused IDs are left in its RandomBag
+	Log_dir_space     *StorageSpace // nil if the storage backend can't tell
+	Paste_dir_space   *StorageSpace // nil if the storage backend can't tell
+	Last_expiry_sweep int64         // Unix time of the last RemoveAllExpiredURLsFromRAM. 0 if it hasn't run yet or the map never expires anything.
+}
+
+// The map is ready once it has finished loading. A read-only map is still ready since it can serve every GetEntry, check Storage.Writable for writes.
+func (mh MapHealth) Ready() bool {
+	return mh.Load_progress.Done
+}
+
+// Caller must hold the lock that protects slice_map
+func Remaining_IDs_Common(slice_map map[int]*RandomBag64) map[int]int {
+	remaining_ids := make(map[int]int, len(slice_map))
+	for length, bag := range slice_map {
+		remaining_ids[length] = bag.Size()
+	}
+	return remaining_ids
+}
+
+// Doesn't fail: a directory whose free space can't be read is logged and reported as unknown (nil)
+func Disk_Space_For_Health_Common(backend StorageBackend, dir string) *StorageSpace {
+	space, err := Storage_Disk_Space(backend, dir)
+	if err != nil {
+		log.Println("Failed to get disk space for", dir, "error:", err)
+		return nil
+	}
+	return space
+}
@@ -8,52 +8,59 @@ package util
 import (
 	"errors"
 	"log"
-	"os"
 	"sync"
 )
 
 type MapSizeFileManager struct {
 	mut                     sync.Mutex
+	backend                 StorageBackend
 	size_multiple           int64
 	current_rounded_size    int64
 	size_file_path_absolute string
 }
 
 func NewMapSizeFileManager(size_file_path_absolute string, size_multiple int64) *MapSizeFileManager {
+	return NewMapSizeFileManagerWithBackend(nil, size_file_path_absolute, size_multiple)
+}
+
+// Same as NewMapSizeFileManager but the size file is kept in the given backend. nil means the local file system.
+func NewMapSizeFileManagerWithBackend(backend StorageBackend, size_file_path_absolute string, size_multiple int64) *MapSizeFileManager {
+	backend = storage_backend_or_local(backend)
 	// Get current rounded size
 	// Try to open the file
 	// First, create the size file if it doesn't exist
-	// Check if it exists using os.stat
-	_, err := os.Stat(size_file_path_absolute)
+	// Check if it exists using Stat
+	_, err := backend.Stat(size_file_path_absolute)
 	if err != nil {
 		// if it doesn't exist then create it
 		log.Println("Size file doesn't exist, creating it...")
-		f, err := os.OpenFile(size_file_path_absolute, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644) //nolint:govet // ignore err shadow
-		Check_err(err)
 		// set it to the size_growth_amount to begin with.
-		_, err = f.WriteString(Int64_to_string(size_multiple))
-		Check_err(err)
-		// close the file!
-		err = f.Close()
-		Check_err(err)
+		// If this fails then reading it below fails too, which is dealt with there.
+		_ = backend.ReplaceBlob(size_file_path_absolute, []byte(Int64_to_string(size_multiple)))
 	}
 	// Now get the current rounded size
-	current_rounded_size, err := _internal_get_current_rounded_size(size_file_path_absolute, size_multiple)
+	current_rounded_size, err := _internal_get_current_rounded_size(backend, size_file_path_absolute, size_multiple)
 	if err != nil {
-		log.Fatal("Get_current_rounded_size error: ", err)
-		panic(err)
+		// e.g. the disk filled up while the file was being rewritten. The size is only a hint, so start over from the minimum.
+		log.Println("Size file is unreadable, resetting it. Error:", err)
+		current_rounded_size = size_multiple
+		err = backend.ReplaceBlob(size_file_path_absolute, []byte(Int64_to_string(size_multiple)))
+		if err != nil {
+			log.Println("Failed to reset size file:", err)
+		}
 	}
 
 	return &MapSizeFileManager{
+		backend:                 backend,
 		size_multiple:           size_multiple,
 		size_file_path_absolute: size_file_path_absolute,
 		current_rounded_size:    current_rounded_size,
 	}
 }
 
-func _internal_get_current_rounded_size(size_file_path string, size_multiple int64) (int64, error) {
+func _internal_get_current_rounded_size(backend StorageBackend, size_file_path string, size_multiple int64) (int64, error) {
 	// try to open it
-	buf, err := os.ReadFile(size_file_path)
+	buf, err := backend.GetBlob(size_file_path)
 	if err != nil {
 		return -1, err
 	}
@@ -81,15 +88,15 @@ func (msfm *MapSizeFileManager) UpdateMapSizeRounded(actual_size int64) {
 	// Now round it to the nearest size
 	rounded_size := ((number_to_round / msfm.size_multiple) + 1) * msfm.size_multiple
 
-	if rounded_size > msfm.current_rounded_size {
-		msfm.current_rounded_size = rounded_size
-	} else { // do nothing
+	if rounded_size <= msfm.current_rounded_size { // do nothing
 		return
 	}
 	// If updated current_rounded_size, write it into file.
-	err := os.WriteFile(msfm.size_file_path_absolute, []byte(Int64_to_string(msfm.current_rounded_size)), 0644)
+	err := msfm.backend.ReplaceBlob(msfm.size_file_path_absolute, []byte(Int64_to_string(rounded_size)))
 	if err != nil {
-		log.Fatal(err)
-		panic(err)
+		// The size is only a hint, so this isn't worth failing over. Leave current_rounded_size alone so that we try again next time.
+		log.Println("Failed to update size file:", err)
+		return
 	}
+	msfm.current_rounded_size = rounded_size
 }
@@ -0,0 +1,106 @@
+// Parsing is the slow part of loading: every record has to be md5'd, base64 decoded, and have its key and timestamp validated.
+// So worker goroutines parse whole log files at the same time, and the records are handed to a single consumer one file at a time, in the same order as the files were given.
+// The consumer sees exactly what it would have seen reading the files one after another, so whatever it does with the records (e.g. detecting duplicate keys) works the same.
+package util
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"sync"
+)
+
+type ParsedLogSegment struct {
+	Path    string
+	Records []*LogRecord // Every record before Err, in file order
+	Err     error        // nil if the whole file was read. Otherwise the same error that ForEachLogRecordInSegment would have returned.
+}
+
+// Returns runtime.GOMAXPROCS if workers is 0 or less
+func log_parse_workers_or_default(workers int) int {
+	if workers <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return workers
+}
+
+func parse_log_segment(backend StorageBackend, path string, b53m *Base53IDManager, allow_alias_ids bool) *ParsedLogSegment {
+	parsed := ParsedLogSegment{Path: path, Records: nil, Err: nil}
+	f, err := backend.OpenSegment(path)
+	if err != nil {
+		parsed.Err = err
+		return &parsed
+	}
+	defer f.Close()
+
+	lrr := NewLogRecordReader(f, b53m, allow_alias_ids)
+	for {
+		record, err := lrr.Next()
+		if errors.Is(err, io.EOF) {
+			return &parsed
+		}
+		if err != nil {
+			parsed.Err = err
+			return &parsed
+		}
+		parsed.Records = append(parsed.Records, record)
+	}
+}
+
+// Parses the files using the given number of worker goroutines (0 means GOMAXPROCS) and calls fn once per file, in the order of paths, from the calling goroutine.
+// At most 2*workers parsed files are held in memory at once. Stops at the first error returned by fn and returns it.
+func ForEachParsedLogSegment(backend StorageBackend, paths []string, b53m *Base53IDManager, allow_alias_ids bool, workers int,
+	fn func(*ParsedLogSegment) error) error {
+	backend = storage_backend_or_local(backend)
+	workers = log_parse_workers_or_default(workers)
+
+	results := make([]chan *ParsedLogSegment, len(paths))
+	for i := range results {
+		results[i] = make(chan *ParsedLogSegment, 1)
+	}
+	jobs := make(chan int)
+	in_flight := make(chan struct{}, 2*workers) // bounds how far the workers can get ahead of fn
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(done)
+		wg.Wait()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for i := range paths {
+			select {
+			case in_flight <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] <- parse_log_segment(backend, paths[i], b53m, allow_alias_ids) // never blocks, the channel is buffered
+			}
+		}()
+	}
+
+	for i := range paths {
+		parsed := <-results[i]
+		err := fn(parsed)
+		<-in_flight
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
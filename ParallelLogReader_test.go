@@ -0,0 +1,164 @@
+package util_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/1f604/util"
+)
+
+// Writes num_files log files named 1.log, 2.log, ... with records_per_file URL entries each, using consecutive Base53 IDs of the given length.
+func write_benchmark_log_files(tb testing.TB, backend util.StorageBackend, dir string, num_files int, records_per_file int, id_length int) {
+	tb.Helper()
+
+	b53m := util.NewBase53IDManager()
+	err := backend.MkdirAll(dir)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var id util.Base53ID
+	id, err = b53m.NewBase53ID(strings.Repeat("0", id_length-1), '0', false)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for f := 1; f <= num_files; f++ {
+		var sb strings.Builder
+		for r := 0; r < records_per_file; r++ {
+			line, err := util.Format_Log_Record(id.GetCombinedString(), "https://example.com/"+util.Int64_to_string(int64(r)), util.TYPE_MAP_ITEM_URL.ToString(), 1700000000)
+			if err != nil {
+				tb.Fatal(err)
+			}
+			sb.WriteString(line)
+			id, err = b53m.B53_generate_next_Base53ID(id)
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+		err = backend.AppendToSegment(filepath.Join(dir, fmt.Sprintf("%d.log", f)), []byte(sb.String()))
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+func Test_ForEachParsedLogSegment_Keeps_File_Order(t *testing.T) {
+	t.Parallel()
+
+	backend := util.NewMemoryStorageBackend()
+	write_benchmark_log_files(t, backend, "/logs", 20, 50, 5)
+	// Cut the last file off in the middle of a record
+	last := "/logs/20.log"
+	info, err := backend.Stat(last)
+	util.Assert_no_error(t, err, 1)
+	err = backend.TruncateSegment(last, info.Size-3)
+	util.Assert_no_error(t, err, 1)
+
+	paths, err := util.List_Log_Segments(backend, "/logs", util.NewLogStructuredPermanentStorageWithBackend(backend, 1<<20, "/logs"))
+	util.Assert_no_error(t, err, 1)
+	b53m := util.NewBase53IDManager()
+
+	expected := []string{}
+	for _, path := range paths {
+		err = util.ForEachLogRecordInSegment(backend, path, b53m, false, func(record *util.LogRecord) error {
+			expected = append(expected, path+" "+record.Key)
+			return nil
+		})
+		if err != nil {
+			expected = append(expected, path+" "+err.Error())
+		}
+	}
+
+	got := []string{}
+	truncated_files := 0
+	err = util.ForEachParsedLogSegment(backend, paths, b53m, false, 4, func(parsed *util.ParsedLogSegment) error {
+		for _, record := range parsed.Records {
+			got = append(got, parsed.Path+" "+record.Key)
+		}
+		if parsed.Err != nil {
+			got = append(got, parsed.Path+" "+parsed.Err.Error())
+		}
+		var truncated_err util.LogFileTruncatedError
+		if errors.As(parsed.Err, &truncated_err) {
+			truncated_files++
+		}
+		return nil
+	})
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_string_slice(t, got, nil, expected, 1)
+	util.Assert_result_equals_interface(t, truncated_files, nil, 1, 1)
+
+	// Stops at the first error from fn
+	calls := 0
+	err = util.ForEachParsedLogSegment(backend, paths, b53m, false, 4, func(parsed *util.ParsedLogSegment) error {
+		calls++
+		if calls == 3 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	util.Assert_error_equals(t, err, "stop", 1)
+	util.Assert_result_equals_interface(t, calls, nil, 3, 1)
+}
+
+var benchmark_log_datasets sync.Map // number of records -> *util.MemoryStorageBackend
+
+func benchmark_load_stored_records(b *testing.B, num_records int, workers int) {
+	b.Helper()
+
+	const records_per_file = 100000
+	backend_any, ok := benchmark_log_datasets.Load(num_records)
+	if !ok {
+		backend := util.NewMemoryStorageBackend()
+		write_benchmark_log_files(b, backend, "/logs", num_records/records_per_file, records_per_file, 6)
+		backend_any, _ = benchmark_log_datasets.LoadOrStore(num_records, backend)
+	}
+	backend := backend_any.(*util.MemoryStorageBackend) //nolint:forcetypeassert // it's a test
+	b53m := util.NewBase53IDManager()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var nil_map_ptr *util.ConcurrentPermanentMap = nil
+		params := util.LSRFD_Params{
+			B53m:                        b53m,
+			Log_directory_path_absolute: "/logs",
+			Size_file_path_absolute:     "/size.txt",
+			Lss:                         util.NewLogStructuredPermanentStorageWithBackend(backend, 1<<30, "/logs"),
+			Slice_storage:               make(map[int]*util.RandomBag64),
+			Nil_ptr:                     nil_map_ptr,
+			Size_file_rounded_multiple:  1000000,
+			Generate_strings_up_to:      2,
+			Storage_backend:             backend,
+			Log_parse_workers:           workers,
+		}
+		concurrent_map, _ := util.LoadStoredRecordsFromDisk(&params)
+		if concurrent_map.NumItems() != num_records {
+			b.Fatal("Expected", num_records, "items, got", concurrent_map.NumItems())
+		}
+	}
+}
+
+// go test -run XXX -bench LoadStoredRecords -benchtime 3x
+func Benchmark_LoadStoredRecords_1M_Sequential(b *testing.B) {
+	benchmark_load_stored_records(b, 1000000, 1)
+}
+func Benchmark_LoadStoredRecords_1M_Parallel(b *testing.B) {
+	benchmark_load_stored_records(b, 1000000, 0)
+}
+
+// These need several GB of RAM
+func Benchmark_LoadStoredRecords_10M_Sequential(b *testing.B) {
+	if testing.Short() {
+		b.Skip("Skipping 10M record benchmark in short mode")
+	}
+	benchmark_load_stored_records(b, 10000000, 1)
+}
+
+func Benchmark_LoadStoredRecords_10M_Parallel(b *testing.B) {
+	if testing.Short() {
+		b.Skip("Skipping 10M record benchmark in short mode")
+	}
+	benchmark_load_stored_records(b, 10000000, 0)
+}
@@ -0,0 +1,386 @@
+// At-rest encryption for paste files. Nothing leaves the server: the keys are just bytes that you load however you like.
+// There are two ways to encrypt a paste, and they can be combined:
+//  1. With a server key. Set Paste_keyring in CEPUMParams or CPPUMParams and every new paste is encrypted with the keyring's current key.
+//  2. With a passphrase, for password-protected pastes. Seal the contents with Seal_Paste_With_Passphrase before putting them.
+//     The server never sees the passphrase again until someone wants to read the paste, so it doesn't need a key at all for these.
+//
+// Either way each paste gets its own key, derived from the server key (HKDF-SHA256) or the passphrase (Argon2id) with a random salt,
+// and is encrypted with XChaCha20-Poly1305. The header at the start of the file holds everything needed to decrypt it apart from the key itself:
+//
+//	magic (5 bytes) | version | mode | key ID length | key ID | salt (16 bytes) | nonce (24 bytes) | ciphertext
+//
+// The whole header is authenticated, so changing the key ID or the mode makes decryption fail.
+// The header stays in the file so that backups, replication and imports, which copy paste files as they are,
+// can never separate a paste from what's needed to decrypt it. Not every storage backend has xattrs either.
+// The same metadata (mode, key ID, KDF and its parameters, salt and nonce) also goes in the entry's metadata in the log, as a paste_encryption record
+// just before the entry record, so that fsck, exports, backups and anything else reading the log can tell an encrypted paste from a plain one without opening it.
+// That record is only a copy: decryption always uses the header, so the two can't disagree about how to decrypt a paste.
+// It describes the outer layer only. A passphrase layer inside a server key layer can't be seen without the server key, so it shows up as a server key paste.
+// Files without the header are plaintext, e.g. pastes written before encryption was turned on, and are returned as they are.
+// The key ID is what lets you rotate keys: add a new key, make it current, and keep the old one around until the pastes that use it have expired.
+//
+// The file name of a paste includes part of a hash of what's in the file, which is the ciphertext here, so it doesn't give anything away.
+// Deduplication can't see through the encryption, so encrypted pastes are never deduplicated.
+//
+// Each passphrase derivation uses 64 MiB of RAM, so only PASTE_MAX_CONCURRENT_PASSPHRASE_DERIVATIONS run at once and the rest wait their turn.
+// Otherwise a burst of requests for password-protected pastes could run the server out of memory.
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	PASTE_KEY_SIZE_BYTES                        = chacha20poly1305.KeySize
+	PASTE_MAX_CONCURRENT_PASSPHRASE_DERIVATIONS = 4
+
+	paste_envelope_magic        = "\x00PENC"
+	paste_envelope_version      = 1
+	paste_envelope_salt_size    = 16
+	paste_envelope_mode_server  = 's'
+	paste_envelope_mode_phrase  = 'p'
+	paste_key_derivation_info   = "github.com/1f604/util paste v1"
+	paste_max_key_id_length     = 255
+	paste_argon2_time           = 3
+	paste_argon2_memory_kib     = 64 * 1024
+	paste_argon2_threads        = 4
+	paste_envelope_fixed_header = len(paste_envelope_magic) + 3 // version, mode, key ID length
+)
+
+// Returned when the paste is password-protected and no passphrase was given
+type PastePassphraseRequiredError struct{}
+
+func (e PastePassphraseRequiredError) Error() string {
+	return "This paste is password-protected"
+}
+
+// Returned when the passphrase is wrong, or the file has been corrupted or tampered with. There's no way to tell which.
+type PasteDecryptionError struct{}
+
+func (e PasteDecryptionError) Error() string {
+	return "Failed to decrypt paste: wrong passphrase, or the file is corrupted"
+}
+
+// Returned when the paste was encrypted with a server key that isn't in the keyring
+type UnknownPasteKeyError struct {
+	Key_id string
+}
+
+func (e UnknownPasteKeyError) Error() string {
+	return fmt.Sprintf("Paste was encrypted with key %#v, which is not in the keyring", e.Key_id)
+}
+
+type PasteKeyring struct {
+	current_key_id string
+	keys           map[string][]byte // key ID -> PASTE_KEY_SIZE_BYTES random bytes
+}
+
+// New pastes are encrypted with the key called current_key_id. The other keys are only used to decrypt older pastes.
+// Every key must be PASTE_KEY_SIZE_BYTES long and should come from a CSPRNG, e.g. head -c 32 /dev/urandom.
+func NewPasteKeyring(current_key_id string, keys map[string][]byte) (*PasteKeyring, error) {
+	if _, ok := keys[current_key_id]; !ok {
+		return nil, fmt.Errorf("The current key %#v is not in the keyring", current_key_id)
+	}
+	copied := make(map[string][]byte, len(keys))
+	for key_id, key := range keys {
+		if key_id == "" || len(key_id) > paste_max_key_id_length {
+			return nil, fmt.Errorf("Key ID %#v must be between 1 and %d bytes long", key_id, paste_max_key_id_length)
+		}
+		if len(key) != PASTE_KEY_SIZE_BYTES {
+			return nil, fmt.Errorf("Key %#v is %d bytes long, expected %d", key_id, len(key), PASTE_KEY_SIZE_BYTES)
+		}
+		copied[key_id] = bytes.Clone(key)
+	}
+	return &PasteKeyring{
+		current_key_id: current_key_id,
+		keys:           copied,
+	}, nil
+}
+
+// Encrypts the paste with the keyring's current key. A nil keyring returns the contents as they are.
+func (pk *PasteKeyring) Seal(plaintext []byte) ([]byte, error) {
+	if pk == nil {
+		return plaintext, nil
+	}
+	return seal_paste(paste_envelope_mode_server, pk.current_key_id, plaintext, func(salt []byte) ([]byte, error) {
+		return derive_paste_key_from_server_key(pk.keys[pk.current_key_id], salt)
+	})
+}
+
+// Encrypts the paste with a key derived from the passphrase. Put the result in the map instead of the plaintext.
+func Seal_Paste_With_Passphrase(plaintext []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("Passphrase must not be empty")
+	}
+	return seal_paste(paste_envelope_mode_phrase, "", plaintext, func(salt []byte) ([]byte, error) {
+		return derive_paste_key_from_passphrase(passphrase, salt), nil
+	})
+}
+
+// Whether the contents are sealed with a passphrase, possibly inside a server key layer.
+// The keyring is only needed to look inside the server key layer and can be nil otherwise.
+func Paste_Needs_Passphrase(contents []byte, keyring *PasteKeyring) (bool, error) {
+	_, err := Open_Paste(contents, keyring, "")
+	if errors.As(err, &PastePassphraseRequiredError{}) {
+		return true, nil
+	}
+	return false, err
+}
+
+// Decrypts a paste file. Plaintext files are returned as they are.
+// A server key layer is removed with the keyring, and a passphrase layer (on its own or inside a server key layer) with the passphrase.
+// Nothing inside a passphrase layer is touched, since that's whatever the user put in.
+func Open_Paste(contents []byte, keyring *PasteKeyring, passphrase string) ([]byte, error) {
+	header, ok := parse_paste_envelope(contents)
+	if !ok {
+		return contents, nil
+	}
+	if header.mode == paste_envelope_mode_server {
+		if keyring == nil {
+			return nil, UnknownPasteKeyError{Key_id: header.key_id}
+		}
+		server_key, ok := keyring.keys[header.key_id]
+		if !ok {
+			return nil, UnknownPasteKeyError{Key_id: header.key_id}
+		}
+		paste_key, err := derive_paste_key_from_server_key(server_key, header.salt)
+		if err != nil {
+			return nil, err
+		}
+		contents, err = open_paste_envelope(contents, header, paste_key)
+		if err != nil {
+			return nil, err
+		}
+		header, ok = parse_paste_envelope(contents)
+		if !ok || header.mode != paste_envelope_mode_phrase {
+			return contents, nil
+		}
+	}
+	if passphrase == "" {
+		return nil, PastePassphraseRequiredError{}
+	}
+	return open_paste_envelope(contents, header, derive_paste_key_from_passphrase(passphrase, header.salt))
+}
+
+// How a paste is encrypted, as stored in a LOG_RECORD_TYPE_PASTE_ENCRYPTION record
+type PasteEncryptionInfo struct {
+	Passphrase bool   // sealed with a passphrase rather than a server key
+	Key_id     string // the server key it was sealed with. Empty for passphrases.
+	Kdf        string // how the paste key was derived, with its parameters
+	Salt       []byte
+	Nonce      []byte
+}
+
+const (
+	paste_kdf_server_key = "hkdf-sha256"
+	paste_info_fields    = 5
+)
+
+var g_paste_kdf_passphrase = fmt.Sprintf("argon2id-t%d-m%d-p%d", paste_argon2_time, paste_argon2_memory_kib, paste_argon2_threads)
+
+// Returns false if the contents aren't encrypted
+func Paste_Encryption_Info(contents []byte) (*PasteEncryptionInfo, bool) {
+	header, ok := parse_paste_envelope(contents)
+	if !ok {
+		return nil, false
+	}
+	info := &PasteEncryptionInfo{
+		Passphrase: header.mode == paste_envelope_mode_phrase,
+		Key_id:     header.key_id,
+		Kdf:        paste_kdf_server_key,
+		Salt:       bytes.Clone(header.salt),
+		Nonce:      bytes.Clone(header.nonce),
+	}
+	if info.Passphrase {
+		info.Kdf = g_paste_kdf_passphrase
+	}
+	return info, true
+}
+
+// The value of the log record: mode, hex key ID, KDF, hex salt and hex nonce, separated by spaces. Key IDs can be any bytes, hence the hex.
+func (info *PasteEncryptionInfo) String() string {
+	mode := "server"
+	if info.Passphrase {
+		mode = "passphrase"
+	}
+	return strings.Join([]string{mode, hex.EncodeToString([]byte(info.Key_id)), info.Kdf, hex.EncodeToString(info.Salt), hex.EncodeToString(info.Nonce)}, " ")
+}
+
+func Parse_Paste_Encryption_Info(value string) (*PasteEncryptionInfo, error) {
+	fields := strings.Split(value, " ")
+	if len(fields) != paste_info_fields || (fields[0] != "server" && fields[0] != "passphrase") {
+		return nil, fmt.Errorf("Invalid paste encryption info %#v", value)
+	}
+	key_id, err := hex.DecodeString(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid key ID in paste encryption info: %w", err)
+	}
+	salt, err := hex.DecodeString(fields[3])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid salt in paste encryption info: %w", err)
+	}
+	nonce, err := hex.DecodeString(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nonce in paste encryption info: %w", err)
+	}
+	return &PasteEncryptionInfo{
+		Passphrase: fields[0] == "passphrase",
+		Key_id:     string(key_id),
+		Kdf:        fields[2],
+		Salt:       salt,
+		Nonce:      nonce,
+	}, nil
+}
+
+// Writes a paste encryption record before the entry record. It can go anywhere among the other chained records, since everything that reads the log skips it.
+type paste_encryption_log_storage struct {
+	LogStorage
+	info *PasteEncryptionInfo
+}
+
+func (s paste_encryption_log_storage) AppendNewEntry(key string, value string, value_type MapItemValueType, timestamp int64) error {
+	err := s.LogStorage.AppendNewRecord(key, s.info.String(), LOG_RECORD_TYPE_PASTE_ENCRYPTION, timestamp)
+	if err != nil {
+		return err
+	}
+	return s.LogStorage.AppendNewEntry(key, value, value_type, timestamp)
+}
+
+// Wraps log_storage so that the entry's metadata says how the paste is encrypted, if it is
+func with_paste_encryption_info(log_storage LogStorage, contents []byte, value_type MapItemValueType) LogStorage { //nolint:ireturn // it's one of the wrappers
+	if value_type != TYPE_MAP_ITEM_PASTE {
+		return log_storage
+	}
+	info, ok := Paste_Encryption_Info(contents)
+	if !ok {
+		return log_storage
+	}
+	return paste_encryption_log_storage{LogStorage: log_storage, info: info}
+}
+
+type paste_envelope_header struct {
+	mode   byte
+	key_id string
+	salt   []byte
+	nonce  []byte
+	length int // of the whole header, which is also the additional data
+}
+
+func derive_paste_key_from_server_key(server_key []byte, salt []byte) ([]byte, error) {
+	paste_key := make([]byte, PASTE_KEY_SIZE_BYTES)
+	_, err := io.ReadFull(hkdf.New(sha256.New, server_key, salt, []byte(paste_key_derivation_info)), paste_key)
+	return paste_key, err
+}
+
+var g_paste_passphrase_derivation_slots = make(chan struct{}, PASTE_MAX_CONCURRENT_PASSPHRASE_DERIVATIONS)
+
+// The Argon2 parameters are fixed by the version, so that a crafted header can't make the server use lots of memory
+func derive_paste_key_from_passphrase(passphrase string, salt []byte) []byte {
+	g_paste_passphrase_derivation_slots <- struct{}{}
+	defer func() { <-g_paste_passphrase_derivation_slots }()
+
+	return argon2.IDKey([]byte(passphrase), salt, paste_argon2_time, paste_argon2_memory_kib, paste_argon2_threads, PASTE_KEY_SIZE_BYTES)
+}
+
+func seal_paste(mode byte, key_id string, plaintext []byte, derive_key func(salt []byte) ([]byte, error)) ([]byte, error) {
+	salt := make([]byte, paste_envelope_salt_size)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	paste_key, err := derive_key(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(paste_key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, paste_envelope_fixed_header+len(key_id)+len(salt)+len(nonce))
+	header = append(header, paste_envelope_magic...)
+	header = append(header, paste_envelope_version, mode, byte(len(key_id)))
+	header = append(header, key_id...)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+	sealed := make([]byte, len(header), len(header)+len(plaintext)+aead.Overhead())
+	copy(sealed, header)
+	return aead.Seal(sealed, nonce, plaintext, header), nil
+}
+
+func parse_paste_envelope(contents []byte) (*paste_envelope_header, bool) {
+	if len(contents) < paste_envelope_fixed_header || string(contents[:len(paste_envelope_magic)]) != paste_envelope_magic {
+		return nil, false
+	}
+	version := contents[len(paste_envelope_magic)]
+	mode := contents[len(paste_envelope_magic)+1]
+	key_id_length := int(contents[len(paste_envelope_magic)+2])
+	if version != paste_envelope_version || (mode != paste_envelope_mode_server && mode != paste_envelope_mode_phrase) {
+		return nil, false
+	}
+	length := paste_envelope_fixed_header + key_id_length + paste_envelope_salt_size + chacha20poly1305.NonceSizeX
+	if len(contents) < length {
+		return nil, false
+	}
+	rest := contents[paste_envelope_fixed_header:length]
+	return &paste_envelope_header{
+		mode:   mode,
+		key_id: string(rest[:key_id_length]),
+		salt:   rest[key_id_length : key_id_length+paste_envelope_salt_size],
+		nonce:  rest[key_id_length+paste_envelope_salt_size:],
+		length: length,
+	}, true
+}
+
+func open_paste_envelope(contents []byte, header *paste_envelope_header, paste_key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(paste_key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, header.nonce, contents[header.length:], contents[:header.length])
+	if err != nil {
+		return nil, PasteDecryptionError{}
+	}
+	return plaintext, nil
+}
+
+// Encrypts long_url with the keyring if it's a paste. Used by the put functions of the persistent maps, but not by replication, backups or imports,
+// which copy paste files that are already encrypted.
+func Seal_Paste_Common(keyring *PasteKeyring, long_url string, value_type MapItemValueType) (string, error) {
+	if keyring == nil || value_type != TYPE_MAP_ITEM_PASTE {
+		return long_url, nil
+	}
+	sealed, err := keyring.Seal([]byte(long_url))
+	if err != nil {
+		return "", err
+	}
+	return string(sealed), nil
+}
+
+// Reads the paste file that the item points to and decrypts it. passphrase is only needed for password-protected pastes.
+func ReadPaste_Common(backend StorageBackend, keyring *PasteKeyring, item MapItem, passphrase string) ([]byte, error) {
+	if item.GetType().ValueType != TYPE_MAP_ITEM_PASTE {
+		return nil, errors.New("Not a paste")
+	}
+	contents, err := storage_backend_or_local(backend).GetBlob(item.GetValue())
+	if err != nil {
+		return nil, err
+	}
+	return Open_Paste(contents, keyring, passphrase)
+}
@@ -0,0 +1,205 @@
+package util_test
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func new_test_paste_keyring(t *testing.T, current_key_id string) *util.PasteKeyring {
+	t.Helper()
+
+	keyring, err := util.NewPasteKeyring(current_key_id, map[string][]byte{
+		"old": bytes.Repeat([]byte{1}, util.PASTE_KEY_SIZE_BYTES),
+		"new": bytes.Repeat([]byte{2}, util.PASTE_KEY_SIZE_BYTES),
+	})
+	util.Assert_no_error(t, err, 1)
+	return keyring
+}
+
+func Test_Paste_Keyring_Rotation(t *testing.T) {
+	t.Parallel()
+
+	plaintext := []byte("secret paste")
+	sealed, err := new_test_paste_keyring(t, "old").Seal(plaintext)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_bool(t, bytes.Contains(sealed, plaintext), nil, false, 1)
+
+	// Still readable after the current key changes
+	opened, err := util.Open_Paste(sealed, new_test_paste_keyring(t, "new"), "")
+	util.Assert_result_equals_bytes(t, opened, err, string(plaintext), 1)
+
+	// but not without the key
+	_, err = util.Open_Paste(sealed, nil, "")
+	util.Assert_error_equals(t, err, util.UnknownPasteKeyError{Key_id: "old"}.Error(), 1)
+
+	// Tampering is detected
+	sealed[len(sealed)-1] ^= 1
+	_, err = util.Open_Paste(sealed, new_test_paste_keyring(t, "new"), "")
+	util.Assert_error_equals(t, err, util.PasteDecryptionError{}.Error(), 1)
+
+	// Plaintext is returned as it is
+	opened, err = util.Open_Paste(plaintext, nil, "")
+	util.Assert_result_equals_bytes(t, opened, err, string(plaintext), 1)
+
+	_, err = util.NewPasteKeyring("missing", map[string][]byte{})
+	util.Assert_error_equals(t, err, `The current key "missing" is not in the keyring`, 1)
+	_, err = util.NewPasteKeyring("short", map[string][]byte{"short": {1, 2, 3}})
+	util.Assert_error_equals(t, err, `Key "short" is 3 bytes long, expected 32`, 1)
+}
+
+func Test_Paste_Passphrase(t *testing.T) {
+	t.Parallel()
+
+	plaintext := []byte("password-protected paste")
+	sealed, err := util.Seal_Paste_With_Passphrase(plaintext, "hunter2")
+	util.Assert_no_error(t, err, 1)
+	// The server key layer goes around the passphrase layer
+	keyring := new_test_paste_keyring(t, "new")
+	double_sealed, err := keyring.Seal(sealed)
+	util.Assert_no_error(t, err, 1)
+
+	for _, contents := range [][]byte{sealed, double_sealed} {
+		needs_passphrase, err := util.Paste_Needs_Passphrase(contents, keyring)
+		util.Assert_result_equals_bool(t, needs_passphrase, err, true, 1)
+		_, err = util.Open_Paste(contents, keyring, "")
+		util.Assert_error_equals(t, err, util.PastePassphraseRequiredError{}.Error(), 1)
+		_, err = util.Open_Paste(contents, keyring, "wrong")
+		util.Assert_error_equals(t, err, util.PasteDecryptionError{}.Error(), 1)
+		opened, err := util.Open_Paste(contents, keyring, "hunter2")
+		util.Assert_result_equals_bytes(t, opened, err, string(plaintext), 1)
+	}
+	// What's inside a passphrase layer is left alone, even if it looks encrypted
+	nested, err := util.Seal_Paste_With_Passphrase(sealed, "outer")
+	util.Assert_no_error(t, err, 1)
+	opened, err := util.Open_Paste(nested, nil, "outer")
+	util.Assert_result_equals_bytes(t, opened, err, string(sealed), 1)
+}
+
+// More requests than there are derivation slots just have to wait their turn
+func Test_Paste_Passphrase_Concurrent_Opens(t *testing.T) {
+	t.Parallel()
+
+	sealed, err := util.Seal_Paste_With_Passphrase([]byte("secret paste"), "hunter2")
+	util.Assert_no_error(t, err, 1)
+	var wg sync.WaitGroup
+	errs := make(chan error, util.PASTE_MAX_CONCURRENT_PASSPHRASE_DERIVATIONS+1)
+	for i := 0; i < util.PASTE_MAX_CONCURRENT_PASSPHRASE_DERIVATIONS+1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := util.Open_Paste(sealed, nil, "hunter2")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		util.Assert_no_error(t, err, 1)
+	}
+}
+
+func Test_CEPUM_Encrypted_Pastes(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	keyring := new_test_paste_keyring(t, "new")
+	with_keyring := func(p *util.CEPUMParams) { p.Paste_keyring = keyring }
+	cepum := h.StartCEPUM(with_keyring)
+	key, err := cepum.PutEntry(2, "at rest", h.Clock.Now()+100, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	protected, err := util.Seal_Paste_With_Passphrase([]byte("protected"), "hunter2")
+	util.Assert_no_error(t, err, 1)
+	protected_key, err := cepum.PutEntry(2, string(protected), h.Clock.Now()+100, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+
+	// Nothing readable on disk
+	for _, path := range h.PasteFiles() {
+		contents, err := h.Backend.GetBlob(path)
+		util.Assert_no_error(t, err, 1)
+		util.Assert_result_equals_bool(t, bytes.Contains(contents, []byte("at rest")), nil, false, 1)
+		util.Assert_result_equals_bool(t, bytes.Contains(contents, []byte("protected")), nil, false, 1)
+	}
+
+	cepum = h.StartCEPUM(with_keyring)
+	item, err := cepum.GetEntry(key)
+	util.Assert_no_error(t, err, 1)
+	contents, err := cepum.ReadPaste(item, "")
+	util.Assert_result_equals_bytes(t, contents, err, "at rest", 1)
+	item, err = cepum.GetEntry(protected_key)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.ReadPaste(item, "")
+	util.Assert_error_equals(t, err, util.PastePassphraseRequiredError{}.Error(), 1)
+	contents, err = cepum.ReadPaste(item, "hunter2")
+	util.Assert_result_equals_bytes(t, contents, err, "protected", 1)
+}
+
+func Test_CEPUM_Encrypted_Paste_Metadata(t *testing.T) {
+	t.Parallel()
+
+	// Fsck compares expiry times against the real clock
+	h := urlmaptest.NewOnDisk(t)
+	h.Clock.Set(time.Now().Unix())
+	with_keyring := func(p *util.CEPUMParams) { p.Paste_keyring = new_test_paste_keyring(t, "new") }
+	cepum := h.StartCEPUM(with_keyring)
+	paste_key, err := cepum.PutEntryWithMaxHits(2, "secret paste", h.Clock.Now()+1000, util.TYPE_MAP_ITEM_PASTE, 2)
+	util.Assert_no_error(t, err, 1)
+	url_key, err := cepum.PutEntry(2, "google.com", h.Clock.Now()+1000, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	item, err := cepum.GetEntry(paste_key)
+	util.Assert_no_error(t, err, 1)
+	contents, err := os.ReadFile(item.GetValue())
+	util.Assert_no_error(t, err, 1)
+
+	// The log says how the paste is encrypted without anyone having to open it, and says nothing about the URL
+	infos := map[string]*util.PasteEncryptionInfo{}
+	for _, log_file := range h.LogFiles() {
+		err = util.ForEachLogRecordInFile(log_file, h.B53m, false, func(record *util.LogRecord) error {
+			if record.Type == util.LOG_RECORD_TYPE_PASTE_ENCRYPTION {
+				infos[record.Key], err = util.Parse_Paste_Encryption_Info(record.Value)
+				return err
+			}
+			return nil
+		})
+		util.Assert_no_error(t, err, 1)
+	}
+	expected, ok := util.Paste_Encryption_Info(contents)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+	util.Assert_result_equals_interface(t, infos[paste_key].String(), nil, expected.String(), 1)
+	util.Assert_result_equals_interface(t, infos[paste_key].Key_id, nil, "new", 1)
+	util.Assert_result_equals_interface(t, infos[paste_key].Kdf, nil, "hkdf-sha256", 1)
+	_, ok = infos[url_key]
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	report, err := util.Fsck(&util.FsckParams{ //nolint:exhaustruct // no repair
+		Log_directory_path_absolute:   h.LogDir(),
+		Paste_directory_path_absolute: h.PasteDir(),
+		Expiring:                      true,
+		B53m:                          h.B53m,
+	})
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Encrypted_pastes, nil, 1, 1)
+	util.Assert_result_equals_interface(t, len(report.Problems), nil, 0, 1)
+
+	// The record sits among the max hits records, which still work after a restart
+	cepum = h.StartCEPUM(with_keyring)
+	item, err = cepum.GetEntry(paste_key)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.GetEntry(paste_key)
+	util.Assert_error_equals(t, err, util.KeyExpiredError{}.Error(), 1)
+
+	// Passphrase pastes say which KDF parameters they were sealed with
+	sealed, err := util.Seal_Paste_With_Passphrase([]byte("secret paste"), "hunter2")
+	util.Assert_no_error(t, err, 1)
+	info, ok := util.Paste_Encryption_Info(sealed)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+	parsed, err := util.Parse_Paste_Encryption_Info(info.String())
+	util.Assert_result_equals_interface(t, parsed.String(), err, info.String(), 1)
+	util.Assert_result_equals_interface(t, parsed.Kdf, nil, "argon2id-t3-m65536-p4", 1)
+	_, ok = util.Paste_Encryption_Info([]byte("secret paste"))
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+}
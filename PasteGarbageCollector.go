@@ -0,0 +1,93 @@
+// Finds paste files that no map entry refers to, and optionally deletes them.
+// These are left behind when deleting an expired or rolled back paste fails, or by logs written before pastes had intent records.
+// Files younger than the grace period are never touched, since PutEntry writes the paste file before it puts the entry into the map.
+package util
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// The periodic paste GC only looks at the map once, before it scans the directory, so a paste that's written in between looks like an orphan
+// until its entry is in the map. The grace period has to be long enough to cover that.
+const PASTE_GC_MIN_GRACE_PERIOD_SECONDS = 60
+
+type PasteGCReport struct {
+	Files_scanned int
+	Orphans       []string // absolute paths
+	Deleted       int
+}
+
+// is_referenced is called with the absolute path of each file in the paste directory.
+// If delete_orphans is false, orphans are only reported.
+func CollectOrphanedPastes(paste_directory_path_absolute string, is_referenced func(string) bool, grace_period_seconds int64, delete_orphans bool) (*PasteGCReport, error) {
+	return CollectOrphanedPastesInBackend(nil, paste_directory_path_absolute, is_referenced, grace_period_seconds, delete_orphans)
+}
+
+// Same as CollectOrphanedPastes but for a paste directory in the given backend. nil means the local file system.
+func CollectOrphanedPastesInBackend(backend StorageBackend, paste_directory_path_absolute string, is_referenced func(string) bool, grace_period_seconds int64,
+	delete_orphans bool) (*PasteGCReport, error) {
+	backend = storage_backend_or_local(backend)
+	names, err := backend.ListSegments(paste_directory_path_absolute)
+	if err != nil {
+		return nil, err
+	}
+	report := PasteGCReport{}
+	cutoff := time.Now().Add(-time.Duration(grace_period_seconds) * time.Second)
+	for _, name := range names {
+		report.Files_scanned++
+		absfilepath := filepath.Join(paste_directory_path_absolute, name)
+		if is_referenced(absfilepath) {
+			continue
+		}
+		info, err := backend.Stat(absfilepath)
+		if err != nil {
+			// Deleted since we listed the directory
+			continue
+		}
+		if info.Mod_time.After(cutoff) {
+			// Might be a paste that's being written right now
+			continue
+		}
+		report.Orphans = append(report.Orphans, absfilepath)
+		if delete_orphans {
+			err = backend.Delete(absfilepath)
+			if err != nil {
+				log.Println("Failed to delete orphaned paste file:", absfilepath, "error:", err)
+				continue
+			}
+			report.Deleted++
+		}
+	}
+	return &report, nil
+}
+
+// Takes a snapshot of the paste paths in the map first, then scans the directory without holding any lock.
+// A paste written after the snapshot is younger than the grace period, so it won't be mistaken for an orphan, as long as the grace period isn't tiny.
+// validate_paste_gc_params makes sure of that for the periodic GC.
+func collect_orphaned_pastes_for_map(backend StorageBackend, paste_paths_fn func() map[string]bool, paste_directory_path_absolute string, grace_period_seconds int64,
+	delete_orphans bool) (*PasteGCReport, error) {
+	referenced := paste_paths_fn()
+	return CollectOrphanedPastesInBackend(backend, paste_directory_path_absolute, func(absfilepath string) bool {
+		return referenced[absfilepath]
+	}, grace_period_seconds, delete_orphans)
+}
+
+// Exits if the periodic paste GC is turned on with a grace period that's too short to be safe.
+func validate_paste_gc_params(interval_seconds int, grace_period_seconds int64) {
+	if interval_seconds > 0 && grace_period_seconds < PASTE_GC_MIN_GRACE_PERIOD_SECONDS {
+		log.Fatal("Paste GC grace period must be at least ", PASTE_GC_MIN_GRACE_PERIOD_SECONDS, " seconds when the periodic paste GC is enabled, got: ", grace_period_seconds)
+		panic("Invalid config")
+	}
+}
+
+func log_paste_gc_report(report *PasteGCReport, err error) {
+	if err != nil {
+		log.Println("Paste garbage collection failed:", err)
+		return
+	}
+	if len(report.Orphans) > 0 {
+		log.Println("Paste garbage collection: scanned", report.Files_scanned, "files, found", len(report.Orphans), "orphans, deleted", report.Deleted)
+	}
+}
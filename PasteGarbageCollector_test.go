@@ -0,0 +1,47 @@
+package util_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/1f604/util"
+)
+
+func Test_CPPUM_CollectOrphanedPastes(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	cppum := new_test_cppum(t, dir, false)
+	key, err := cppum.PutEntry(4, "live paste", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	val, err := cppum.GetEntry(key)
+	util.Assert_no_error(t, err, 1)
+	// Make the live paste old too, so that only the reference check keeps it alive
+	old_time := time.Now().Add(-time.Hour)
+	util.Assert_no_error(t, os.Chtimes(val.GetValue(), old_time, old_time), 1)
+
+	old_orphan := filepath.Join(dir, "pastes", "old_orphan")
+	util.Assert_no_error(t, os.WriteFile(old_orphan, []byte("x"), 0o644), 1)
+	util.Assert_no_error(t, os.Chtimes(old_orphan, old_time, old_time), 1)
+	new_orphan := filepath.Join(dir, "pastes", "new_orphan")
+	util.Assert_no_error(t, os.WriteFile(new_orphan, []byte("x"), 0o644), 1)
+
+	// Report only
+	report, err := cppum.CollectOrphanedPastes(60, false)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_string_slice(t, report.Orphans, nil, []string{old_orphan}, 1)
+	util.Assert_result_equals_interface(t, report.Files_scanned, nil, 3, 1)
+	util.Assert_result_equals_interface(t, report.Deleted, nil, 0, 1)
+
+	report, err = cppum.CollectOrphanedPastes(60, true)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, report.Deleted, nil, 1, 1)
+	_, err = os.Stat(old_orphan)
+	util.Assert_result_equals_bool(t, os.IsNotExist(err), nil, true, 1)
+	_, err = os.Stat(new_orphan)
+	util.Assert_no_error(t, err, 1)
+	_, err = os.Stat(val.GetValue())
+	util.Assert_no_error(t, err, 1)
+}
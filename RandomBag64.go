@@ -10,9 +10,15 @@ func (e RandomBagEmptyError) Error() string {
 	return "RandomBag Error: Cannot pop because there are no elements in the bag."
 }
 
+type RandomBagMissingItemError struct{}
+
+func (e RandomBagMissingItemError) Error() string {
+	return "RandomBag Error: Cannot remove an item that is not in the bag."
+}
+
 type RandomBag64 struct {
-	
-	arr []uint64
+	arr       []uint64
+	positions map[uint64]int // index of each item in arr. Only built on the first Remove, since most bags never need it and it's big.
 }
 
 func (rb *RandomBag64) Size() int {
@@ -36,11 +42,7 @@ func (rb *RandomBag64) PopRandom() (uint64, error) {
 	}
 
 	elem := rb.arr[index]
-	n := len(rb.arr)
-	// swap it with the last element
-	rb.arr[index] = rb.arr[n-1]
-	// resize the array
-	rb.arr = rb.arr[:n-1]
+	rb.remove_at(index)
 	// fmt.Println("Returned element:", elem)
 	// fmt.Println("Bag final:", rb.arr)
 	return elem, nil
@@ -49,6 +51,41 @@ func (rb *RandomBag64) PopRandom() (uint64, error) {
 // Push should always succeed
 func (rb *RandomBag64) Push(item uint64) {
 	rb.arr = append(rb.arr, item)
+	if rb.positions != nil {
+		rb.positions[item] = len(rb.arr) - 1
+	}
+}
+
+// Swaps the last element into index and shrinks the array
+func (rb *RandomBag64) remove_at(index int) {
+	n := len(rb.arr)
+	if rb.positions != nil {
+		delete(rb.positions, rb.arr[index])
+		if index != n-1 {
+			rb.positions[rb.arr[n-1]] = index
+		}
+	}
+	rb.arr[index] = rb.arr[n-1]
+	rb.arr = rb.arr[:n-1]
+}
+
+// Removes a specific item from the bag, swapping the last element into its place.
+//
+// The first call indexes the whole bag, which is O(n) time and memory, after that it's O(1).
+// Returns RandomBagMissingItemError if the item was not in the bag.
+func (rb *RandomBag64) Remove(item uint64) error {
+	if rb.positions == nil {
+		rb.positions = make(map[uint64]int, len(rb.arr))
+		for i, elem := range rb.arr {
+			rb.positions[elem] = i
+		}
+	}
+	index, ok := rb.positions[item]
+	if !ok {
+		return RandomBagMissingItemError{}
+	}
+	rb.remove_at(index)
+	return nil
 }
 
 // The RandomBag steals the slice that you pass to it. You should not use the slice anywhere afterwards.
@@ -40,3 +40,29 @@ func Test_RandomBag_Returns_All_Items(t *testing.T) {
 		}
 	}
 }
+
+func Test_RandomBag_Remove(t *testing.T) {
+	t.Parallel()
+
+	bag := util.CreateRandomBagFromSlice([]uint64{1, 2, 3, 4, 5})
+	util.Assert_no_error(t, bag.Remove(3), 1)
+	util.Assert_error_equals(t, bag.Remove(3), util.RandomBagMissingItemError{}.Error(), 1)
+
+	// Pushes and pops after the first Remove keep the index up to date
+	bag.Push(6)
+	util.Assert_no_error(t, bag.Remove(6), 1)
+	seen := []uint64{}
+	for bag.Size() > 1 {
+		item, err := bag.PopRandom()
+		util.Check_err(err)
+		seen = append(seen, item)
+	}
+	var last uint64
+	for _, item := range []uint64{1, 2, 4, 5} {
+		if !slices.Contains(seen, item) {
+			last = item
+		}
+	}
+	util.Assert_no_error(t, bag.Remove(last), 1)
+	util.Assert_result_equals_interface(t, bag.Size(), nil, 0, 1)
+}
@@ -0,0 +1,508 @@
+// Replicates the permanent map's log (LSPS) from a leader process to one or more followers over HTTP.
+//
+// The leader just serves its log files as they are on disk: the follower asks for "file N starting at byte offset O" and gets back every complete record from there on.
+// Since LSPS log files are only ever appended to and are numbered in increasing order, the follower can always resume from the last position it saved.
+// Paste files aren't in the log, so the follower fetches each paste from the leader when it sees the record for it.
+//
+// The follower doesn't copy the leader's files byte for byte. It writes each record into its own log, paste directory and size file using the same
+// write-ahead protocol as PutEntry, so its directories are a normal CPPUM data set. Promoting a follower is just loading those directories with
+// CreateConcurrentPersistentPermanentURLMapFromDisk, which is what Promote does.
+package util
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	REPLICATION_HEADER_LOG_FILE   = "X-Log-File"   // number of the log file the body was read from
+	REPLICATION_HEADER_LOG_OFFSET = "X-Log-Offset" // byte offset in that file where the body starts
+	REPLICATION_HEADER_LOG_SEALED = "X-Log-Sealed" // "1" if the body reaches the end of the file and the leader has moved on to a later file
+)
+
+const replication_max_chunk_size_bytes = 1 << 20
+
+// Serves the leader's log files and paste files to followers. Mount it as a prefix handler, e.g. at "/replication/".
+// Requests:
+// GET <prefix>log?file=N&offset=O returns the complete records in N.log from offset O, or from the start of the next log file if N.log doesn't exist.
+// GET <prefix>paste?path=P returns the contents of the paste file P, which must be in the paste directory.
+type ReplicationLeader struct {
+	backend                       StorageBackend
+	log_directory_path_absolute   string
+	paste_directory_path_absolute string
+}
+
+func NewReplicationLeader(log_directory_path_absolute string, paste_directory_path_absolute string) *ReplicationLeader {
+	return NewReplicationLeaderWithBackend(nil, log_directory_path_absolute, paste_directory_path_absolute)
+}
+
+// Same as NewReplicationLeader but reads the files from the given backend, which should be the one the leader's map uses. nil means the local file system.
+func NewReplicationLeaderWithBackend(backend StorageBackend, log_directory_path_absolute string, paste_directory_path_absolute string) *ReplicationLeader {
+	return &ReplicationLeader{
+		backend:                       storage_backend_or_local(backend),
+		log_directory_path_absolute:   filepath.Clean(log_directory_path_absolute),
+		paste_directory_path_absolute: filepath.Clean(paste_directory_path_absolute),
+	}
+}
+
+func (rl *ReplicationLeader) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/log"):
+		rl.serve_log(w, r)
+	case strings.HasSuffix(r.URL.Path, "/paste"):
+		rl.serve_paste(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Returns the smallest log file number that is >= file_number, or -1 if there isn't one. Also returns whether a log file after that one exists.
+func (rl *ReplicationLeader) find_log_file(file_number int64) (int64, bool, error) {
+	names, err := rl.backend.ListSegments(rl.log_directory_path_absolute)
+	if err != nil {
+		return -1, false, err
+	}
+	var found int64 = -1
+	later_file_exists := false
+	numbers := make([]int64, 0, len(names))
+	for _, name := range names {
+		number, err := LSPS_Parse_log_filename_to_number(name)
+		if err != nil {
+			continue
+		}
+		numbers = append(numbers, number)
+		if number >= file_number && (found == -1 || number < found) {
+			found = number
+		}
+	}
+	for _, number := range numbers {
+		if found != -1 && number > found {
+			later_file_exists = true
+		}
+	}
+	return found, later_file_exists, nil
+}
+
+func (rl *ReplicationLeader) serve_log(w http.ResponseWriter, r *http.Request) {
+	requested_file, err1 := String_to_int64(r.URL.Query().Get("file"))
+	offset, err2 := String_to_int64(r.URL.Query().Get("offset"))
+	if err1 != nil || err2 != nil || requested_file < 0 || offset < 0 {
+		http.Error(w, "Invalid file or offset", http.StatusBadRequest)
+		return
+	}
+	// Check for a later file before reading. LSPS only creates the next file after it's done writing to the current one,
+	// so if a later file exists then this one won't change any more.
+	file_number, sealed, err := rl.find_log_file(requested_file)
+	if err != nil {
+		log.Println("Replication: failed to list log directory:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if file_number == -1 {
+		// Nothing there yet. Tell the follower to keep asking for the same position.
+		w.Header().Set(REPLICATION_HEADER_LOG_FILE, Int64_to_string(requested_file))
+		w.Header().Set(REPLICATION_HEADER_LOG_OFFSET, Int64_to_string(offset))
+		w.Header().Set(REPLICATION_HEADER_LOG_SEALED, "0")
+		return
+	}
+	if file_number != requested_file {
+		offset = 0
+	}
+
+	log_path := filepath.Join(rl.log_directory_path_absolute, Int64_to_string(file_number)+".log")
+	info, err := rl.backend.Stat(log_path)
+	if err != nil {
+		log.Println("Replication: failed to stat log file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	file_size := info.Size
+	if offset > file_size {
+		http.Error(w, "Offset is past the end of the log file", http.StatusBadRequest)
+		return
+	}
+	data, err := read_segment_range(rl.backend, log_path, offset, min(file_size-offset, replication_max_chunk_size_bytes))
+	if err != nil {
+		log.Println("Replication: failed to read log file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Only send complete records. The last one might still be being written.
+	data = data[:bytes.LastIndexByte(data, '\n')+1]
+	sealed = sealed && offset+int64(len(data)) == file_size
+
+	w.Header().Set(REPLICATION_HEADER_LOG_FILE, Int64_to_string(file_number))
+	w.Header().Set(REPLICATION_HEADER_LOG_OFFSET, Int64_to_string(offset))
+	if sealed {
+		w.Header().Set(REPLICATION_HEADER_LOG_SEALED, "1")
+	} else {
+		w.Header().Set(REPLICATION_HEADER_LOG_SEALED, "0")
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(data)
+}
+
+// Reads up to length bytes of the segment starting at offset. Returns fewer bytes if the segment is shorter than that.
+func read_segment_range(backend StorageBackend, path string, offset int64, length int64) ([]byte, error) {
+	rc, err := backend.OpenSegment(path)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if ra, ok := rc.(io.ReaderAt); ok { // local files, no need to read everything before the offset
+		data := make([]byte, length)
+		n, err := ra.ReadAt(data, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return data[:n], nil
+	}
+	_, err = io.CopyN(io.Discard, rc, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(rc, length))
+}
+
+func (rl *ReplicationLeader) serve_paste(w http.ResponseWriter, r *http.Request) {
+	paste_path := filepath.Clean(r.URL.Query().Get("path"))
+	// Don't let followers read anything outside the paste directory
+	if filepath.Dir(paste_path) != rl.paste_directory_path_absolute {
+		http.Error(w, "Invalid paste path", http.StatusBadRequest)
+		return
+	}
+	contents, err := rl.backend.GetBlob(paste_path)
+	if errors.Is(err, os.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("Replication: failed to read paste file:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(contents)
+}
+
+type ReplicationFollowerParams struct {
+	Leader_url                     string // URL that the leader's ReplicationLeader is mounted at, e.g. "http://10.0.0.1:8080/replication/"
+	Log_directory_path_absolute    string
+	Bucket_directory_path_absolute string
+	Size_file_path_absolute        string
+	State_file_path_absolute       string // Where the follower saves its position in the leader's log
+	B53m                           *Base53IDManager
+	Log_file_max_size_bytes        int64
+	Size_file_rounded_multiple     int64
+	Allow_alias_ids                bool
+	Xattr_params                   *XattrParams
+	Poll_interval_seconds          int
+	Http_client                    *http.Client // nil means http.DefaultClient
+}
+
+type ReplicationNotRunningError struct{}
+
+func (e ReplicationNotRunningError) Error() string {
+	return "Replication follower has been stopped"
+}
+
+// A read-only copy of a leader's permanent map that keeps itself up to date.
+type ReplicationFollower struct {
+	mut                sync.Mutex // held while applying records, so that Stop and Promote don't run in the middle of a batch
+	params             ReplicationFollowerParams
+	client             *http.Client
+	urlmap             *ConcurrentPermanentMap
+	lsps               *LogStructuredPermanentStorage
+	pbs                *PermanentBucketStorage
+	map_size_persister *MapSizeFileManager
+	leader_file        int64
+	leader_offset      int64
+	stopped            bool
+	stop_chan          chan struct{}
+	done_chan          chan struct{}
+}
+
+// Loads the follower's own directories and its saved position, then starts polling the leader in the background.
+func StartReplicationFollower(params *ReplicationFollowerParams) (*ReplicationFollower, error) {
+	if params.Poll_interval_seconds <= 0 {
+		return nil, errors.New("Poll_interval_seconds must be positive")
+	}
+	leader_file, leader_offset, err := load_replication_state(params.State_file_path_absolute)
+	if err != nil {
+		return nil, err
+	}
+	lsps := NewLogStructuredPermanentStorage(params.Log_file_max_size_bytes, params.Log_directory_path_absolute)
+	pbs := NewPermanentBucketStorage(params.Bucket_directory_path_absolute)
+	var nil_map_ptr *ConcurrentPermanentMap = nil
+	concurrent_map, map_size_persister := LoadStoredRecordsFromDisk(&LSRFD_Params{
+		B53m:                        params.B53m,
+		Log_directory_path_absolute: params.Log_directory_path_absolute,
+		Size_file_path_absolute:     params.Size_file_path_absolute,
+		Lss:                         lsps,
+		Slice_storage:               make(map[int]*RandomBag64), // followers never hand out IDs
+		Nil_ptr:                     nil_map_ptr,
+		Size_file_rounded_multiple:  params.Size_file_rounded_multiple,
+		Generate_strings_up_to:      0,
+		Allow_alias_ids:             params.Allow_alias_ids,
+	})
+
+	client := params.Http_client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rf := ReplicationFollower{ //nolint:forcetypeassert // just let it crash.
+		mut:                sync.Mutex{},
+		params:             *params,
+		client:             client,
+		urlmap:             concurrent_map.(*ConcurrentPermanentMap),
+		lsps:               lsps,
+		pbs:                pbs,
+		map_size_persister: map_size_persister,
+		leader_file:        leader_file,
+		leader_offset:      leader_offset,
+		stopped:            false,
+		stop_chan:          make(chan struct{}),
+		done_chan:          make(chan struct{}),
+	}
+	go rf.run()
+	return &rf, nil
+}
+
+func (rf *ReplicationFollower) GetEntry(short_url string) (MapItem, error) { //nolint:ireturn // is ok
+	val, err := GetEntryCommon(rf.urlmap, short_url)
+	return val, err
+}
+
+func (rf *ReplicationFollower) NumItems() int {
+	return rf.urlmap.NumItems()
+}
+
+func (rf *ReplicationFollower) NumPastes() int {
+	return rf.urlmap.NumPastes()
+}
+
+// Returns the position in the leader's log that has been replicated so far.
+func (rf *ReplicationFollower) Position() (int64, int64) {
+	rf.mut.Lock()
+	defer rf.mut.Unlock()
+
+	return rf.leader_file, rf.leader_offset
+}
+
+func (rf *ReplicationFollower) run() {
+	defer close(rf.done_chan)
+	for {
+		applied, err := rf.SyncOnce()
+		if err != nil && !errors.As(err, &ReplicationNotRunningError{}) {
+			log.Println("Replication: sync failed:", err)
+		}
+		if err == nil && applied > 0 {
+			continue // there's probably more
+		}
+		select {
+		case <-rf.stop_chan:
+			return
+		case <-time.After(time.Duration(rf.params.Poll_interval_seconds) * time.Second):
+		}
+	}
+}
+
+// Stops polling the leader. The map can still be read afterwards.
+func (rf *ReplicationFollower) Stop() {
+	rf.mut.Lock()
+	if rf.stopped {
+		rf.mut.Unlock()
+		return
+	}
+	rf.stopped = true
+	close(rf.stop_chan)
+	rf.mut.Unlock()
+	<-rf.done_chan
+}
+
+// Fetches one batch of records from the leader and applies them. Returns the number of records applied, so 0 means we've caught up.
+// The background goroutine calls this in a loop, it's exported so that you can catch up right away, e.g. before promoting.
+func (rf *ReplicationFollower) SyncOnce() (int, error) {
+	rf.mut.Lock()
+	defer rf.mut.Unlock()
+
+	if rf.stopped {
+		return 0, ReplicationNotRunningError{}
+	}
+	for {
+		applied, sealed, err := rf.sync_batch_locked()
+		// If we were at the end of a file that has since been sealed, nothing was applied but we're not caught up yet, so go on to the next file.
+		if err != nil || applied > 0 || !sealed {
+			return applied, err
+		}
+	}
+}
+
+// Returns whether the batch reached the end of a sealed file, in which case we've moved on to the next file.
+// Caller must hold rf.mut
+func (rf *ReplicationFollower) sync_batch_locked() (int, bool, error) {
+	log_url := rf.params.Leader_url + "log?file=" + Int64_to_string(rf.leader_file) + "&offset=" + Int64_to_string(rf.leader_offset)
+	resp, err := rf.client.Get(log_url) //nolint:noctx // the client has its own timeout
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, false, fmt.Errorf("Leader returned %s for %s", resp.Status, log_url)
+	}
+	file_number, err1 := String_to_int64(resp.Header.Get(REPLICATION_HEADER_LOG_FILE))
+	offset, err2 := String_to_int64(resp.Header.Get(REPLICATION_HEADER_LOG_OFFSET))
+	if err1 != nil || err2 != nil {
+		return 0, false, errors.New("Leader response is missing the log position headers")
+	}
+	if file_number < rf.leader_file || (file_number == rf.leader_file && offset != rf.leader_offset) || (file_number > rf.leader_file && offset != 0) {
+		return 0, false, fmt.Errorf("Leader returned file %d offset %d, but we asked for file %d offset %d", file_number, offset, rf.leader_file, rf.leader_offset)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, false, err
+	}
+
+	rf.leader_file = file_number
+	rf.leader_offset = offset
+	applied := 0
+	lrr := NewLogRecordReader(bytes.NewReader(body), rf.params.B53m, rf.params.Allow_alias_ids)
+	for {
+		record, err := lrr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = rf.apply_record(record)
+		}
+		if err != nil {
+			// Save what we've applied so far, and try the rest again next time
+			return applied, false, errors.Join(err, save_replication_state(rf.params.State_file_path_absolute, rf.leader_file, rf.leader_offset))
+		}
+		rf.leader_offset = offset + lrr.Offset()
+		applied++
+	}
+	sealed := resp.Header.Get(REPLICATION_HEADER_LOG_SEALED) == "1"
+	if sealed {
+		rf.leader_file++
+		rf.leader_offset = 0
+	}
+	return applied, sealed, save_replication_state(rf.params.State_file_path_absolute, rf.leader_file, rf.leader_offset)
+}
+
+// Caller must hold rf.mut
+func (rf *ReplicationFollower) apply_record(record *LogRecord) error {
+	if record.Type == LOG_RECORD_TYPE_PASTE_INTENT || record.Type == LOG_RECORD_TYPE_PASTE_ENCRYPTION {
+		// Write_Entry_Durably_Common writes our own when we copy the paste
+		return nil
+	}
+	if record.ValueType == nil {
+		// Idempotency keys etc. are kept so that they still work after promotion. It's fine to see them twice.
+		return rf.lsps.AppendNewRecord(record.Key, record.Value, record.Type, record.Timestamp)
+	}
+	// If we crashed before saving our position, we'll see records that we've already applied. Keys in the permanent map are never reused, so skip them.
+	if url_map_contains_key(rf.urlmap, record.Key) {
+		return nil
+	}
+	value := record.Value
+	if record.ValueType == TYPE_MAP_ITEM_PASTE {
+		contents, err := rf.fetch_paste(record.Value)
+		if err != nil {
+			return err
+		}
+		value = string(contents)
+	}
+	stored_value, err := Write_Entry_Durably_Common(record.Key, value, record.ValueType, record.Timestamp, rf.lsps, rf.pbs, rf.params.Xattr_params)
+	if err != nil {
+		return err
+	}
+	err = rf.urlmap.Put_New_Entry(record.Key, stored_value, record.Timestamp, record.ValueType)
+	if err != nil { // We checked above, so this can't happen.
+		log.Fatal("Put_New_Entry failed. This should never happen. Error:", err)
+		panic("Put_New_Entry failed. This should never happen. Error:" + err.Error())
+	}
+	rf.map_size_persister.UpdateMapSizeRounded(int64(rf.urlmap.NumItems()))
+	return nil
+}
+
+func (rf *ReplicationFollower) fetch_paste(leader_paste_path string) ([]byte, error) {
+	paste_url := rf.params.Leader_url + "paste?path=" + url.QueryEscape(leader_paste_path)
+	resp, err := rf.client.Get(paste_url) //nolint:noctx // the client has its own timeout
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Leader returned %s for %s", resp.Status, paste_url)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Stops replication and turns this follower into a normal writable map. The follower must not be used afterwards.
+// cppum_params must point at the follower's directories. The state file is deleted, since the saved position means nothing once we start writing our own records.
+func (rf *ReplicationFollower) Promote(cppum_params *CPPUMParams) (*ConcurrentPersistentPermanentURLMap, error) {
+	if filepath.Clean(cppum_params.Log_directory_path_absolute) != filepath.Clean(rf.params.Log_directory_path_absolute) ||
+		filepath.Clean(cppum_params.Bucket_directory_path_absolute) != filepath.Clean(rf.params.Bucket_directory_path_absolute) {
+		return nil, errors.New("Promote: CPPUM params must use the follower's log and paste directories")
+	}
+	rf.Stop()
+
+	rf.mut.Lock()
+	defer rf.mut.Unlock()
+	err := rf.lsps.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = os.Remove(rf.params.State_file_path_absolute)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	log.Println("Replication: promoting follower at leader file", rf.leader_file, "offset", rf.leader_offset)
+	return CreateConcurrentPersistentPermanentURLMapFromDisk(cppum_params), nil
+}
+
+// The state file holds "file offset". A missing state file means start from the beginning.
+func load_replication_state(state_file_path_absolute string) (int64, int64, error) {
+	data, err := os.ReadFile(state_file_path_absolute)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 { //nolint:gomnd // file and offset
+		return 0, 0, fmt.Errorf("Invalid replication state file %s: %#v", state_file_path_absolute, string(data))
+	}
+	file_number, err1 := strconv.ParseInt(fields[0], 10, 64)
+	offset, err2 := strconv.ParseInt(fields[1], 10, 64)
+	if err1 != nil || err2 != nil || file_number < 0 || offset < 0 {
+		return 0, 0, fmt.Errorf("Invalid replication state file %s: %#v", state_file_path_absolute, string(data))
+	}
+	return file_number, offset, nil
+}
+
+// Writes to a temporary file and renames it over the old one, so that the state file is never half-written.
+func save_replication_state(state_file_path_absolute string, file_number int64, offset int64) error {
+	tmp_path := state_file_path_absolute + ".tmp"
+	err := os.WriteFile(tmp_path, []byte(Int64_to_string(file_number)+" "+Int64_to_string(offset)+"\n"), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, state_file_path_absolute)
+}
@@ -0,0 +1,157 @@
+package util_test
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/1f604/util"
+)
+
+func new_test_follower(t *testing.T, dir string, leader_url string) *util.ReplicationFollower {
+	t.Helper()
+
+	log_dir := filepath.Join(dir, "logs")
+	err := os.MkdirAll(log_dir, os.ModePerm)
+	util.Assert_no_error(t, err, 1)
+	rf, err := util.StartReplicationFollower(&util.ReplicationFollowerParams{
+		Leader_url:                     leader_url,
+		Log_directory_path_absolute:    log_dir,
+		Bucket_directory_path_absolute: filepath.Join(dir, "pastes"),
+		Size_file_path_absolute:        filepath.Join(dir, "size.txt"),
+		State_file_path_absolute:       filepath.Join(dir, "replication_state.txt"),
+		B53m:                           util.NewBase53IDManager(),
+		Log_file_max_size_bytes:        300,
+		Size_file_rounded_multiple:     5,
+		Xattr_params:                   &util.XattrParams{},
+		Poll_interval_seconds:          3600, // the test calls SyncOnce itself
+	})
+	util.Assert_no_error(t, err, 1)
+	return rf
+}
+
+// Calls SyncOnce until there's nothing left to apply and returns the total number of records applied.
+func sync_follower(t *testing.T, rf *util.ReplicationFollower) int {
+	t.Helper()
+
+	total := 0
+	for {
+		applied, err := rf.SyncOnce()
+		util.Assert_no_error(t, err, 1)
+		if applied == 0 {
+			return total
+		}
+		total += applied
+	}
+}
+
+func Test_Replication_Follower_Catches_Up_Resumes_And_Promotes(t *testing.T) {
+	t.Parallel()
+
+	leader_dir := t.TempDir()
+	follower_dir := t.TempDir()
+	leader := new_test_cppum(t, leader_dir, false)
+	server := httptest.NewServer(util.NewReplicationLeader(filepath.Join(leader_dir, "logs"), filepath.Join(leader_dir, "pastes")))
+	defer server.Close()
+	leader_url := server.URL + "/replication/"
+
+	// Enough entries that the leader's log rotates a few times (max log file size is 300 bytes)
+	keys := []string{}
+	for i := 0; i < 10; i++ {
+		key, err := leader.PutEntry(4, "https://example.com/"+util.Int64_to_string(int64(i)), 0, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+		keys = append(keys, key)
+	}
+	paste_key, err := leader.PutEntry(4, "some paste", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+
+	rf := new_test_follower(t, follower_dir, leader_url)
+	sync_follower(t, rf)
+	util.Assert_result_equals_interface(t, rf.NumItems(), nil, 11, 1)
+	item, err := rf.GetEntry(keys[3])
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "https://example.com/3", 1)
+	item, err = rf.GetEntry(paste_key)
+	util.Assert_no_error(t, err, 1)
+	contents, err := os.ReadFile(item.GetValue())
+	util.Assert_result_equals_interface(t, string(contents), err, "some paste", 1)
+
+	// Restart the follower. It resumes from its saved position instead of starting over.
+	rf.Stop()
+	rf = new_test_follower(t, follower_dir, leader_url)
+	util.Assert_result_equals_interface(t, rf.NumItems(), nil, 11, 1)
+	util.Assert_result_equals_interface(t, sync_follower(t, rf), nil, 0, 1)
+	new_key, err := leader.PutEntry(4, "https://example.com/new", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	sync_follower(t, rf)
+	item, err = rf.GetEntry(new_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "https://example.com/new", 1)
+
+	// Even if the saved position is lost, records that were already applied are skipped
+	rf.Stop()
+	err = os.Remove(filepath.Join(follower_dir, "replication_state.txt"))
+	util.Assert_no_error(t, err, 1)
+	rf = new_test_follower(t, follower_dir, leader_url)
+	sync_follower(t, rf)
+	util.Assert_result_equals_interface(t, rf.NumItems(), nil, 12, 1)
+
+	// Promote the follower and write to it
+	promoted, err := rf.Promote(&util.CPPUMParams{
+		Log_directory_path_absolute:    filepath.Join(follower_dir, "logs"),
+		Bucket_directory_path_absolute: filepath.Join(follower_dir, "pastes"),
+		B53m:                           util.NewBase53IDManager(),
+		Generate_strings_up_to:         2,
+		Log_file_max_size_bytes:        300,
+		Size_file_rounded_multiple:     5,
+		Size_file_path_absolute:        filepath.Join(follower_dir, "size.txt"),
+		Xattr_params:                   &util.XattrParams{},
+	})
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, promoted.NumItems(), nil, 12, 1)
+	promoted_key, err := promoted.PutEntry(4, "https://example.com/promoted", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	item, err = promoted.GetEntry(promoted_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "https://example.com/promoted", 1)
+	item, err = promoted.GetEntry(paste_key)
+	util.Assert_no_error(t, err, 1)
+	contents, err = os.ReadFile(item.GetValue())
+	util.Assert_result_equals_interface(t, string(contents), err, "some paste", 1)
+}
+
+func Test_Replication_Leader_Rejects_Paths_Outside_Paste_Directory(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	rl := util.NewReplicationLeader(filepath.Join(dir, "logs"), filepath.Join(dir, "pastes"))
+	req := httptest.NewRequest("GET", "/replication/paste?path="+filepath.Join(dir, "size.txt"), nil)
+	rec := httptest.NewRecorder()
+	rl.ServeHTTP(rec, req)
+	util.Assert_result_equals_interface(t, rec.Code, nil, 400, 1)
+}
+
+func Test_Replication_Leader_Reads_From_Backend(t *testing.T) {
+	t.Parallel()
+
+	backend := util.NewMemoryStorageBackend()
+	util.Assert_no_error(t, backend.MkdirAll("/logs"), 1)
+	util.Assert_no_error(t, backend.MkdirAll("/pastes"), 1)
+	first_record, err := util.Format_Log_Record("abc", "google.com", util.TYPE_MAP_ITEM_URL.ToString(), 1700000000)
+	util.Assert_no_error(t, err, 1)
+	second_record, err := util.Format_Log_Record("def", "example.com", util.TYPE_MAP_ITEM_URL.ToString(), 1700000001)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_no_error(t, backend.AppendToSegment("/logs/0.log", []byte(first_record+second_record)), 1)
+	util.Assert_no_error(t, backend.PutBlob("/pastes/some_paste", []byte("some paste"), nil), 1)
+
+	rl := util.NewReplicationLeaderWithBackend(backend, "/logs", "/pastes")
+	req := httptest.NewRequest("GET", "/replication/log?file=0&offset="+util.Int64_to_string(int64(len(first_record))), nil)
+	rec := httptest.NewRecorder()
+	rl.ServeHTTP(rec, req)
+	util.Assert_result_equals_interface(t, rec.Code, nil, 200, 1)
+	util.Assert_result_equals_interface(t, rec.Body.String(), nil, second_record, 1)
+	util.Assert_result_equals_interface(t, rec.Header().Get(util.REPLICATION_HEADER_LOG_OFFSET), nil, util.Int64_to_string(int64(len(first_record))), 1)
+
+	req = httptest.NewRequest("GET", "/replication/paste?path=/pastes/some_paste", nil)
+	rec = httptest.NewRecorder()
+	rl.ServeHTTP(rec, req)
+	util.Assert_result_equals_interface(t, rec.Body.String(), nil, "some paste", 1)
+}
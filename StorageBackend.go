@@ -0,0 +1,565 @@
+// Storage backends hold the files behind the persistent URL maps: the log segments, the paste files and the size file.
+// The maps only ever talk to a StorageBackend, so the whole CEPUM/CPPUM stack can run on the local file system (the default),
+// entirely in memory (for tests), or on anything that can be wrapped in an fs.FS.
+//
+// Paths are always absolute and use "/" as the separator, just like they did when everything went straight to the os package.
+// Errors should wrap os.ErrNotExist and os.ErrExist where it makes sense, since callers check for those with errors.Is.
+package util
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type StorageFileInfo struct {
+	Size     int64
+	Mod_time time.Time
+}
+
+type StorageBackend interface {
+	MkdirAll(dir string) error
+	// Names of the files in dir, sorted. Subdirectories are not included.
+	ListSegments(dir string) ([]string, error)
+	OpenSegment(path string) (io.ReadCloser, error)
+	// Creates the segment if it doesn't exist. The data must be on durable storage when this returns.
+	AppendToSegment(path string, data []byte) error
+	// Cuts the segment down to size bytes. Used to drop a partial record left behind by a crash. Must be durable when this returns.
+	TruncateSegment(path string, size int64) error
+	// Creates a new blob. Returns an error wrapping os.ErrExist if it already exists. The data must be on durable storage when this returns.
+	PutBlob(path string, data []byte, xattr_params *XattrParams) error
+	// Creates the blob or replaces its contents.
+	ReplaceBlob(path string, data []byte) error
+	GetBlob(path string) ([]byte, error)
+	Stat(path string) (StorageFileInfo, error)
+	// Deletes a segment or blob
+	Delete(path string) error
+}
+
+type StorageSpace struct {
+	Total_bytes uint64
+	Free_bytes  uint64 // Space that the process can actually use, so it excludes blocks reserved for root
+}
+
+// Backends that know how much space is left implement this as well. It's optional because not every backend has a meaningful answer.
+type StorageSpaceReporter interface {
+	DiskSpace(dir string) (StorageSpace, error)
+}
+
+// Returns nil if the backend can't tell how much space is left
+func Storage_Disk_Space(backend StorageBackend, dir string) (*StorageSpace, error) {
+	reporter, ok := storage_backend_or_local(backend).(StorageSpaceReporter)
+	if !ok {
+		return nil, nil //nolint:nilnil // unknown isn't an error
+	}
+	space, err := reporter.DiskSpace(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &space, nil
+}
+
+// Backends that can keep a segment open between appends implement this as well, so that appending a record doesn't have to reopen the file every time.
+// It's optional: open_segment_for_append falls back to AppendToSegment for backends that don't.
+type SegmentAppender interface {
+	// Creates the segment if it doesn't exist
+	OpenSegmentForAppend(path string) (SegmentAppendHandle, error)
+}
+
+type SegmentAppendHandle interface {
+	// Same guarantees as AppendToSegment
+	Append(data []byte) error
+	Close() error
+}
+
+func open_segment_for_append(backend StorageBackend, path string) (SegmentAppendHandle, error) { //nolint:ireturn // it's an interface on purpose
+	backend = storage_backend_or_local(backend)
+	if appender, ok := backend.(SegmentAppender); ok {
+		return appender.OpenSegmentForAppend(path)
+	}
+	err := backend.AppendToSegment(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return backend_segment_append_handle{backend: backend, path: path}, nil
+}
+
+type backend_segment_append_handle struct {
+	backend StorageBackend
+	path    string
+}
+
+func (h backend_segment_append_handle) Append(data []byte) error {
+	return h.backend.AppendToSegment(h.path, data)
+}
+
+func (backend_segment_append_handle) Close() error {
+	return nil
+}
+
+// Returns the local file system backend if backend is nil
+func storage_backend_or_local(backend StorageBackend) StorageBackend { //nolint:ireturn // it's an interface on purpose
+	if backend == nil {
+		return LocalStorageBackend{}
+	}
+	return backend
+}
+
+// Stores everything on the local file system using the os package. This is what the maps always used before backends existed.
+type LocalStorageBackend struct{}
+
+func (LocalStorageBackend) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, os.ModePerm)
+}
+
+func (LocalStorageBackend) ListSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (LocalStorageBackend) OpenSegment(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (LocalStorageBackend) AppendToSegment(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func (LocalStorageBackend) OpenSegmentForAppend(path string) (SegmentAppendHandle, error) { //nolint:ireturn // it's an interface on purpose
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return local_segment_append_handle{f: f}, nil
+}
+
+type local_segment_append_handle struct {
+	f *os.File
+}
+
+func (h local_segment_append_handle) Append(data []byte) error {
+	_, err := h.f.Write(data)
+	if err != nil {
+		return err
+	}
+	return h.f.Sync()
+}
+
+func (h local_segment_append_handle) Close() error {
+	return h.f.Close()
+}
+
+func (LocalStorageBackend) TruncateSegment(path string, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func (LocalStorageBackend) PutBlob(path string, data []byte, xattr_params *XattrParams) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	if err != nil {
+		return err
+	}
+	if xattr_params != nil && xattr_params.SetXattr {
+		return unix.Setxattr(path, xattr_params.XattrName, []byte(xattr_params.Xattrvalue), 0)
+	}
+	return nil
+}
+
+func (LocalStorageBackend) ReplaceBlob(path string, data []byte) error {
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (LocalStorageBackend) GetBlob(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
+
+func (LocalStorageBackend) Stat(path string) (StorageFileInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return StorageFileInfo{}, err
+	}
+	return StorageFileInfo{Size: info.Size(), Mod_time: info.ModTime()}, nil
+}
+
+func (LocalStorageBackend) Delete(path string) error {
+	return os.Remove(path)
+}
+
+func (LocalStorageBackend) DiskSpace(dir string) (StorageSpace, error) {
+	var stat unix.Statfs_t
+	err := unix.Statfs(dir, &stat)
+	if err != nil {
+		return StorageSpace{}, err
+	}
+	return StorageSpace{
+		Total_bytes: stat.Blocks * uint64(stat.Bsize), //nolint:gosec // block size is never negative
+		Free_bytes:  stat.Bavail * uint64(stat.Bsize), //nolint:gosec // block size is never negative
+	}, nil
+}
+
+// Keeps everything in RAM. Meant for tests: it behaves like the local file system (directories have to be created first, PutBlob fails if the blob exists, etc.)
+// but nothing touches the disk, and the same backend can be passed to a new map to simulate a restart.
+type MemoryStorageBackend struct {
+	mut   sync.Mutex
+	files map[string]*memory_storage_file
+	dirs  map[string]bool
+}
+
+type memory_storage_file struct {
+	data     []byte
+	mod_time time.Time
+}
+
+func NewMemoryStorageBackend() *MemoryStorageBackend {
+	return &MemoryStorageBackend{
+		mut:   sync.Mutex{},
+		files: make(map[string]*memory_storage_file),
+		dirs:  map[string]bool{"/": true},
+	}
+}
+
+func memory_storage_not_exist(op string, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+}
+
+// Caller must hold msb.mut
+func (msb *MemoryStorageBackend) check_parent_exists(op string, path string) error {
+	if !msb.dirs[filepath.Dir(path)] {
+		return memory_storage_not_exist(op, path)
+	}
+	return nil
+}
+
+func (msb *MemoryStorageBackend) MkdirAll(dir string) error {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	for dir = filepath.Clean(dir); !msb.dirs[dir]; dir = filepath.Dir(dir) {
+		if _, ok := msb.files[dir]; ok {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		msb.dirs[dir] = true
+	}
+	return nil
+}
+
+func (msb *MemoryStorageBackend) ListSegments(dir string) ([]string, error) {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	dir = filepath.Clean(dir)
+	if !msb.dirs[dir] {
+		return nil, memory_storage_not_exist("readdir", dir)
+	}
+	names := []string{}
+	for path := range msb.files {
+		if filepath.Dir(path) == dir {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (msb *MemoryStorageBackend) OpenSegment(path string) (io.ReadCloser, error) {
+	data, err := msb.GetBlob(path)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (msb *MemoryStorageBackend) AppendToSegment(path string, data []byte) error {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	path = filepath.Clean(path)
+	file, ok := msb.files[path]
+	if !ok {
+		err := msb.check_parent_exists("open", path)
+		if err != nil {
+			return err
+		}
+		file = &memory_storage_file{}
+		msb.files[path] = file
+	}
+	file.data = append(file.data, data...)
+	file.mod_time = time.Now()
+	return nil
+}
+
+func (msb *MemoryStorageBackend) TruncateSegment(path string, size int64) error {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	file, ok := msb.files[filepath.Clean(path)]
+	if !ok {
+		return memory_storage_not_exist("truncate", path)
+	}
+	if size < int64(len(file.data)) {
+		file.data = file.data[:size]
+	}
+	file.mod_time = time.Now()
+	return nil
+}
+
+func (msb *MemoryStorageBackend) PutBlob(path string, data []byte, _ *XattrParams) error {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := msb.files[path]; ok {
+		return &fs.PathError{Op: "open", Path: path, Err: fs.ErrExist}
+	}
+	err := msb.check_parent_exists("open", path)
+	if err != nil {
+		return err
+	}
+	msb.files[path] = &memory_storage_file{data: bytes.Clone(data), mod_time: time.Now()}
+	return nil
+}
+
+func (msb *MemoryStorageBackend) ReplaceBlob(path string, data []byte) error {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	path = filepath.Clean(path)
+	err := msb.check_parent_exists("open", path)
+	if err != nil {
+		return err
+	}
+	msb.files[path] = &memory_storage_file{data: bytes.Clone(data), mod_time: time.Now()}
+	return nil
+}
+
+func (msb *MemoryStorageBackend) GetBlob(path string) ([]byte, error) {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	file, ok := msb.files[filepath.Clean(path)]
+	if !ok {
+		return nil, memory_storage_not_exist("open", path)
+	}
+	return bytes.Clone(file.data), nil
+}
+
+func (msb *MemoryStorageBackend) Stat(path string) (StorageFileInfo, error) {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	file, ok := msb.files[filepath.Clean(path)]
+	if !ok {
+		return StorageFileInfo{}, memory_storage_not_exist("stat", path)
+	}
+	return StorageFileInfo{Size: int64(len(file.data)), Mod_time: file.mod_time}, nil
+}
+
+func (msb *MemoryStorageBackend) Delete(path string) error {
+	msb.mut.Lock()
+	defer msb.mut.Unlock()
+
+	path = filepath.Clean(path)
+	if _, ok := msb.files[path]; !ok {
+		return memory_storage_not_exist("remove", path)
+	}
+	delete(msb.files, path)
+	return nil
+}
+
+type StorageReadOnlyError struct{}
+
+func (e StorageReadOnlyError) Error() string {
+	return "Storage backend is read-only"
+}
+
+// The file operations that FSStorageBackend needs in order to write. This is the subset of afero.Fs that we use,
+// so wrapping an afero.Fs (or anything else like it) in a few lines of code is enough to make it writable.
+// Names are fs.FS-style paths, i.e. without the leading "/".
+type WritableFS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (WritableFile, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	Remove(name string) error
+}
+
+type WritableFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// Adapts an fs.FS (os.DirFS, fstest.MapFS, a zip file, etc.) into a StorageBackend. Absolute paths are mapped onto the fs.FS by dropping the leading "/".
+// An fs.FS is read-only, so the write methods return StorageReadOnlyError unless the fs.FS also implements WritableFS.
+// Extended attributes are not supported.
+type FSStorageBackend struct {
+	fsys fs.FS
+}
+
+func NewFSStorageBackend(fsys fs.FS) *FSStorageBackend {
+	return &FSStorageBackend{fsys: fsys}
+}
+
+func fs_storage_name(path string) string {
+	name := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (fsb *FSStorageBackend) writable() (WritableFS, error) { //nolint:ireturn // it's an interface on purpose
+	wfs, ok := fsb.fsys.(WritableFS)
+	if !ok {
+		return nil, StorageReadOnlyError{}
+	}
+	return wfs, nil
+}
+
+func (fsb *FSStorageBackend) MkdirAll(dir string) error {
+	wfs, err := fsb.writable()
+	if err != nil {
+		// Fine as long as it's already there
+		info, stat_err := fs.Stat(fsb.fsys, fs_storage_name(dir))
+		if stat_err == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return wfs.MkdirAll(fs_storage_name(dir), os.ModePerm)
+}
+
+func (fsb *FSStorageBackend) ListSegments(dir string) ([]string, error) {
+	entries, err := fs.ReadDir(fsb.fsys, fs_storage_name(dir))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (fsb *FSStorageBackend) OpenSegment(path string) (io.ReadCloser, error) {
+	return fsb.fsys.Open(fs_storage_name(path))
+}
+
+func (fsb *FSStorageBackend) write(path string, flag int, data []byte) error {
+	wfs, err := fsb.writable()
+	if err != nil {
+		return err
+	}
+	f, err := wfs.OpenFile(fs_storage_name(path), flag, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func (fsb *FSStorageBackend) AppendToSegment(path string, data []byte) error {
+	return fsb.write(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, data)
+}
+
+func (fsb *FSStorageBackend) TruncateSegment(path string, size int64) error {
+	wfs, err := fsb.writable()
+	if err != nil {
+		return err
+	}
+	f, err := wfs.OpenFile(fs_storage_name(path), os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err == nil {
+		err = f.Sync()
+	}
+	if close_err := f.Close(); err == nil {
+		err = close_err
+	}
+	return err
+}
+
+func (fsb *FSStorageBackend) PutBlob(path string, data []byte, _ *XattrParams) error {
+	return fsb.write(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, data)
+}
+
+func (fsb *FSStorageBackend) ReplaceBlob(path string, data []byte) error {
+	return fsb.write(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+}
+
+func (fsb *FSStorageBackend) GetBlob(path string) ([]byte, error) {
+	return fs.ReadFile(fsb.fsys, fs_storage_name(path))
+}
+
+func (fsb *FSStorageBackend) Stat(path string) (StorageFileInfo, error) {
+	info, err := fs.Stat(fsb.fsys, fs_storage_name(path))
+	if err != nil {
+		return StorageFileInfo{}, err
+	}
+	return StorageFileInfo{Size: info.Size(), Mod_time: info.ModTime()}, nil
+}
+
+func (fsb *FSStorageBackend) Delete(path string) error {
+	wfs, err := fsb.writable()
+	if err != nil {
+		return err
+	}
+	return wfs.Remove(fs_storage_name(path))
+}
@@ -0,0 +1,116 @@
+package util_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/1f604/util"
+)
+
+func new_test_cppum_in_backend(t *testing.T, backend util.StorageBackend) *util.ConcurrentPersistentPermanentURLMap {
+	t.Helper()
+
+	// These paths don't exist on the real file system, everything lives in the backend.
+	err := backend.MkdirAll("/nonexistent/logs")
+	util.Assert_no_error(t, err, 1)
+	return util.CreateConcurrentPersistentPermanentURLMapFromDisk(&util.CPPUMParams{
+		Log_directory_path_absolute:    "/nonexistent/logs",
+		Bucket_directory_path_absolute: "/nonexistent/pastes",
+		B53m:                           util.NewBase53IDManager(),
+		Generate_strings_up_to:         2,
+		Log_file_max_size_bytes:        100,
+		Size_file_rounded_multiple:     5,
+		Size_file_path_absolute:        "/nonexistent/size.txt",
+		Xattr_params:                   &util.XattrParams{},
+		Storage_backend:                backend,
+	})
+}
+
+func Test_CPPUM_Memory_Storage_Backend_Survives_Restart(t *testing.T) {
+	t.Parallel()
+
+	backend := util.NewMemoryStorageBackend()
+	cppum := new_test_cppum_in_backend(t, backend)
+
+	url_key, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	paste_key, err := cppum.PutEntry(4, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	// Enough entries to rotate the log file a few times
+	for i := 0; i < 5; i++ {
+		_, err = cppum.PutEntry(4, "example.com/"+util.Int64_to_string(int64(i)), 0, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+	}
+	_, err = os.Stat("/nonexistent")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Expected nothing to be written to the real file system, got:", err)
+	}
+
+	cppum = new_test_cppum_in_backend(t, backend)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 7, 1)
+	util.Assert_result_equals_interface(t, cppum.NumPastes(), nil, 1, 1)
+	item, err := cppum.GetEntry(url_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "google.com", 1)
+	item, err = cppum.GetEntry(paste_key)
+	util.Assert_no_error(t, err, 1)
+	contents, err := backend.GetBlob(item.GetValue())
+	util.Assert_result_equals_bytes(t, contents, err, "hello world", 1)
+
+	log_files, err := backend.ListSegments("/nonexistent/logs")
+	util.Assert_no_error(t, err, 1)
+	if len(log_files) < 2 {
+		t.Fatal("Expected the log file to have been rotated, got:", log_files)
+	}
+}
+
+func Test_FS_Storage_Backend(t *testing.T) {
+	t.Parallel()
+
+	backend := util.NewFSStorageBackend(fstest.MapFS{
+		"logs/0.log":  {Data: []byte("first")},
+		"logs/1.log":  {Data: []byte("second")},
+		"logs/subdir": {Mode: os.ModeDir},
+	})
+	names, err := backend.ListSegments("/logs")
+	util.Assert_result_equals_string_slice(t, names, err, []string{"0.log", "1.log"}, 1)
+	contents, err := backend.GetBlob("/logs/1.log")
+	util.Assert_result_equals_bytes(t, contents, err, "second", 1)
+	info, err := backend.Stat("/logs/0.log")
+	util.Assert_result_equals_interface(t, info.Size, err, int64(5), 1)
+	_, err = backend.GetBlob("/logs/2.log")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Expected os.ErrNotExist, got:", err)
+	}
+
+	// fstest.MapFS is read-only
+	err = backend.AppendToSegment("/logs/1.log", []byte("more"))
+	if !errors.As(err, &util.StorageReadOnlyError{}) {
+		t.Fatal("Expected StorageReadOnlyError, got:", err)
+	}
+}
+
+func Test_Log_Storage_Returns_Errors_Instead_Of_Exiting(t *testing.T) {
+	t.Parallel()
+
+	backend := util.NewMemoryStorageBackend()
+	util.Assert_no_error(t, backend.MkdirAll("/nonexistent/logs"), 1)
+
+	// The file that LSPS would rotate to already exists
+	lsps := util.NewLogStructuredPermanentStorageWithBackend(backend, 0, "/nonexistent/logs")
+	util.Assert_no_error(t, lsps.AppendNewEntry("00", "a.com", util.TYPE_MAP_ITEM_URL, 1700000000), 1)
+	util.Assert_no_error(t, backend.AppendToSegment("/nonexistent/logs/1.log", []byte{}), 1)
+	err := lsps.AppendNewEntry("02", "b.com", util.TYPE_MAP_ITEM_URL, 1700000000)
+	util.Assert_result_equals_bool(t, errors.Is(err, os.ErrExist), nil, true, 1)
+
+	// A file with a bad name doesn't stop the expired buckets from being deleted
+	util.Assert_no_error(t, backend.MkdirAll("/nonexistent/buckets"), 1)
+	lbses := util.NewLogBucketStructuredExpiringStorageWithBackend(backend, 100, "/nonexistent/buckets")
+	util.Assert_no_error(t, lbses.AppendNewEntry("00", "a.com", util.TYPE_MAP_ITEM_URL, 1000), 1)
+	util.Assert_no_error(t, backend.AppendToSegment("/nonexistent/buckets/not_a_bucket", []byte{}), 1)
+	err = lbses.DeleteExpiredLogFiles(0)
+	util.Assert_result_equals_bool(t, err != nil, nil, true, 1)
+	names, err := backend.ListSegments("/nonexistent/buckets")
+	util.Assert_result_equals_interface(t, len(names), err, 1, 1)
+}
@@ -0,0 +1,113 @@
+// Keeps track of whether the maps can write to storage.
+// When a write fails (disk full, I/O error, read-only file system etc.) the map goes into read-only mode: GetEntry keeps working and PutEntry returns ErrStorageUnavailable.
+// Nothing has to be done to get out of read-only mode. Every so often a PutEntry is let through to try again, and as soon as one succeeds the map is writable again.
+package util
+
+import (
+	"errors"
+	"sync"
+)
+
+// Returned by PutEntry while the map is read-only, and wraps the storage error that caused it.
+// Use errors.Is(err, ErrStorageUnavailable) to check for it.
+type StorageUnavailableError struct {
+	Err error // nil if the write wasn't attempted because the map is read-only
+}
+
+var ErrStorageUnavailable = StorageUnavailableError{Err: nil}
+
+func (e StorageUnavailableError) Error() string {
+	if e.Err == nil {
+		return "Storage is unavailable, the map is read-only"
+	}
+	return "Storage is unavailable, the map is read-only: " + e.Err.Error()
+}
+
+func (e StorageUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+func (e StorageUnavailableError) Is(target error) bool {
+	_, ok := target.(StorageUnavailableError) //nolint:errorlint // it's the type that matters
+	return ok
+}
+
+type StorageStatus struct {
+	Writable          bool
+	Last_error        string // The error that made the map read-only. Empty if writable.
+	Unavailable_since int64  // Unix time of the first failed write. 0 if writable.
+	Last_attempt      int64  // Unix time of the last write that was tried while read-only. 0 if writable.
+}
+
+type StorageHealth struct {
+	mut                    sync.Mutex
+	clock                  Clock
+	retry_interval_seconds int64
+	status                 StorageStatus
+}
+
+// While the storage is unavailable, a write is let through at most once every retry_interval_seconds to see if it works again.
+// 0 means every write is tried.
+func NewStorageHealth(retry_interval_seconds int64, clock Clock) *StorageHealth {
+	return &StorageHealth{
+		mut:                    sync.Mutex{},
+		clock:                  clock_or_real(clock),
+		retry_interval_seconds: retry_interval_seconds,
+		status:                 StorageStatus{Writable: true},
+	}
+}
+
+func (sh *StorageHealth) Status() StorageStatus {
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+
+	return sh.status
+}
+
+// Returns whether a write should be tried. If the storage is unavailable, this only returns true once every retry interval.
+func (sh *StorageHealth) allow_write() bool {
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+
+	if sh.status.Writable {
+		return true
+	}
+	now := sh.clock()
+	if now-sh.status.Last_attempt < sh.retry_interval_seconds {
+		return false
+	}
+	sh.status.Last_attempt = now
+	return true
+}
+
+func (sh *StorageHealth) record_result(err error) {
+	sh.mut.Lock()
+	defer sh.mut.Unlock()
+
+	if err == nil {
+		sh.status = StorageStatus{Writable: true}
+		return
+	}
+	if !errors.Is(err, ErrStorageUnavailable) {
+		// e.g. the URL was invalid, which says nothing about the storage
+		return
+	}
+	if sh.status.Writable {
+		now := sh.clock()
+		sh.status.Writable = false
+		sh.status.Unavailable_since = now
+		sh.status.Last_attempt = now
+	}
+	sh.status.Last_error = err.Error()
+}
+
+// Calls put_fn unless the map is read-only, and updates the health according to what put_fn returns.
+// put_fn must wrap storage errors in StorageUnavailableError, which Write_Entry_Durably_Common does.
+func PutEntry_Storage_Health_Common(sh *StorageHealth, put_fn func() (string, error)) (string, error) {
+	if !sh.allow_write() {
+		return "", ErrStorageUnavailable
+	}
+	key, err := put_fn()
+	sh.record_result(err)
+	return key, err
+}
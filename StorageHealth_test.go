@@ -0,0 +1,55 @@
+package util_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func Test_Read_Only_Mode_When_Disk_Is_Full(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cppum := h.StartCPPUM(func(p *util.CPPUMParams) { p.Storage_retry_interval_seconds = 60 })
+	key, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	// Invalid input says nothing about the storage
+	_, err = cppum.PutEntry(4, "bad\turl", 0, util.TYPE_MAP_ITEM_URL)
+	if err == nil || errors.Is(err, util.ErrStorageUnavailable) {
+		t.Fatal("Expected a validation error, got:", err)
+	}
+	util.Assert_result_equals_bool(t, cppum.StorageStatus().Writable, nil, true, 1)
+
+	h.Backend.SetDiskFull(true)
+	_, err = cppum.PutEntry(4, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+	if !errors.Is(err, util.ErrStorageUnavailable) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal("Expected ErrStorageUnavailable caused by ENOSPC, got:", err)
+	}
+	status := cppum.StorageStatus()
+	util.Assert_result_equals_bool(t, status.Writable, nil, false, 1)
+	util.Assert_result_equals_interface(t, status.Unavailable_since, nil, h.Clock.Now(), 1)
+
+	// Reads keep working
+	item, err := cppum.GetEntry(key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "google.com", 1)
+
+	// Writes fail straight away until the retry interval is up, even if there's space again
+	h.Backend.SetDiskFull(false)
+	writes_before := h.Backend.Writes()
+	_, err = cppum.PutEntryWithID("2y", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	if !errors.Is(err, util.ErrStorageUnavailable) {
+		t.Fatal("Expected ErrStorageUnavailable, got:", err)
+	}
+	util.Assert_result_equals_interface(t, h.Backend.Writes(), nil, writes_before, 1)
+
+	h.Clock.Advance(60)
+	_, err = cppum.PutEntryWithID("2y", "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_bool(t, cppum.StorageStatus().Writable, nil, true, 1)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 2, 1)
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 0, 1)
+}
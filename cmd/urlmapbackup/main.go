@@ -0,0 +1,123 @@
+// Command-line tool for backing up log directories and restoring them.
+//
+// Back up the log files (and their pastes) that aren't in the backup directory yet. For expiring maps (-expiring) that means snapshots of the live buckets:
+//
+//	urlmapbackup backup -logdir /opt/urlmap/logs -target /mnt/backups/urlmap
+//
+// Or write them to a tar file, using the manifest from the previous tar backup to skip what it already has:
+//
+//	urlmapbackup backup -logdir /opt/urlmap/logs -tar backup2.tar -prev-manifest manifest1.json
+//
+// Rebuild a log directory from a backup directory, leaving out everything after a given time:
+//
+//	urlmapbackup restore -backup /mnt/backups/urlmap -logdir /opt/urlmap/logs -pastedir /opt/urlmap/pastes -until 1700000000
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/1f604/util"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: urlmapbackup backup|restore [flags]")
+	fmt.Fprintln(os.Stderr, "Run urlmapbackup backup -h or urlmapbackup restore -h for the list of flags.")
+	os.Exit(2) //nolint:gomnd // 2 is the conventional exit code for usage errors
+}
+
+func main() {
+	if len(os.Args) < 2 { //nolint:gomnd // need the subcommand
+		usage()
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	log_dir := fs.String("logdir", "", "absolute path of the log directory")
+	expiring := fs.Bool("expiring", false, "the log directory belongs to the expiring map (bucketed logs) rather than the permanent map (backup only)")
+	allow_alias_ids := fs.Bool("allow-alias-ids", false, "accept keys that are not valid Base53 IDs")
+	target := fs.String("target", "", "absolute path of the backup directory (backup only)")
+	tar_path := fs.String("tar", "", "write a tar file instead of backing up into a directory (backup only)")
+	prev_manifest := fs.String("prev-manifest", "", "manifest of the previous tar backup, so that only new files are included (backup only)")
+	manifest_out := fs.String("manifest-out", "", "where to write the updated manifest after a tar backup (backup only)")
+	backup_dir := fs.String("backup", "", "absolute path of the backup directory to restore from (restore only)")
+	paste_dir := fs.String("pastedir", "", "absolute path of the paste directory to restore into (restore only)")
+	until := fs.Int64("until", 0, "only restore records with timestamps up to this unix time, 0 for everything (restore only)")
+	bucket_interval := fs.Int64("bucket-interval", 0, "bucket interval in seconds (restoring an expiring map only)")
+	log_file_max_size := fs.Int64("log-file-max-size", 100*1024*1024, "max log file size in bytes (restoring a permanent map only)") //nolint:gomnd // 100MB
+	set_xattr := fs.Bool("set-xattr", false, "set the can_be_served xattr on restored paste files (restore only)")
+	err := fs.Parse(os.Args[2:])
+	util.Check_err(err)
+
+	if *log_dir == "" {
+		log.Fatal("-logdir is required")
+	}
+
+	switch os.Args[1] {
+	case "backup":
+		params := util.BackupParams{
+			Log_directory_path_absolute: *log_dir,
+			Expiring:                    *expiring,
+			B53m:                        util.NewBase53IDManager(),
+			Allow_alias_ids:             *allow_alias_ids,
+		}
+		var report *util.BackupReport
+		switch {
+		case *target != "":
+			report, err = util.BackupToDirectory(&params, *target)
+		case *tar_path != "":
+			var previous *util.BackupManifest
+			if *prev_manifest != "" {
+				previous, err = util.Read_Backup_Manifest(*prev_manifest)
+				util.Check_err(err)
+			}
+			f, err := os.Create(*tar_path)
+			util.Check_err(err)
+			var manifest *util.BackupManifest
+			manifest, report, err = util.BackupToTar(&params, previous, f)
+			util.Check_err(err)
+			util.Check_err(f.Close())
+			if *manifest_out != "" {
+				data, err := json.MarshalIndent(manifest, "", "  ")
+				util.Check_err(err)
+				util.Check_err(os.WriteFile(*manifest_out, data, 0o644)) //nolint:gosec // it's not secret
+			}
+		default:
+			log.Fatal("-target or -tar is required")
+		}
+		if err != nil {
+			log.Fatal("Backup failed: ", err)
+		}
+		for _, path := range report.Missing_pastes {
+			log.Println("Paste file no longer exists:", path)
+		}
+		log.Println("Copied", report.Log_files_copied, "log files and", report.Paste_files_copied, "paste files")
+	case "restore":
+		if *backup_dir == "" || *paste_dir == "" {
+			log.Fatal("-backup and -pastedir are required")
+		}
+		count, err := util.RestoreFromBackup(&util.RestoreParams{
+			Backup_directory_path_absolute: *backup_dir,
+			Log_directory_path_absolute:    *log_dir,
+			Paste_directory_path_absolute:  *paste_dir,
+			Bucket_interval:                *bucket_interval,
+			Log_file_max_size_bytes:        *log_file_max_size,
+			B53m:                           util.NewBase53IDManager(),
+			Allow_alias_ids:                *allow_alias_ids,
+			Xattr_params: &util.XattrParams{
+				SetXattr:   *set_xattr,
+				XattrName:  util.XATTR_1F604_FILESERVER_CAN_BE_SERVED,
+				Xattrvalue: "true",
+			},
+			Until_timestamp: *until,
+		})
+		if err != nil {
+			log.Fatal("Restore failed after ", count, " entries: ", err)
+		}
+		log.Println("Restored", count, "entries")
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,90 @@
+// Command-line tool for exporting and importing URL map data.
+//
+// Export the live entries of a log directory to stdout:
+//
+//	urlmapdata export -logdir /opt/urlmap/logs -expiring -format jsonl > entries.jsonl
+//
+// Import them into a fresh log directory on another server:
+//
+//	urlmapdata import -logdir /opt/urlmap/logs -pastedir /opt/urlmap/pastes -expiring -bucket-interval 86400 -format jsonl < entries.jsonl
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/1f604/util"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: urlmapdata export|import [flags]")
+	fmt.Fprintln(os.Stderr, "Run urlmapdata export -h or urlmapdata import -h for the list of flags.")
+	os.Exit(2) //nolint:gomnd // 2 is the conventional exit code for usage errors
+}
+
+func main() {
+	if len(os.Args) < 2 { //nolint:gomnd // need the subcommand
+		usage()
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	log_dir := fs.String("logdir", "", "absolute path of the log directory")
+	paste_dir := fs.String("pastedir", "", "absolute path of the paste directory (import only)")
+	expiring := fs.Bool("expiring", false, "the log directory belongs to the expiring map (bucketed logs) rather than the permanent map")
+	format := fs.String("format", "jsonl", "jsonl or csv")
+	allow_alias_ids := fs.Bool("allow-alias-ids", false, "accept keys that are not valid Base53 IDs")
+	bucket_interval := fs.Int64("bucket-interval", 0, "bucket interval in seconds (import into expiring map only)")
+	log_file_max_size := fs.Int64("log-file-max-size", 100*1024*1024, "max log file size in bytes (import into permanent map only)") //nolint:gomnd // 100MB
+	set_xattr := fs.Bool("set-xattr", false, "set the can_be_served xattr on imported paste files")
+	err := fs.Parse(os.Args[2:])
+	util.Check_err(err)
+
+	if *log_dir == "" {
+		log.Fatal("-logdir is required")
+	}
+
+	switch os.Args[1] {
+	case "export":
+		count, err := util.ExportLogDirectory(&util.ExportParams{
+			Log_directory_path_absolute: *log_dir,
+			Expiring:                    *expiring,
+			B53m:                        util.NewBase53IDManager(),
+			Allow_alias_ids:             *allow_alias_ids,
+			Format:                      util.ExportFormat(*format),
+		}, os.Stdout)
+		if err != nil {
+			log.Fatal("Export failed after ", count, " entries: ", err)
+		}
+		log.Println("Exported", count, "entries")
+	case "import":
+		if *paste_dir == "" {
+			log.Fatal("-pastedir is required")
+		}
+		if *expiring && *bucket_interval <= 0 {
+			log.Fatal("-bucket-interval is required when importing into the expiring map")
+		}
+		count, err := util.ImportIntoLogDirectory(&util.ImportParams{
+			Log_directory_path_absolute:   *log_dir,
+			Paste_directory_path_absolute: *paste_dir,
+			Expiring:                      *expiring,
+			Bucket_interval:               *bucket_interval,
+			Log_file_max_size_bytes:       *log_file_max_size,
+			B53m:                          util.NewBase53IDManager(),
+			Allow_alias_ids:               *allow_alias_ids,
+			Xattr_params: &util.XattrParams{
+				SetXattr:   *set_xattr,
+				XattrName:  util.XATTR_1F604_FILESERVER_CAN_BE_SERVED,
+				Xattrvalue: "true",
+			},
+			Format: util.ExportFormat(*format),
+		}, os.Stdin)
+		if err != nil {
+			log.Fatal("Import failed after ", count, " entries: ", err)
+		}
+		log.Println("Imported", count, "entries")
+	default:
+		usage()
+	}
+}
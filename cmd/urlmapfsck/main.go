@@ -0,0 +1,53 @@
+// Offline checker for URL store log and paste directories. Stop the server before running this.
+//
+// Check only:
+//
+//	urlmapfsck -logdir /opt/urlmap/logs -pastedir /opt/urlmap/pastes -expiring
+//
+// Check and repair, moving bad records and files into the quarantine directory and deleting orphaned pastes:
+//
+//	urlmapfsck -logdir /opt/urlmap/logs -pastedir /opt/urlmap/pastes -expiring -repair -quarantine /opt/urlmap/quarantine
+//
+// Exits with status 1 if any problems were found.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/1f604/util"
+)
+
+func main() {
+	log_dir := flag.String("logdir", "", "absolute path of the log directory")
+	paste_dir := flag.String("pastedir", "", "absolute path of the paste directory. If empty, paste files are not checked")
+	expiring := flag.Bool("expiring", false, "the log directory belongs to the expiring map (bucketed logs) rather than the permanent map")
+	allow_alias_ids := flag.Bool("allow-alias-ids", false, "accept keys that are not valid Base53 IDs")
+	repair := flag.Bool("repair", false, "quarantine bad records and files, and delete orphaned paste files")
+	quarantine_dir := flag.String("quarantine", "", "absolute path of the quarantine directory (required with -repair)")
+	flag.Parse()
+
+	if *log_dir == "" {
+		log.Fatal("-logdir is required")
+	}
+
+	report, err := util.Fsck(&util.FsckParams{
+		Log_directory_path_absolute:        *log_dir,
+		Paste_directory_path_absolute:      *paste_dir,
+		Expiring:                           *expiring,
+		B53m:                               util.NewBase53IDManager(),
+		Allow_alias_ids:                    *allow_alias_ids,
+		Repair:                             *repair,
+		Quarantine_directory_path_absolute: *quarantine_dir,
+	})
+	if report != nil {
+		report.Print(os.Stdout)
+	}
+	if err != nil {
+		log.Fatal("Fsck failed: ", err)
+	}
+	if len(report.Problems) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,197 @@
+// Runs a permanent URL map as a replication leader or follower, so that replication can be tried out locally with two processes.
+//
+// Start a leader and put something into it:
+//
+//	urlmapreplica leader -dir /tmp/leader -listen localhost:8081
+//	curl -X POST --data 'https://example.com' 'localhost:8081/put?type=url'
+//
+// Start a follower and read from it:
+//
+//	urlmapreplica follower -dir /tmp/follower -listen localhost:8082 -leader http://localhost:8081/replication/
+//	curl 'localhost:8082/get?id=...'
+//
+// Promote the follower by hand, after which it accepts writes and can be followed itself:
+//
+//	curl -X POST localhost:8082/promote
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/1f604/util"
+)
+
+type replica_server struct {
+	mut          sync.Mutex
+	cppum        *util.ConcurrentPersistentPermanentURLMap // nil while following
+	follower     *util.ReplicationFollower                 // nil once promoted
+	leader       *util.ReplicationLeader
+	cppum_params *util.CPPUMParams
+}
+
+func (s *replica_server) handle_get(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var item util.MapItem
+	var err error
+	if s.cppum != nil {
+		item, err = s.cppum.GetEntry(r.URL.Query().Get("id"))
+	} else {
+		item, err = s.follower.GetEntry(r.URL.Query().Get("id"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if item.GetType().ValueType == util.TYPE_MAP_ITEM_PASTE {
+		http.ServeFile(w, r, item.GetValue())
+		return
+	}
+	fmt.Fprintln(w, item.GetValue())
+}
+
+func (s *replica_server) handle_put(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.cppum == nil {
+		http.Error(w, "This is a read-only follower", http.StatusForbidden)
+		return
+	}
+	value_type, err := util.Parse_MapItemValueType(r.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, err := s.cppum.PutEntry(6, string(body), 0, value_type) //nolint:gomnd // 6 characters is plenty
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, key)
+}
+
+func (s *replica_server) handle_replication(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	leader := s.leader
+	s.mut.Unlock()
+
+	if leader == nil {
+		http.Error(w, "Not a leader", http.StatusServiceUnavailable)
+		return
+	}
+	leader.ServeHTTP(w, r)
+}
+
+func (s *replica_server) handle_promote(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.follower == nil {
+		http.Error(w, "Already a leader", http.StatusConflict)
+		return
+	}
+	// Catch up with whatever the leader has, in case it's still reachable
+	for {
+		applied, err := s.follower.SyncOnce()
+		if err != nil || applied == 0 {
+			break
+		}
+	}
+	cppum, err := s.follower.Promote(s.cppum_params)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.cppum = cppum
+	s.follower = nil
+	s.leader = util.NewReplicationLeader(s.cppum_params.Log_directory_path_absolute, s.cppum_params.Bucket_directory_path_absolute)
+	log.Println("Promoted to leader")
+	fmt.Fprintln(w, "Promoted")
+}
+
+func main() {
+	if len(os.Args) < 2 || (os.Args[1] != "leader" && os.Args[1] != "follower") { //nolint:gomnd // need the subcommand
+		fmt.Fprintln(os.Stderr, "Usage: urlmapreplica leader|follower [flags]")
+		os.Exit(2) //nolint:gomnd // 2 is the conventional exit code for usage errors
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	dir := fs.String("dir", "", "absolute path of the data directory. Logs, pastes, the size file and the replication state go in here.")
+	listen := fs.String("listen", "localhost:8081", "address to listen on")
+	leader_url := fs.String("leader", "", "URL of the leader's replication handler (follower only)")
+	poll_interval := fs.Int("poll-interval", 1, "seconds between polls when there's nothing new (follower only)")
+	err := fs.Parse(os.Args[2:])
+	util.Check_err(err)
+	if *dir == "" {
+		log.Fatal("-dir is required")
+	}
+
+	log_dir := filepath.Join(*dir, "logs")
+	paste_dir := filepath.Join(*dir, "pastes")
+	err = os.MkdirAll(log_dir, os.ModePerm)
+	util.Check_err(err)
+	s := replica_server{
+		cppum_params: &util.CPPUMParams{
+			Log_directory_path_absolute:    log_dir,
+			Bucket_directory_path_absolute: paste_dir,
+			B53m:                           util.NewBase53IDManager(),
+			Generate_strings_up_to:         2,
+			Log_file_max_size_bytes:        1024 * 1024, //nolint:gomnd // 1MB
+			Size_file_rounded_multiple:     100,         //nolint:gomnd // whatever
+			Size_file_path_absolute:        filepath.Join(*dir, "size.txt"),
+			Xattr_params:                   &util.XattrParams{},
+		},
+	}
+
+	if os.Args[1] == "leader" {
+		s.cppum = util.CreateConcurrentPersistentPermanentURLMapFromDisk(s.cppum_params)
+		s.leader = util.NewReplicationLeader(log_dir, paste_dir)
+	} else {
+		if *leader_url == "" {
+			log.Fatal("-leader is required")
+		}
+		s.follower, err = util.StartReplicationFollower(&util.ReplicationFollowerParams{
+			Leader_url:                     *leader_url,
+			Log_directory_path_absolute:    log_dir,
+			Bucket_directory_path_absolute: paste_dir,
+			Size_file_path_absolute:        s.cppum_params.Size_file_path_absolute,
+			State_file_path_absolute:       filepath.Join(*dir, "replication_state.txt"),
+			B53m:                           s.cppum_params.B53m,
+			Log_file_max_size_bytes:        s.cppum_params.Log_file_max_size_bytes,
+			Size_file_rounded_multiple:     s.cppum_params.Size_file_rounded_multiple,
+			Xattr_params:                   s.cppum_params.Xattr_params,
+			Poll_interval_seconds:          *poll_interval,
+		})
+		util.Check_err(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", s.handle_get)
+	mux.HandleFunc("/put", s.handle_put)
+	mux.HandleFunc("/promote", s.handle_promote)
+	mux.HandleFunc("/replication/", s.handle_replication)
+	log.Println("Running as", os.Args[1], "on", *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux)) //nolint:gosec // it's a demo tool
+}
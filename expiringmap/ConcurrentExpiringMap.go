@@ -0,0 +1,346 @@
+// A generic map with expiring entries, i.e. a TTL cache. It knows nothing about URLs or pastes, so it can be used for anything with an expiry time, e.g. tokens or sessions.
+// util.ConcurrentExpiringMap (the URL store) is a thin wrapper over ConcurrentExpiringMap[string, *util.ExpiringMapItem].
+//
+// Expiry times are unix timestamps in seconds, read from Options.Clock.
+// Get never returns an expired entry, but expired entries stay in RAM until RemoveExpired gets to them (or the janitor does, if there is one).
+// RemoveExpired works in batches and lets go of the lock between batches, so it never holds up readers for long.
+// Uses sync.Mutex to protect concurrent access, rather than a RWMutex, since Get has to update the LRU list anyway.
+package expiringmap
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Returns the current unix time in seconds.
+type Clock func() int64
+
+func real_clock() int64 {
+	return time.Now().Unix()
+}
+
+type RemovalReason int
+
+const (
+	REMOVAL_REASON_EXPIRED RemovalReason = iota // RemoveExpired found the entry had expired
+	REMOVAL_REASON_EVICTED                      // The map was full and the entry was evicted to make room
+)
+
+func (r RemovalReason) String() string {
+	switch r {
+	case REMOVAL_REASON_EXPIRED:
+		return "expired"
+	case REMOVAL_REASON_EVICTED:
+		return "evicted"
+	}
+	return "unknown"
+}
+
+type KeyAlreadyExistsError struct{}
+
+func (e KeyAlreadyExistsError) Error() string {
+	return "expiringmap: key already exists"
+}
+
+// Called with the map's lock held, so it must not call back into the map. Not called for Delete, since the caller already knows.
+type ExpiryCallback[K comparable, V any] func(key K, value V, reason RemovalReason)
+
+// How many entries RemoveExpired removes before letting go of the lock so that readers can get in
+const DEFAULT_EXPIRY_BATCH_SIZE = 10000
+
+// The zero value is a map with no limits, no callback, no janitor, a heap expiry index and the real clock.
+type Options[K comparable, V any] struct {
+	Initial_size             int64
+	Expiry_callback          ExpiryCallback[K, V]
+	Clock                    Clock          // nil means the real clock
+	Expiry_index             ExpiryIndex[K] // nil means a HeapExpiryIndex. Must be empty.
+	Expiry_batch_size        int            // 0 means DEFAULT_EXPIRY_BATCH_SIZE
+	Capacity                 Capacity[K, V] // The zero value means unlimited. See Capacity.
+	Janitor_interval_seconds int            // If not 0, a goroutine calls RemoveExpired this often until Close is called.
+	Extra_keeparound_seconds int64          // What the janitor passes to RemoveExpired
+}
+
+type map_entry[K comparable, V any] struct {
+	value       V
+	expiry_time int64
+	size        int64         // from Capacity.Size_of, 0 if there isn't one
+	lru_element *list.Element // nil unless the eviction policy is LRU
+}
+
+type ConcurrentExpiringMap[K comparable, V any] struct {
+	mut               sync.Mutex
+	m                 map[K]*map_entry[K, V]
+	expiry_index      ExpiryIndex[K]
+	expiry_callback   ExpiryCallback[K, V]
+	clock             Clock
+	expiry_batch_size int
+	capacity          Capacity[K, V]
+	total_bytes       int64      // sum of the entries' sizes
+	lru               *list.List // front is the most recently used key. nil unless the eviction policy is LRU.
+	stop_janitor      chan struct{}
+	close_once        sync.Once
+}
+
+func New[K comparable, V any](options Options[K, V]) *ConcurrentExpiringMap[K, V] {
+	cem := &ConcurrentExpiringMap[K, V]{
+		mut:               sync.Mutex{},
+		m:                 make(map[K]*map_entry[K, V], options.Initial_size),
+		expiry_index:      options.Expiry_index,
+		expiry_callback:   options.Expiry_callback,
+		clock:             options.Clock,
+		expiry_batch_size: options.Expiry_batch_size,
+		capacity:          Capacity[K, V]{}, //nolint:exhaustruct // set below
+		total_bytes:       0,
+		lru:               nil,
+		stop_janitor:      make(chan struct{}),
+		close_once:        sync.Once{},
+	}
+	if cem.expiry_index == nil {
+		cem.expiry_index = NewHeapExpiryIndex[K](options.Initial_size)
+	}
+	if cem.clock == nil {
+		cem.clock = real_clock
+	}
+	if cem.expiry_batch_size < 1 {
+		cem.expiry_batch_size = DEFAULT_EXPIRY_BATCH_SIZE
+	}
+	cem.set_capacity_locked(options.Capacity)
+	if options.Janitor_interval_seconds > 0 {
+		go cem.run_janitor(time.Duration(options.Janitor_interval_seconds)*time.Second, options.Extra_keeparound_seconds)
+	}
+	return cem
+}
+
+func (cem *ConcurrentExpiringMap[K, V]) run_janitor(interval time.Duration, extra_keeparound_seconds int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cem.RemoveExpired(extra_keeparound_seconds)
+		case <-cem.stop_janitor:
+			return
+		}
+	}
+}
+
+// Stops the janitor. The map can still be used afterwards.
+func (cem *ConcurrentExpiringMap[K, V]) Close() {
+	cem.close_once.Do(func() { close(cem.stop_janitor) })
+}
+
+// Makes the map use the given clock to decide which entries have expired. nil means the real clock.
+func (cem *ConcurrentExpiringMap[K, V]) SetClock(clock Clock) {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	if clock == nil {
+		clock = real_clock
+	}
+	cem.clock = clock
+}
+
+// Replaces the expiry index, e.g. with a BucketedExpiryIndex. Only call this while the map is empty.
+func (cem *ConcurrentExpiringMap[K, V]) SetExpiryIndex(expiry_index ExpiryIndex[K]) {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	if len(cem.m) != 0 || cem.expiry_index.Len() != 0 {
+		panic("SetExpiryIndex called on a map that isn't empty")
+	}
+	cem.expiry_index = expiry_index
+}
+
+// Sets how many entries RemoveExpired removes each time it takes the lock. Anything less than 1 means DEFAULT_EXPIRY_BATCH_SIZE.
+func (cem *ConcurrentExpiringMap[K, V]) SetExpiryBatchSize(batch_size int) {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	if batch_size < 1 {
+		batch_size = DEFAULT_EXPIRY_BATCH_SIZE
+	}
+	cem.expiry_batch_size = batch_size
+}
+
+// The time according to the map's clock, for comparing with what GetWithExpiry returns
+func (cem *ConcurrentExpiringMap[K, V]) Now() int64 {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	return cem.clock()
+}
+
+func (cem *ConcurrentExpiringMap[K, V]) Len() int {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	return len(cem.m)
+}
+
+// Caller must hold cem.mut
+func (cem *ConcurrentExpiringMap[K, V]) touch(entry *map_entry[K, V]) {
+	if entry.lru_element != nil {
+		cem.lru.MoveToFront(entry.lru_element)
+	}
+}
+
+// Caller must hold cem.mut
+func (cem *ConcurrentExpiringMap[K, V]) remove_locked(key K, entry *map_entry[K, V]) {
+	if entry.lru_element != nil {
+		cem.lru.Remove(entry.lru_element)
+	}
+	cem.total_bytes -= entry.size
+	delete(cem.m, key)
+}
+
+// Caller must hold cem.mut and must have checked that key isn't in the map
+func (cem *ConcurrentExpiringMap[K, V]) insert_locked(key K, value V, expiry_time int64) error {
+	size := cem.size_of(key, value)
+	err := cem.make_room_locked(1, size, nil)
+	if err != nil {
+		return err
+	}
+	entry := &map_entry[K, V]{value: value, expiry_time: expiry_time, size: size, lru_element: nil}
+	if cem.lru != nil {
+		entry.lru_element = cem.lru.PushFront(key)
+	}
+	cem.m[key] = entry
+	cem.total_bytes += size
+	cem.expiry_index.Add(key, expiry_time)
+	return nil
+}
+
+// Inserts the entry, or replaces it if the key is already in the map.
+// Only returns an error (MapFullError) if the map is full and the eviction policy is EVICTION_POLICY_REJECT_NEW.
+func (cem *ConcurrentExpiringMap[K, V]) Put(key K, value V, expiry_time int64) error {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	entry, ok := cem.m[key]
+	if !ok {
+		return cem.insert_locked(key, value, expiry_time)
+	}
+	size := cem.size_of(key, value)
+	err := cem.make_room_locked(0, size-entry.size, entry)
+	if err != nil {
+		return err
+	}
+	cem.total_bytes += size - entry.size
+	entry.value = value
+	entry.size = size
+	if entry.expiry_time != expiry_time {
+		entry.expiry_time = expiry_time
+		cem.expiry_index.Add(key, expiry_time)
+	}
+	cem.touch(entry)
+	return nil
+}
+
+// Inserts the entry. Returns KeyAlreadyExistsError and changes nothing if the key is already in the map, even if its entry has expired but hasn't been removed yet.
+// Returns MapFullError in the same cases as Put.
+func (cem *ConcurrentExpiringMap[K, V]) PutNew(key K, value V, expiry_time int64) error {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	if _, ok := cem.m[key]; ok {
+		return KeyAlreadyExistsError{}
+	}
+	return cem.insert_locked(key, value, expiry_time)
+}
+
+// Returns false if the key isn't in the map or its entry has expired.
+func (cem *ConcurrentExpiringMap[K, V]) Get(key K) (V, bool) {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	entry, ok := cem.m[key]
+	if !ok || entry.expiry_time <= cem.clock() {
+		var zero_value V
+		return zero_value, false
+	}
+	cem.touch(entry)
+	return entry.value, true
+}
+
+// Same as Get except that it also returns entries that have expired but haven't been removed yet, so you can tell "expired" apart from "never existed".
+func (cem *ConcurrentExpiringMap[K, V]) GetWithExpiry(key K) (V, int64, bool) {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	entry, ok := cem.m[key]
+	if !ok {
+		var zero_value V
+		return zero_value, 0, false
+	}
+	cem.touch(entry)
+	return entry.value, entry.expiry_time, true
+}
+
+// Removes the entry without calling the expiry callback. Returns false if the key wasn't in the map.
+func (cem *ConcurrentExpiringMap[K, V]) Delete(key K) bool {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	entry, ok := cem.m[key]
+	if !ok {
+		return false
+	}
+	cem.remove_locked(key, entry)
+	return true
+}
+
+// Changes the expiry time of an entry. It can be moved earlier as well as later. Returns false if the key isn't in the map.
+func (cem *ConcurrentExpiringMap[K, V]) Extend(key K, new_expiry_time int64) bool {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	entry, ok := cem.m[key]
+	if !ok {
+		return false
+	}
+	if entry.expiry_time != new_expiry_time {
+		entry.expiry_time = new_expiry_time
+		cem.expiry_index.Add(key, new_expiry_time) // the old index entry is skipped when it comes up
+	}
+	return true
+}
+
+// fn must not modify the map. Includes entries that have expired but haven't been removed yet.
+func (cem *ConcurrentExpiringMap[K, V]) ForEach(fn func(key K, value V, expiry_time int64)) {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	for k, entry := range cem.m {
+		fn(k, entry.value, entry.expiry_time)
+	}
+}
+
+// Removes every entry that expired more than extra_keeparound_seconds ago, calling the expiry callback for each.
+// Keeping entries around for a while after they expire lets callers tell people that something has expired rather than that it never existed.
+// Entries are removed in batches, and the lock is released between batches.
+func (cem *ConcurrentExpiringMap[K, V]) RemoveExpired(extra_keeparound_seconds int64) {
+	for cem.remove_expired_batch(extra_keeparound_seconds) {
+	}
+}
+
+// Returns true if there may be more expired entries left
+func (cem *ConcurrentExpiringMap[K, V]) remove_expired_batch(extra_keeparound_seconds int64) bool {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	cutoff := cem.clock() - extra_keeparound_seconds
+	keys := cem.expiry_index.PopExpired(cutoff, cem.expiry_batch_size)
+	for _, key := range keys {
+		entry, ok := cem.m[key]
+		// Skip index entries that are out of date: the key was deleted, or its expiry time was changed and it has another index entry
+		if !ok || entry.expiry_time > cutoff {
+			continue
+		}
+		cem.remove_locked(key, entry)
+		if cem.expiry_callback != nil {
+			cem.expiry_callback(key, entry.value, REMOVAL_REASON_EXPIRED)
+		}
+	}
+	return len(keys) == cem.expiry_batch_size
+}
@@ -0,0 +1,155 @@
+package expiringmap_test
+
+import (
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/expiringmap"
+)
+
+type removal struct {
+	key    string
+	value  int
+	reason expiringmap.RemovalReason
+}
+
+func new_test_map(capacity expiringmap.Capacity[string, int]) (*expiringmap.ConcurrentExpiringMap[string, int], *int64, *[]removal) {
+	now := int64(1700000000)
+	removals := []removal{}
+	cem := expiringmap.New(expiringmap.Options[string, int]{ //nolint:exhaustruct // it's a test
+		Clock:    func() int64 { return now },
+		Capacity: capacity,
+		Expiry_callback: func(key string, value int, reason expiringmap.RemovalReason) {
+			removals = append(removals, removal{key: key, value: value, reason: reason})
+		},
+	})
+	return cem, &now, &removals
+}
+
+func Test_Get_Put_Delete_Extend(t *testing.T) {
+	t.Parallel()
+
+	cem, now, removals := new_test_map(expiringmap.Capacity[string, int]{})
+	err := cem.Put("a", 1, *now+10)
+	util.Assert_no_error(t, err, 1)
+	err = cem.PutNew("a", 2, *now+10)
+	util.Assert_error_equals(t, err, expiringmap.KeyAlreadyExistsError{}.Error(), 1)
+	err = cem.PutNew("b", 2, *now+20)
+	util.Assert_no_error(t, err, 1)
+	value, ok := cem.Get("a")
+	util.Assert_result_equals_interface(t, value, nil, 1, 1)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+
+	// Put replaces
+	cem.Put("a", 3, *now+10)
+	value, _ = cem.Get("a")
+	util.Assert_result_equals_interface(t, value, nil, 3, 1)
+
+	// Expired entries aren't returned by Get, but GetWithExpiry still has them until they're removed
+	*now += 15
+	_, ok = cem.Get("a")
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	value, expiry_time, ok := cem.GetWithExpiry("a")
+	util.Assert_result_equals_interface(t, value, nil, 3, 1)
+	util.Assert_result_equals_interface(t, expiry_time, nil, int64(1700000010), 1)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+
+	// Extending brings it back
+	util.Assert_result_equals_bool(t, cem.Extend("a", *now+100), nil, true, 1)
+	util.Assert_result_equals_bool(t, cem.Extend("nope", *now+100), nil, false, 1)
+	_, ok = cem.Get("a")
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+
+	util.Assert_result_equals_bool(t, cem.Delete("b"), nil, true, 1)
+	util.Assert_result_equals_bool(t, cem.Delete("b"), nil, false, 1)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 1, 1)
+
+	// The old index entries for "a" and "b" are skipped
+	cem.RemoveExpired(0)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 1, 1)
+	util.Assert_result_equals_interface(t, len(*removals), nil, 0, 1)
+
+	*now += 100
+	cem.RemoveExpired(0)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 0, 1)
+	util.Assert_result_equals_interface(t, len(*removals), nil, 1, 1)
+	util.Assert_result_equals_interface(t, (*removals)[0], nil, removal{key: "a", value: 3, reason: expiringmap.REMOVAL_REASON_EXPIRED}, 1)
+}
+
+func Test_Remove_Expired_Keeparound(t *testing.T) {
+	t.Parallel()
+
+	cem, now, removals := new_test_map(expiringmap.Capacity[string, int]{})
+	cem.SetExpiryBatchSize(2)
+	for i := 0; i < 10; i++ {
+		cem.Put(util.Int64_to_string(int64(i)), i, *now+int64(i))
+	}
+	*now += 5
+	cem.RemoveExpired(3) // removes those that expired at or before now-3, i.e. 0, 1 and 2
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 7, 1)
+	keys := []string{}
+	for _, r := range *removals {
+		keys = append(keys, r.key)
+	}
+	sort.Strings(keys)
+	util.Assert_result_equals_string_slice(t, keys, nil, []string{"0", "1", "2"}, 1)
+}
+
+func Test_LRU_Eviction(t *testing.T) {
+	t.Parallel()
+
+	cem, now, removals := new_test_map(expiringmap.Capacity[string, int]{Max_items: 3})
+	for i, key := range []string{"a", "b", "c"} {
+		util.Assert_no_error(t, cem.Put(key, i+1, *now+100), 1)
+	}
+	cem.Get("a") // now "b" is the least recently used
+	util.Assert_no_error(t, cem.Put("d", 4, *now+100), 1)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 3, 1)
+	_, ok := cem.Get("b")
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	util.Assert_result_equals_interface(t, len(*removals), nil, 1, 1)
+	util.Assert_result_equals_interface(t, (*removals)[0], nil, removal{key: "b", value: 2, reason: expiringmap.REMOVAL_REASON_EVICTED}, 1)
+
+	// Replacing an existing key doesn't evict anything
+	util.Assert_no_error(t, cem.Put("c", 5, *now+100), 1)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 3, 1)
+	util.Assert_result_equals_interface(t, len(*removals), nil, 1, 1)
+}
+
+func Test_Janitor(t *testing.T) {
+	t.Parallel()
+
+	var removed atomic.Int64
+	now := time.Now().Unix()
+	cem := expiringmap.New(expiringmap.Options[string, int]{ //nolint:exhaustruct // it's a test
+		Janitor_interval_seconds: 1,
+		Expiry_callback:          func(string, int, expiringmap.RemovalReason) { removed.Add(1) },
+	})
+	defer cem.Close()
+	cem.Put("gone", 1, now-10)
+	cem.Put("stays", 2, now+1000)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for removed.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	util.Assert_result_equals_interface(t, removed.Load(), nil, int64(1), 1)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 1, 1)
+	cem.Close() // calling it twice is fine
+}
+
+func Test_Bucketed_Index(t *testing.T) {
+	t.Parallel()
+
+	cem, now, _ := new_test_map(expiringmap.Capacity[string, int]{})
+	cem.SetExpiryIndex(expiringmap.NewBucketedExpiryIndex[string](60))
+	for i := 0; i < 300; i++ {
+		cem.Put(util.Int64_to_string(int64(i)), i, *now+int64(i))
+	}
+	*now += 150
+	cem.RemoveExpired(0)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 149, 1)
+}
@@ -0,0 +1,196 @@
+// Size limits for ConcurrentExpiringMap. Without them the map only shrinks when entries expire, so it can grow until it runs out of memory.
+// The limit can be on the number of entries, on their estimated size in bytes, or both.
+// What happens when the map is full depends on the eviction policy:
+//  1. EVICTION_POLICY_LRU (the default): evict the entries that were least recently put or got.
+//  2. EVICTION_POLICY_SOONEST_TO_EXPIRE: evict the entries that expire first, since they were going away soon anyway. Uses the expiry index, so with a BucketedExpiryIndex it's only accurate to the bucket interval.
+//  3. EVICTION_POLICY_REJECT_NEW: evict nothing. Putting new keys fails with MapFullError until entries expire.
+//     The byte limit is checked before the entry goes in, so the map can end up over it by one entry. That way IsFull can tell in advance whether a put will fail.
+//
+// Evicted entries go to the expiry callback with REMOVAL_REASON_EVICTED.
+// If Capacity.Before_evict is set, it's called while the entry is still in the map. If it fails, the entry stays and the map is left over its limit until the next put tries again.
+package expiringmap
+
+import "container/list"
+
+type EvictionPolicy int
+
+const (
+	EVICTION_POLICY_LRU EvictionPolicy = iota
+	EVICTION_POLICY_SOONEST_TO_EXPIRE
+	EVICTION_POLICY_REJECT_NEW
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EVICTION_POLICY_LRU:
+		return "lru"
+	case EVICTION_POLICY_SOONEST_TO_EXPIRE:
+		return "soonest_to_expire"
+	case EVICTION_POLICY_REJECT_NEW:
+		return "reject_new"
+	}
+	return "unknown"
+}
+
+type Capacity[K comparable, V any] struct {
+	Max_items       int   // 0 means no limit on the number of entries
+	Max_bytes       int64 // 0 means no limit on the total size. Needs Size_of.
+	Size_of         func(key K, value V) int64
+	Eviction_policy EvictionPolicy
+	// Called with the map's lock held before an entry is evicted, e.g. to persist the eviction. If it returns an error, the entry isn't evicted.
+	Before_evict func(key K, value V) error
+}
+
+type MapFullError struct{}
+
+func (e MapFullError) Error() string {
+	return "expiringmap: map is full"
+}
+
+// Changes the limits. Entries are evicted straight away if the map is now over them, unless the policy is EVICTION_POLICY_REJECT_NEW.
+// When switching to LRU, the entries already in the map are put in the LRU list in no particular order.
+func (cem *ConcurrentExpiringMap[K, V]) SetCapacity(capacity Capacity[K, V]) {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	cem.set_capacity_locked(capacity)
+	if capacity.Eviction_policy != EVICTION_POLICY_REJECT_NEW {
+		_ = cem.make_room_locked(0, 0, nil) // can't fail with 0 extra
+	}
+}
+
+// Caller must hold cem.mut
+func (cem *ConcurrentExpiringMap[K, V]) set_capacity_locked(capacity Capacity[K, V]) {
+	if capacity.Max_bytes > 0 && capacity.Size_of == nil {
+		panic("expiringmap: Capacity.Max_bytes needs Capacity.Size_of")
+	}
+	cem.capacity = capacity
+	cem.total_bytes = 0
+	for k, entry := range cem.m {
+		entry.size = cem.size_of(k, entry.value)
+		cem.total_bytes += entry.size
+	}
+
+	limited := capacity.Max_items > 0 || capacity.Max_bytes > 0
+	if limited && capacity.Eviction_policy == EVICTION_POLICY_LRU {
+		if cem.lru == nil {
+			cem.lru = list.New()
+			for k, entry := range cem.m {
+				entry.lru_element = cem.lru.PushFront(k)
+			}
+		}
+		return
+	}
+	cem.lru = nil
+	for _, entry := range cem.m {
+		entry.lru_element = nil
+	}
+}
+
+// Caller must hold cem.mut
+func (cem *ConcurrentExpiringMap[K, V]) size_of(key K, value V) int64 {
+	if cem.capacity.Size_of == nil {
+		return 0
+	}
+	return cem.capacity.Size_of(key, value)
+}
+
+// Returns true if putting a new key would fail with MapFullError. That can only happen with EVICTION_POLICY_REJECT_NEW.
+// Useful for checking before doing something expensive, e.g. writing the entry to disk.
+func (cem *ConcurrentExpiringMap[K, V]) IsFull() bool {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	return cem.capacity.Eviction_policy == EVICTION_POLICY_REJECT_NEW && cem.over_capacity_locked(1, 1)
+}
+
+// Estimated size of all the entries, according to Capacity.Size_of
+func (cem *ConcurrentExpiringMap[K, V]) TotalBytes() int64 {
+	cem.mut.Lock()
+	defer cem.mut.Unlock()
+
+	return cem.total_bytes
+}
+
+// Caller must hold cem.mut. Whether adding extra_items entries and extra_bytes bytes would put the map over its limits.
+func (cem *ConcurrentExpiringMap[K, V]) over_capacity_locked(extra_items int, extra_bytes int64) bool {
+	if cem.capacity.Max_items > 0 && len(cem.m)+extra_items > cem.capacity.Max_items {
+		return true
+	}
+	return cem.capacity.Max_bytes > 0 && cem.total_bytes+extra_bytes > cem.capacity.Max_bytes
+}
+
+// Caller must hold cem.mut. Evicts entries until extra_items entries and extra_bytes more bytes fit. keep is never evicted.
+// Only returns an error (MapFullError) if the policy is EVICTION_POLICY_REJECT_NEW.
+func (cem *ConcurrentExpiringMap[K, V]) make_room_locked(extra_items int, extra_bytes int64, keep *map_entry[K, V]) error {
+	if cem.capacity.Eviction_policy == EVICTION_POLICY_REJECT_NEW {
+		// Only check that the map isn't already at its limit, so that IsFull can tell in advance
+		if (extra_items > 0 || extra_bytes > 0) && cem.over_capacity_locked(extra_items, min(max(extra_bytes, 0), 1)) {
+			return MapFullError{}
+		}
+		return nil
+	}
+	for cem.over_capacity_locked(extra_items, max(extra_bytes, 0)) {
+		var key K
+		var entry *map_entry[K, V]
+		var ok bool
+		if cem.capacity.Eviction_policy == EVICTION_POLICY_SOONEST_TO_EXPIRE {
+			key, entry, ok = cem.pop_soonest_to_expire_locked(keep)
+		} else {
+			key, entry, ok = cem.least_recently_used_locked(keep)
+		}
+		if !ok {
+			return nil // everything else has gone, so the entry is bigger than Max_bytes on its own. Let it in anyway.
+		}
+		if cem.capacity.Before_evict != nil && cem.capacity.Before_evict(key, entry.value) != nil {
+			if cem.capacity.Eviction_policy == EVICTION_POLICY_SOONEST_TO_EXPIRE {
+				cem.expiry_index.Add(key, entry.expiry_time) // pop_soonest_to_expire_locked took it out
+			}
+			return nil // keep it and let the new entry in over the limit. The next put will try again.
+		}
+		cem.remove_locked(key, entry)
+		if cem.expiry_callback != nil {
+			cem.expiry_callback(key, entry.value, REMOVAL_REASON_EVICTED)
+		}
+	}
+	return nil
+}
+
+// Caller must hold cem.mut
+func (cem *ConcurrentExpiringMap[K, V]) least_recently_used_locked(keep *map_entry[K, V]) (K, *map_entry[K, V], bool) {
+	for e := cem.lru.Back(); e != nil; e = e.Prev() {
+		key := e.Value.(K) //nolint:forcetypeassert // only keys go in the list
+		entry := cem.m[key]
+		if entry != keep {
+			return key, entry, true
+		}
+	}
+	var zero_key K
+	return zero_key, nil, false
+}
+
+// Caller must hold cem.mut. Pops index entries until it finds one that isn't out of date.
+func (cem *ConcurrentExpiringMap[K, V]) pop_soonest_to_expire_locked(keep *map_entry[K, V]) (K, *map_entry[K, V], bool) {
+	kept := false
+	var keep_key K
+	defer func() {
+		if kept {
+			cem.expiry_index.Add(keep_key, keep.expiry_time)
+		}
+	}()
+	for {
+		key, expiry_time, ok := cem.expiry_index.PopSoonest()
+		if !ok {
+			return key, nil, false
+		}
+		entry, ok := cem.m[key]
+		if !ok || entry.expiry_time != expiry_time {
+			continue
+		}
+		if entry == keep {
+			kept, keep_key = true, key
+			continue
+		}
+		return key, entry, true
+	}
+}
@@ -0,0 +1,118 @@
+package expiringmap_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/expiringmap"
+)
+
+func Test_Evict_Soonest_To_Expire(t *testing.T) {
+	t.Parallel()
+
+	cem, now, removals := new_test_map(expiringmap.Capacity[string, int]{ //nolint:exhaustruct // it's a test
+		Max_items:       3,
+		Eviction_policy: expiringmap.EVICTION_POLICY_SOONEST_TO_EXPIRE,
+	})
+	util.Assert_no_error(t, cem.Put("a", 1, *now+300), 1)
+	util.Assert_no_error(t, cem.Put("b", 2, *now+100), 1)
+	util.Assert_no_error(t, cem.Put("c", 3, *now+200), 1)
+	// "b" was going to expire first, but now it's "c". The old index entry for "b" must not get it evicted.
+	util.Assert_result_equals_bool(t, cem.Extend("b", *now+400), nil, true, 1)
+	util.Assert_no_error(t, cem.Put("d", 4, *now+500), 1)
+	util.Assert_result_equals_interface(t, len(*removals), nil, 1, 1)
+	util.Assert_result_equals_interface(t, (*removals)[0], nil, removal{key: "c", value: 3, reason: expiringmap.REMOVAL_REASON_EVICTED}, 1)
+	util.Assert_no_error(t, cem.Put("e", 5, *now+600), 1)
+	util.Assert_result_equals_interface(t, (*removals)[1].key, nil, "a", 1)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 3, 1)
+}
+
+func Test_Failed_Before_Evict_Keeps_Entry(t *testing.T) {
+	t.Parallel()
+
+	fail := true
+	evicting := []string{}
+	cem, now, removals := new_test_map(expiringmap.Capacity[string, int]{ //nolint:exhaustruct // it's a test
+		Max_items:       2,
+		Eviction_policy: expiringmap.EVICTION_POLICY_SOONEST_TO_EXPIRE,
+		Before_evict: func(key string, _ int) error {
+			evicting = append(evicting, key)
+			if fail {
+				return errors.New("disk on fire")
+			}
+			return nil
+		},
+	})
+	util.Assert_no_error(t, cem.Put("a", 1, *now+100), 1)
+	util.Assert_no_error(t, cem.Put("b", 2, *now+200), 1)
+	// "a" can't be evicted, so the map goes over its limit rather than losing it or rejecting "c"
+	util.Assert_no_error(t, cem.Put("c", 3, *now+300), 1)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 3, 1)
+	util.Assert_result_equals_interface(t, len(*removals), nil, 0, 1)
+	value, ok := cem.Get("a")
+	util.Assert_result_equals_interface(t, value, nil, 1, 1)
+	util.Assert_result_equals_bool(t, ok, nil, true, 1)
+
+	// The next put tries again, and "a" is still the soonest to expire
+	fail = false
+	util.Assert_no_error(t, cem.Put("d", 4, *now+400), 1)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 2, 1)
+	util.Assert_result_equals_string_slice(t, evicting, nil, []string{"a", "a", "b"}, 1)
+	util.Assert_result_equals_interface(t, (*removals)[0].key, nil, "a", 1)
+	util.Assert_result_equals_interface(t, (*removals)[1].key, nil, "b", 1)
+}
+
+func Test_Reject_New_When_Full(t *testing.T) {
+	t.Parallel()
+
+	cem, now, removals := new_test_map(expiringmap.Capacity[string, int]{ //nolint:exhaustruct // it's a test
+		Max_items:       2,
+		Eviction_policy: expiringmap.EVICTION_POLICY_REJECT_NEW,
+	})
+	util.Assert_no_error(t, cem.PutNew("a", 1, *now+10), 1)
+	util.Assert_result_equals_bool(t, cem.IsFull(), nil, false, 1)
+	util.Assert_no_error(t, cem.PutNew("b", 2, *now+100), 1)
+	util.Assert_result_equals_bool(t, cem.IsFull(), nil, true, 1)
+	err := cem.PutNew("c", 3, *now+100)
+	util.Assert_error_equals(t, err, expiringmap.MapFullError{}.Error(), 1)
+	// Replacing is still fine
+	util.Assert_no_error(t, cem.Put("b", 5, *now+100), 1)
+	util.Assert_result_equals_interface(t, len(*removals), nil, 0, 1)
+
+	// Once something expires there's room again
+	*now += 20
+	cem.RemoveExpired(0)
+	util.Assert_result_equals_bool(t, cem.IsFull(), nil, false, 1)
+	util.Assert_no_error(t, cem.PutNew("c", 3, *now+100), 1)
+}
+
+func Test_Max_Bytes(t *testing.T) {
+	t.Parallel()
+
+	cem, now, removals := new_test_map(expiringmap.Capacity[string, int]{ //nolint:exhaustruct // it's a test
+		Max_bytes: 100,
+		Size_of:   func(_ string, value int) int64 { return int64(value) },
+	})
+	util.Assert_no_error(t, cem.Put("a", 40, *now+100), 1)
+	util.Assert_no_error(t, cem.Put("b", 40, *now+100), 1)
+	util.Assert_result_equals_interface(t, cem.TotalBytes(), nil, int64(80), 1)
+	util.Assert_no_error(t, cem.Put("c", 30, *now+100), 1) // "a" has to go
+	util.Assert_result_equals_interface(t, cem.TotalBytes(), nil, int64(70), 1)
+	util.Assert_result_equals_interface(t, (*removals)[0].key, nil, "a", 1)
+
+	// Growing an entry evicts others, but never the entry itself
+	util.Assert_no_error(t, cem.Put("c", 90, *now+100), 1)
+	util.Assert_result_equals_interface(t, cem.TotalBytes(), nil, int64(90), 1)
+	util.Assert_result_equals_interface(t, cem.Len(), nil, 1, 1)
+
+	// Lowering the limit evicts straight away
+	cem.SetCapacity(expiringmap.Capacity[string, int]{ //nolint:exhaustruct // it's a test
+		Max_items: 1,
+		Size_of:   func(_ string, value int) int64 { return int64(value) },
+	})
+	util.Assert_no_error(t, cem.Put("d", 1, *now+100), 1)
+	_, ok := cem.Get("c")
+	util.Assert_result_equals_bool(t, ok, nil, false, 1)
+	util.Assert_result_equals_interface(t, cem.TotalBytes(), nil, int64(1), 1)
+}
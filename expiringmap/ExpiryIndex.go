@@ -0,0 +1,285 @@
+// The expiry index tells ConcurrentExpiringMap which keys have expired, so it doesn't have to look at every entry.
+// There are two of them:
+//  1. The heap (the default). Exact, but it costs a pointer plus a heap-allocated item per entry, and O(log n) per insert.
+//  2. Time buckets. Each entry goes in the bucket for expiry_time / bucket_interval, so inserting is O(1) and there's no per-entry allocation.
+//     For the URL maps, use the same bucket_interval as the LBSES so that entries expire from RAM in the same groups as their log files expire from disk.
+//
+// Users of the index are expected to access it with a mutex.
+// The index may hand back keys that have since been deleted, replaced or extended, so the map has to check the entry before removing it.
+package expiringmap
+
+import (
+	"container/heap"
+	"sort"
+)
+
+type ExpiryIndex[K comparable] interface {
+	// Adds a key. Before Init (or the first PopExpired), keys can be added in any order without paying for ordering them.
+	Add(key K, expiry_time int64)
+	// Called once after the initial bulk load
+	Init()
+	// Counts keys that have since been deleted, replaced or extended too, until they're popped
+	Len() int
+	// Removes and returns up to max_keys of the keys whose expiry time is <= cutoff.
+	PopExpired(cutoff int64, max_keys int) []K
+	// Removes and returns the key that expires first, for EVICTION_POLICY_SOONEST_TO_EXPIRE. Returns false if the index is empty.
+	PopSoonest() (K, int64, bool)
+}
+
+type heap_item[K comparable] struct {
+	key         K
+	expiry_time int64
+}
+
+// ============= All this stuff is just to implement the interface required by heap ===================
+type heap_queue[K comparable] []*heap_item[K]
+
+func (pq heap_queue[K]) Len() int { return len(pq) }
+
+func (pq heap_queue[K]) Less(i, j int) bool { // root is the element with smallest expiry date
+	return pq[i].expiry_time < pq[j].expiry_time
+}
+
+func (pq heap_queue[K]) Swap(i, j int) {
+	pq[i], pq[j] = pq[j], pq[i]
+}
+
+func (pq *heap_queue[K]) Push(x any) {
+	item := x.(*heap_item[K]) //nolint:forcetypeassert // only heap calls this
+	*pq = append(*pq, item)
+}
+
+func (pq *heap_queue[K]) Pop() any {
+	old := *pq
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil // avoid memory leak
+	*pq = old[0 : n-1]
+	return item
+}
+
+// ====================================================================================================
+
+type HeapExpiryIndex[K comparable] struct {
+	hq          heap_queue[K]
+	initialized bool
+}
+
+func NewHeapExpiryIndex[K comparable](size int64) *HeapExpiryIndex[K] {
+	return &HeapExpiryIndex[K]{
+		hq:          make(heap_queue[K], 0, size),
+		initialized: false,
+	}
+}
+
+func (hei *HeapExpiryIndex[K]) Add(key K, expiry_time int64) {
+	item := heap_item[K]{
+		key:         key,
+		expiry_time: expiry_time,
+	}
+	if hei.initialized {
+		heap.Push(&hei.hq, &item)
+	} else {
+		hei.hq.Push(&item)
+	}
+}
+
+func (hei *HeapExpiryIndex[K]) Init() {
+	heap.Init(&hei.hq)
+	hei.initialized = true
+}
+
+func (hei *HeapExpiryIndex[K]) Len() int {
+	return len(hei.hq)
+}
+
+func (hei *HeapExpiryIndex[K]) PopExpired(cutoff int64, max_keys int) []K {
+	if !hei.initialized {
+		hei.Init()
+	}
+	keys := []K{}
+	// pop root from hq until root is no longer expired or the thing is empty
+	for len(hei.hq) > 0 && len(keys) < max_keys && hei.hq[0].expiry_time <= cutoff {
+		item := heap.Pop(&hei.hq).(*heap_item[K]) //nolint:forcetypeassert // it's always a heap_item
+		keys = append(keys, item.key)
+	}
+	return keys
+}
+
+func (hei *HeapExpiryIndex[K]) PopSoonest() (K, int64, bool) {
+	if !hei.initialized {
+		hei.Init()
+	}
+	if len(hei.hq) == 0 {
+		var zero_key K
+		return zero_key, 0, false
+	}
+	item := heap.Pop(&hei.hq).(*heap_item[K]) //nolint:forcetypeassert // it's always a heap_item
+	return item.key, item.expiry_time, true
+}
+
+type expiry_bucket_entry[K comparable] struct {
+	key         K
+	expiry_time int64
+}
+
+// Only the bucket that's currently being scanned is kept as a heap, see PopExpired
+type expiry_bucket[K comparable] []expiry_bucket_entry[K]
+
+func (eb expiry_bucket[K]) Len() int { return len(eb) }
+
+func (eb expiry_bucket[K]) Less(i, j int) bool { return eb[i].expiry_time < eb[j].expiry_time }
+
+func (eb expiry_bucket[K]) Swap(i, j int) { eb[i], eb[j] = eb[j], eb[i] }
+
+func (eb *expiry_bucket[K]) Push(x any) {
+	*eb = append(*eb, x.(expiry_bucket_entry[K])) //nolint:forcetypeassert // only heap calls this
+}
+
+func (eb *expiry_bucket[K]) Pop() any {
+	old := *eb
+	last := old[len(old)-1]
+	old[len(old)-1] = expiry_bucket_entry[K]{} // don't keep the key alive
+	*eb = old[:len(old)-1]
+	return last
+}
+
+type BucketedExpiryIndex[K comparable] struct {
+	bucket_interval int64
+	buckets         map[int64]expiry_bucket[K] // bucket number -> entries
+	bucket_numbers  []int64                    // sorted, so the oldest bucket is first
+	num_entries     int
+	heap_bucket     int64 // the bucket that has been turned into a heap, if has_heap_bucket
+	has_heap_bucket bool
+}
+
+func NewBucketedExpiryIndex[K comparable](bucket_interval int64) *BucketedExpiryIndex[K] {
+	if bucket_interval <= 0 {
+		panic("NewBucketedExpiryIndex: bucket_interval must be positive")
+	}
+	return &BucketedExpiryIndex[K]{
+		bucket_interval: bucket_interval,
+		buckets:         make(map[int64]expiry_bucket[K]),
+		bucket_numbers:  []int64{},
+		num_entries:     0,
+		heap_bucket:     0,
+		has_heap_bucket: false,
+	}
+}
+
+func (bei *BucketedExpiryIndex[K]) bucket_number(expiry_time int64) int64 {
+	// Round towards minus infinity so that negative times don't end up in the bucket after theirs
+	n := expiry_time / bei.bucket_interval
+	if expiry_time < 0 && expiry_time%bei.bucket_interval != 0 {
+		n--
+	}
+	return n
+}
+
+func (bei *BucketedExpiryIndex[K]) is_heap_bucket(n int64) bool {
+	return bei.has_heap_bucket && bei.heap_bucket == n
+}
+
+func (bei *BucketedExpiryIndex[K]) Add(key K, expiry_time int64) {
+	n := bei.bucket_number(expiry_time)
+	bucket, ok := bei.buckets[n]
+	if !ok {
+		// There are only ever a handful of buckets, so keeping them sorted with an insert is fine
+		i := sort.Search(len(bei.bucket_numbers), func(i int) bool { return bei.bucket_numbers[i] >= n })
+		bei.bucket_numbers = append(bei.bucket_numbers, 0)
+		copy(bei.bucket_numbers[i+1:], bei.bucket_numbers[i:])
+		bei.bucket_numbers[i] = n
+	}
+	entry := expiry_bucket_entry[K]{key: key, expiry_time: expiry_time}
+	if bei.is_heap_bucket(n) {
+		heap.Push(&bucket, entry)
+	} else {
+		bucket = append(bucket, entry)
+	}
+	bei.buckets[n] = bucket
+	bei.num_entries++
+}
+
+// Nothing to do, the buckets are always in order
+func (bei *BucketedExpiryIndex[K]) Init() {}
+
+// Like the heap, this counts entries for keys that have since been deleted, replaced or extended until they get popped, so it can be more than the number of keys in the map.
+func (bei *BucketedExpiryIndex[K]) Len() int {
+	return bei.num_entries
+}
+
+func (bei *BucketedExpiryIndex[K]) remove_oldest_bucket() {
+	n := bei.bucket_numbers[0]
+	delete(bei.buckets, n)
+	bei.bucket_numbers = bei.bucket_numbers[1:]
+	if bei.is_heap_bucket(n) {
+		bei.has_heap_bucket = false
+	}
+}
+
+// Buckets that have completely expired are emptied from the end.
+// The bucket that cutoff falls in gets turned into a heap the first time it's looked at, so after that each batch only costs O(max_keys * log(bucket size)) instead of a scan of the whole bucket under the map lock.
+func (bei *BucketedExpiryIndex[K]) PopExpired(cutoff int64, max_keys int) []K {
+	keys := []K{}
+	cutoff_bucket := bei.bucket_number(cutoff)
+	for len(bei.bucket_numbers) > 0 && len(keys) < max_keys {
+		n := bei.bucket_numbers[0]
+		if n > cutoff_bucket {
+			break
+		}
+		bucket := bei.buckets[n]
+		if n < cutoff_bucket {
+			// Taking leaves off the end keeps a heap a heap, so this is fine for the heap bucket too
+			for len(bucket) > 0 && len(keys) < max_keys {
+				keys = append(keys, bucket[len(bucket)-1].key)
+				bucket[len(bucket)-1] = expiry_bucket_entry[K]{} // don't keep the key alive
+				bucket = bucket[:len(bucket)-1]
+				bei.num_entries--
+			}
+		} else {
+			if !bei.is_heap_bucket(n) {
+				heap.Init(&bucket)
+				bei.heap_bucket = n
+				bei.has_heap_bucket = true
+			}
+			for len(bucket) > 0 && len(keys) < max_keys && bucket[0].expiry_time <= cutoff {
+				entry := heap.Pop(&bucket).(expiry_bucket_entry[K]) //nolint:forcetypeassert // it's always an expiry_bucket_entry
+				keys = append(keys, entry.key)
+				bei.num_entries--
+			}
+		}
+		if len(bucket) == 0 {
+			bei.remove_oldest_bucket()
+			continue
+		}
+		bei.buckets[n] = bucket
+		if n == cutoff_bucket {
+			break // whatever is left in the current bucket hasn't expired yet
+		}
+	}
+	return keys
+}
+
+// Returns any key from the oldest bucket, so it's only the soonest to expire to within the bucket interval. Scanning the bucket for the real one would make evicting O(n).
+// If the oldest bucket is the one PopExpired has turned into a heap, it's exact.
+func (bei *BucketedExpiryIndex[K]) PopSoonest() (K, int64, bool) {
+	if len(bei.bucket_numbers) == 0 {
+		var zero_key K
+		return zero_key, 0, false
+	}
+	n := bei.bucket_numbers[0]
+	bucket := bei.buckets[n]
+	var entry expiry_bucket_entry[K]
+	if bei.is_heap_bucket(n) {
+		entry = heap.Pop(&bucket).(expiry_bucket_entry[K]) //nolint:forcetypeassert // it's always an expiry_bucket_entry
+	} else {
+		entry = bucket.Pop().(expiry_bucket_entry[K]) //nolint:forcetypeassert // it's always an expiry_bucket_entry
+	}
+	bei.num_entries--
+	if len(bucket) == 0 {
+		bei.remove_oldest_bucket()
+	} else {
+		bei.buckets[n] = bucket
+	}
+	return entry.key, entry.expiry_time, true
+}
@@ -0,0 +1,37 @@
+package urlmaptest
+
+import "sync"
+
+// A clock that only moves when you tell it to. Pass fc.Now as the Clock in CEPUMParams/CPPUMParams.
+type FakeClock struct {
+	mut sync.Mutex
+	now int64
+}
+
+func NewFakeClock(start_unix int64) *FakeClock {
+	return &FakeClock{
+		mut: sync.Mutex{},
+		now: start_unix,
+	}
+}
+
+func (fc *FakeClock) Now() int64 {
+	fc.mut.Lock()
+	defer fc.mut.Unlock()
+
+	return fc.now
+}
+
+func (fc *FakeClock) Advance(seconds int64) {
+	fc.mut.Lock()
+	defer fc.mut.Unlock()
+
+	fc.now += seconds
+}
+
+func (fc *FakeClock) Set(now_unix int64) {
+	fc.mut.Lock()
+	defer fc.mut.Unlock()
+
+	fc.now = now_unix
+}
@@ -0,0 +1,229 @@
+package urlmaptest
+
+import (
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+
+	"github.com/1f604/util"
+)
+
+// Returned by the append that TearNextAppend tore. Only part of the data was written, as if the process died halfway through.
+type TornWriteError struct{}
+
+func (e TornWriteError) Error() string {
+	return "urlmaptest: torn write"
+}
+
+// Wraps another backend and makes its writes fail on demand.
+// Reads always go straight through, so you can still inspect the state after a fault.
+type FaultyStorageBackend struct {
+	mut              sync.Mutex
+	inner            util.StorageBackend
+	fail_next_writes int
+	fail_err         error
+	tear_next_append int // -1 if disabled, otherwise how many bytes of the next append make it to storage
+	disk_full        bool
+	fault_hook       func(op string, path string) error
+	read_hook        func(op string, path string)
+	writes           int
+}
+
+func NewFaultyStorageBackend(inner util.StorageBackend) *FaultyStorageBackend {
+	return &FaultyStorageBackend{
+		mut:              sync.Mutex{},
+		inner:            inner,
+		fail_next_writes: 0,
+		fail_err:         nil,
+		tear_next_append: -1,
+		disk_full:        false,
+		fault_hook:       nil,
+		read_hook:        nil,
+		writes:           0,
+	}
+}
+
+// The next n writes (anything that modifies storage, including deletes) return err and leave storage untouched.
+func (fsb *FaultyStorageBackend) FailNextWrites(n int, err error) {
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+
+	fsb.fail_next_writes = n
+	fsb.fail_err = err
+}
+
+// The next append only writes the first keep_bytes bytes and then returns TornWriteError.
+func (fsb *FaultyStorageBackend) TearNextAppend(keep_bytes int) {
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+
+	fsb.tear_next_append = keep_bytes
+}
+
+// While the disk is full, writing data fails with ENOSPC. Creating directories, deleting and truncating still work, like on a real disk.
+func (fsb *FaultyStorageBackend) SetDiskFull(full bool) {
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+
+	fsb.disk_full = full
+}
+
+// hook is called before every write with the name of the StorageBackend method (e.g. "PutBlob") and the path.
+// If it returns an error, the write fails with that error. This lets you fail one particular kind of write, e.g. only deletes of paste files.
+func (fsb *FaultyStorageBackend) SetFaultHook(hook func(op string, path string) error) {
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+
+	fsb.fault_hook = hook
+}
+
+// hook is called before every read (ListSegments, OpenSegment, GetBlob and Stat) with the method name and the path.
+// Reads can't be made to fail, but the hook can block, e.g. to hold a map in the middle of loading.
+// It is called without holding any locks, so other operations carry on while it blocks.
+func (fsb *FaultyStorageBackend) SetReadHook(hook func(op string, path string)) {
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+
+	fsb.read_hook = hook
+}
+
+func (fsb *FaultyStorageBackend) before_read(op string, path string) {
+	fsb.mut.Lock()
+	hook := fsb.read_hook
+	fsb.mut.Unlock()
+
+	if hook != nil {
+		hook(op, path)
+	}
+}
+
+func (fsb *FaultyStorageBackend) ClearFaults() {
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+
+	fsb.fail_next_writes = 0
+	fsb.fail_err = nil
+	fsb.tear_next_append = -1
+	fsb.disk_full = false
+	fsb.fault_hook = nil
+	fsb.read_hook = nil
+}
+
+// Number of writes that were attempted, including the ones that failed.
+func (fsb *FaultyStorageBackend) Writes() int {
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+
+	return fsb.writes
+}
+
+// Returns the error the write should fail with, or nil if it should go through.
+func (fsb *FaultyStorageBackend) check_write(op string, path string, adds_data bool) error {
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+
+	fsb.writes++
+	if fsb.fail_next_writes > 0 {
+		fsb.fail_next_writes--
+		return fsb.fail_err
+	}
+	if fsb.disk_full && adds_data {
+		return &fs.PathError{Op: op, Path: path, Err: syscall.ENOSPC}
+	}
+	if fsb.fault_hook != nil {
+		return fsb.fault_hook(op, path)
+	}
+	return nil
+}
+
+func (fsb *FaultyStorageBackend) MkdirAll(dir string) error {
+	if err := fsb.check_write("MkdirAll", dir, false); err != nil {
+		return err
+	}
+	return fsb.inner.MkdirAll(dir)
+}
+
+func (fsb *FaultyStorageBackend) ListSegments(dir string) ([]string, error) {
+	fsb.before_read("ListSegments", dir)
+	return fsb.inner.ListSegments(dir)
+}
+
+func (fsb *FaultyStorageBackend) OpenSegment(path string) (io.ReadCloser, error) {
+	fsb.before_read("OpenSegment", path)
+	return fsb.inner.OpenSegment(path)
+}
+
+func (fsb *FaultyStorageBackend) AppendToSegment(path string, data []byte) error {
+	if err := fsb.check_write("AppendToSegment", path, true); err != nil {
+		return err
+	}
+	fsb.mut.Lock()
+	keep_bytes := fsb.tear_next_append
+	fsb.tear_next_append = -1
+	fsb.mut.Unlock()
+
+	if keep_bytes >= 0 && keep_bytes < len(data) {
+		err := fsb.inner.AppendToSegment(path, data[:keep_bytes])
+		if err != nil {
+			return err
+		}
+		return TornWriteError{}
+	}
+	return fsb.inner.AppendToSegment(path, data)
+}
+
+func (fsb *FaultyStorageBackend) TruncateSegment(path string, size int64) error {
+	if err := fsb.check_write("TruncateSegment", path, false); err != nil {
+		return err
+	}
+	return fsb.inner.TruncateSegment(path, size)
+}
+
+func (fsb *FaultyStorageBackend) PutBlob(path string, data []byte, xattr_params *util.XattrParams) error {
+	if err := fsb.check_write("PutBlob", path, true); err != nil {
+		return err
+	}
+	return fsb.inner.PutBlob(path, data, xattr_params)
+}
+
+func (fsb *FaultyStorageBackend) ReplaceBlob(path string, data []byte) error {
+	if err := fsb.check_write("ReplaceBlob", path, true); err != nil {
+		return err
+	}
+	return fsb.inner.ReplaceBlob(path, data)
+}
+
+func (fsb *FaultyStorageBackend) GetBlob(path string) ([]byte, error) {
+	fsb.before_read("GetBlob", path)
+	return fsb.inner.GetBlob(path)
+}
+
+func (fsb *FaultyStorageBackend) Stat(path string) (util.StorageFileInfo, error) {
+	fsb.before_read("Stat", path)
+	return fsb.inner.Stat(path)
+}
+
+func (fsb *FaultyStorageBackend) Delete(path string) error {
+	if err := fsb.check_write("Delete", path, false); err != nil {
+		return err
+	}
+	return fsb.inner.Delete(path)
+}
+
+// Reports no free space while SetDiskFull is on. Otherwise asks the inner backend, and if it doesn't know (e.g. the memory backend), pretends there is 1 TiB free.
+func (fsb *FaultyStorageBackend) DiskSpace(dir string) (util.StorageSpace, error) {
+	space, err := util.Storage_Disk_Space(fsb.inner, dir)
+	if err != nil {
+		return util.StorageSpace{}, err
+	}
+	if space == nil {
+		space = &util.StorageSpace{Total_bytes: 1 << 40, Free_bytes: 1 << 40}
+	}
+	fsb.mut.Lock()
+	defer fsb.mut.Unlock()
+	if fsb.disk_full {
+		space.Free_bytes = 0
+	}
+	return *space, nil
+}
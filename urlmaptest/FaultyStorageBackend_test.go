@@ -0,0 +1,117 @@
+package urlmaptest_test
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+var errInjected = errors.New("injected fault")
+
+func Test_Size_File_Failures_Are_Not_Fatal(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cppum := h.StartCPPUM(nil)
+	h.Backend.SetFaultHook(func(op string, path string) error {
+		if op == "ReplaceBlob" && path == h.SizeFilePath() {
+			return errInjected
+		}
+		return nil
+	})
+	for i := 0; i < 20; i++ {
+		_, err := cppum.PutEntry(4, "example.com/"+util.Int64_to_string(int64(i)), 0, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+	}
+
+	// A size file that was cut short by a full disk is reset on startup instead of refusing to start
+	h.Backend.ClearFaults()
+	err := h.Backend.ReplaceBlob(h.SizeFilePath(), []byte{})
+	util.Assert_no_error(t, err, 1)
+	cppum = h.StartCPPUM(nil)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 20, 1)
+}
+
+func Test_Failed_Deletes_Are_Retried_Later(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	_, err := cepum.PutEntry(4, "short lived paste", h.Clock.Now()+30, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+
+	h.Backend.SetFaultHook(func(op string, _ string) error {
+		if op == "Delete" {
+			return errInjected
+		}
+		return nil
+	})
+	h.Clock.Advance(1000)
+	cepum.RemoveAllExpiredURLsFromRAM()
+	cepum.RemoveAllExpiredURLsFromDisk()
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 0, 1)
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 1, 1)
+	util.Assert_result_equals_interface(t, len(h.LogFiles()), nil, 1, 1)
+
+	h.Backend.ClearFaults()
+	report, err := cepum.CollectOrphanedPastes(0, true)
+	util.Assert_result_equals_interface(t, report.Deleted, err, 1, 1)
+	cepum.RemoveAllExpiredURLsFromDisk()
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 0, 1)
+	util.Assert_result_equals_interface(t, len(h.LogFiles()), nil, 0, 1)
+}
+
+func Test_Idempotency_Key_Is_Written_With_Entry(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	enable_idempotency := func(p *util.CPPUMParams) { p.Idempotency_window_seconds = 3600 }
+	cppum := h.StartCPPUM(enable_idempotency)
+	// The token record goes first. Fail the entry record right after it, as if the server died in between.
+	appends := 0
+	h.Backend.SetFaultHook(func(op string, _ string) error {
+		if op == "AppendToSegment" {
+			appends++
+			if appends == 2 {
+				return errInjected
+			}
+		}
+		return nil
+	})
+	_, err := cppum.PutEntryWithIdempotencyKey("request-1", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	if !errors.Is(err, errInjected) {
+		t.Fatal("Expected injected error, got:", err)
+	}
+	h.Backend.ClearFaults()
+
+	// The token without its entry is ignored, so the retry creates the entry
+	cppum = h.StartCPPUM(enable_idempotency)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 0, 1)
+	key, err := cppum.PutEntryWithIdempotencyKey("request-1", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	// and from then on the token comes back with the entry
+	cppum = h.StartCPPUM(enable_idempotency)
+	retry_key, err := cppum.PutEntryWithIdempotencyKey("request-1", 4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_result_equals_interface(t, retry_key, err, key, 1)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 1, 1)
+}
+
+func Test_InsertFile_Returns_Write_Errors(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.NewOnDisk(t)
+	h.Backend.SetDiskFull(true)
+	pbs := util.NewPermanentBucketStorageWithBackend(h.Backend, h.PasteDir())
+	_, err := pbs.InsertFile([]byte("hello"), h.Clock.Now(), &util.XattrParams{})
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal("Expected ENOSPC, got:", err)
+	}
+	if len(h.PasteFiles()) != 0 {
+		t.Fatal("Expected no paste files, got:", strings.Join(h.PasteFiles(), ", "))
+	}
+}
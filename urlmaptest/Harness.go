@@ -0,0 +1,165 @@
+// Package urlmaptest builds CEPUMs and CPPUMs for tests, in RAM or in a temp directory, with a fake clock and injectable storage faults.
+// Starting a map again from the same harness simulates a restart: the new map loads whatever the previous one left in storage.
+// Every write is durable as soon as it returns, so just dropping the old map is the same as the process crashing.
+//
+//	h := urlmaptest.New(t)
+//	cppum := h.StartCPPUM(nil)
+//	key, _ := cppum.PutEntry(4, "example.com", 0, util.TYPE_MAP_ITEM_URL)
+//	h.Backend.FailNextWrites(1, errors.New("EIO"))
+//	...
+//	cppum = h.StartCPPUM(nil) // restart
+package urlmaptest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/1f604/util"
+)
+
+// Arbitrary time in 2023, since the maps reject timestamps from before 2023.
+const DEFAULT_START_TIME = 1700000000
+
+// Background jobs run this rarely so that they never run during a test. Call RemoveAllExpiredURLsFromRAM etc. yourself instead.
+const background_interval_seconds = 24 * 60 * 60
+
+type Harness struct {
+	t       testing.TB
+	Backend *FaultyStorageBackend
+	Clock   *FakeClock
+	Dir     string // Everything the maps store goes under here
+	B53m    *util.Base53IDManager
+}
+
+// Keeps everything in RAM. Dir doesn't exist on the real file system.
+func New(t testing.TB) *Harness {
+	t.Helper()
+
+	return new_harness(t, util.NewMemoryStorageBackend(), "/urlmaptest")
+}
+
+// Keeps everything in a temp directory that is removed when the test ends.
+func NewOnDisk(t testing.TB) *Harness {
+	t.Helper()
+
+	return new_harness(t, util.LocalStorageBackend{}, t.TempDir())
+}
+
+func new_harness(t testing.TB, inner util.StorageBackend, dir string) *Harness {
+	t.Helper()
+
+	h := Harness{
+		t:       t,
+		Backend: NewFaultyStorageBackend(inner),
+		Clock:   NewFakeClock(DEFAULT_START_TIME),
+		Dir:     dir,
+		B53m:    util.NewBase53IDManager(),
+	}
+	for _, subdir := range []string{"logs", "pastes"} {
+		err := inner.MkdirAll(filepath.Join(dir, subdir))
+		if err != nil {
+			t.Fatal("urlmaptest: failed to create directory:", err)
+		}
+	}
+	return &h
+}
+
+func (h *Harness) LogDir() string {
+	return filepath.Join(h.Dir, "logs")
+}
+
+func (h *Harness) PasteDir() string {
+	return filepath.Join(h.Dir, "pastes")
+}
+
+func (h *Harness) SizeFilePath() string {
+	return filepath.Join(h.Dir, "size.txt")
+}
+
+// Small log files so that rotation gets exercised, and only 2 character IDs are pregenerated to keep startup fast.
+func (h *Harness) CPPUMParams() *util.CPPUMParams {
+	return &util.CPPUMParams{
+		Log_directory_path_absolute:    h.LogDir(),
+		Bucket_directory_path_absolute: h.PasteDir(),
+		B53m:                           h.B53m,
+		Generate_strings_up_to:         2,
+		Log_file_max_size_bytes:        1024,
+		Size_file_rounded_multiple:     5,
+		Size_file_path_absolute:        h.SizeFilePath(),
+		Xattr_params:                   &util.XattrParams{},
+		Storage_backend:                h.Backend,
+		Clock:                          h.Clock.Now,
+	}
+}
+
+// Bucket interval of a minute. Expired entries are kept in RAM for a minute and on disk for 3 minutes.
+func (h *Harness) CEPUMParams() *util.CEPUMParams {
+	return &util.CEPUMParams{
+		Expiry_check_interval_seconds_ram:    background_interval_seconds,
+		Expiry_check_interval_seconds_disk:   background_interval_seconds,
+		Extra_keeparound_seconds_ram:         60,
+		Extra_keeparound_seconds_disk:        180,
+		Bucket_interval:                      60,
+		Bucket_directory_path_absolute:       h.LogDir(),
+		Paste_bucket_directory_path_absolute: h.PasteDir(),
+		Size_file_path_absolute:              h.SizeFilePath(),
+		B53m:                                 h.B53m,
+		Size_file_rounded_multiple:           5,
+		Generate_strings_up_to:               2,
+		Xattr_params:                         &util.XattrParams{},
+		Storage_backend:                      h.Backend,
+		Clock:                                h.Clock.Now,
+	}
+}
+
+// Loads a CPPUM from the harness's storage. modify_params can change the defaults from CPPUMParams, or be nil.
+// Call it again to simulate a restart.
+func (h *Harness) StartCPPUM(modify_params func(*util.CPPUMParams)) *util.ConcurrentPersistentPermanentURLMap {
+	h.t.Helper()
+
+	params := h.CPPUMParams()
+	if modify_params != nil {
+		modify_params(params)
+	}
+	return util.CreateConcurrentPersistentPermanentURLMapFromDisk(params)
+}
+
+// Loads a CEPUM from the harness's storage. modify_params can change the defaults from CEPUMParams, or be nil.
+// Call it again to simulate a restart.
+func (h *Harness) StartCEPUM(modify_params func(*util.CEPUMParams)) *util.ConcurrentExpiringPersistentURLMap {
+	h.t.Helper()
+
+	params := h.CEPUMParams()
+	if modify_params != nil {
+		modify_params(params)
+	}
+	return util.CreateConcurrentExpiringPersistentURLMapFromDisk(params)
+}
+
+// Lists the log files, as absolute paths.
+func (h *Harness) LogFiles() []string {
+	h.t.Helper()
+
+	return h.list(h.LogDir())
+}
+
+// Lists the paste files, as absolute paths.
+func (h *Harness) PasteFiles() []string {
+	h.t.Helper()
+
+	return h.list(h.PasteDir())
+}
+
+func (h *Harness) list(dir string) []string {
+	h.t.Helper()
+
+	names, err := h.Backend.ListSegments(dir)
+	if err != nil {
+		h.t.Fatal("urlmaptest: failed to list", dir, "error:", err)
+	}
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths
+}
@@ -0,0 +1,181 @@
+package urlmaptest_test
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+)
+
+func Test_CPPUM_Restart(t *testing.T) {
+	t.Parallel()
+
+	for name, h := range map[string]*urlmaptest.Harness{"memory": urlmaptest.New(t), "disk": urlmaptest.NewOnDisk(t)} {
+		cppum := h.StartCPPUM(nil)
+		url_key, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+		util.Assert_no_error(t, err, 1)
+		paste_key, err := cppum.PutEntry(4, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+		util.Assert_no_error(t, err, 1)
+
+		cppum = h.StartCPPUM(nil)
+		util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 2, 1)
+		item, err := cppum.GetEntry(url_key)
+		util.Assert_result_equals_interface(t, item.GetValue(), err, "google.com", 1)
+		item, err = cppum.GetEntry(paste_key)
+		util.Assert_no_error(t, err, 1)
+		contents, err := h.Backend.GetBlob(item.GetValue())
+		util.Assert_result_equals_bytes(t, contents, err, "hello world", 1)
+		if len(h.PasteFiles()) != 1 {
+			t.Fatal(name, "expected exactly one paste file, got:", h.PasteFiles())
+		}
+	}
+}
+
+func Test_CEPUM_Expiry_With_Fake_Clock(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	url_key, err := cepum.PutEntry(4, "google.com", h.Clock.Now()+30, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	_, err = cepum.PutEntry(4, "short lived paste", h.Clock.Now()+30, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	long_key, err := cepum.PutEntry(4, "example.com", h.Clock.Now()+3600, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	h.Clock.Advance(31)
+	_, err = cepum.GetEntry(url_key)
+	if !errors.As(err, &util.KeyExpiredError{}) {
+		t.Fatal("Expected KeyExpiredError, got:", err)
+	}
+	// Still in RAM until the keeparound period is over
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 3, 1)
+	h.Clock.Advance(60)
+	cepum.RemoveAllExpiredURLsFromRAM()
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 1, 1)
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 0, 1)
+
+	// The expired entries are still in the log, but they don't come back after a restart
+	cepum = h.StartCEPUM(nil)
+	util.Assert_result_equals_interface(t, cepum.NumItems(), nil, 1, 1)
+	item, err := cepum.GetEntry(long_key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "example.com", 1)
+
+	// Once the disk keeparound period is over, the bucket with the expired entries goes
+	log_files_before := len(h.LogFiles())
+	h.Clock.Advance(300)
+	cepum.RemoveAllExpiredURLsFromDisk()
+	util.Assert_result_equals_interface(t, len(h.LogFiles()), nil, log_files_before-1, 1)
+}
+
+func Test_Failed_Writes_Leave_Nothing_Behind(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cppum := h.StartCPPUM(nil)
+	_, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	eio := errors.New("input/output error")
+	h.Backend.FailNextWrites(1, eio)
+	_, err = cppum.PutEntry(4, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+	if !errors.Is(err, eio) {
+		t.Fatal("Expected the injected error, got:", err)
+	}
+
+	h.Backend.SetDiskFull(true)
+	_, err = cppum.PutEntry(4, "hello world", 0, util.TYPE_MAP_ITEM_PASTE)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal("Expected ENOSPC, got:", err)
+	}
+	_, err = cppum.PutEntry(4, "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	if !errors.Is(err, syscall.ENOSPC) {
+		t.Fatal("Expected ENOSPC, got:", err)
+	}
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 1, 1)
+	util.Assert_result_equals_interface(t, len(h.PasteFiles()), nil, 0, 1)
+
+	// Writes work again once there's space
+	h.Backend.SetDiskFull(false)
+	_, err = cppum.PutEntry(4, "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	cppum = h.StartCPPUM(nil)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 2, 1)
+}
+
+func Test_Torn_Write_Is_Dropped_On_Restart(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cppum := h.StartCPPUM(nil)
+	key, err := cppum.PutEntry(4, "google.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+
+	h.Backend.TearNextAppend(10)
+	_, err = cppum.PutEntry(4, "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	if !errors.As(err, &urlmaptest.TornWriteError{}) {
+		t.Fatal("Expected TornWriteError, got:", err)
+	}
+
+	// The process "crashed" in the middle of the append
+	cppum = h.StartCPPUM(nil)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 1, 1)
+	item, err := cppum.GetEntry(key)
+	util.Assert_result_equals_interface(t, item.GetValue(), err, "google.com", 1)
+
+	// The partial record was cut off, so records appended after it can be read back
+	_, err = cppum.PutEntry(4, "example.com", 0, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	cppum = h.StartCPPUM(nil)
+	util.Assert_result_equals_interface(t, cppum.NumItems(), nil, 2, 1)
+}
+
+func Test_Torn_Write_Then_Successful_Write_Survives_Restart(t *testing.T) {
+	t.Parallel()
+
+	for _, truncate_fails := range []bool{false, true} {
+		for _, expiring := range []bool{false, true} {
+			h := urlmaptest.New(t)
+			if truncate_fails {
+				// Then the partial record can't be cut off, and the next record has to go somewhere else
+				h.Backend.SetFaultHook(func(op string, _ string) error {
+					if op == "TruncateSegment" {
+						return errors.New("EIO")
+					}
+					return nil
+				})
+			}
+			start := func() util.GenericConcurrentPersistentMap {
+				if expiring {
+					return h.StartCEPUM(nil)
+				}
+				return h.StartCPPUM(nil)
+			}
+			m := start()
+			h.Backend.TearNextAppend(10)
+			_, err := m.PutEntry(4, "google.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+			if !errors.As(err, &urlmaptest.TornWriteError{}) {
+				t.Fatal("Expected TornWriteError, got:", err)
+			}
+
+			// Writes are back on in the same process
+			key, err := m.PutEntry(4, "example.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+			if truncate_fails && expiring {
+				// A bucket can't be rotated, so nothing more goes into it until the partial record is gone
+				util.Assert_error_equals(t, err, util.StorageUnavailableError{Err: errors.New("EIO")}.Error(), 1)
+				h.Backend.SetFaultHook(nil)
+				key, err = m.PutEntry(4, "example.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+			}
+			util.Assert_no_error(t, err, 1)
+
+			h.Backend.SetFaultHook(nil)
+			m = start()
+			item, err := m.GetEntry(key)
+			util.Assert_result_equals_interface(t, item.GetValue(), err, "example.com", 1)
+			util.Assert_result_equals_interface(t, m.NumItems(), nil, 1, 1)
+		}
+	}
+}
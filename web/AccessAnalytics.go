@@ -0,0 +1,70 @@
+// Helpers for feeding util.AccessTracker from HTTP handlers, and a handler for reading the stats back out. Mount it somewhere private, e.g.
+//
+//	web.NewMuxEntry("admin.example.com", web.NewAccessStatsHandler(tracker, 100), "/stats", util.EXACT_MATCH_HANDLER),
+package util
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/1f604/util"
+)
+
+// The same referrer and user agent that Nginx_Log_Received_Request logs
+func Click_Details_From_Request(r *http.Request) util.ClickDetails {
+	return util.ClickDetails{
+		Referrer:   r.Referer(),
+		User_agent: r.UserAgent(),
+	}
+}
+
+// Call this after the short URL has been found, since GetEntry or UseHit has already counted the hit. tracker may be nil.
+func Record_Click_From_Request(tracker *util.AccessTracker, short_url string, r *http.Request) {
+	tracker.Record_Click(short_url, Click_Details_From_Request(r))
+}
+
+// GET ?key=abc responds with the stats and history of that key, otherwise with the top ?n= keys (default max_n, at most max_n).
+func NewAccessStatsHandler(tracker *util.AccessTracker, max_n int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		var response any
+		if key := r.URL.Query().Get("key"); key != "" {
+			stats, _ := tracker.Stats(key)
+			history, err := tracker.History(key)
+			if err != nil {
+				log.Println("Failed to read access history for", key, "error:", err)
+				http.Error(w, "Failed to read access history.", http.StatusInternalServerError)
+				return
+			}
+			response = struct {
+				Stats   util.AccessStats
+				History *util.AccessHistory
+			}{stats, history}
+		} else {
+			n := max_n
+			if n_str := r.URL.Query().Get("n"); n_str != "" {
+				parsed, err := strconv.Atoi(n_str)
+				if err != nil || parsed < 1 {
+					http.Error(w, "n must be a positive integer.", http.StatusBadRequest)
+					return
+				}
+				n = min(parsed, max_n)
+			}
+			response = tracker.TopN(n)
+		}
+		body, err := json.Marshal(response)
+		if err != nil {
+			log.Println("Failed to marshal access stats:", err)
+			http.Error(w, "Failed to marshal access stats.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(body) //nolint: errcheck // nothing we can do if the client went away
+	}
+}
@@ -0,0 +1,90 @@
+// Liveness and readiness checks for load balancers. Mount them as exact match entries, e.g.
+//
+//	web.NewMuxEntry("example.com", web.LivenessHandler, "/healthz", util.EXACT_MATCH_HANDLER),
+//	web.NewMuxEntry("example.com", web.NewReadinessHandler(maps, 1<<30), "/readyz", util.EXACT_MATCH_HANDLER),
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/1f604/util"
+)
+
+// Always says OK. If the process can answer this then it's alive.
+func LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte("OK\n")) //nolint: errcheck // nothing we can do if the client went away
+}
+
+type ReadinessReport struct {
+	Ready    bool
+	Problems []string                  // Why Ready is false. Empty if ready.
+	Writable bool                      // false if any map's storage is read-only. Doesn't affect Ready, since reads still work.
+	Warnings []string                  // Why Writable is false. Empty if writable.
+	Maps     map[string]util.MapHealth // map name -> health
+}
+
+// Builds the report that NewReadinessHandler sends. A map is not ready if it is still loading,
+// or if the log or paste directory has less than min_free_bytes free. Directories whose free space is unknown are not counted against it.
+// A map whose storage is read-only is still ready, because taking it out of the load balancer would stop redirects as well. It's reported in Writable instead.
+func Get_Readiness_Report(maps map[string]util.GenericConcurrentPersistentMap, min_free_bytes uint64) ReadinessReport {
+	report := ReadinessReport{
+		Ready:    true,
+		Problems: []string{},
+		Writable: true,
+		Warnings: []string{},
+		Maps:     make(map[string]util.MapHealth, len(maps)),
+	}
+	for name, m := range maps {
+		health := m.Health()
+		report.Maps[name] = health
+		if !health.Load_progress.Done {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s: still loading (%d of %d log files)", name, health.Load_progress.Files_loaded, health.Load_progress.Files_total))
+		}
+		if !health.Storage.Writable {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("%s: storage is read-only: %s", name, health.Storage.Last_error))
+		}
+		if health.Log_dir_space != nil && health.Log_dir_space.Free_bytes < min_free_bytes {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s: log directory has only %d bytes free", name, health.Log_dir_space.Free_bytes))
+		}
+		if health.Paste_dir_space != nil && health.Paste_dir_space.Free_bytes < min_free_bytes {
+			report.Problems = append(report.Problems, fmt.Sprintf("%s: paste directory has only %d bytes free", name, health.Paste_dir_space.Free_bytes))
+		}
+	}
+	report.Ready = len(report.Problems) == 0
+	report.Writable = len(report.Warnings) == 0
+	return report
+}
+
+// Responds with a ReadinessReport as JSON. The status code is 200 if every map is ready and 503 otherwise, so load balancers don't have to parse the body.
+func NewReadinessHandler(maps map[string]util.GenericConcurrentPersistentMap, min_free_bytes uint64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		report := Get_Readiness_Report(maps, min_free_bytes)
+		body, err := json.Marshal(report)
+		if err != nil {
+			log.Println("Failed to marshal readiness report:", err)
+			http.Error(w, "Failed to marshal readiness report.", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body) //nolint: errcheck // nothing we can do if the client went away
+	}
+}
@@ -0,0 +1,76 @@
+package util_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+	web "github.com/1f604/util/web"
+)
+
+func Test_Readiness_Handler(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	maps := map[string]util.GenericConcurrentPersistentMap{"expiring": cepum}
+	mux_entries := []*web.MuxEntry{
+		web.NewMuxEntry("example.com", web.LivenessHandler, "/healthz", util.EXACT_MATCH_HANDLER),
+		web.NewMuxEntry("example.com", web.NewReadinessHandler(maps, 1<<20), "/readyz", util.EXACT_MATCH_HANDLER),
+	}
+	router := web.NewLongestPrefixRouter(mux_entries, fallback_handler, false)
+
+	get := func(path string) (int, web.ReadinessReport) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		router.ServeHTTP(rr, req)
+		var report web.ReadinessReport
+		if path == "/readyz" {
+			err := json.Unmarshal(rr.Body.Bytes(), &report)
+			util.Assert_no_error(t, err, 2)
+		}
+		return rr.Code, report
+	}
+
+	code, _ := get("/healthz")
+	util.Assert_result_equals_interface(t, code, nil, http.StatusOK, 1)
+
+	_, err := cepum.PutEntry(2, "google.com", h.Clock.Now()+30, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	h.Clock.Advance(1000)
+	cepum.RemoveAllExpiredURLsFromRAM()
+
+	code, report := get("/readyz")
+	util.Assert_result_equals_interface(t, code, nil, http.StatusOK, 1)
+	util.Assert_result_equals_bool(t, report.Ready, nil, true, 1)
+	health := report.Maps["expiring"]
+	util.Assert_result_equals_bool(t, health.Load_progress.Done, nil, true, 1)
+	util.Assert_result_equals_interface(t, health.Last_expiry_sweep, nil, h.Clock.Now(), 1)
+	// The expired ID went back into the bag
+	util.Assert_result_equals_interface(t, health.Remaining_ids[2], nil, 53, 1)
+
+	// Read-only storage is reported, but reads still work so it's still ready
+	h.Backend.FailNextWrites(1, syscall.EIO)
+	_, err = cepum.PutEntry(2, "example.com", h.Clock.Now()+30, util.TYPE_MAP_ITEM_URL)
+	if !errors.Is(err, util.ErrStorageUnavailable) {
+		t.Fatal("Expected ErrStorageUnavailable, got:", err)
+	}
+	code, report = get("/readyz")
+	util.Assert_result_equals_interface(t, code, nil, http.StatusOK, 1)
+	util.Assert_result_equals_bool(t, report.Ready, nil, true, 1)
+	util.Assert_result_equals_bool(t, report.Writable, nil, false, 1)
+	util.Assert_result_equals_interface(t, len(report.Warnings), nil, 1, 1)
+
+	// A full disk makes it not ready, even before a write fails
+	h.Backend.SetDiskFull(true)
+	code, report = get("/readyz")
+	util.Assert_result_equals_interface(t, code, nil, http.StatusServiceUnavailable, 1)
+	util.Assert_result_equals_bool(t, report.Ready, nil, false, 1)
+	util.Assert_result_equals_interface(t, report.Maps["expiring"].Log_dir_space.Free_bytes, nil, uint64(0), 1)
+	util.Assert_result_equals_interface(t, len(report.Problems), nil, 2, 1)
+}
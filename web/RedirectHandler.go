@@ -0,0 +1,129 @@
+// Glue between GenericConcurrentPersistentMap.GetEntryNoConsume/UseHit and HTTP. Mount it as a longest prefix handler, e.g.
+//
+//	web.NewMuxEntry("example.com", web.NewRedirectHandler(cepum, b53m, "/", false), "/", util.LONGEST_PREFIX_HANDLER),
+//
+// Then GET /abc redirects to whatever abc points to. It's NewShortURLHandler for links only, so the two always behave the same way.
+// The bits they share (requested_key, use_hit, Long_URL_Location and Write_Lookup_Error) live here.
+package util
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/1f604/util"
+)
+
+// Returned by requested_key for IDs that can't be in any map, e.g. because of a bad checksum
+type MalformedIDError struct {
+	Err error
+}
+
+func (e MalformedIDError) Error() string {
+	return "Malformed ID: " + e.Err.Error()
+}
+
+func (e MalformedIDError) Unwrap() error {
+	return e.Err
+}
+
+// Writes the response for an error from requested_key or GetEntry:
+//   - 400 if the ID is malformed, see MalformedIDError
+//   - 404 if the key doesn't exist
+//   - 410 if it has expired, saying when
+//   - 503 if the map is still loading or can't write to its storage (entries with max hits can't be read then)
+//   - 500 for anything else
+//
+// Lookups that fail are never cached, since the key may be handed out again later.
+func Write_Lookup_Error(w http.ResponseWriter, err error) {
+	w.Header().Set("Cache-Control", "no-store")
+	var expired_err util.KeyExpiredError
+	var storage_err util.StorageUnavailableError
+	var malformed_err MalformedIDError
+	switch {
+	case errors.As(err, &malformed_err):
+		http.Error(w, "Malformed link.", http.StatusBadRequest)
+	case errors.As(err, &expired_err):
+		expired_at := time.Unix(expired_err.GetExpiryTime(), 0).UTC()
+		http.Error(w, fmt.Sprintf("This link expired at %s.", expired_at.Format(http.TimeFormat)), http.StatusGone)
+	case errors.Is(err, util.ErrNotFound):
+		http.Error(w, "Link not found.", http.StatusNotFound)
+	case errors.Is(err, util.ErrMapLoading), errors.As(err, &storage_err):
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Service unavailable, please try again later.", http.StatusServiceUnavailable)
+	default:
+		log.Println("Unexpected error from GetEntry:", err)
+		http.Error(w, "Internal server error.", http.StatusInternalServerError)
+	}
+}
+
+// Looks up the rest of the path after prefix and responds with a 302 to the long URL. Errors are handled by Write_Lookup_Error.
+// Pastes are not links, so they get a 404. Redirects aren't cached, use NewShortURLHandler for that.
+func NewRedirectHandler(m util.GenericConcurrentPersistentMap, b53m *util.Base53IDManager, prefix string, allow_alias_ids bool) http.HandlerFunc {
+	return NewShortURLHandler(&ShortURLHandlerParams{ //nolint:exhaustruct // the rest are defaults
+		Map:               m,
+		B53m:              b53m,
+		Prefix:            prefix,
+		Allow_alias_ids:   allow_alias_ids,
+		Max_cache_seconds: -1,
+		Urls_only:         true,
+	})
+}
+
+// Turns the rest of the path after prefix into the key to look up, see util.Normalize_Requested_ID.
+// IDs that can't be in the map, e.g. because of a bad checksum, are a MalformedIDError, so that they get a 400 rather than looking like a link that's gone.
+func requested_key(b53m *util.Base53IDManager, path string, prefix string, allow_alias_ids bool) (string, error) {
+	key, _, err := util.Normalize_Requested_ID(b53m, strings.TrimPrefix(path, prefix), allow_alias_ids)
+	if err != nil {
+		return "", MalformedIDError{Err: err}
+	}
+	return key, nil
+}
+
+// Uses up a hit of item, which came from GetEntryNoConsume, and records the click in tracker (which may be nil).
+// HEAD requests only ask whether the entry is there, so they don't use up a hit or count as a click.
+// If the entry can't be handed out any more, e.g. because a concurrent request used up its last hit, writes the error and returns false.
+func use_hit(w http.ResponseWriter, r *http.Request, m util.GenericConcurrentPersistentMap, tracker *util.AccessTracker, key string, item util.MapItem) bool {
+	if r.Method == http.MethodHead {
+		return true
+	}
+	err := m.UseHit(key, item)
+	if err != nil {
+		Write_Lookup_Error(w, err)
+		return false
+	}
+	Record_Click_From_Request(tracker, key, r)
+	return true
+}
+
+// What to put in the Location header for a long URL.
+// Browsers resolve a Location without a scheme against the request URL, so "google.com" would redirect to a path on this site. Those get https:// in front.
+// Only a "://" right after a valid scheme counts, so "example.com/?r=http://x" still gets one. url.Parse isn't used since it takes "google.com:8080" to be a scheme.
+func Long_URL_Location(long_url string) string {
+	scheme, _, found := strings.Cut(long_url, "://")
+	if found && is_url_scheme(scheme) {
+		return long_url
+	}
+	return "https://" + long_url
+}
+
+// scheme = ALPHA *( ALPHA / DIGIT / "+" / "-" / "." ), see RFC 3986 section 3.1
+func is_url_scheme(s string) bool {
+	if s == "" || !is_ascii_letter(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if !is_ascii_letter(c) && (c < '0' || c > '9') && c != '+' && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func is_ascii_letter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
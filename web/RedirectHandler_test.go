@@ -0,0 +1,66 @@
+package util_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+	web "github.com/1f604/util/web"
+)
+
+func Test_Redirect_Handler(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	mux_entries := []*web.MuxEntry{
+		web.NewMuxEntry("example.com", web.NewRedirectHandler(cepum, h.B53m, "/l/", false), "/l/", util.LONGEST_PREFIX_HANDLER),
+	}
+	router := web.NewLongestPrefixRouter(mux_entries, fallback_handler, false)
+	get := func(key string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/l/"+key, nil))
+		return rr
+	}
+
+	// Put before the random IDs are handed out so that they can't clash with it
+	typo_key := with_checksum(t, h.B53m, "0h")
+	_, err := cepum.PutEntryWithID(typo_key, "https://example.org/typo", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	key, err := cepum.PutEntry(2, "https://example.org/page", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	paste_key, err := cepum.PutEntry(2, "not a link", h.Clock.Now()+100, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+
+	rr := get(key)
+	util.Assert_result_equals_interface(t, rr.Code, nil, http.StatusFound, 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Location"), nil, "https://example.org/page", 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Cache-Control"), nil, "no-store", 1)
+	util.Assert_result_equals_interface(t, get(paste_key).Code, nil, http.StatusNotFound, 1)
+
+	// Typing O instead of 0 still works, and bad IDs don't reach the map
+	util.Assert_result_equals_interface(t, get(strings.ReplaceAll(typo_key, "0", "O")).Header().Get("Location"), nil, "https://example.org/typo", 1)
+	util.Assert_result_equals_interface(t, get("x").Code, nil, http.StatusBadRequest, 1)
+	util.Assert_result_equals_interface(t, get(with_checksum(t, h.B53m, "0h0h")).Code, nil, http.StatusNotFound, 1)
+
+	// A long URL without a scheme must not redirect to a path on this site
+	bare_key, err := cepum.PutEntry(2, "google.com", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, get(bare_key).Header().Get("Location"), nil, "https://google.com", 1)
+	util.Assert_result_equals_interface(t, web.Long_URL_Location("http://example.org"), nil, "http://example.org", 1)
+	util.Assert_result_equals_interface(t, web.Long_URL_Location("example.com/?r=http://x"), nil, "https://example.com/?r=http://x", 1)
+	util.Assert_result_equals_interface(t, web.Long_URL_Location("google.com:8080/x"), nil, "https://google.com:8080/x", 1)
+
+	// Expired links say when they expired until they're removed from RAM, and then they're just not found
+	h.Clock.Advance(101)
+	rr = get(key)
+	util.Assert_result_equals_interface(t, rr.Code, nil, http.StatusGone, 1)
+	util.Assert_result_equals_bool(t, strings.Contains(rr.Body.String(), "Tue, 14 Nov 2023 22:15:00 GMT"), nil, true, 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Cache-Control"), nil, "no-store", 1)
+	h.Clock.Advance(100)
+	cepum.RemoveAllExpiredURLsFromRAM()
+	util.Assert_result_equals_interface(t, get(key).Code, nil, http.StatusNotFound, 1)
+}
@@ -0,0 +1,161 @@
+// Serves a short URL map: GET <prefix><id> redirects to the long URL, or responds with the paste.
+// It's a longest prefix handler, so put it in the router with NewShortURLMuxEntry:
+//
+//	web.NewShortURLMuxEntry("example.com", &web.ShortURLHandlerParams{Map: cepum, B53m: b53m, Prefix: "/"}),
+//
+// The ID is normalized the same way PutEntryWithID normalizes it, so e.g. an 'O' typed instead of a '0' still works, and IDs with a bad checksum are a 400
+// without touching the map. Errors are handled by Write_Lookup_Error.
+//
+// Responses are cached for at most Max_cache_seconds, and never past the entry's expiry time, since by then its ID may belong to something else.
+// Entries with max hits and password-protected pastes are never cached.
+package util
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/1f604/util"
+)
+
+// How long responses can be cached for if ShortURLHandlerParams.Max_cache_seconds is 0
+const DEFAULT_SHORT_URL_MAX_CACHE_SECONDS = 60 * 60
+
+// Where the passphrase of a password-protected paste goes. Not a query parameter, so that it doesn't end up in access logs.
+const PASTE_PASSPHRASE_HEADER = "X-Paste-Passphrase"
+
+type ShortURLHandlerParams struct {
+	Map                util.GenericConcurrentPersistentMap
+	B53m               *util.Base53IDManager
+	Prefix             string              // must start and end with /
+	Allow_alias_ids    bool                // same as in the map's params
+	Max_cache_seconds  int64               // 0 means DEFAULT_SHORT_URL_MAX_CACHE_SECONDS, less than 0 means don't cache
+	Paste_content_type string              // "" means text/plain, so that pastes can't run scripts on this site
+	Access_tracker     *util.AccessTracker // records the referrer and user agent of every click. nil means don't.
+	Clock              util.Clock          // nil means the real clock
+	Urls_only          bool                // pastes get a 404, see NewRedirectHandler
+}
+
+func NewShortURLMuxEntry(hostname string, params *ShortURLHandlerParams) *MuxEntry {
+	return NewMuxEntry(hostname, NewShortURLHandler(params), params.Prefix, util.LONGEST_PREFIX_HANDLER)
+}
+
+func NewShortURLHandler(params *ShortURLHandlerParams) http.HandlerFunc {
+	max_cache_seconds := params.Max_cache_seconds
+	if max_cache_seconds == 0 {
+		max_cache_seconds = DEFAULT_SHORT_URL_MAX_CACHE_SECONDS
+	}
+	paste_content_type := params.Paste_content_type
+	if paste_content_type == "" {
+		paste_content_type = "text/plain; charset=utf-8"
+	}
+	clock := params.Clock
+	if clock == nil {
+		clock = util.Real_Clock
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		key, err := requested_key(params.B53m, r.URL.Path, params.Prefix, params.Allow_alias_ids)
+		if err != nil {
+			Write_Lookup_Error(w, err)
+			return
+		}
+		// Nothing is used up until the entry is actually handed out, see use_hit
+		item, err := params.Map.GetEntryNoConsume(key)
+		if err != nil {
+			Write_Lookup_Error(w, err)
+			return
+		}
+
+		switch item.GetType().ValueType {
+		case util.TYPE_MAP_ITEM_URL:
+			if !use_hit(w, r, params.Map, params.Access_tracker, key, item) {
+				return
+			}
+			set_short_url_cache_headers(w, item, clock(), max_cache_seconds)
+			w.Header().Set("Location", Long_URL_Location(item.GetValue()))
+			w.WriteHeader(http.StatusFound)
+		case util.TYPE_MAP_ITEM_PASTE:
+			if params.Urls_only {
+				w.Header().Set("Cache-Control", "no-store")
+				http.Error(w, "Link not found.", http.StatusNotFound)
+				return
+			}
+			serve_paste(w, r, params, key, item, clock(), max_cache_seconds, paste_content_type)
+		default:
+			log.Println("Unknown value type for key", key)
+			http.Error(w, "Internal server error.", http.StatusInternalServerError)
+		}
+	}
+}
+
+func has_max_hits(item util.MapItem) bool {
+	limited, ok := item.(interface{ GetMaxHits() int64 })
+	return ok && limited.GetMaxHits() > 0
+}
+
+func set_short_url_cache_headers(w http.ResponseWriter, item util.MapItem, now int64, max_cache_seconds int64) {
+	if has_max_hits(item) {
+		max_cache_seconds = -1 // every hit has to reach the map
+	}
+	if item.GetType().IsTemporary {
+		max_cache_seconds = min(max_cache_seconds, item.GetExpiryTime()-now)
+	}
+	if max_cache_seconds <= 0 {
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age="+util.Int64_to_string(max_cache_seconds))
+	w.Header().Set("Expires", time.Unix(now+max_cache_seconds, 0).UTC().Format(http.TimeFormat))
+}
+
+// The passphrase is checked before the hit is used up, so that a missing or wrong passphrase doesn't burn a read.
+func serve_paste(w http.ResponseWriter, r *http.Request, params *ShortURLHandlerParams, key string, item util.MapItem, now int64, max_cache_seconds int64,
+	content_type string) {
+	passphrase := r.Header.Get(PASTE_PASSPHRASE_HEADER)
+	contents, err := params.Map.ReadPaste(item, passphrase)
+	switch {
+	case err == nil:
+	case errors.Is(err, util.PastePassphraseRequiredError{}):
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "This paste is password-protected. Send the passphrase in the "+PASTE_PASSPHRASE_HEADER+" header.", http.StatusUnauthorized)
+		return
+	case errors.Is(err, util.PasteDecryptionError{}):
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "Wrong passphrase.", http.StatusForbidden)
+		return
+	default:
+		log.Println("Failed to read paste file:", item.GetValue(), "error:", err)
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "Internal server error.", http.StatusInternalServerError)
+		return
+	}
+	if !use_hit(w, r, params.Map, params.Access_tracker, key, item) {
+		return
+	}
+	set_short_url_cache_headers(w, item, now, max_cache_seconds)
+	if passphrase != "" {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Del("Expires")
+	}
+	w.Header().Set("Content-Type", content_type)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if has_max_hits(item) {
+		// Every hit gets the whole paste, otherwise a Range request would use up a read for part of it
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			w.Write(contents) //nolint:errcheck // nothing to do if the client has gone away
+		}
+		return
+	}
+	// Handles HEAD and Range requests
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+}
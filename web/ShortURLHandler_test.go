@@ -0,0 +1,157 @@
+package util_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/1f604/util"
+	"github.com/1f604/util/urlmaptest"
+	web "github.com/1f604/util/web"
+)
+
+const short_url_test_alphabet = "02345678ABCDEFGHJKLMNPQRSTUVXYZabcefghijknopqrstuvxyz"
+
+// Returns str_without_csum with its checksum appended
+func with_checksum(t *testing.T, b53m *util.Base53IDManager, str_without_csum string) string {
+	t.Helper()
+
+	for _, csum := range []byte(short_url_test_alphabet) {
+		id, err := b53m.NewBase53ID(str_without_csum, csum, false)
+		if err == nil {
+			return id.GetCombinedString()
+		}
+	}
+	t.Fatal("No checksum found for", str_without_csum)
+	return ""
+}
+
+func Test_Short_URL_Handler(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	mux_entries := []*web.MuxEntry{
+		web.NewShortURLMuxEntry("example.com", &web.ShortURLHandlerParams{
+			Map:                cepum,
+			B53m:               h.B53m,
+			Prefix:             "/s/",
+			Allow_alias_ids:    false,
+			Max_cache_seconds:  600,
+			Paste_content_type: "",
+			Access_tracker:     nil,
+			Clock:              h.Clock.Now,
+		}),
+	}
+	router := web.NewLongestPrefixRouter(mux_entries, fallback_handler, false)
+	get := func(key string, passphrase string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/s/"+key, nil)
+		if passphrase != "" {
+			req.Header.Set(web.PASTE_PASSPHRASE_HEADER, passphrase)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Typing O instead of 0 and 9 instead of g still works
+	key := with_checksum(t, h.B53m, "0g")
+	_, err := cepum.PutEntryWithID(key, "https://example.org/page", h.Clock.Now()+100, util.TYPE_MAP_ITEM_URL)
+	util.Assert_no_error(t, err, 1)
+	rr := get(strings.NewReplacer("0", "O", "g", "9").Replace(key), "")
+	util.Assert_result_equals_interface(t, rr.Code, nil, http.StatusFound, 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Location"), nil, "https://example.org/page", 1)
+	// Not cached for longer than the link lasts
+	util.Assert_result_equals_interface(t, rr.Header().Get("Cache-Control"), nil, "public, max-age=100", 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Expires"), nil, "Tue, 14 Nov 2023 22:15:00 GMT", 1)
+
+	// Bad checksums don't reach the map, and aren't mistaken for links that have gone
+	rr = get(key[:2]+string(short_url_test_alphabet[(strings.IndexByte(short_url_test_alphabet, key[2])+1)%len(short_url_test_alphabet)]), "")
+	util.Assert_result_equals_interface(t, rr.Code, nil, http.StatusBadRequest, 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Cache-Control"), nil, "no-store", 1)
+
+	paste_key, err := cepum.PutEntry(2, "some paste", h.Clock.Now()+100000, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	rr = get(paste_key, "")
+	util.Assert_result_equals_interface(t, rr.Code, nil, http.StatusOK, 1)
+	util.Assert_result_equals_interface(t, rr.Body.String(), nil, "some paste", 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Content-Type"), nil, "text/plain; charset=utf-8", 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Cache-Control"), nil, "public, max-age=600", 1)
+
+	protected, err := util.Seal_Paste_With_Passphrase([]byte("protected"), "hunter2")
+	util.Assert_no_error(t, err, 1)
+	protected_key, err := cepum.PutEntry(2, string(protected), h.Clock.Now()+100000, util.TYPE_MAP_ITEM_PASTE)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, get(protected_key, "").Code, nil, http.StatusUnauthorized, 1)
+	util.Assert_result_equals_interface(t, get(protected_key, "wrong").Code, nil, http.StatusForbidden, 1)
+	rr = get(protected_key, "hunter2")
+	util.Assert_result_equals_interface(t, rr.Body.String(), nil, "protected", 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Cache-Control"), nil, "no-store", 1)
+
+	// Every read of an entry with max hits has to be counted
+	limited_key, err := cepum.PutEntryWithMaxHits(2, "https://example.org/once", h.Clock.Now()+100000, util.TYPE_MAP_ITEM_URL, 1)
+	util.Assert_no_error(t, err, 1)
+	rr = get(limited_key, "")
+	util.Assert_result_equals_interface(t, rr.Code, nil, http.StatusFound, 1)
+	util.Assert_result_equals_interface(t, rr.Header().Get("Cache-Control"), nil, "no-store", 1)
+	util.Assert_result_equals_interface(t, get(limited_key, "").Code, nil, http.StatusGone, 1)
+}
+
+func Test_Short_URL_Handler_Only_Uses_Up_Reads_That_Are_Served(t *testing.T) {
+	t.Parallel()
+
+	h := urlmaptest.New(t)
+	cepum := h.StartCEPUM(nil)
+	handler := web.NewShortURLHandler(&web.ShortURLHandlerParams{
+		Map:                cepum,
+		B53m:               h.B53m,
+		Prefix:             "/s/",
+		Allow_alias_ids:    false,
+		Max_cache_seconds:  0,
+		Paste_content_type: "",
+		Access_tracker:     nil,
+		Clock:              h.Clock.Now,
+	})
+	serve := func(method string, key string, header string, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://example.com/s/"+key, nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	protected, err := util.Seal_Paste_With_Passphrase([]byte("burn after reading"), "hunter2")
+	util.Assert_no_error(t, err, 1)
+	key, err := cepum.PutEntryWithMaxHits(2, string(protected), h.Clock.Now()+100000, util.TYPE_MAP_ITEM_PASTE, 2)
+	util.Assert_no_error(t, err, 1)
+
+	// None of these get the paste, so none of them use up a read
+	util.Assert_result_equals_interface(t, serve(http.MethodGet, key, "", "").Code, nil, http.StatusUnauthorized, 1)
+	util.Assert_result_equals_interface(t, serve(http.MethodGet, key, web.PASTE_PASSPHRASE_HEADER, "wrong").Code, nil, http.StatusForbidden, 1)
+	rr := serve(http.MethodHead, key, web.PASTE_PASSPHRASE_HEADER, "hunter2")
+	util.Assert_result_equals_interface(t, rr.Code, nil, http.StatusOK, 1)
+	util.Assert_result_equals_interface(t, rr.Body.Len(), nil, 0, 1)
+
+	// A Range request uses up a read, so it gets the whole paste
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/s/"+key, nil)
+	req.Header.Set(web.PASTE_PASSPHRASE_HEADER, "hunter2")
+	req.Header.Set("Range", "bytes=0-3")
+	rr = httptest.NewRecorder()
+	handler(rr, req)
+	util.Assert_result_equals_interface(t, rr.Code, nil, http.StatusOK, 1)
+	util.Assert_result_equals_interface(t, rr.Body.String(), nil, "burn after reading", 1)
+
+	rr = serve(http.MethodGet, key, web.PASTE_PASSPHRASE_HEADER, "hunter2")
+	util.Assert_result_equals_interface(t, rr.Body.String(), nil, "burn after reading", 1)
+	util.Assert_result_equals_interface(t, serve(http.MethodGet, key, web.PASTE_PASSPHRASE_HEADER, "hunter2").Code, nil, http.StatusGone, 1)
+
+	// HEAD doesn't use up the hit of a link either
+	link_key, err := cepum.PutEntryWithMaxHits(2, "https://example.org/once", h.Clock.Now()+100000, util.TYPE_MAP_ITEM_URL, 1)
+	util.Assert_no_error(t, err, 1)
+	util.Assert_result_equals_interface(t, serve(http.MethodHead, link_key, "", "").Code, nil, http.StatusFound, 1)
+	util.Assert_result_equals_interface(t, serve(http.MethodGet, link_key, "", "").Code, nil, http.StatusFound, 1)
+	util.Assert_result_equals_interface(t, serve(http.MethodGet, link_key, "", "").Code, nil, http.StatusGone, 1)
+}